@@ -0,0 +1,44 @@
+package mp1
+
+import (
+	"fmt"
+
+	"github.com/bamboovir/cs425/lib/mp1/checker"
+	"github.com/spf13/cobra"
+)
+
+var (
+	ErrCheckFailed = fmt.Errorf("the run violates a TO property")
+)
+
+func CheckCMDMain(inputs []string, opts *checker.Options) error {
+	trace, err := checker.Load(inputs)
+	if err != nil {
+		return err
+	}
+	report := checker.Check(trace, opts)
+	fmt.Print(report.String())
+	if !report.OK() {
+		return ErrCheckFailed
+	}
+	return nil
+}
+
+func NewCheckCMD() *cobra.Command {
+	opts := &checker.Options{}
+	cmd := &cobra.Command{
+		Use:   "check [node=]<log>...",
+		Short: "check",
+		Long: "check total order, agreement, integrity and validity of the TO-deliveries of a run, and report the first divergence of every property. " +
+			"A log is the stderr of a node, or a delivery trace, run the nodes with METRICS=y to trace multicasts and body digests",
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := CheckCMDMain(args, opts)
+			ExitWrapper(err)
+		},
+	}
+
+	cmd.Flags().StringSliceVar(&opts.Crashed, "crashed", []string{}, "nodes that crashed during the run, they are not held to agreement and validity")
+	cmd.Flags().BoolVar(&opts.AllowLag, "allow-lag", false, "accept correct nodes that were stopped before they delivered the tail of the run")
+	return cmd
+}
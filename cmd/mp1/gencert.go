@@ -0,0 +1,187 @@
+package mp1
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+const (
+	CAName       = "mp1-test-ca"
+	CACertFile   = "ca.pem"
+	CAKeyFile    = "ca-key.pem"
+	CertFileTmpl = "%s.pem"
+	KeyFileTmpl  = "%s-key.pem"
+)
+
+type certAuthority struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func writePEM(path string, blockType string, der []byte, perm os.FileMode) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	return ioutil.WriteFile(path, data, perm)
+}
+
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(path, "EC PRIVATE KEY", der, 0600)
+}
+
+// loadOrCreateCA reuses the CA in outDir, so certificates of nodes added later are signed by the same CA
+func loadOrCreateCA(outDir string, validity time.Duration) (ca *certAuthority, err error) {
+	certPath := filepath.Join(outDir, CACertFile)
+	keyPath := filepath.Join(outDir, CAKeyFile)
+
+	certPEM, certErr := ioutil.ReadFile(certPath)
+	keyPEM, keyErr := ioutil.ReadFile(keyPath)
+	if certErr == nil && keyErr == nil {
+		certBlock, _ := pem.Decode(certPEM)
+		keyBlock, _ := pem.Decode(keyPEM)
+		if certBlock == nil || keyBlock == nil {
+			return nil, fmt.Errorf("invalid ca in [%s]", outDir)
+		}
+		cert, err := x509.ParseCertificate(certBlock.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse ca certificate failed")
+		}
+		key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse ca key failed")
+		}
+		return &certAuthority{cert: cert, key: key}, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: CAName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	err = writePEM(certPath, "CERTIFICATE", der, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = writeKey(keyPath, key)
+	if err != nil {
+		return nil, err
+	}
+	return &certAuthority{cert: cert, key: key}, nil
+}
+
+// issue signs a certificate whose common name is the node id, it is valid for both server and client authentication
+func (ca *certAuthority) issue(outDir string, nodeID string, hosts []string, validity time.Duration) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: nodeID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return err
+	}
+	err = writePEM(filepath.Join(outDir, fmt.Sprintf(CertFileTmpl, nodeID)), "CERTIFICATE", der, 0644)
+	if err != nil {
+		return err
+	}
+	return writeKey(filepath.Join(outDir, fmt.Sprintf(KeyFileTmpl, nodeID)), key)
+}
+
+func GenCertCMDMain(outDir string, nodeIDs []string, hosts []string, validity time.Duration) (err error) {
+	err = os.MkdirAll(outDir, 0755)
+	if err != nil {
+		return err
+	}
+	ca, err := loadOrCreateCA(outDir, validity)
+	if err != nil {
+		return errors.Wrap(err, "create ca failed")
+	}
+	for _, nodeID := range nodeIDs {
+		err = ca.issue(outDir, nodeID, hosts, validity)
+		if err != nil {
+			return errors.Wrapf(err, "issue certificate of node [%s] failed", nodeID)
+		}
+		logger.Infof("issue certificate of node [%s] in [%s]", nodeID, outDir)
+	}
+	return nil
+}
+
+func NewGenCertCMD() *cobra.Command {
+	var outDir string
+	var hosts []string
+	var validity time.Duration
+	cmd := &cobra.Command{
+		Use:   "gencert <node id>...",
+		Short: "gencert",
+		Long:  "generate a local test CA and a certificate for every node id, the common name of a node certificate is its node id",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := GenCertCMDMain(outDir, args, hosts, validity)
+			ExitWrapper(err)
+		},
+	}
+
+	cmd.Flags().StringVar(&outDir, "out", "certs", "output directory, an existing CA in it is reused")
+	cmd.Flags().StringSliceVar(&hosts, "hosts", []string{"localhost", "127.0.0.1"}, "host names and addresses added to every node certificate")
+	cmd.Flags().DurationVar(&validity, "validity", 365*24*time.Hour, "validity of the generated certificates")
+	return cmd
+}
@@ -5,12 +5,19 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 
+	"github.com/bamboovir/cs425/lib/codec"
+	"github.com/bamboovir/cs425/lib/mp1/admin"
 	"github.com/bamboovir/cs425/lib/mp1/config"
 	"github.com/bamboovir/cs425/lib/mp1/metrics"
 	"github.com/bamboovir/cs425/lib/mp1/multicast"
+	"github.com/bamboovir/cs425/lib/mp1/tracing"
 	"github.com/bamboovir/cs425/lib/mp1/transaction"
+	"github.com/bamboovir/cs425/lib/raft"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -22,6 +29,8 @@ var (
 
 const (
 	CONN_HOST = "0.0.0.0"
+	// DefaultShutdownTimeout bounds the wait for the in-flight TO messages of this node on shutdown
+	DefaultShutdownTimeout = 10 * time.Second
 )
 
 func ParsePort(portRawStr string) (port int, err error) {
@@ -39,7 +48,35 @@ func ExitWrapper(err error) {
 	}
 }
 
-func ConstructGroup(nodeID string, nodePort string, configPath string) (group *multicast.Group, err error) {
+type Options struct {
+	TotalOrderStrategy string
+	SequencerID        string
+	FailureDetector    string
+	HeartbeatPeriod    time.Duration
+	SuspicionTimeout   time.Duration
+	DeadTimeout        time.Duration
+	GossipFanout       int
+	Join               bool
+	AdvertiseHost      string
+	Codec              string
+	DataDir            string
+	SendQueueSize      int
+	SendQueuePolicy    string
+	MaxInFlight        int
+	MaxInFlightGroup   int
+	RMulticastMode     string
+	RMulticastFanout   int
+	RMulticastRounds   int
+	AntiEntropyPeriod  time.Duration
+	BatchWindow        time.Duration
+	BatchSize          int
+	MetricsAddr        string
+	TraceFile          string
+	AdminAddr          string
+	ShutdownTimeout    time.Duration
+}
+
+func ConstructGroup(nodeID string, nodePort string, configPath string, opts *Options) (group *multicast.Group, err error) {
 	nodesConfig, err := config.ConfigParser(configPath)
 	if err != nil {
 		return nil, err
@@ -54,47 +91,234 @@ func ConstructGroup(nodeID string, nodePort string, configPath string) (group *m
 		})
 	}
 
+	var totalOrderFactory multicast.TotalOrderFactory
+	totalOrderStrategy := multicast.ISISStrategy
+	if opts.TotalOrderStrategy == raft.StrategyName {
+		// raft keeps its term, vote and log in memory, a member replaying its wal would rejoin with an empty log
+		if opts.DataDir != "" {
+			return nil, fmt.Errorf("--data-dir is not supported with --total-order %s, a raft member cannot restart", raft.StrategyName)
+		}
+		totalOrderFactory = raft.NewTotalOrderFactory(raft.DefaultConfig())
+	} else {
+		totalOrderStrategy, err = multicast.ParseTotalOrderStrategyKind(opts.TotalOrderStrategy)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	failureDetectorMode, err := multicast.ParseFailureDetectorMode(opts.FailureDetector)
+	if err != nil {
+		return nil, err
+	}
+	failureDetectorConfig := &multicast.FailureDetectorConfig{
+		Mode:             failureDetectorMode,
+		HeartbeatPeriod:  opts.HeartbeatPeriod,
+		SuspicionTimeout: opts.SuspicionTimeout,
+		DeadTimeout:      opts.DeadTimeout,
+		GossipFanout:     opts.GossipFanout,
+	}
+
+	messageCodec, err := codec.Lookup(opts.Codec)
+	if err != nil {
+		return nil, err
+	}
+	codec.SetDefault(messageCodec)
+
+	if opts.SendQueueSize < 1 {
+		return nil, fmt.Errorf("send queue size should be positive, received %d", opts.SendQueueSize)
+	}
+	rmulticastMode, err := multicast.ParseRMulticastMode(opts.RMulticastMode)
+	if err != nil {
+		return nil, err
+	}
+	rmulticastConfig := multicast.DefaultRMulticastConfig()
+	rmulticastConfig.Mode = rmulticastMode
+	rmulticastConfig.Fanout = opts.RMulticastFanout
+	rmulticastConfig.Rounds = opts.RMulticastRounds
+	rmulticastConfig.AntiEntropyPeriod = opts.AntiEntropyPeriod
+
+	if opts.BatchSize < 1 {
+		return nil, fmt.Errorf("batch size should be positive, received %d", opts.BatchSize)
+	}
+	batchConfig := &multicast.BatchConfig{
+		Window: opts.BatchWindow,
+		Size:   opts.BatchSize,
+	}
+
+	sendQueuePolicy, err := multicast.ParseSendQueuePolicy(opts.SendQueuePolicy)
+	if err != nil {
+		return nil, err
+	}
+	sendQueueConfig := &multicast.SendQueueConfig{
+		Size:   opts.SendQueueSize,
+		Policy: sendQueuePolicy,
+	}
+
+	var tlsConfig *multicast.TLSConfig
+	if nodesConfig.TLS != nil {
+		tlsConfig = &multicast.TLSConfig{
+			CAPath:   nodesConfig.TLS.CAPath,
+			CertPath: nodesConfig.TLS.CertPath,
+			KeyPath:  nodesConfig.TLS.KeyPath,
+		}
+	}
+
 	addr := net.JoinHostPort(CONN_HOST, nodePort)
 	group = multicast.NewGroupBuilder().
 		WithSelfNodeID(nodeID).
 		WithSelfNodeAddr(addr).
+		WithAdvertiseAddr(net.JoinHostPort(opts.AdvertiseHost, nodePort)).
 		WithMembers(members).
 		AddMember(nodeID, addr).
+		WithTotalOrderStrategy(totalOrderStrategy).
+		WithTotalOrderFactory(totalOrderFactory).
+		WithSequencer(opts.SequencerID).
+		WithFailureDetector(failureDetectorConfig).
+		WithJoin(opts.Join).
+		WithTLS(tlsConfig).
+		WithSendQueue(sendQueueConfig).
+		WithRMulticast(rmulticastConfig).
+		WithBatch(batchConfig).
+		WithAdmission(&multicast.AdmissionConfig{
+			MaxInFlightPerNode:  opts.MaxInFlight,
+			MaxInFlightPerGroup: opts.MaxInFlightGroup,
+		}).
 		Build()
 	return group, nil
 }
 
-func RootCMDMain(nodeID string, nodePort string, configPath string) (err error) {
+// RootCMDMain runs the node until SIGINT or SIGTERM, then shuts it down gracefully,
+// the signals received during the shutdown are ignored, every step of it is bounded by a timeout.
+// A node ejected by another member stops at once and exits with an error
+func RootCMDMain(nodeID string, nodePort string, configPath string, opts *Options) (err error) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// groupCtx outlives ctx, the node keeps its connections while it drains and leaves
+	groupCtx, cancelGroup := context.WithCancel(context.Background())
+	defer cancelGroup()
+
 	metrics.SetupMetrics()
-	group, err := ConstructGroup(nodeID, nodePort, configPath)
+	if opts.TraceFile != "" {
+		err = tracing.Setup(opts.TraceFile)
+		if err != nil {
+			return err
+		}
+		defer tracing.Close()
+	}
+	group, err := ConstructGroup(nodeID, nodePort, configPath, opts)
 	if err != nil {
 		return err
 	}
+	if opts.MetricsAddr != "" {
+		err = metrics.Serve(groupCtx, opts.MetricsAddr)
+		if err != nil {
+			return err
+		}
+	}
 	router := group.TO()
 
-	transactionProcessor := transaction.NewProcessor()
+	transactionProcessor := transaction.NewProcessor(nodeID)
+	if opts.DataDir != "" {
+		err = transactionProcessor.OpenWAL(opts.DataDir)
+		if err != nil {
+			return errors.Wrap(err, "open write-ahead log failed")
+		}
+		defer transactionProcessor.Close()
+	}
 	transactionProcessor.RegisteTransactionHandler(router)
+	group.SetStateMachine(transactionProcessor)
+	if opts.AdminAddr != "" {
+		err = admin.New(group, transactionProcessor).Serve(groupCtx, opts.AdminAddr)
+		if err != nil {
+			return err
+		}
+	}
 
-	err = group.Start(context.Background())
-
-	if err != nil {
-		return errors.Wrap(err, "group start failed")
+	started := make(chan error, 1)
+	go func() {
+		started <- group.Start(groupCtx)
+	}()
+	select {
+	case err = <-started:
+		if err != nil {
+			return errors.Wrap(err, "group start failed")
+		}
+	case <-ctx.Done():
+		logger.Infof("node [%s] is interrupted before the group is started", nodeID)
+		cancelGroup()
+		<-started
+		return nil
 	}
-	transactionEventEmitter := transaction.TransactionEventListenerPipeline(os.Stdin)
 
+	transactionEventEmitter := transaction.TransactionEventListenerPipeline(ctx, os.Stdin)
+	pipelineDone := make(chan struct{})
 	go func() {
+		defer close(pipelineDone)
 		for msg := range transactionEventEmitter {
-			err = group.TO().Multicast(msg.Path, msg.Body)
+			err := group.TO().MulticastContext(groupCtx, msg.Path, msg.Body)
 			if err != nil {
 				logger.Errorf("%v", err)
 				continue
 			}
 		}
 	}()
-	select {}
+
+	select {
+	case <-ctx.Done():
+		err = shutdown(group, pipelineDone, opts.ShutdownTimeout)
+	case <-transactionProcessor.Failed():
+		err = failStop(group, transactionProcessor.Err())
+	case <-group.Left():
+		// another member ejected this node, the group no longer delivers to it
+		err = group.Ejected()
+	}
+	cancelGroup()
+	<-group.Done()
+	logger.Infof("node [%s] is shut down", nodeID)
+	os.Stdout.Sync()
+	os.Stderr.Sync()
+	return err
+}
+
+// shutdown waits for the transactions already read to be multicast and delivered, then announces the departure of this node
+func shutdown(group *multicast.Group, pipelineDone chan struct{}, timeout time.Duration) (err error) {
+	logger.Infof("node [%s] is shutting down, drain in-flight messages for up to %v", group.SelfNodeID, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	select {
+	case <-pipelineDone:
+	case <-ctx.Done():
+	}
+	err = group.Drain(ctx)
+	if err != nil {
+		logger.Errorf("drain in-flight messages failed, leave anyway: %v", err)
+	}
+
+	leaveCtx, cancelLeave := context.WithTimeout(context.Background(), multicast.JoinTimeout)
+	defer cancelLeave()
+	err = group.Leave(leaveCtx)
+	if err != nil {
+		return errors.Wrap(err, "leave group failed")
+	}
+	return nil
+}
+
+// failStop announces the departure of a node that can no longer log the transactions it delivers,
+// it does not drain, this node would not apply its in-flight messages anyway
+func failStop(group *multicast.Group, cause error) (err error) {
+	logger.Errorf("node [%s] can not log delivered transactions, leave the group", group.SelfNodeID)
+	leaveCtx, cancelLeave := context.WithTimeout(context.Background(), multicast.JoinTimeout)
+	defer cancelLeave()
+	err = group.Leave(leaveCtx)
+	if err != nil {
+		logger.Errorf("leave group failed: %v", err)
+	}
+	return errors.Wrap(cause, "write-ahead log failed")
 }
 
 func NewRootCMD() *cobra.Command {
+	opts := &Options{}
 	cmd := &cobra.Command{
 		Use:   "mp1",
 		Short: "mp1",
@@ -105,10 +329,49 @@ func NewRootCMD() *cobra.Command {
 			nodePort := args[1]
 			configPath := args[2]
 
-			err := RootCMDMain(nodeID, nodePort, configPath)
+			err := RootCMDMain(nodeID, nodePort, configPath, opts)
 			ExitWrapper(err)
 		},
 	}
 
+	cmd.Flags().StringVar(&opts.TotalOrderStrategy, "total-order", string(multicast.ISISStrategy), "total order strategy, isis, sequencer or raft")
+	cmd.Flags().StringVar(&opts.SequencerID, "sequencer", "", "fixed sequencer node id of the sequencer strategy, elect the sequencer if empty")
+
+	defaultFailureDetector := multicast.DefaultFailureDetectorConfig()
+	cmd.Flags().StringVar(&opts.FailureDetector, "failure-detector", string(defaultFailureDetector.Mode), "heartbeat failure detector mode, none, all-to-all or gossip")
+	cmd.Flags().DurationVar(&opts.HeartbeatPeriod, "heartbeat-period", defaultFailureDetector.HeartbeatPeriod, "period between two heartbeats")
+	cmd.Flags().DurationVar(&opts.SuspicionTimeout, "suspicion-timeout", defaultFailureDetector.SuspicionTimeout, "silence before a member is suspected")
+	cmd.Flags().DurationVar(&opts.DeadTimeout, "dead-timeout", defaultFailureDetector.DeadTimeout, "silence before a member is confirmed dead and ejected")
+	cmd.Flags().IntVar(&opts.GossipFanout, "gossip-fanout", defaultFailureDetector.GossipFanout, "number of peers a gossip heartbeat is sent to")
+
+	hostname, _ := os.Hostname()
+	cmd.Flags().BoolVar(&opts.Join, "join", false, "join a running group, the nodes in the config file are asked to sponsor this node")
+	cmd.Flags().StringVar(&opts.AdvertiseHost, "advertise-host", hostname, "host other members dial to reach this node after it joins")
+	cmd.Flags().StringVar(&opts.Codec, "codec", codec.JSONName, "preferred message codec, json or msgpack, negotiated with every peer")
+	cmd.Flags().StringVar(&opts.DataDir, "data-dir", "", "directory of the write-ahead log of delivered transactions, balances are only kept in memory if empty")
+
+	defaultSendQueue := multicast.DefaultSendQueueConfig()
+	cmd.Flags().IntVar(&opts.SendQueueSize, "send-queue-size", defaultSendQueue.Size, "number of messages queued for every peer")
+	cmd.Flags().StringVar(&opts.SendQueuePolicy, "send-queue-policy", string(defaultSendQueue.Policy), "what a send does once the queue of a peer is full, block, drop or eject")
+
+	defaultAdmission := multicast.DefaultAdmissionConfig()
+	cmd.Flags().IntVar(&opts.MaxInFlight, "max-in-flight", defaultAdmission.MaxInFlightPerNode, "TO messages of this node not delivered yet before reading the standard input waits, 0 is no cap")
+	cmd.Flags().IntVar(&opts.MaxInFlightGroup, "max-in-flight-group", defaultAdmission.MaxInFlightPerGroup, "TO messages of every member not delivered yet before reading the standard input waits, 0 is no cap")
+
+	defaultRMulticast := multicast.DefaultRMulticastConfig()
+	cmd.Flags().StringVar(&opts.RMulticastMode, "r-multicast", string(defaultRMulticast.Mode), "r-multicast relay mode, flood, push or push-pull")
+	cmd.Flags().IntVar(&opts.RMulticastFanout, "r-multicast-fanout", defaultRMulticast.Fanout, "number of peers a gossip relay is sent to")
+	cmd.Flags().IntVar(&opts.RMulticastRounds, "r-multicast-rounds", defaultRMulticast.Rounds, "number of hops a message is relayed by gossip")
+	cmd.Flags().DurationVar(&opts.AntiEntropyPeriod, "anti-entropy-period", defaultRMulticast.AntiEntropyPeriod, "period between two digest exchanges of push-pull")
+
+	defaultBatch := multicast.DefaultBatchConfig()
+	cmd.Flags().DurationVar(&opts.BatchWindow, "batch-window", defaultBatch.Window, "time an isis ask, reply or announce waits to share a frame with others, 0 sends every message on its own")
+	cmd.Flags().IntVar(&opts.BatchSize, "batch-size", defaultBatch.Size, "number of isis messages after which a batch is sent before its window is over")
+
+	cmd.Flags().StringVar(&opts.MetricsAddr, "metrics-addr", "", "address of the prometheus /metrics endpoint, such as :9100, disabled if empty")
+	cmd.Flags().StringVar(&opts.TraceFile, "trace-file", "", "file the spans of this node are written to as OTLP json lines, tracing is disabled if empty")
+	cmd.Flags().StringVar(&opts.AdminAddr, "admin-addr", "", "address of the admin http api and pprof, such as 127.0.0.1:9200, disabled if empty")
+	cmd.Flags().DurationVar(&opts.ShutdownTimeout, "shutdown-timeout", DefaultShutdownTimeout, "time the in-flight messages of this node are given to be delivered on SIGINT or SIGTERM before it leaves the group")
+
 	return cmd
 }
@@ -0,0 +1,129 @@
+package mp1
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"github.com/bamboovir/cs425/lib/codec"
+	"github.com/bamboovir/cs425/lib/memnet"
+	"github.com/bamboovir/cs425/lib/mp1/multicast"
+)
+
+var shutdownNodeIDs = []string{"A", "B", "C"}
+
+// deliveredBodies the bodies every node TO-delivered, in order
+type deliveredBodies struct {
+	bodies map[string][]string
+	lock   *sync.Mutex
+}
+
+func (d *deliveredBodies) record(nodeID string, msg *multicast.TOMsg) error {
+	body := ""
+	err := codec.Unmarshal(msg.Body, &body)
+	if err != nil {
+		return err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.bodies[nodeID] = append(d.bodies[nodeID], body)
+	return nil
+}
+
+func (d *deliveredBodies) of(nodeID string) []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]string{}, d.bodies[nodeID]...)
+}
+
+// startShutdownGroups starts A, B and C on a memnet network, the context of each group is cancelled by its cancel func
+func startShutdownGroups(t *testing.T, d *deliveredBodies) (map[string]*multicast.Group, map[string]context.CancelFunc) {
+	t.Helper()
+	network := memnet.New(&memnet.Config{Seed: 11, MaxDelay: time.Millisecond})
+	members := make([]multicast.Node, 0, len(shutdownNodeIDs))
+	for _, nodeID := range shutdownNodeIDs {
+		members = append(members, multicast.Node{ID: nodeID, Addr: "mem-" + nodeID})
+	}
+
+	groups := map[string]*multicast.Group{}
+	cancels := map[string]context.CancelFunc{}
+	started := make(chan error, len(shutdownNodeIDs))
+	for _, nodeID := range shutdownNodeIDs {
+		nodeID := nodeID
+		group := multicast.NewGroupBuilder().
+			WithSelfNodeID(nodeID).
+			WithSelfNodeAddr("mem-" + nodeID).
+			WithMembers(members).
+			WithTransport(network).
+			Build()
+		group.TO().Bind("/test", func(msg *multicast.TOMsg) error { return d.record(nodeID, msg) })
+		ctx, cancel := context.WithCancel(context.Background())
+		groups[nodeID] = group
+		cancels[nodeID] = cancel
+		go func() {
+			started <- group.Start(ctx)
+		}()
+	}
+	t.Cleanup(func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+		network.Close()
+	})
+	for range shutdownNodeIDs {
+		err := <-started
+		if err != nil {
+			t.Fatalf("start group: %v", err)
+		}
+	}
+	return groups, cancels
+}
+
+func TestShutdownDeliversPipelinedMsgAndLeaves(t *testing.T) {
+	d := &deliveredBodies{bodies: map[string][]string{}, lock: &sync.Mutex{}}
+	groups, cancels := startShutdownGroups(t, d)
+
+	// the pipeline read one transaction before the signal, it is still multicast when the shutdown starts
+	pipelineDone := make(chan struct{})
+	go func() {
+		defer close(pipelineDone)
+		err := groups["A"].TO().MulticastContext(context.Background(), "/test", "pipelined")
+		if err != nil {
+			t.Errorf("to-multicast: %v", err)
+		}
+	}()
+	err := shutdown(groups["A"], pipelineDone, DefaultShutdownTimeout)
+	if err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if got := d.of("A"); len(got) != 1 || got[0] != "pipelined" {
+		t.Fatalf("node [A] delivered %v before it left, want the pipelined msg", got)
+	}
+	if groups["A"].View().Contains("A") {
+		t.Fatalf("node [A] did not install its leave: %s", groups["A"].View())
+	}
+
+	// A still runs, its peers install the leave after the pipelined msg in the total order
+	for _, nodeID := range []string{"B", "C"} {
+		group := groups[nodeID]
+		deadline := time.Now().Add(10 * time.Second)
+		for group.View().Contains("A") {
+			if time.Now().After(deadline) {
+				t.Fatalf("node [%s] did not install the leave of A: %s", nodeID, group.View())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := d.of(nodeID); len(got) != 1 || got[0] != "pipelined" {
+			t.Fatalf("node [%s] delivered %v before the leave of A, want the pipelined msg", nodeID, got)
+		}
+	}
+
+	cancels["A"]()
+	select {
+	case <-groups["A"].Done():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("node [A] did not close its connections once its context is done")
+	}
+}
@@ -1,7 +1,12 @@
 package broker
 
+import (
+	sync "github.com/sasha-s/go-deadlock"
+)
+
 type Broker struct {
 	stopCh    chan struct{}
+	stopOnce  *sync.Once
 	publishCh chan interface{}
 	subCh     chan chan interface{}
 	unsubCh   chan chan interface{}
@@ -10,6 +15,7 @@ type Broker struct {
 func New() *Broker {
 	return &Broker{
 		stopCh:    make(chan struct{}),
+		stopOnce:  &sync.Once{},
 		publishCh: make(chan interface{}, 1),
 		subCh:     make(chan chan interface{}, 1),
 		unsubCh:   make(chan chan interface{}, 1),
@@ -36,21 +42,32 @@ func (b *Broker) Start() {
 		}
 	}
 }
+
+// Stop may be called more than once, a message published after Stop is dropped
 func (b *Broker) Stop() {
-	close(b.stopCh)
+	b.stopOnce.Do(func() { close(b.stopCh) })
 }
 
 func (b *Broker) Subscribe() chan interface{} {
 	msgCh := make(chan interface{}, 5)
-	b.subCh <- msgCh
+	select {
+	case b.subCh <- msgCh:
+	case <-b.stopCh:
+	}
 	return msgCh
 }
 
 func (b *Broker) Unsubscribe(msgCh chan interface{}) {
-	b.unsubCh <- msgCh
+	select {
+	case b.unsubCh <- msgCh:
+	case <-b.stopCh:
+	}
 	close(msgCh)
 }
 
 func (b *Broker) Publish(msg interface{}) {
-	b.publishCh <- msg
+	select {
+	case b.publishCh <- msg:
+	case <-b.stopCh:
+	}
 }
@@ -0,0 +1,122 @@
+package codec
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Codec encodes messages of every layer, a connection uses the codec negotiated in its handshake
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+const (
+	JSONName    = "json"
+	MsgpackName = "msgpack"
+)
+
+var (
+	JSON    Codec = &jsonCodec{}
+	Msgpack Codec = &msgpackCodec{}
+)
+
+var (
+	codecs = map[string]Codec{
+		JSONName:    JSON,
+		MsgpackName: Msgpack,
+	}
+	defaultCodec = JSON
+)
+
+func Lookup(name string) (Codec, error) {
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unrecognized codec [%s]", name)
+	}
+	return c, nil
+}
+
+// Names returns the names of every supported codec
+func Names() []string {
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Offer returns the codecs a client proposes in its handshake, in order of preference
+func Offer(preferred Codec) []string {
+	offered := []string{preferred.Name()}
+	for _, name := range Names() {
+		if name != preferred.Name() {
+			offered = append(offered, name)
+		}
+	}
+	return offered
+}
+
+// Negotiate picks preferred if the client offered it, otherwise the first offered codec this side supports,
+// JSON is the fallback every node understands
+func Negotiate(offered []string, preferred Codec) Codec {
+	for _, name := range offered {
+		if name == preferred.Name() {
+			return preferred
+		}
+	}
+	for _, name := range offered {
+		c, ok := codecs[name]
+		if ok {
+			return c
+		}
+	}
+	return JSON
+}
+
+// SetDefault sets the codec used to encode message bodies nested in other messages
+func SetDefault(c Codec) {
+	defaultCodec = c
+}
+
+func Default() Codec {
+	return defaultCodec
+}
+
+// tags the first byte of the data Marshal returns, it names the codec of the rest,
+// so a body relayed over links with other codecs, or encoded by a member with another default codec, still decodes
+var (
+	tags = map[string]byte{
+		JSONName:    0x01,
+		MsgpackName: 0x02,
+	}
+	tagged = map[byte]Codec{
+		0x01: JSON,
+		0x02: Msgpack,
+	}
+)
+
+// Marshal encodes v with the default codec, prefixed by the tag of the codec
+func Marshal(v interface{}) ([]byte, error) {
+	body, err := defaultCodec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 1, len(body)+1)
+	data[0] = tags[defaultCodec.Name()]
+	return append(data, body...), nil
+}
+
+// Unmarshal decodes data encoded by Marshal with the codec its tag names
+func Unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return fmt.Errorf("unmarshal empty data, missing codec tag")
+	}
+	c, ok := tagged[data[0]]
+	if !ok {
+		return fmt.Errorf("unrecognized codec tag [0x%02x]", data[0])
+	}
+	return c.Unmarshal(data[1:], v)
+}
@@ -0,0 +1,119 @@
+package codec
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+type testMsg struct {
+	Src   string            `json:"src"`
+	Seq   uint64            `json:"seq"`
+	Body  []byte            `json:"body"`
+	Clock map[string]uint64 `json:"clock,omitempty"`
+	Next  *testMsg          `json:"next,omitempty"`
+}
+
+func withDefault(t *testing.T, c Codec) {
+	t.Helper()
+	previous := Default()
+	SetDefault(c)
+	t.Cleanup(func() { SetDefault(previous) })
+}
+
+func TestRoundTrip(t *testing.T) {
+	values := []struct {
+		name string
+		v    interface{}
+		out  func() interface{}
+	}{
+		{"struct", testMsg{Src: "A", Seq: 7, Body: []byte{0xc0, 0x00, 0xff}, Clock: map[string]uint64{"A": 1}, Next: &testMsg{Src: "B"}}, func() interface{} { return &testMsg{} }},
+		{"nil", nil, func() interface{} { return new(*testMsg) }},
+		{"string", "deposit", func() interface{} { return new(string) }},
+		{"uint", uint64(1 << 40), func() interface{} { return new(uint64) }},
+		{"slice", []string{"a", "b"}, func() interface{} { return new([]string) }},
+		{"bytes", []byte{0x80, 0x90}, func() interface{} { return new([]byte) }},
+		{"bool", true, func() interface{} { return new(bool) }},
+	}
+	for _, c := range []Codec{JSON, Msgpack} {
+		withDefault(t, c)
+		for _, value := range values {
+			data, err := Marshal(value.v)
+			if err != nil {
+				t.Fatalf("%s marshal %s: %v", c.Name(), value.name, err)
+			}
+			out := value.out()
+			err = Unmarshal(data, out)
+			if err != nil {
+				t.Fatalf("%s unmarshal %s: %v", c.Name(), value.name, err)
+			}
+			got := reflect.ValueOf(out).Elem().Interface()
+			want := value.v
+			if want == nil {
+				want = (*testMsg)(nil)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s round trip of %s got %#v, want %#v", c.Name(), value.name, got, want)
+			}
+		}
+	}
+}
+
+func TestUnmarshalFollowsTagNotDefault(t *testing.T) {
+	withDefault(t, Msgpack)
+	// a msgpack nil and a msgpack fixint look like nothing JSON would start with
+	for _, v := range []interface{}{nil, 5} {
+		data, err := Marshal(v)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		SetDefault(JSON)
+		var out interface{}
+		err = Unmarshal(data, &out)
+		if err != nil {
+			t.Fatalf("unmarshal msgpack %v with json default: %v", v, err)
+		}
+		SetDefault(Msgpack)
+	}
+}
+
+func TestUnmarshalRejectsUntaggedData(t *testing.T) {
+	out := &testMsg{}
+	if err := Unmarshal([]byte(`{"src":"A"}`), out); err == nil {
+		t.Fatalf("untagged data decoded")
+	}
+	if err := Unmarshal(nil, out); err == nil {
+		t.Fatalf("empty data decoded")
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	if c := Negotiate(Offer(Msgpack), JSON); c != JSON {
+		t.Fatalf("negotiated %s, want the preferred json", c.Name())
+	}
+	if c := Negotiate([]string{"gob", MsgpackName}, JSON); c != Msgpack {
+		t.Fatalf("negotiated %s, want the first supported msgpack", c.Name())
+	}
+	if c := Negotiate(nil, Msgpack); c != JSON {
+		t.Fatalf("negotiated %s with an old client, want json", c.Name())
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	buf := &bytes.Buffer{}
+	for _, payload := range [][]byte{{}, []byte("hi"), bytes.Repeat([]byte{0xc0}, 1<<16)} {
+		err := WriteFrame(buf, payload)
+		if err != nil {
+			t.Fatalf("write frame: %v", err)
+		}
+	}
+	for _, size := range []int{0, 2, 1 << 16} {
+		payload, err := ReadFrame(buf)
+		if err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+		if len(payload) != size {
+			t.Fatalf("frame of %d bytes, want %d", len(payload), size)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	FrameHeaderSize = 4
+	MaxFrameSize    = 64 << 20
+)
+
+// WriteFrame writes payload prefixed by its length as a 4 bytes big endian integer
+func WriteFrame(w io.Writer, payload []byte) (err error) {
+	if len(payload) > MaxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds limit %d", len(payload), MaxFrameSize)
+	}
+	frame := make([]byte, FrameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[FrameHeaderSize:], payload)
+	_, err = w.Write(frame)
+	return err
+}
+
+// ReadFrame reads one length-prefixed frame, r should be buffered
+func ReadFrame(r io.Reader) (payload []byte, err error) {
+	header := make([]byte, FrameHeaderSize)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > MaxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds limit %d", size, MaxFrameSize)
+	}
+	payload = make([]byte, size)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
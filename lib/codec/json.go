@@ -0,0 +1,19 @@
+package codec
+
+import (
+	"encoding/json"
+)
+
+type jsonCodec struct{}
+
+func (c *jsonCodec) Name() string {
+	return JSONName
+}
+
+func (c *jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c *jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,774 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+
+	sync "github.com/sasha-s/go-deadlock"
+)
+
+// msgpackCodec encodes structs as msgpack maps keyed by their json tags,
+// byte slices are written as raw bin instead of base64, so nested message bodies do not grow with every layer
+type msgpackCodec struct{}
+
+func (c *msgpackCodec) Name() string {
+	return MsgpackName
+}
+
+func (c *msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	e := &msgpackEncoder{buf: make([]byte, 0, 128)}
+	err := e.encode(reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+func (c *msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("msgpack unmarshal needs a non-nil pointer, got %T", v)
+	}
+	d := &msgpackDecoder{data: data}
+	err := d.decode(rv.Elem())
+	if err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return fmt.Errorf("msgpack unmarshal: %d trailing bytes", len(d.data)-d.pos)
+	}
+	return nil
+}
+
+type structField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var (
+	structFieldsCache     = map[reflect.Type][]structField{}
+	structFieldsCacheLock = &sync.RWMutex{}
+)
+
+// structFields lists the exported fields of t under the names encoding/json would use
+func structFields(t reflect.Type) []structField {
+	structFieldsCacheLock.RLock()
+	fields, ok := structFieldsCache[t]
+	structFieldsCacheLock.RUnlock()
+	if ok {
+		return fields
+	}
+
+	fields = make([]structField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := f.Name
+		opts := strings.Split(tag, ",")
+		if opts[0] != "" {
+			name = opts[0]
+		}
+		omitEmpty := false
+		for _, opt := range opts[1:] {
+			if opt == "omitempty" {
+				omitEmpty = true
+			}
+		}
+		fields = append(fields, structField{
+			name:      name,
+			index:     f.Index,
+			omitEmpty: omitEmpty,
+		})
+	}
+
+	structFieldsCacheLock.Lock()
+	structFieldsCache[t] = fields
+	structFieldsCacheLock.Unlock()
+	return fields
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+type msgpackEncoder struct {
+	buf []byte
+}
+
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf = append(e.buf, 0xc0)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		return e.encode(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, 0xc3)
+		} else {
+			e.buf = append(e.buf, 0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.encodeUint(v.Uint())
+	case reflect.Float32:
+		e.buf = append(e.buf, 0xca)
+		e.buf = appendUint32(e.buf, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		e.buf = append(e.buf, 0xcb)
+		e.buf = appendUint64(e.buf, math.Float64bits(v.Float()))
+	case reflect.String:
+		e.encodeString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.encodeBytes(v.Bytes())
+			return nil
+		}
+		return e.encodeArray(v)
+	case reflect.Array:
+		return e.encodeArray(v)
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		return e.encodeMap(v)
+	case reflect.Struct:
+		return e.encodeStruct(v)
+	default:
+		return fmt.Errorf("msgpack marshal: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) encodeInt(i int64) {
+	switch {
+	case i >= 0:
+		e.encodeUint(uint64(i))
+	case i >= -32:
+		e.buf = append(e.buf, byte(i))
+	case i >= math.MinInt8:
+		e.buf = append(e.buf, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		e.buf = append(e.buf, 0xd1)
+		e.buf = appendUint16(e.buf, uint16(i))
+	case i >= math.MinInt32:
+		e.buf = append(e.buf, 0xd2)
+		e.buf = appendUint32(e.buf, uint32(i))
+	default:
+		e.buf = append(e.buf, 0xd3)
+		e.buf = appendUint64(e.buf, uint64(i))
+	}
+}
+
+func (e *msgpackEncoder) encodeUint(u uint64) {
+	switch {
+	case u <= 0x7f:
+		e.buf = append(e.buf, byte(u))
+	case u <= math.MaxUint8:
+		e.buf = append(e.buf, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		e.buf = append(e.buf, 0xcd)
+		e.buf = appendUint16(e.buf, uint16(u))
+	case u <= math.MaxUint32:
+		e.buf = append(e.buf, 0xce)
+		e.buf = appendUint32(e.buf, uint32(u))
+	default:
+		e.buf = append(e.buf, 0xcf)
+		e.buf = appendUint64(e.buf, u)
+	}
+}
+
+func (e *msgpackEncoder) encodeString(s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		e.buf = append(e.buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xda)
+		e.buf = appendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, 0xdb)
+		e.buf = appendUint32(e.buf, uint32(n))
+	}
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) encodeBytes(b []byte) {
+	n := len(b)
+	switch {
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xc5)
+		e.buf = appendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, 0xc6)
+		e.buf = appendUint32(e.buf, uint32(n))
+	}
+	e.buf = append(e.buf, b...)
+}
+
+func (e *msgpackEncoder) encodeArrayHeader(n int) {
+	switch {
+	case n < 16:
+		e.buf = append(e.buf, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xdc)
+		e.buf = appendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, 0xdd)
+		e.buf = appendUint32(e.buf, uint32(n))
+	}
+}
+
+func (e *msgpackEncoder) encodeMapHeader(n int) {
+	switch {
+	case n < 16:
+		e.buf = append(e.buf, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xde)
+		e.buf = appendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, 0xdf)
+		e.buf = appendUint32(e.buf, uint32(n))
+	}
+}
+
+func (e *msgpackEncoder) encodeArray(v reflect.Value) error {
+	e.encodeArrayHeader(v.Len())
+	for i := 0; i < v.Len(); i++ {
+		err := e.encode(v.Index(i))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeMap writes keys in sorted order, so equal maps encode to equal bytes
+func (e *msgpackEncoder) encodeMap(v reflect.Value) error {
+	if v.Type().Key().Kind() != reflect.String {
+		return fmt.Errorf("msgpack marshal: unsupported map key type %s", v.Type().Key())
+	}
+	keys := v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	e.encodeMapHeader(len(keys))
+	for _, key := range keys {
+		e.encodeString(key.String())
+		err := e.encode(v.MapIndex(key))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) encodeStruct(v reflect.Value) error {
+	fields := structFields(v.Type())
+	values := make([]reflect.Value, 0, len(fields))
+	names := make([]string, 0, len(fields))
+	for _, f := range fields {
+		fv := v.FieldByIndex(f.index)
+		if f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		values = append(values, fv)
+		names = append(names, f.name)
+	}
+	e.encodeMapHeader(len(values))
+	for i, fv := range values {
+		e.encodeString(names[i])
+		err := e.encode(fv)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendUint16(b []byte, u uint16) []byte {
+	return append(b, byte(u>>8), byte(u))
+}
+
+func appendUint32(b []byte, u uint32) []byte {
+	return append(b, byte(u>>24), byte(u>>16), byte(u>>8), byte(u))
+}
+
+func appendUint64(b []byte, u uint64) []byte {
+	return append(b, byte(u>>56), byte(u>>48), byte(u>>40), byte(u>>32), byte(u>>24), byte(u>>16), byte(u>>8), byte(u))
+}
+
+type msgpackFamily int
+
+const (
+	familyNil msgpackFamily = iota
+	familyBool
+	familyInt
+	familyUint
+	familyFloat
+	familyStr
+	familyBin
+	familyArray
+	familyMap
+)
+
+// msgpackToken is one decoded header, n is the length of a str, bin, array or map
+type msgpackToken struct {
+	family msgpackFamily
+	b      bool
+	i      int64
+	u      uint64
+	f      float64
+	n      int
+}
+
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *msgpackDecoder) read(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, fmt.Errorf("msgpack unmarshal: unexpected end of data")
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) readUint(size int) (uint64, error) {
+	b, err := d.read(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+func (d *msgpackDecoder) readLen(family msgpackFamily, size int) (msgpackToken, error) {
+	n, err := d.readUint(size)
+	if err != nil {
+		return msgpackToken{}, err
+	}
+	return msgpackToken{family: family, n: int(n)}, nil
+}
+
+func (d *msgpackDecoder) next() (msgpackToken, error) {
+	b, err := d.read(1)
+	if err != nil {
+		return msgpackToken{}, err
+	}
+	c := b[0]
+
+	switch {
+	case c <= 0x7f:
+		return msgpackToken{family: familyUint, u: uint64(c)}, nil
+	case c >= 0xe0:
+		return msgpackToken{family: familyInt, i: int64(int8(c))}, nil
+	case c >= 0x80 && c <= 0x8f:
+		return msgpackToken{family: familyMap, n: int(c & 0x0f)}, nil
+	case c >= 0x90 && c <= 0x9f:
+		return msgpackToken{family: familyArray, n: int(c & 0x0f)}, nil
+	case c >= 0xa0 && c <= 0xbf:
+		return msgpackToken{family: familyStr, n: int(c & 0x1f)}, nil
+	}
+
+	switch c {
+	case 0xc0:
+		return msgpackToken{family: familyNil}, nil
+	case 0xc2:
+		return msgpackToken{family: familyBool, b: false}, nil
+	case 0xc3:
+		return msgpackToken{family: familyBool, b: true}, nil
+	case 0xc4:
+		return d.readLen(familyBin, 1)
+	case 0xc5:
+		return d.readLen(familyBin, 2)
+	case 0xc6:
+		return d.readLen(familyBin, 4)
+	case 0xca:
+		u, err := d.readUint(4)
+		return msgpackToken{family: familyFloat, f: float64(math.Float32frombits(uint32(u)))}, err
+	case 0xcb:
+		u, err := d.readUint(8)
+		return msgpackToken{family: familyFloat, f: math.Float64frombits(u)}, err
+	case 0xcc:
+		u, err := d.readUint(1)
+		return msgpackToken{family: familyUint, u: u}, err
+	case 0xcd:
+		u, err := d.readUint(2)
+		return msgpackToken{family: familyUint, u: u}, err
+	case 0xce:
+		u, err := d.readUint(4)
+		return msgpackToken{family: familyUint, u: u}, err
+	case 0xcf:
+		u, err := d.readUint(8)
+		return msgpackToken{family: familyUint, u: u}, err
+	case 0xd0:
+		u, err := d.readUint(1)
+		return msgpackToken{family: familyInt, i: int64(int8(u))}, err
+	case 0xd1:
+		u, err := d.readUint(2)
+		return msgpackToken{family: familyInt, i: int64(int16(u))}, err
+	case 0xd2:
+		u, err := d.readUint(4)
+		return msgpackToken{family: familyInt, i: int64(int32(u))}, err
+	case 0xd3:
+		u, err := d.readUint(8)
+		return msgpackToken{family: familyInt, i: int64(u)}, err
+	case 0xd9:
+		return d.readLen(familyStr, 1)
+	case 0xda:
+		return d.readLen(familyStr, 2)
+	case 0xdb:
+		return d.readLen(familyStr, 4)
+	case 0xdc:
+		return d.readLen(familyArray, 2)
+	case 0xdd:
+		return d.readLen(familyArray, 4)
+	case 0xde:
+		return d.readLen(familyMap, 2)
+	case 0xdf:
+		return d.readLen(familyMap, 4)
+	}
+	return msgpackToken{}, fmt.Errorf("msgpack unmarshal: unsupported format byte 0x%02x", c)
+}
+
+func (d *msgpackDecoder) decode(v reflect.Value) error {
+	t, err := d.next()
+	if err != nil {
+		return err
+	}
+	return d.decodeToken(t, v)
+}
+
+func (d *msgpackDecoder) decodeToken(t msgpackToken, v reflect.Value) error {
+	if t.family == familyNil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decodeToken(t, v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("msgpack unmarshal: unsupported type %s", v.Type())
+		}
+		generic, err := d.decodeGeneric(t)
+		if err != nil {
+			return err
+		}
+		if generic == nil {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		v.Set(reflect.ValueOf(generic))
+		return nil
+	}
+
+	switch t.family {
+	case familyBool:
+		if v.Kind() != reflect.Bool {
+			return mismatch("bool", v)
+		}
+		v.SetBool(t.b)
+	case familyInt, familyUint:
+		return setInteger(t, v)
+	case familyFloat:
+		if v.Kind() != reflect.Float32 && v.Kind() != reflect.Float64 {
+			return mismatch("float", v)
+		}
+		v.SetFloat(t.f)
+	case familyStr, familyBin:
+		b, err := d.read(t.n)
+		if err != nil {
+			return err
+		}
+		switch {
+		case v.Kind() == reflect.String:
+			v.SetString(string(b))
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			bytes := make([]byte, len(b))
+			copy(bytes, b)
+			v.SetBytes(bytes)
+		default:
+			return mismatch("str", v)
+		}
+	case familyArray:
+		return d.decodeArray(t.n, v)
+	case familyMap:
+		return d.decodeMap(t.n, v)
+	}
+	return nil
+}
+
+func setInteger(t msgpackToken, v reflect.Value) error {
+	negative := t.family == familyInt && t.i < 0
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := t.i
+		if t.family == familyUint {
+			if t.u > math.MaxInt64 {
+				return mismatch("uint", v)
+			}
+			i = int64(t.u)
+		}
+		if v.OverflowInt(i) {
+			return mismatch("int", v)
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if negative {
+			return mismatch("negative int", v)
+		}
+		u := t.u
+		if t.family == familyInt {
+			u = uint64(t.i)
+		}
+		if v.OverflowUint(u) {
+			return mismatch("uint", v)
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		if t.family == familyUint {
+			v.SetFloat(float64(t.u))
+		} else {
+			v.SetFloat(float64(t.i))
+		}
+	default:
+		return mismatch("int", v)
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) decodeArray(n int, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		slice := reflect.MakeSlice(v.Type(), n, n)
+		for i := 0; i < n; i++ {
+			err := d.decode(slice.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+	case reflect.Array:
+		for i := 0; i < n; i++ {
+			if i >= v.Len() {
+				err := d.skip()
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			err := d.decode(v.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return mismatch("array", v)
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) decodeKey() (string, error) {
+	t, err := d.next()
+	if err != nil {
+		return "", err
+	}
+	if t.family != familyStr && t.family != familyBin {
+		return "", fmt.Errorf("msgpack unmarshal: map key must be a string")
+	}
+	b, err := d.read(t.n)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("msgpack unmarshal: unsupported map key type %s", v.Type().Key())
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), n))
+		}
+		for i := 0; i < n; i++ {
+			key, err := d.decodeKey()
+			if err != nil {
+				return err
+			}
+			elem := reflect.New(v.Type().Elem()).Elem()
+			err = d.decode(elem)
+			if err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+		}
+	case reflect.Struct:
+		fields := structFields(v.Type())
+		for i := 0; i < n; i++ {
+			key, err := d.decodeKey()
+			if err != nil {
+				return err
+			}
+			field, ok := lookupField(fields, key)
+			if !ok {
+				err = d.skip()
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			err = d.decode(v.FieldByIndex(field.index))
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return mismatch("map", v)
+	}
+	return nil
+}
+
+// lookupField prefers an exact match, then a case-insensitive one like encoding/json
+func lookupField(fields []structField, name string) (structField, bool) {
+	for _, f := range fields {
+		if f.name == name {
+			return f, true
+		}
+	}
+	for _, f := range fields {
+		if strings.EqualFold(f.name, name) {
+			return f, true
+		}
+	}
+	return structField{}, false
+}
+
+func (d *msgpackDecoder) skip() error {
+	t, err := d.next()
+	if err != nil {
+		return err
+	}
+	_, err = d.decodeGeneric(t)
+	return err
+}
+
+// decodeGeneric decodes into the types encoding/json uses for interface{}, except integers and bin
+func (d *msgpackDecoder) decodeGeneric(t msgpackToken) (interface{}, error) {
+	switch t.family {
+	case familyNil:
+		return nil, nil
+	case familyBool:
+		return t.b, nil
+	case familyInt:
+		return t.i, nil
+	case familyUint:
+		return t.u, nil
+	case familyFloat:
+		return t.f, nil
+	case familyStr:
+		b, err := d.read(t.n)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case familyBin:
+		b, err := d.read(t.n)
+		if err != nil {
+			return nil, err
+		}
+		bytes := make([]byte, len(b))
+		copy(bytes, b)
+		return bytes, nil
+	case familyArray:
+		array := make([]interface{}, t.n)
+		for i := 0; i < t.n; i++ {
+			elem, err := d.next()
+			if err != nil {
+				return nil, err
+			}
+			array[i], err = d.decodeGeneric(elem)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	default:
+		m := make(map[string]interface{}, t.n)
+		for i := 0; i < t.n; i++ {
+			key, err := d.decodeKey()
+			if err != nil {
+				return nil, err
+			}
+			elem, err := d.next()
+			if err != nil {
+				return nil, err
+			}
+			m[key], err = d.decodeGeneric(elem)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+}
+
+func mismatch(family string, v reflect.Value) error {
+	return fmt.Errorf("msgpack unmarshal: cannot decode %s into %s", family, v.Type())
+}
@@ -0,0 +1,84 @@
+package memnet
+
+import (
+	"time"
+
+	"github.com/bamboovir/cs425/lib/codec"
+	"github.com/bamboovir/cs425/lib/mp1/metrics"
+	"github.com/bamboovir/cs425/lib/mp1/multicast"
+)
+
+// delivery a copy of a message on the way, due at at on the virtual clock
+type delivery struct {
+	at    time.Time
+	seq   uint64
+	link  *link
+	data  []byte
+	index int
+}
+
+type deliveryQueue []*delivery
+
+func (q deliveryQueue) Len() int { return len(q) }
+
+func (q deliveryQueue) Less(i, j int) bool {
+	if !q[i].at.Equal(q[j].at) {
+		return q[i].at.Before(q[j].at)
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q deliveryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *deliveryQueue) Push(x interface{}) {
+	item := x.(*delivery)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *deliveryQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*q = old[0 : n-1]
+	return item
+}
+
+// link the messages of one sender to an endpoint, lastAt keeps them in order like a tcp connection,
+// its fields are guarded by the network lock
+type link struct {
+	srcID    string
+	endpoint *endpoint
+	lastAt   time.Time
+	closed   bool
+}
+
+func newLink(srcID string, ep *endpoint) *link {
+	return &link{
+		srcID:    srcID,
+		endpoint: ep,
+	}
+}
+
+// receive is called by the scheduler without the network lock, so the handler may send
+func (ep *endpoint) receive(srcID string, data []byte) {
+	metrics.NewBandwidthLogEntry(ep.nodeID, len(data)+codec.FrameHeaderSize).Log()
+	metrics.PeerReceivedBytes.Add(float64(len(data)+codec.FrameHeaderSize), ep.nodeID, srcID)
+	metrics.PeerReceivedMessages.Inc(ep.nodeID, srcID)
+	msg := &multicast.BMsg{}
+	err := codec.Unmarshal(data, msg)
+	if err != nil {
+		logger.Errorf("node [%s] decode msg from [%s] failed: %v", ep.nodeID, srcID, err)
+		return
+	}
+	err = ep.deliver(msg)
+	if err != nil {
+		logger.Errorf("node [%s] process msg from [%s] failed: %v", ep.nodeID, srcID, err)
+	}
+}
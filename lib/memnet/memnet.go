@@ -0,0 +1,450 @@
+package memnet
+
+import (
+	"container/heap"
+	"context"
+	"math/rand"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"github.com/bamboovir/cs425/lib/codec"
+	"github.com/bamboovir/cs425/lib/mp1/metrics"
+	"github.com/bamboovir/cs425/lib/mp1/multicast"
+	errors "github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	logger = log.WithField("src", "memnet")
+)
+
+var (
+	ErrConnectionRefused = errors.New("connection refused")
+	ErrConnectionClosed  = errors.New("connection is closed")
+	ErrAddressInUse      = errors.New("address already in use")
+)
+
+// Config every fault is drawn from one rand seeded with Seed, in the order the messages are sent,
+// so a run with the same seed and the same sends injects the same faults.
+// A message waits a delay between MinDelay and MaxDelay on the virtual clock of the network, the messages of a link keep their order,
+// unless a message is picked with ReorderRate, then it may overtake the messages sent before it.
+// The clock of a Manual network only moves on Advance, so the messages sent between two advances are stamped with the same time
+type Config struct {
+	Seed        int64
+	MinDelay    time.Duration
+	MaxDelay    time.Duration
+	DropRate    float64
+	DupRate     float64
+	ReorderRate float64
+	Manual      bool
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Seed:     1,
+		MinDelay: 0,
+		MaxDelay: time.Millisecond,
+	}
+}
+
+type Stats struct {
+	Sent       uint64 `json:"sent"`
+	Delivered  uint64 `json:"delivered"`
+	Dropped    uint64 `json:"dropped"`
+	Duplicated uint64 `json:"duplicated"`
+	Reordered  uint64 `json:"reordered"`
+}
+
+// Network an in-process network of the members of a group, it implements multicast.Transport.
+// The delays run on a virtual clock, one scheduler loop takes the message with the earliest delivery time,
+// moves the clock to it and runs the handler of its endpoint before it takes the next one,
+// so every handler runs on the scheduler, one at a time, and a run takes as long as its handlers instead of its delays.
+// A handler must not wait for another message, it would stall the network
+type Network struct {
+	config     *Config
+	rand       *rand.Rand
+	now        time.Time
+	until      time.Time
+	advanced   chan struct{}
+	endpoints  map[string]*endpoint
+	partitions map[string]int
+	crashed    map[string]struct{}
+	queue      deliveryQueue
+	nextSeq    uint64
+	stats      Stats
+	listened   chan struct{}
+	wake       chan struct{}
+	done       chan struct{}
+	lock       *sync.Mutex
+}
+
+// endpoint a listening member, every sender has its own link
+type endpoint struct {
+	nodeID  string
+	addr    string
+	deliver func(msg *multicast.BMsg) error
+	links   map[string]*link
+}
+
+func New(config *Config) *Network {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	n := &Network{
+		config:     config,
+		rand:       rand.New(rand.NewSource(config.Seed)),
+		now:        time.Unix(0, 0),
+		until:      time.Unix(0, 0),
+		endpoints:  map[string]*endpoint{},
+		partitions: map[string]int{},
+		crashed:    map[string]struct{}{},
+		queue:      deliveryQueue{},
+		listened:   make(chan struct{}),
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		lock:       &sync.Mutex{},
+	}
+	go n.schedule()
+	return n
+}
+
+// Listen the endpoint is closed once ctx is done, the messages on the way to it are lost
+func (n *Network) Listen(ctx context.Context, nodeID string, addr string, deliver func(msg *multicast.BMsg) error) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if _, ok := n.endpoints[addr]; ok {
+		return errors.Wrapf(ErrAddressInUse, "listen on [%s] failed", addr)
+	}
+	delete(n.crashed, nodeID)
+	ep := &endpoint{
+		nodeID:  nodeID,
+		addr:    addr,
+		deliver: deliver,
+		links:   map[string]*link{},
+	}
+	n.endpoints[addr] = ep
+	close(n.listened)
+	n.listened = make(chan struct{})
+	go n.unlisten(ctx, ep)
+	logger.Infof("node [%s] listening on: %s", nodeID, addr)
+	return nil
+}
+
+// unlisten closes ep once ctx is done, unless ep was already crashed and its address is reused by a restarted node
+func (n *Network) unlisten(ctx context.Context, ep *endpoint) {
+	select {
+	case <-n.done:
+		return
+	case <-ctx.Done():
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.endpoints[ep.addr] != ep {
+		return
+	}
+	for _, l := range ep.links {
+		l.closed = true
+	}
+	delete(n.endpoints, ep.addr)
+	logger.Infof("node [%s] stop listening on: %s", ep.nodeID, ep.addr)
+}
+
+// Dial an attempt ends early once any node listens, so the members started together connect without waiting for retryInterval
+func (n *Network) Dial(ctx context.Context, srcID string, dstID string, addr string, retryInterval time.Duration, attempts int) (multicast.Sender, error) {
+	for attempt := 1; ; attempt++ {
+		n.lock.Lock()
+		ep, ok := n.endpoints[addr]
+		listened := n.listened
+		n.lock.Unlock()
+		if ok && ep.nodeID == dstID {
+			break
+		}
+		if attempts != 0 && attempt >= attempts {
+			return nil, errors.Wrapf(ErrConnectionRefused, "dial [%s] in [%s] failed after %d attempts", dstID, addr, attempts)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-listened:
+		case <-time.After(retryInterval):
+		}
+	}
+	return &conn{
+		network: n,
+		srcID:   srcID,
+		dstID:   dstID,
+		addr:    addr,
+	}, nil
+}
+
+// Partition splits the members into groups, a message between two groups is dropped,
+// the members that are not listed form one more group
+func (n *Network) Partition(groups ...[]string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.partitions = map[string]int{}
+	for i, group := range groups {
+		for _, nodeID := range group {
+			n.partitions[nodeID] = i + 1
+		}
+	}
+	logger.Infof("partition network into %v", groups)
+}
+
+// Heal removes every partition
+func (n *Network) Heal() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.partitions = map[string]int{}
+	logger.Infof("heal network")
+}
+
+// Crash stops the endpoint of nodeID, the messages on the way to it are lost,
+// a sender to it gives up on its next send as if the connection was refused, and the senders of nodeID are closed.
+// A crashed node may Listen again as a restarted node
+func (n *Network) Crash(nodeID string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for addr, ep := range n.endpoints {
+		if ep.nodeID != nodeID {
+			continue
+		}
+		for _, l := range ep.links {
+			l.closed = true
+		}
+		delete(n.endpoints, addr)
+	}
+	n.crashed[nodeID] = struct{}{}
+	logger.Infof("crash node [%s]", nodeID)
+}
+
+// Now the virtual clock, the delivery time of the last message the scheduler took
+func (n *Network) Now() time.Time {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.now
+}
+
+func (n *Network) Stats() Stats {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.stats
+}
+
+// Close stops the scheduler, the messages on the way are lost
+func (n *Network) Close() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	select {
+	case <-n.done:
+		return
+	default:
+	}
+	close(n.done)
+	for _, ep := range n.endpoints {
+		for _, l := range ep.links {
+			l.closed = true
+		}
+	}
+}
+
+// reachable caller should hold lock
+func (n *Network) reachable(srcID string, dstID string) bool {
+	if _, ok := n.crashed[srcID]; ok {
+		return false
+	}
+	if _, ok := n.crashed[dstID]; ok {
+		return false
+	}
+	return n.partitions[srcID] == n.partitions[dstID]
+}
+
+// linkOf caller should hold lock
+func (n *Network) linkOf(ep *endpoint, srcID string) *link {
+	l, ok := ep.links[srcID]
+	if !ok {
+		l = newLink(srcID, ep)
+		ep.links[srcID] = l
+	}
+	return l
+}
+
+// send draws the faults of one message and schedules its copies, caller should hold lock
+func (n *Network) send(srcID string, ep *endpoint, data []byte) {
+	n.stats.Sent++
+	if !n.reachable(srcID, ep.nodeID) || n.rand.Float64() < n.config.DropRate {
+		n.stats.Dropped++
+		return
+	}
+	copies := 1
+	if n.rand.Float64() < n.config.DupRate {
+		copies = 2
+		n.stats.Duplicated++
+	}
+
+	l := n.linkOf(ep, srcID)
+	now := n.now
+	for i := 0; i < copies; i++ {
+		delay := n.config.MinDelay
+		if n.config.MaxDelay > n.config.MinDelay {
+			delay += time.Duration(n.rand.Int63n(int64(n.config.MaxDelay - n.config.MinDelay)))
+		}
+		at := now.Add(delay)
+		if n.rand.Float64() < n.config.ReorderRate {
+			n.stats.Reordered++
+		} else if at.Before(l.lastAt) {
+			at = l.lastAt
+		}
+		if at.After(l.lastAt) {
+			l.lastAt = at
+		}
+		heap.Push(&n.queue, &delivery{
+			at:   at,
+			seq:  n.nextSeq,
+			link: l,
+			data: data,
+		})
+		n.nextSeq++
+	}
+	n.signal()
+}
+
+// due reports whether the scheduler may take the head of the queue, caller should hold lock
+func (n *Network) due() bool {
+	if n.queue.Len() == 0 {
+		return false
+	}
+	return !n.config.Manual || !n.queue[0].at.After(n.until)
+}
+
+// Advance moves the clock of a Manual network by d, it returns once every message due by then is handled,
+// including the messages the handlers sent in time to be due by then
+func (n *Network) Advance(d time.Duration) {
+	advanced := make(chan struct{})
+	n.lock.Lock()
+	n.until = n.until.Add(d)
+	n.advanced = advanced
+	n.lock.Unlock()
+	n.signal()
+
+	select {
+	case <-advanced:
+	case <-n.done:
+	}
+}
+
+// signal wakes up the scheduler
+func (n *Network) signal() {
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// schedule hands the messages to their endpoints one at a time, in the order of their delivery time,
+// messages due at the same time are handed over in the order they were sent
+func (n *Network) schedule() {
+	for {
+		n.lock.Lock()
+		for !n.due() {
+			if n.advanced != nil {
+				if n.until.After(n.now) {
+					n.now = n.until
+				}
+				close(n.advanced)
+				n.advanced = nil
+			}
+			n.lock.Unlock()
+			select {
+			case <-n.done:
+				return
+			case <-n.wake:
+			}
+			n.lock.Lock()
+		}
+		select {
+		case <-n.done:
+			n.lock.Unlock()
+			return
+		default:
+		}
+		head := heap.Pop(&n.queue).(*delivery)
+		if head.at.After(n.now) {
+			n.now = head.at
+		}
+		if head.link.closed || !n.reachable(head.link.srcID, head.link.endpoint.nodeID) {
+			n.stats.Dropped++
+			n.lock.Unlock()
+			continue
+		}
+		n.stats.Delivered++
+		n.lock.Unlock()
+
+		head.link.endpoint.receive(head.link.srcID, head.data)
+	}
+}
+
+// conn a Sender of srcID to the endpoint of dstID, messages are encoded with the default codec, as they would be on the wire.
+// It does not reconnect, once the endpoint of dstID is gone it gives up on the first send, like a tcp client out of retries
+type conn struct {
+	network  *Network
+	srcID    string
+	dstID    string
+	addr     string
+	closed   bool
+	failed   error
+	onGiveUp func(err error)
+}
+
+func (c *conn) Send(msg *multicast.BMsg) error {
+	data, err := codec.Marshal(msg)
+	if err != nil {
+		return errors.Wrap(err, "encode msg failed")
+	}
+
+	n := c.network
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if _, crashed := n.crashed[c.srcID]; c.closed || crashed {
+		return ErrConnectionClosed
+	}
+	if c.failed != nil {
+		return c.failed
+	}
+	ep, ok := n.endpoints[c.addr]
+	if !ok || ep.nodeID != c.dstID {
+		c.giveUp(errors.Wrapf(ErrConnectionRefused, "send to [%s] failed", c.dstID))
+		return c.failed
+	}
+	n.send(c.srcID, ep, data)
+	metrics.PeerSentBytes.Add(float64(len(data)+codec.FrameHeaderSize), c.srcID, c.dstID)
+	metrics.PeerSentMessages.Inc(c.srcID, c.dstID)
+	return nil
+}
+
+// giveUp calls onGiveUp in its own goroutine, as it removes the member whose queue is sending, caller should hold the network lock
+func (c *conn) giveUp(err error) {
+	c.failed = err
+	logger.Errorf("node [%s] give up sending to [%s]: %v", c.srcID, c.dstID, err)
+	if c.onGiveUp != nil {
+		go c.onGiveUp(err)
+	}
+}
+
+// OnGiveUp f is called right away if the conn already gave up
+func (c *conn) OnGiveUp(f func(err error)) {
+	c.network.lock.Lock()
+	defer c.network.lock.Unlock()
+	c.onGiveUp = f
+	if c.failed != nil {
+		go f(c.failed)
+	}
+}
+
+func (c *conn) Close() error {
+	c.network.lock.Lock()
+	defer c.network.lock.Unlock()
+	c.closed = true
+	return nil
+}
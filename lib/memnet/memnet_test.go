@@ -0,0 +1,203 @@
+package memnet
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"github.com/bamboovir/cs425/lib/mp1/multicast"
+	errors "github.com/pkg/errors"
+)
+
+// inbox records what an endpoint delivers, and the most handlers it saw running at once on the network
+type inbox struct {
+	paths      []string
+	running    int
+	maxRunning int
+	lock       sync.Mutex
+}
+
+func (i *inbox) deliver(msg *multicast.BMsg) error {
+	i.lock.Lock()
+	i.running++
+	if i.running > i.maxRunning {
+		i.maxRunning = i.running
+	}
+	i.paths = append(i.paths, msg.SrcID+msg.Path)
+	i.lock.Unlock()
+
+	time.Sleep(time.Millisecond)
+	i.lock.Lock()
+	i.running--
+	i.lock.Unlock()
+	return nil
+}
+
+func (i *inbox) delivered() []string {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return append([]string{}, i.paths...)
+}
+
+func listen(t *testing.T, n *Network, box *inbox, nodeIDs ...string) {
+	t.Helper()
+	for _, nodeID := range nodeIDs {
+		err := n.Listen(context.Background(), nodeID, "mem-"+nodeID, box.deliver)
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+	}
+}
+
+func dial(t *testing.T, n *Network, srcID string, dstID string) multicast.Sender {
+	t.Helper()
+	sender, err := n.Dial(context.Background(), srcID, dstID, "mem-"+dstID, time.Millisecond, 1)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	return sender
+}
+
+func send(t *testing.T, sender multicast.Sender, srcID string, path string) {
+	t.Helper()
+	err := sender.Send(&multicast.BMsg{SrcID: srcID, Path: path})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+}
+
+func waitDelivered(box *inbox, n int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(box.delivered()) < n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	return box.delivered()
+}
+
+func TestDelaysRunOnVirtualClock(t *testing.T) {
+	n := New(&Config{Seed: 1, MinDelay: time.Hour, MaxDelay: 2 * time.Hour})
+	defer n.Close()
+	box := &inbox{}
+	listen(t, n, box, "B")
+	sender := dial(t, n, "A", "B")
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		send(t, sender, "A", fmt.Sprintf("/%d", i))
+	}
+	got := waitDelivered(box, 10)
+	if len(got) != 10 {
+		t.Fatalf("delivered %d msgs, want 10", len(got))
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("hours of virtual delay took %v of wall time", elapsed)
+	}
+	if now := n.Now(); now.Before(time.Unix(0, 0).Add(time.Hour)) {
+		t.Fatalf("virtual clock at %v, want at least an hour in", now)
+	}
+	// no reorder is drawn, so the link keeps the order of the sends
+	for i, path := range got {
+		if want := fmt.Sprintf("A/%d", i); path != want {
+			t.Fatalf("delivered %v, want the order of the sends", got)
+		}
+	}
+}
+
+func TestSameSeedSameSchedule(t *testing.T) {
+	run := func() ([]string, Stats) {
+		n := New(&Config{Seed: 7, MaxDelay: 10 * time.Millisecond, DupRate: 0.2, ReorderRate: 0.3, Manual: true})
+		defer n.Close()
+		box := &inbox{}
+		listen(t, n, box, "C")
+		senders := map[string]multicast.Sender{"A": dial(t, n, "A", "C"), "B": dial(t, n, "B", "C")}
+		for i := 0; i < 20; i++ {
+			for _, srcID := range []string{"A", "B"} {
+				send(t, senders[srcID], srcID, fmt.Sprintf("/%d", i))
+			}
+		}
+		n.Advance(time.Second)
+		return box.delivered(), n.Stats()
+	}
+
+	first, stats := run()
+	if stats.Reordered == 0 || stats.Duplicated == 0 {
+		t.Fatalf("no fault drawn in %+v", stats)
+	}
+	if uint64(len(first)) != stats.Delivered || stats.Delivered != stats.Sent+stats.Duplicated {
+		t.Fatalf("delivered %d msgs, stats %+v", len(first), stats)
+	}
+	second, _ := run()
+	if !reflect.DeepEqual(first, second) {
+		t.Fatalf("same seed delivered\n%v\nthen\n%v", first, second)
+	}
+}
+
+func TestManualClockOnlyMovesOnAdvance(t *testing.T) {
+	n := New(&Config{Seed: 1, MinDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond, Manual: true})
+	defer n.Close()
+	box := &inbox{}
+	listen(t, n, box, "B")
+	send(t, dial(t, n, "A", "B"), "A", "/x")
+
+	n.Advance(5 * time.Millisecond)
+	if got := box.delivered(); len(got) != 0 {
+		t.Fatalf("delivered %v before it was due", got)
+	}
+	n.Advance(5 * time.Millisecond)
+	if got := box.delivered(); len(got) != 1 {
+		t.Fatalf("delivered %v once due, want [A/x]", got)
+	}
+	if want := time.Unix(0, 0).Add(10 * time.Millisecond); !n.Now().Equal(want) {
+		t.Fatalf("virtual clock at %v, want %v", n.Now(), want)
+	}
+}
+
+func TestHandlersRunOneAtATime(t *testing.T) {
+	n := New(nil)
+	defer n.Close()
+	box := &inbox{}
+	listen(t, n, box, "B", "C")
+	for _, srcID := range []string{"A", "B", "C"} {
+		for _, dstID := range []string{"B", "C"} {
+			sender := dial(t, n, srcID, dstID)
+			for i := 0; i < 5; i++ {
+				send(t, sender, srcID, fmt.Sprintf("/%d", i))
+			}
+		}
+	}
+	if got := waitDelivered(box, 30); len(got) != 30 {
+		t.Fatalf("delivered %d msgs, want 30", len(got))
+	}
+	box.lock.Lock()
+	defer box.lock.Unlock()
+	if box.maxRunning != 1 {
+		t.Fatalf("%d handlers ran at once, want every handler on the scheduler", box.maxRunning)
+	}
+}
+
+func TestSenderGivesUpOnCrashedMember(t *testing.T) {
+	n := New(nil)
+	defer n.Close()
+	listen(t, n, &inbox{}, "B")
+	sender := dial(t, n, "A", "B")
+	gaveUp := make(chan error, 1)
+	sender.OnGiveUp(func(err error) { gaveUp <- err })
+
+	n.Crash("B")
+	err := sender.Send(&multicast.BMsg{SrcID: "A", Path: "/x"})
+	if errors.Cause(err) != ErrConnectionRefused {
+		t.Fatalf("send to crashed member returned %v, want connection refused", err)
+	}
+	select {
+	case err = <-gaveUp:
+		if errors.Cause(err) != ErrConnectionRefused {
+			t.Fatalf("gave up with %v, want connection refused", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("sender to a crashed member did not give up")
+	}
+}
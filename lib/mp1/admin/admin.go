@@ -0,0 +1,241 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/bamboovir/cs425/lib/mp1/multicast"
+	"github.com/bamboovir/cs425/lib/mp1/router"
+	"github.com/bamboovir/cs425/lib/mp1/transaction"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	logger = log.WithField("src", "admin")
+)
+
+const (
+	MembersPath   = "/members"
+	EjectPath     = "/members/:id/eject"
+	TOPath        = "/to"
+	HoldQueuePath = "/to/hold-queue"
+	VotesPath     = "/to/votes"
+	SeqsPath      = "/to/seqs"
+	BalancesPath  = "/balances"
+	SnapshotPath  = "/snapshot"
+	PprofPath     = "/debug/pprof/"
+)
+
+// Ledger the application state the admin api reads and snapshots
+type Ledger interface {
+	Balances() map[string]int
+	TakeSnapshot() error
+}
+
+// StatusError an error answered with its http status
+type StatusError struct {
+	Status int
+	Err    error
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+func statusErrorf(status int, format string, a ...interface{}) error {
+	return &StatusError{Status: status, Err: fmt.Errorf(format, a...)}
+}
+
+// request the msg the router runs an admin endpoint with
+type request struct {
+	writer http.ResponseWriter
+	req    *http.Request
+}
+
+type SeqsResponse struct {
+	Strategy        string `json:"strategy"`
+	MaxProposalSeq  uint64 `json:"max_proposal_seq"`
+	MaxAgreementSeq uint64 `json:"max_agreement_seq"`
+}
+
+type HoldQueueResponse struct {
+	DeliveryPaused bool                            `json:"delivery_paused"`
+	HeadOfLine     *multicast.HoldQueueItemStats   `json:"head_of_line"`
+	Items          []*multicast.HoldQueueItemStats `json:"items"`
+}
+
+// Server the admin api of a node, it reads the live state of the group and the ledger,
+// and can eject a member or snapshot the ledger, the paths are routed by the router of the protocol layers
+type Server struct {
+	group  *multicast.Group
+	ledger Ledger
+	router *router.Router
+}
+
+func New(group *multicast.Group, ledger Ledger) *Server {
+	s := &Server{
+		group:  group,
+		ledger: ledger,
+		router: router.New(),
+	}
+	s.router.Use(router.Recover(), router.Logger(logger))
+	s.router.Fallback(func(route *router.Route, msg interface{}) error {
+		return statusErrorf(http.StatusNotFound, "no admin endpoint on [%s]", route.Path)
+	})
+	s.bind()
+	return s
+}
+
+// handle binds f to the path for method, the value f returns is answered as json
+func (s *Server) handle(method string, path string, f func(route *router.Route, req *http.Request) (interface{}, error)) {
+	s.router.BindHandler(path, func(route *router.Route, msg interface{}) error {
+		r := msg.(*request)
+		if r.req.Method != method {
+			return statusErrorf(http.StatusMethodNotAllowed, "[%s] only accepts %s", route.Pattern, method)
+		}
+		v, err := f(route, r.req)
+		if err != nil {
+			return err
+		}
+		writeJSON(r.writer, http.StatusOK, v)
+		return nil
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(v)
+	if err != nil {
+		logger.Errorf("write response failed: %v", err)
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	err := s.router.Run(req.URL.Path, &request{writer: w, req: req})
+	if err == nil {
+		return
+	}
+	status := http.StatusInternalServerError
+	if statusErr, ok := err.(*StatusError); ok {
+		status = statusErr.Status
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (s *Server) totalOrderStats() (*multicast.TotalOrderStats, error) {
+	inspector, ok := s.group.TO().(multicast.TotalOrderInspector)
+	if !ok {
+		return nil, statusErrorf(http.StatusNotImplemented, "total order strategy does not report its state")
+	}
+	return inspector.Stats(), nil
+}
+
+func (s *Server) bind() {
+	s.handle(http.MethodGet, MembersPath, func(route *router.Route, req *http.Request) (interface{}, error) {
+		return s.group.Liveness(), nil
+	})
+
+	// the eject is answered once it is TO-multicast, GET MembersPath shows when the view without the member is installed
+	s.handle(http.MethodPost, EjectPath, func(route *router.Route, req *http.Request) (interface{}, error) {
+		nodeID := route.Params["id"]
+		if nodeID == s.group.SelfNodeID {
+			return nil, statusErrorf(http.StatusBadRequest, "node [%s] can not eject itself, stop it to leave the group", nodeID)
+		}
+		if !s.group.View().Contains(nodeID) {
+			return nil, statusErrorf(http.StatusNotFound, "node [%s] is not a member", nodeID)
+		}
+		logger.Infof("admin ejects node [%s]", nodeID)
+		err := s.group.Eject(nodeID)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"ejecting": nodeID}, nil
+	})
+
+	s.handle(http.MethodGet, TOPath, func(route *router.Route, req *http.Request) (interface{}, error) {
+		return s.totalOrderStats()
+	})
+
+	s.handle(http.MethodGet, HoldQueuePath, func(route *router.Route, req *http.Request) (interface{}, error) {
+		stats, err := s.totalOrderStats()
+		if err != nil {
+			return nil, err
+		}
+		return &HoldQueueResponse{
+			DeliveryPaused: stats.DeliveryPaused,
+			HeadOfLine:     stats.HeadOfLine,
+			Items:          stats.HoldQueue,
+		}, nil
+	})
+
+	s.handle(http.MethodGet, VotesPath, func(route *router.Route, req *http.Request) (interface{}, error) {
+		stats, err := s.totalOrderStats()
+		if err != nil {
+			return nil, err
+		}
+		return stats.PendingVotes, nil
+	})
+
+	s.handle(http.MethodGet, SeqsPath, func(route *router.Route, req *http.Request) (interface{}, error) {
+		stats, err := s.totalOrderStats()
+		if err != nil {
+			return nil, err
+		}
+		return &SeqsResponse{
+			Strategy:        stats.Strategy,
+			MaxProposalSeq:  stats.MaxProposalSeq,
+			MaxAgreementSeq: stats.MaxAgreementSeq,
+		}, nil
+	})
+
+	s.handle(http.MethodGet, BalancesPath, func(route *router.Route, req *http.Request) (interface{}, error) {
+		return s.ledger.Balances(), nil
+	})
+
+	s.handle(http.MethodPost, SnapshotPath, func(route *router.Route, req *http.Request) (interface{}, error) {
+		err := s.ledger.TakeSnapshot()
+		if err == transaction.ErrNoWAL {
+			return nil, &StatusError{Status: http.StatusConflict, Err: err}
+		}
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"snapshot": "ok"}, nil
+	})
+}
+
+// Serve serves the admin api and pprof on addr until ctx is done, it returns once addr is bound
+func (s *Server) Serve(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "serve admin api on [%s] failed", addr)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(PprofPath, pprof.Index)
+	mux.HandleFunc(PprofPath+"cmdline", pprof.Cmdline)
+	mux.HandleFunc(PprofPath+"profile", pprof.Profile)
+	mux.HandleFunc(PprofPath+"symbol", pprof.Symbol)
+	mux.HandleFunc(PprofPath+"trace", pprof.Trace)
+	mux.Handle("/", s)
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			logger.Errorf("serve admin api failed: %v", err)
+		}
+	}()
+	logger.Infof("serve admin api on %s", listener.Addr())
+	return nil
+}
@@ -0,0 +1,115 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bamboovir/cs425/lib/mp1/multicast"
+	"github.com/bamboovir/cs425/lib/mp1/transaction"
+)
+
+type testLedger struct{}
+
+func (testLedger) Balances() map[string]int { return map[string]int{"alice": 10} }
+
+func (testLedger) TakeSnapshot() error { return transaction.ErrNoWAL }
+
+// newTestServer the admin api of node A in a group of A, B and C that is not started
+func newTestServer() *Server {
+	group := multicast.NewGroupBuilder().
+		WithSelfNodeID("A").
+		AddMember("A", "a").
+		AddMember("B", "b").
+		AddMember("C", "c").
+		Build()
+	return New(group, testLedger{})
+}
+
+func serve(t *testing.T, s *Server, method string, path string, v interface{}) int {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+	if v != nil {
+		err := json.Unmarshal(recorder.Body.Bytes(), v)
+		if err != nil {
+			t.Fatalf("decode response of %s %s: %v, body %s", method, path, err, recorder.Body.String())
+		}
+	}
+	return recorder.Code
+}
+
+func TestMembersReportsView(t *testing.T) {
+	s := newTestServer()
+	members := []*multicast.MemberLiveness{}
+	if status := serve(t, s, http.MethodGet, MembersPath, &members); status != http.StatusOK {
+		t.Fatalf("GET %s answered %d", MembersPath, status)
+	}
+	if len(members) != 3 || members[0].ID != "A" || !members[0].Self || members[1].ID != "B" || members[1].Self {
+		t.Fatalf("members %+v, want A as self, then B and C", members)
+	}
+	if status := serve(t, s, http.MethodPost, MembersPath, nil); status != http.StatusMethodNotAllowed {
+		t.Fatalf("POST %s answered %d, want %d", MembersPath, status, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestTotalOrderStatus(t *testing.T) {
+	s := newTestServer()
+	stats := &multicast.TotalOrderStats{}
+	if status := serve(t, s, http.MethodGet, TOPath, stats); status != http.StatusOK {
+		t.Fatalf("GET %s answered %d", TOPath, status)
+	}
+	if stats.Strategy != string(multicast.ISISStrategy) || stats.DeliveryPaused || len(stats.HoldQueue) != 0 {
+		t.Fatalf("status %+v, want an empty isis hold queue", stats)
+	}
+
+	seqs := &SeqsResponse{}
+	if status := serve(t, s, http.MethodGet, SeqsPath, seqs); status != http.StatusOK || seqs.Strategy != string(multicast.ISISStrategy) {
+		t.Fatalf("GET %s answered %d with %+v", SeqsPath, status, seqs)
+	}
+	if status := serve(t, s, http.MethodGet, "/unknown", nil); status != http.StatusNotFound {
+		t.Fatalf("GET /unknown answered %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestEjectChecksMember(t *testing.T) {
+	s := newTestServer()
+	for _, c := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodPost, "/members/A/eject", http.StatusBadRequest},
+		{http.MethodPost, "/members/D/eject", http.StatusNotFound},
+		{http.MethodGet, "/members/B/eject", http.StatusMethodNotAllowed},
+	} {
+		resp := map[string]string{}
+		if status := serve(t, s, c.method, c.path, &resp); status != c.status || resp["error"] == "" {
+			t.Fatalf("%s %s answered %d with %v, want %d with an error", c.method, c.path, status, resp, c.status)
+		}
+	}
+}
+
+func TestEjectMulticastsViewChange(t *testing.T) {
+	s := newTestServer()
+	resp := map[string]string{}
+	if status := serve(t, s, http.MethodPost, "/members/B/eject", &resp); status != http.StatusOK || resp["ejecting"] != "B" {
+		t.Fatalf("POST /members/B/eject answered %d with %v, want B ejecting", status, resp)
+	}
+	inspector := s.group.TO().(multicast.TotalOrderInspector)
+	if votes := inspector.Stats().PendingVotes; len(votes) != 1 {
+		t.Fatalf("%d msgs wait for votes after the eject, want the view change", len(votes))
+	}
+}
+
+func TestSnapshotWithoutWAL(t *testing.T) {
+	s := newTestServer()
+	if status := serve(t, s, http.MethodPost, SnapshotPath, nil); status != http.StatusConflict {
+		t.Fatalf("POST %s answered %d, want %d", SnapshotPath, status, http.StatusConflict)
+	}
+	balances := map[string]int{}
+	if status := serve(t, s, http.MethodGet, BalancesPath, &balances); status != http.StatusOK || balances["alice"] != 10 {
+		t.Fatalf("GET %s answered %d with %v", BalancesPath, status, balances)
+	}
+}
@@ -0,0 +1,362 @@
+package checker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	TotalOrder = "total order"
+	Agreement  = "agreement"
+	Integrity  = "integrity"
+	Validity   = "validity"
+	// msgIDSize a TO msg id is a uuid followed by the sha1 of its encoded message, see multicast.NewTOAskProposalSeqMsg
+	msgIDSize = 36 + 40
+)
+
+type Options struct {
+	// Crashed nodes only have to deliver in total order and without duplicates
+	Crashed []string
+	// AllowLag accepts a correct node that stopped before it delivered the tail of the run,
+	// a message it misses must come after its last delivery
+	AllowLag bool
+}
+
+// Violation Position orders the violations of a property, the first divergence is the violation with the smallest position
+type Violation struct {
+	Position int
+	Detail   string
+}
+
+type Result struct {
+	Property   string
+	Checked    bool
+	Note       string
+	Violations int
+	First      *Violation
+}
+
+func (r *Result) violate(v *Violation) {
+	r.Violations++
+	if r.First == nil || v.Position < r.First.Position {
+		r.First = v
+	}
+}
+
+func (r *Result) OK() bool {
+	return r.Violations == 0
+}
+
+func (r *Result) String() string {
+	switch {
+	case !r.Checked:
+		return fmt.Sprintf("%s: skipped, %s", r.Property, r.Note)
+	case r.OK():
+		return fmt.Sprintf("%s: ok", r.Property)
+	default:
+		return fmt.Sprintf("%s: violated, %d violations, first divergence: %s", r.Property, r.Violations, r.First.Detail)
+	}
+}
+
+type Report struct {
+	Nodes      []string
+	Crashed    []string
+	Multicasts int
+	Deliveries int
+	Results    []*Result
+}
+
+func (r *Report) OK() bool {
+	for _, result := range r.Results {
+		if !result.OK() {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Report) String() string {
+	builder := strings.Builder{}
+	builder.WriteString(fmt.Sprintf("nodes: %s", strings.Join(r.Nodes, " ")))
+	if len(r.Crashed) > 0 {
+		builder.WriteString(fmt.Sprintf(" (crashed: %s)", strings.Join(r.Crashed, " ")))
+	}
+	builder.WriteString(fmt.Sprintf("\nevents: %d multicasts, %d deliveries\n", r.Multicasts, r.Deliveries))
+	for _, result := range r.Results {
+		builder.WriteString(result.String())
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
+
+type checker struct {
+	trace   Trace
+	opts    *Options
+	nodes   []string
+	correct []string
+	crashed map[string]bool
+}
+
+// Check verifies total order, agreement, integrity and validity of the TO-deliveries of a run
+func Check(trace Trace, opts *Options) *Report {
+	if opts == nil {
+		opts = &Options{}
+	}
+	c := &checker{
+		trace:   trace,
+		opts:    opts,
+		nodes:   make([]string, 0, len(trace)),
+		correct: make([]string, 0, len(trace)),
+		crashed: map[string]bool{},
+	}
+	for _, nodeID := range opts.Crashed {
+		c.crashed[nodeID] = true
+	}
+	for nodeID := range trace {
+		c.nodes = append(c.nodes, nodeID)
+	}
+	sort.Strings(c.nodes)
+
+	report := &Report{Nodes: c.nodes}
+	for _, nodeID := range c.nodes {
+		if c.crashed[nodeID] {
+			report.Crashed = append(report.Crashed, nodeID)
+		} else {
+			c.correct = append(c.correct, nodeID)
+		}
+		report.Multicasts += len(trace[nodeID].Multicasts)
+		report.Deliveries += len(trace[nodeID].Deliveries)
+	}
+
+	report.Results = []*Result{
+		c.checkTotalOrder(),
+		c.checkAgreement(),
+		c.checkIntegrity(report.Multicasts),
+		c.checkValidity(report.Multicasts),
+	}
+	return report
+}
+
+// firstDeliveries drops the duplicates of a delivery order, they are reported by the integrity check
+func firstDeliveries(deliveries []*Event) (order []*Event, byMsgID map[string]*Event) {
+	order = make([]*Event, 0, len(deliveries))
+	byMsgID = map[string]*Event{}
+	for _, event := range deliveries {
+		if _, ok := byMsgID[event.MsgID]; ok {
+			continue
+		}
+		byMsgID[event.MsgID] = event
+		order = append(order, event)
+	}
+	return order, byMsgID
+}
+
+// checkTotalOrder every two nodes deliver the messages they both delivered in the same order and at the same seq
+func (c *checker) checkTotalOrder() *Result {
+	result := &Result{Property: TotalOrder, Checked: true}
+	orders := map[string][]*Event{}
+	delivered := map[string]map[string]*Event{}
+	for _, nodeID := range c.nodes {
+		orders[nodeID], delivered[nodeID] = firstDeliveries(c.trace[nodeID].Deliveries)
+	}
+
+	for i, p := range c.nodes {
+		for _, q := range c.nodes[i+1:] {
+			common := func(order []*Event, other map[string]*Event) []*Event {
+				events := make([]*Event, 0, len(order))
+				for _, event := range order {
+					if _, ok := other[event.MsgID]; ok {
+						events = append(events, event)
+					}
+				}
+				return events
+			}
+			orderOfP := common(orders[p], delivered[q])
+			orderOfQ := common(orders[q], delivered[p])
+
+			for k := range orderOfP {
+				eventOfP, eventOfQ := orderOfP[k], orderOfQ[k]
+				if eventOfP.MsgID != eventOfQ.MsgID {
+					result.violate(&Violation{
+						Position: k,
+						Detail: fmt.Sprintf(
+							"nodes [%s] and [%s] diverge at their common delivery %d, [%s] delivered %s (%s), [%s] delivered %s (%s)",
+							p, q, k, p, eventOfP.Label(), eventOfP.Source, q, eventOfQ.Label(), eventOfQ.Source,
+						),
+					})
+					break
+				}
+				if eventOfP.Seq != eventOfQ.Seq {
+					result.violate(&Violation{
+						Position: k,
+						Detail: fmt.Sprintf(
+							"nodes [%s] and [%s] delivered msg [%s] at different seqs, %s (%s) and %s (%s)",
+							p, q, eventOfP.MsgID, eventOfP.Label(), eventOfP.Source, eventOfQ.Label(), eventOfQ.Source,
+						),
+					})
+					break
+				}
+			}
+		}
+	}
+	return result
+}
+
+// checkAgreement every correct node delivers every message a correct node delivered
+func (c *checker) checkAgreement() *Result {
+	result := &Result{Property: Agreement, Checked: true}
+	if len(c.correct) < 2 {
+		result.Checked = false
+		result.Note = "less than two correct nodes"
+		return result
+	}
+
+	// position of a message is the earliest position any correct node delivered it at
+	position := map[string]int{}
+	deliveredBy := map[string]*Event{}
+	delivered := map[string]map[string]*Event{}
+	lastPosition := map[string]int{}
+	for _, nodeID := range c.correct {
+		var order []*Event
+		order, delivered[nodeID] = firstDeliveries(c.trace[nodeID].Deliveries)
+		for k, event := range order {
+			if p, ok := position[event.MsgID]; !ok || k < p {
+				position[event.MsgID] = k
+				deliveredBy[event.MsgID] = event
+			}
+		}
+	}
+	for _, nodeID := range c.correct {
+		last := -1
+		for msgID := range delivered[nodeID] {
+			if position[msgID] > last {
+				last = position[msgID]
+			}
+		}
+		lastPosition[nodeID] = last
+	}
+
+	msgIDs := make([]string, 0, len(deliveredBy))
+	for msgID := range deliveredBy {
+		msgIDs = append(msgIDs, msgID)
+	}
+	sort.Slice(msgIDs, func(i, j int) bool {
+		if position[msgIDs[i]] != position[msgIDs[j]] {
+			return position[msgIDs[i]] < position[msgIDs[j]]
+		}
+		return msgIDs[i] < msgIDs[j]
+	})
+
+	for _, nodeID := range c.correct {
+		for _, msgID := range msgIDs {
+			event := deliveredBy[msgID]
+			if _, ok := delivered[nodeID][msgID]; ok {
+				continue
+			}
+			if c.opts.AllowLag && position[msgID] > lastPosition[nodeID] {
+				continue
+			}
+			result.violate(&Violation{
+				Position: position[msgID],
+				Detail: fmt.Sprintf(
+					"node [%s] never delivered %s, which node [%s] delivered at %d (%s)",
+					nodeID, event.Label(), event.NodeID, event.Index, event.Source,
+				),
+			})
+		}
+	}
+	return result
+}
+
+// checkIntegrity a node delivers a message at most once, only if some node multicast it, and with the body it was multicast with
+func (c *checker) checkIntegrity(multicasts int) *Result {
+	result := &Result{Property: Integrity, Checked: true}
+	multicastBy := map[string]*Event{}
+	for _, nodeID := range c.nodes {
+		for _, event := range c.trace[nodeID].Multicasts {
+			multicastBy[event.MsgID] = event
+		}
+	}
+
+	digests := map[string]*Event{}
+	for _, nodeID := range c.nodes {
+		seen := map[string]*Event{}
+		for _, event := range c.trace[nodeID].Deliveries {
+			if first, ok := seen[event.MsgID]; ok {
+				result.violate(&Violation{
+					Position: event.Index,
+					Detail: fmt.Sprintf(
+						"node [%s] delivered msg [%s] twice, at %d (%s) and at %d (%s)",
+						nodeID, event.MsgID, first.Index, first.Source, event.Index, event.Source,
+					),
+				})
+				continue
+			}
+			seen[event.MsgID] = event
+
+			if _, ok := multicastBy[event.MsgID]; multicasts > 0 && !ok {
+				result.violate(&Violation{
+					Position: event.Index,
+					Detail:   fmt.Sprintf("node [%s] delivered %s (%s), which no node multicast", nodeID, event.Label(), event.Source),
+				})
+			}
+			if event.Digest == "" {
+				continue
+			}
+			if len(event.MsgID) == msgIDSize && !strings.HasSuffix(event.MsgID, event.Digest) {
+				result.violate(&Violation{
+					Position: event.Index,
+					Detail:   fmt.Sprintf("node [%s] delivered %s (%s) with a body that does not match its id", nodeID, event.Label(), event.Source),
+				})
+			}
+			if other, ok := digests[event.MsgID]; ok && other.Digest != event.Digest {
+				result.violate(&Violation{
+					Position: event.Index,
+					Detail: fmt.Sprintf(
+						"nodes [%s] and [%s] delivered different bodies for msg [%s] (%s, %s)",
+						other.NodeID, nodeID, event.MsgID, other.Source, event.Source,
+					),
+				})
+			} else if !ok {
+				digests[event.MsgID] = event
+			}
+		}
+	}
+	if multicasts == 0 {
+		result.Note = "fabricated messages are not checked, the trace has no multicast events"
+	}
+	return result
+}
+
+// checkValidity a correct node delivers every message it multicast
+func (c *checker) checkValidity(multicasts int) *Result {
+	result := &Result{Property: Validity, Checked: true}
+	if multicasts == 0 {
+		result.Checked = false
+		result.Note = "the trace has no multicast events"
+		return result
+	}
+
+	for _, nodeID := range c.correct {
+		nodeTrace := c.trace[nodeID]
+		_, delivered := firstDeliveries(nodeTrace.Deliveries)
+		var lastDelivery int64
+		if len(nodeTrace.Deliveries) > 0 {
+			lastDelivery = nodeTrace.Deliveries[len(nodeTrace.Deliveries)-1].Timestamp
+		}
+		for k, event := range nodeTrace.Multicasts {
+			if _, ok := delivered[event.MsgID]; ok {
+				continue
+			}
+			if c.opts.AllowLag && event.Timestamp > lastDelivery {
+				continue
+			}
+			result.violate(&Violation{
+				Position: k,
+				Detail:   fmt.Sprintf("node [%s] multicast msg [%s] (%s) but never delivered it", nodeID, event.MsgID, event.Source),
+			})
+		}
+	}
+	return result
+}
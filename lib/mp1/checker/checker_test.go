@@ -0,0 +1,147 @@
+package checker
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bamboovir/cs425/lib/mp1/metrics"
+)
+
+func multicastEvent(nodeID string, msgID string, timestamp int64) *Event {
+	return &Event{NodeID: nodeID, Kind: metrics.MulticastEvent, MsgID: msgID, Timestamp: timestamp}
+}
+
+func deliverEvent(nodeID string, msgID string, seq uint64, timestamp int64) *Event {
+	return &Event{NodeID: nodeID, Kind: metrics.DeliverEvent, MsgID: msgID, Seq: seq, ProcessID: "A", Timestamp: timestamp}
+}
+
+// consistentTrace A multicasts m1 to m3, every node delivers them in order
+func consistentTrace(nodeIDs ...string) Trace {
+	trace := Trace{}
+	for i, msgID := range []string{"m1", "m2", "m3"} {
+		trace.add(multicastEvent("A", msgID, int64(i)))
+	}
+	for _, nodeID := range nodeIDs {
+		for i, msgID := range []string{"m1", "m2", "m3"} {
+			trace.add(deliverEvent(nodeID, msgID, uint64(i+1), int64(10+i)))
+		}
+	}
+	return trace
+}
+
+func resultOf(t *testing.T, report *Report, property string) *Result {
+	t.Helper()
+	for _, result := range report.Results {
+		if result.Property == property {
+			return result
+		}
+	}
+	t.Fatalf("report has no %s result", property)
+	return nil
+}
+
+func expectViolated(t *testing.T, report *Report, property string, detail string) {
+	t.Helper()
+	result := resultOf(t, report, property)
+	if result.OK() {
+		t.Fatalf("%s holds, want it violated\n%s", property, report)
+	}
+	if !strings.Contains(result.First.Detail, detail) {
+		t.Fatalf("first %s violation is %q, want it to mention %q", property, result.First.Detail, detail)
+	}
+}
+
+func TestCheckConsistentRun(t *testing.T) {
+	report := Check(consistentTrace("A", "B", "C"), nil)
+	if !report.OK() {
+		t.Fatalf("consistent run violates\n%s", report)
+	}
+	if report.Multicasts != 3 || report.Deliveries != 9 {
+		t.Fatalf("counted %d multicasts and %d deliveries, want 3 and 9", report.Multicasts, report.Deliveries)
+	}
+}
+
+func TestCheckReportsFirstDivergence(t *testing.T) {
+	trace := consistentTrace("A", "B")
+	trace.add(deliverEvent("C", "m1", 1, 10))
+	trace.add(deliverEvent("C", "m3", 2, 11))
+	trace.add(deliverEvent("C", "m2", 3, 12))
+	expectViolated(t, Check(trace, nil), TotalOrder, "diverge at their common delivery 1")
+}
+
+func TestCheckReportsDifferentSeq(t *testing.T) {
+	trace := consistentTrace("A")
+	trace.add(deliverEvent("B", "m1", 1, 10))
+	trace.add(deliverEvent("B", "m2", 5, 11))
+	trace.add(deliverEvent("B", "m3", 6, 12))
+	expectViolated(t, Check(trace, nil), TotalOrder, "msg [m2] at different seqs")
+}
+
+func TestCheckAgreementOfCrashedNode(t *testing.T) {
+	trace := consistentTrace("A", "B")
+	trace.add(deliverEvent("C", "m1", 1, 10))
+
+	expectViolated(t, Check(trace, nil), Agreement, "node [C] never delivered [2:A][m2]")
+	report := Check(trace, &Options{Crashed: []string{"C"}})
+	if !report.OK() {
+		t.Fatalf("crashed node missing the tail violates\n%s", report)
+	}
+}
+
+func TestCheckAgreementAllowsLagOnlyAtTheTail(t *testing.T) {
+	lagging := consistentTrace("A", "B")
+	lagging.add(deliverEvent("C", "m1", 1, 10))
+	lagging.add(deliverEvent("C", "m2", 2, 11))
+	if report := Check(lagging, &Options{AllowLag: true}); !report.OK() {
+		t.Fatalf("node behind at the tail violates with lag allowed\n%s", report)
+	}
+
+	gap := consistentTrace("A", "B")
+	gap.add(deliverEvent("C", "m1", 1, 10))
+	gap.add(deliverEvent("C", "m3", 3, 12))
+	expectViolated(t, Check(gap, &Options{AllowLag: true}), Agreement, "node [C] never delivered [2:A][m2]")
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	duplicate := consistentTrace("A")
+	duplicate.add(deliverEvent("A", "m3", 3, 13))
+	expectViolated(t, Check(duplicate, nil), Integrity, "delivered msg [m3] twice")
+
+	fabricated := consistentTrace("A")
+	fabricated.add(deliverEvent("A", "m4", 4, 13))
+	expectViolated(t, Check(fabricated, nil), Integrity, "which no node multicast")
+
+	// an isis msg id ends with the digest of its body
+	msgID := strings.Repeat("u", 36) + strings.Repeat("d", 40)
+	tampered := Trace{}
+	tampered.add(multicastEvent("A", msgID, 0))
+	for _, nodeID := range []string{"A", "B"} {
+		event := deliverEvent(nodeID, msgID, 1, 10)
+		event.Digest = strings.Repeat("d", 40)
+		if nodeID == "B" {
+			event.Digest = strings.Repeat("e", 40)
+		}
+		tampered.add(event)
+	}
+	report := Check(tampered, nil)
+	expectViolated(t, report, Integrity, "node [B] delivered")
+	if result := resultOf(t, report, Integrity); result.Violations != 2 {
+		t.Fatalf("%d integrity violations, want the mismatched id and the differing bodies\n%s", result.Violations, report)
+	}
+}
+
+func TestCheckValidity(t *testing.T) {
+	trace := consistentTrace("A", "B")
+	trace.add(multicastEvent("B", "m4", 20))
+	expectViolated(t, Check(trace, nil), Validity, "node [B] multicast msg [m4]")
+	// m4 is multicast after the last delivery of B, so B may have stopped before it came back
+	if report := Check(trace, &Options{AllowLag: true}); !report.OK() {
+		t.Fatalf("multicast after the last delivery violates with lag allowed\n%s", report)
+	}
+
+	withoutMulticasts := Trace{}
+	withoutMulticasts.add(deliverEvent("A", "m1", 1, 10))
+	if result := resultOf(t, Check(withoutMulticasts, nil), Validity); result.Checked {
+		t.Fatalf("validity checked without multicast events")
+	}
+}
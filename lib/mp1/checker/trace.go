@@ -0,0 +1,245 @@
+package checker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bamboovir/cs425/lib/mp1/metrics"
+	"github.com/pkg/errors"
+)
+
+const (
+	DeliverySrc = "metrics.delivery"
+	// MaxLineSize a log line may carry a whole message when LOG=trace
+	MaxLineSize = 16 * 1024 * 1024
+)
+
+var (
+	deliverLineRegex = regexp.MustCompile(`TO deliver \[(\d+):([^\]]*)\]\[([^\]]+)\]`)
+)
+
+// Event a TO-multicast or a TO-delivery of one node, Index is the position of a delivery in the delivery order of its node
+type Event struct {
+	NodeID    string
+	Kind      string
+	MsgID     string
+	Seq       uint64
+	ProcessID string
+	Digest    string
+	Timestamp int64
+	Index     int
+	Source    string
+}
+
+func (e *Event) Label() string {
+	return fmt.Sprintf("[%d:%s][%s]", e.Seq, e.ProcessID, e.MsgID)
+}
+
+// NodeTrace the events of one node in the order they were logged
+type NodeTrace struct {
+	NodeID     string
+	Multicasts []*Event
+	Deliveries []*Event
+}
+
+// Trace the traces of every node of a run, keyed by node id
+type Trace map[string]*NodeTrace
+
+func (t Trace) node(nodeID string) *NodeTrace {
+	nodeTrace, ok := t[nodeID]
+	if !ok {
+		nodeTrace = &NodeTrace{NodeID: nodeID}
+		t[nodeID] = nodeTrace
+	}
+	return nodeTrace
+}
+
+func (t Trace) add(event *Event) {
+	nodeTrace := t.node(event.NodeID)
+	if event.Kind == metrics.MulticastEvent {
+		nodeTrace.Multicasts = append(nodeTrace.Multicasts, event)
+		return
+	}
+	event.Index = len(nodeTrace.Deliveries)
+	nodeTrace.Deliveries = append(nodeTrace.Deliveries, event)
+}
+
+// ParseInput an input is a path, or node=path to name the node of a log that has no delivery entries,
+// the node of a plain log falls back to the file name without extension
+func ParseInput(input string) (nodeID string, path string) {
+	if i := strings.Index(input, "="); i > 0 {
+		return input[:i], input[i+1:]
+	}
+	base := filepath.Base(input)
+	return strings.TrimSuffix(base, filepath.Ext(base)), input
+}
+
+// Load reads every input into one trace.
+// A line is either a bare delivery entry, or a text or json log line of a node, whose message is a delivery entry or a "TO deliver" line.
+// The "TO deliver" lines of a file are only used if the file has no delivery entries, they carry no digest and no multicast
+func Load(inputs []string) (trace Trace, err error) {
+	trace = Trace{}
+	for _, input := range inputs {
+		nodeID, path := ParseInput(input)
+		entries, fallback, err := loadFile(nodeID, path)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			entries = fallback
+		}
+		for _, event := range entries {
+			trace.add(event)
+		}
+	}
+	return trace, nil
+}
+
+func loadFile(nodeID string, path string) (entries []*Event, fallback []*Event, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "open [%s] failed", path)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), MaxLineSize)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		source := fmt.Sprintf("%s:%d", path, lineNum)
+		msg, src := parseLogLine(scanner.Text())
+		if msg == "" {
+			continue
+		}
+
+		if src == DeliverySrc || (src == "" && strings.HasPrefix(msg, "{")) {
+			event, ok := parseDeliveryEntry(msg)
+			if !ok {
+				continue
+			}
+			if event.NodeID == "" {
+				event.NodeID = nodeID
+			}
+			event.Source = source
+			entries = append(entries, event)
+			continue
+		}
+
+		matches := deliverLineRegex.FindStringSubmatch(msg)
+		if matches == nil {
+			continue
+		}
+		seq, err := strconv.ParseUint(matches[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		fallback = append(fallback, &Event{
+			NodeID:    nodeID,
+			Kind:      metrics.DeliverEvent,
+			Seq:       seq,
+			ProcessID: matches[2],
+			MsgID:     matches[3],
+			Source:    source,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, errors.Wrapf(err, "read [%s] failed", path)
+	}
+	return entries, fallback, nil
+}
+
+// parseLogLine returns the message and the src field of a log line of the json or the text formatter,
+// a line that is neither is returned as the message
+func parseLogLine(line string) (msg string, src string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return "", ""
+	}
+
+	if strings.HasPrefix(line, "{") {
+		fields := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			return line, ""
+		}
+		if _, ok := fields["event"]; ok {
+			return line, ""
+		}
+		msg, _ = fields["msg"].(string)
+		src, _ = fields["src"].(string)
+		return msg, src
+	}
+
+	msg, ok := textField(line, "msg")
+	if !ok {
+		return line, ""
+	}
+	src, _ = textField(line, "src")
+	return msg, src
+}
+
+// textField reads key=value of the logrus text formatter, a quoted value is unquoted
+func textField(line string, key string) (value string, ok bool) {
+	prefix := key + "="
+	start := -1
+	for i := 0; i+len(prefix) <= len(line); i++ {
+		if (i == 0 || line[i-1] == ' ') && strings.HasPrefix(line[i:], prefix) {
+			start = i + len(prefix)
+			break
+		}
+	}
+	if start < 0 {
+		return "", false
+	}
+
+	rest := line[start:]
+	if !strings.HasPrefix(rest, `"`) {
+		if end := strings.IndexByte(rest, ' '); end >= 0 {
+			rest = rest[:end]
+		}
+		return rest, true
+	}
+
+	escaped := false
+	for i := 1; i < len(rest); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case rest[i] == '\\':
+			escaped = true
+		case rest[i] == '"':
+			value, err := strconv.Unquote(rest[:i+1])
+			if err != nil {
+				return "", false
+			}
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func parseDeliveryEntry(msg string) (event *Event, ok bool) {
+	entry := &metrics.DeliveryLogEntry{}
+	if err := json.Unmarshal([]byte(msg), entry); err != nil {
+		return nil, false
+	}
+	if entry.Event != metrics.MulticastEvent && entry.Event != metrics.DeliverEvent {
+		return nil, false
+	}
+	timestamp, _ := strconv.ParseInt(entry.Timestamp, 10, 64)
+	return &Event{
+		NodeID:    entry.NodeID,
+		Kind:      entry.Event,
+		MsgID:     entry.MsgID,
+		Seq:       entry.Seq,
+		ProcessID: entry.ProcessID,
+		Digest:    entry.Digest,
+		Timestamp: timestamp,
+	}, true
+}
@@ -0,0 +1,77 @@
+package checker
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bamboovir/cs425/lib/mp1/metrics"
+)
+
+func writeLog(t *testing.T, name string, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		t.Fatalf("write log: %v", err)
+	}
+	return path
+}
+
+func entryJSON(t *testing.T, entry *metrics.DeliveryLogEntry) string {
+	t.Helper()
+	encoded, err := entry.Encode()
+	if err != nil {
+		t.Fatalf("encode entry: %v", err)
+	}
+	return string(encoded)
+}
+
+func TestParseInput(t *testing.T) {
+	if nodeID, path := ParseInput("B=/tmp/err.txt"); nodeID != "B" || path != "/tmp/err.txt" {
+		t.Fatalf("parsed %s %s", nodeID, path)
+	}
+	if nodeID, path := ParseInput("/tmp/logs/C.log"); nodeID != "C" || path != "/tmp/logs/C.log" {
+		t.Fatalf("parsed %s %s", nodeID, path)
+	}
+}
+
+func TestLoadReadsJSONAndTextLogs(t *testing.T) {
+	multicastEntry := entryJSON(t, &metrics.DeliveryLogEntry{NodeID: "A", Event: metrics.MulticastEvent, MsgID: "m1", Timestamp: "1"})
+	deliverEntry := entryJSON(t, &metrics.DeliveryLogEntry{NodeID: "A", Event: metrics.DeliverEvent, MsgID: "m1", Seq: 1, ProcessID: "A", Timestamp: "2"})
+	jsonLog := writeLog(t, "A.log",
+		`{"level":"info","msg":"node [A] listening","src":"b-multicast"}`,
+		`{"level":"info","msg":`+strconv.Quote(multicastEntry)+`,"src":"`+DeliverySrc+`"}`,
+		`{"level":"info","msg":"TO deliver [9:A][ignored]","src":"total-ording"}`,
+		`{"level":"info","msg":`+strconv.Quote(deliverEntry)+`,"src":"`+DeliverySrc+`"}`,
+	)
+	textLog := writeLog(t, "B.log",
+		`time="2026-10-18T00:00:00Z" level=info msg=`+strconv.Quote(strings.Replace(deliverEntry, `"A","event"`, `"B","event"`, 1))+` src=`+DeliverySrc,
+	)
+	// a log without delivery entries falls back to the TO deliver lines, named by its input
+	plainLog := writeLog(t, "err.txt",
+		`time="2026-10-18T00:00:00Z" level=info msg="TO deliver [1:A][m1]" src=total-ording`,
+	)
+
+	trace, err := Load([]string{jsonLog, textLog, "C=" + plainLog})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(trace["A"].Multicasts) != 1 || len(trace["A"].Deliveries) != 1 {
+		t.Fatalf("node [A] has %d multicasts and %d deliveries, want the 2 entries", len(trace["A"].Multicasts), len(trace["A"].Deliveries))
+	}
+	if event := trace["A"].Deliveries[0]; event.Timestamp != 2 || event.Source != jsonLog+":4" {
+		t.Fatalf("node [A] delivery %+v", event)
+	}
+	if len(trace["B"].Deliveries) != 1 || trace["B"].Deliveries[0].MsgID != "m1" {
+		t.Fatalf("node [B] deliveries %v, want m1 of the text log", trace["B"].Deliveries)
+	}
+	if len(trace["C"].Deliveries) != 1 || trace["C"].Deliveries[0].Seq != 1 || trace["C"].Deliveries[0].ProcessID != "A" {
+		t.Fatalf("node [C] deliveries %v, want the TO deliver line", trace["C"].Deliveries)
+	}
+	if report := Check(trace, nil); !report.OK() {
+		t.Fatalf("loaded run violates\n%s", report)
+	}
+}
@@ -3,14 +3,20 @@ package config
 import (
 	"bufio"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	TLSDirective = "tls"
+)
+
 type Config struct {
 	ConfigItems []ConfigItem
+	TLS         *TLSItem
 }
 
 type ConfigItem struct {
@@ -19,20 +25,35 @@ type ConfigItem struct {
 	NodePort string
 }
 
+// TLSItem is given by the line "tls <ca> <cert> <key>", relative paths are resolved against the directory of the config file
+type TLSItem struct {
+	CAPath   string
+	CertPath string
+	KeyPath  string
+}
+
 func ConfigParser(path string) (config *Config, err error) {
-	configItems, err := ConfigItemsParser(path)
+	configItems, tlsItem, err := ConfigItemsParser(path)
 	if err != nil {
 		return nil, err
 	}
 	return &Config{
 		ConfigItems: configItems,
+		TLS:         tlsItem,
 	}, nil
 }
 
-func ConfigItemsParser(path string) (configItem []ConfigItem, err error) {
+func resolvePath(configPath string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(configPath), path)
+}
+
+func ConfigItemsParser(path string) (configItem []ConfigItem, tlsItem *TLSItem, err error) {
 	f, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer f.Close()
 
@@ -45,16 +66,27 @@ func ConfigItemsParser(path string) (configItem []ConfigItem, err error) {
 		firstLine = strings.TrimSpace(firstLine)
 		configItemCount, err = strconv.Atoi(firstLine)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
 	i := 0
-	for scanner.Scan() && i <= configItemCount {
-		i += 1
+	for scanner.Scan() {
 		line := scanner.Text()
 		line = strings.TrimSpace(line)
 		fields := strings.Fields(line)
+		if len(fields) == 4 && fields[0] == TLSDirective {
+			tlsItem = &TLSItem{
+				CAPath:   resolvePath(path, fields[1]),
+				CertPath: resolvePath(path, fields[2]),
+				KeyPath:  resolvePath(path, fields[3]),
+			}
+			continue
+		}
+		if i > configItemCount {
+			continue
+		}
+		i += 1
 		if len(fields) != 3 {
 			log.Errorf("invalid input format, skip")
 			continue
@@ -74,8 +106,8 @@ func ConfigItemsParser(path string) (configItem []ConfigItem, err error) {
 	err = scanner.Err()
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return configItem, nil
+	return configItem, tlsItem, nil
 }
@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MaxTrackedMulticasts bounds the TO-multicasts waiting for their delivery, the oldest one is forgotten to track another
+	MaxTrackedMulticasts = 65536
+	TransactionAccepted  = "accepted"
+	TransactionRejected  = "rejected"
+)
+
+var (
+	PeerSentBytes        = DefaultRegistry.NewCounterVec("mp1_peer_sent_bytes_total", "Bytes sent to a peer, frame headers included.", "node", "peer")
+	PeerSentMessages     = DefaultRegistry.NewCounterVec("mp1_peer_sent_messages_total", "Messages sent to a peer.", "node", "peer")
+	PeerReceivedBytes    = DefaultRegistry.NewCounterVec("mp1_peer_received_bytes_total", "Bytes received from a peer, frame headers included.", "node", "peer")
+	PeerReceivedMessages = DefaultRegistry.NewCounterVec("mp1_peer_received_messages_total", "Messages received from a peer.", "node", "peer")
+	TODeliveryLatency    = DefaultRegistry.NewHistogramVec("mp1_to_delivery_latency_seconds", "Time from the TO-multicast of a message to its delivery on the same node.", DefaultBuckets, "node")
+	HoldQueueDepth       = DefaultRegistry.NewGaugeVec("mp1_hold_queue_depth", "TO messages received but not delivered yet.", "node")
+	VoteWait             = DefaultRegistry.NewHistogramVec("mp1_to_vote_wait_seconds", "Time from asking the proposals of a message to collecting the vote of every alive member.", DefaultBuckets, "node")
+	Members              = DefaultRegistry.NewGaugeVec("mp1_members", "Members of the group a node is connected to, itself included.", "node")
+	Transactions         = DefaultRegistry.NewCounterVec("mp1_transactions_total", "TO-delivered transactions by kind and result.", "node", "kind", "result")
+
+	multicastStarts      = map[string]*list.Element{}
+	multicastStartsOrder = list.New()
+	multicastStartsLock  = &sync.Mutex{}
+)
+
+// multicastStart an element of multicastStartsOrder, the oldest TO-multicast is at the front
+type multicastStart struct {
+	key   string
+	start time.Time
+}
+
+// TrackTOMulticast remembers when this node TO-multicast the message of key,
+// key is any id the node also knows the message by when it delivers it
+func TrackTOMulticast(nodeID string, key string) {
+	multicastStartsLock.Lock()
+	defer multicastStartsLock.Unlock()
+	key = nodeID + "/" + key
+	if _, ok := multicastStarts[key]; ok {
+		return
+	}
+	// a message lost with a crashed member is never delivered, so the oldest one gives way
+	for len(multicastStarts) >= MaxTrackedMulticasts {
+		oldest := multicastStartsOrder.Front()
+		delete(multicastStarts, oldest.Value.(*multicastStart).key)
+		multicastStartsOrder.Remove(oldest)
+	}
+	multicastStarts[key] = multicastStartsOrder.PushBack(&multicastStart{key: key, start: time.Now()})
+}
+
+// untrackTOMulticast returns when the message of key was TO-multicast, and forgets it
+func untrackTOMulticast(nodeID string, key string) (start time.Time, ok bool) {
+	multicastStartsLock.Lock()
+	defer multicastStartsLock.Unlock()
+	key = nodeID + "/" + key
+	element, ok := multicastStarts[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	delete(multicastStarts, key)
+	multicastStartsOrder.Remove(element)
+	return element.Value.(*multicastStart).start, true
+}
+
+// ObserveTODelivery observes the latency of a message this node TO-multicast, other messages are ignored
+func ObserveTODelivery(nodeID string, key string) {
+	start, ok := untrackTOMulticast(nodeID, key)
+	if ok {
+		TODeliveryLatency.Observe(time.Since(start).Seconds(), nodeID)
+	}
+}
+
+// ForgetTOMulticast forgets a message this node TO-multicast that will not be delivered, such as one it failed to send
+func ForgetTOMulticast(nodeID string, key string) {
+	untrackTOMulticast(nodeID, key)
+}
+
+// Serve serves the default registry on MetricsPath of addr until ctx is done, it returns once addr is bound
+func Serve(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "serve metrics on [%s] failed", addr)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, DefaultRegistry)
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			logger.Errorf("serve metrics failed: %v", err)
+		}
+	}()
+	logger.Infof("serve metrics on %s%s", listener.Addr(), MetricsPath)
+	return nil
+}
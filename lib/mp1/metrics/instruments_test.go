@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"strconv"
+	"testing"
+)
+
+func tracked(nodeID string, key string) bool {
+	multicastStartsLock.Lock()
+	defer multicastStartsLock.Unlock()
+	_, ok := multicastStarts[nodeID+"/"+key]
+	return ok
+}
+
+func TestForgetTOMulticast(t *testing.T) {
+	TrackTOMulticast("A", "sent")
+	TrackTOMulticast("A", "failed")
+	ForgetTOMulticast("A", "failed")
+	if tracked("A", "failed") {
+		t.Fatalf("forgotten msg is still tracked")
+	}
+	if !tracked("A", "sent") {
+		t.Fatalf("forgetting a msg forgot another")
+	}
+	ObserveTODelivery("A", "sent")
+	if tracked("A", "sent") {
+		t.Fatalf("delivered msg is still tracked")
+	}
+}
+
+func TestTrackTOMulticastEvictsOldest(t *testing.T) {
+	for i := 0; i <= MaxTrackedMulticasts; i++ {
+		TrackTOMulticast("B", strconv.Itoa(i))
+	}
+	defer func() {
+		for i := 0; i <= MaxTrackedMulticasts; i++ {
+			ForgetTOMulticast("B", strconv.Itoa(i))
+		}
+	}()
+
+	if tracked("B", "0") {
+		t.Fatalf("oldest msg is still tracked once the limit is reached")
+	}
+	if !tracked("B", "1") || !tracked("B", strconv.Itoa(MaxTrackedMulticasts)) {
+		t.Fatalf("newer msgs are not tracked")
+	}
+	multicastStartsLock.Lock()
+	defer multicastStartsLock.Unlock()
+	if len(multicastStarts) != MaxTrackedMulticasts || multicastStartsOrder.Len() != MaxTrackedMulticasts {
+		t.Fatalf("tracking %d msgs in a list of %d, want %d", len(multicastStarts), multicastStartsOrder.Len(), MaxTrackedMulticasts)
+	}
+}
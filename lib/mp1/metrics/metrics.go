@@ -13,6 +13,9 @@ var (
 	logger          = log.WithField("src", "metrics")
 	bandwidthLogger = log.WithField("src", "metrics.bandwidth")
 	delayLogger     = log.WithField("src", "metrics.delay")
+	sendQueueLogger = log.WithField("src", "metrics.send-queue")
+	admissionLogger = log.WithField("src", "metrics.admission")
+	deliveryLogger  = log.WithField("src", "metrics.delivery")
 	enableLog       = true
 )
 
@@ -97,3 +100,142 @@ func (d *DelayLogEntry) Log() {
 		delayLogger.Infof(string(encoded))
 	}
 }
+
+type SendQueueLogEntry struct {
+	NodeID    string `json:"node_id"`
+	PeerID    string `json:"peer_id"`
+	Depth     int    `json:"depth"`
+	Dropped   uint64 `json:"dropped"`
+	Timestamp string `json:"timestamp"`
+}
+
+func NewSendQueueLogEntry(nodeID string, peerID string, depth int, dropped uint64) *SendQueueLogEntry {
+	return &SendQueueLogEntry{
+		NodeID:    nodeID,
+		PeerID:    peerID,
+		Depth:     depth,
+		Dropped:   dropped,
+		Timestamp: NowUnixNana(),
+	}
+}
+
+func (s *SendQueueLogEntry) Encode() (data []byte, err error) {
+	data, err = json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *SendQueueLogEntry) Log() {
+	encoded, err := s.Encode()
+	if err != nil {
+		logger.Errorf("encode send queue log entry failed: %v", err)
+		return
+	}
+
+	if enableLog {
+		sendQueueLogger.Infof(string(encoded))
+	}
+}
+
+type AdmissionLogEntry struct {
+	NodeID          string `json:"node_id"`
+	InFlightOfNode  int    `json:"in_flight_node"`
+	InFlightOfGroup int    `json:"in_flight_group"`
+	Waiting         int    `json:"waiting"`
+	Throttled       uint64 `json:"throttled"`
+	WaitedNanos     int64  `json:"waited_nanos"`
+	Timestamp       string `json:"timestamp"`
+}
+
+func NewAdmissionLogEntry(nodeID string, inFlightOfNode int, inFlightOfGroup int, waiting int, throttled uint64, waitedNanos int64) *AdmissionLogEntry {
+	return &AdmissionLogEntry{
+		NodeID:          nodeID,
+		InFlightOfNode:  inFlightOfNode,
+		InFlightOfGroup: inFlightOfGroup,
+		Waiting:         waiting,
+		Throttled:       throttled,
+		WaitedNanos:     waitedNanos,
+		Timestamp:       NowUnixNana(),
+	}
+}
+
+func (a *AdmissionLogEntry) Encode() (data []byte, err error) {
+	data, err = json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (a *AdmissionLogEntry) Log() {
+	encoded, err := a.Encode()
+	if err != nil {
+		logger.Errorf("encode admission log entry failed: %v", err)
+		return
+	}
+
+	if enableLog {
+		admissionLogger.Infof(string(encoded))
+	}
+}
+
+const (
+	MulticastEvent = "multicast"
+	DeliverEvent   = "deliver"
+)
+
+// DeliveryLogEntry a TO-multicast or a TO-delivery of a node, the entries of a run form the trace read by the checker,
+// Digest is the sha1 of the encoded TO message
+type DeliveryLogEntry struct {
+	NodeID    string `json:"node_id"`
+	Event     string `json:"event"`
+	MsgID     string `json:"msg_id"`
+	Seq       uint64 `json:"seq,omitempty"`
+	ProcessID string `json:"process_id,omitempty"`
+	Digest    string `json:"digest,omitempty"`
+	Timestamp string `json:"timestamp"`
+}
+
+func NewMulticastLogEntry(nodeID string, msgID string, digest string) *DeliveryLogEntry {
+	return &DeliveryLogEntry{
+		NodeID:    nodeID,
+		Event:     MulticastEvent,
+		MsgID:     msgID,
+		Digest:    digest,
+		Timestamp: NowUnixNana(),
+	}
+}
+
+func NewDeliverLogEntry(nodeID string, msgID string, seq uint64, processID string, digest string) *DeliveryLogEntry {
+	return &DeliveryLogEntry{
+		NodeID:    nodeID,
+		Event:     DeliverEvent,
+		MsgID:     msgID,
+		Seq:       seq,
+		ProcessID: processID,
+		Digest:    digest,
+		Timestamp: NowUnixNana(),
+	}
+}
+
+func (d *DeliveryLogEntry) Encode() (data []byte, err error) {
+	data, err = json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (d *DeliveryLogEntry) Log() {
+	encoded, err := d.Encode()
+	if err != nil {
+		logger.Errorf("encode delivery log entry failed: %v", err)
+		return
+	}
+
+	if enableLog {
+		deliveryLogger.Infof(string(encoded))
+	}
+}
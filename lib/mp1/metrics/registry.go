@@ -0,0 +1,250 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	sync "github.com/sasha-s/go-deadlock"
+)
+
+const (
+	CounterType   = "counter"
+	GaugeType     = "gauge"
+	HistogramType = "histogram"
+	MetricsPath   = "/metrics"
+	ContentType   = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var (
+	// DefaultBuckets of latencies in seconds, from 1ms to 10s
+	DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	// DefaultRegistry holds the metrics of this process, it is served by Handler
+	DefaultRegistry = NewRegistry()
+)
+
+// Registry an in-process registry of metric families, written in the prometheus text format
+type Registry struct {
+	families map[string]*family
+	lock     *sync.Mutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		families: map[string]*family{},
+		lock:     &sync.Mutex{},
+	}
+}
+
+func (r *Registry) register(f *family) *family {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if existing, ok := r.families[f.name]; ok {
+		return existing
+	}
+	r.families[f.name] = f
+	return f
+}
+
+// family the series of one metric, keyed by their label values
+type family struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	buckets    []float64
+	series     map[string]*series
+	lock       *sync.Mutex
+}
+
+// series value is the value of a counter or a gauge, counts are the cumulative bucket counts of a histogram
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	count       uint64
+}
+
+func newFamily(name string, help string, kind string, labelNames []string, buckets []float64) *family {
+	return &family{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     map[string]*series{},
+		lock:       &sync.Mutex{},
+	}
+}
+
+// seriesOf caller should hold lock, missing label values are empty
+func (f *family) seriesOf(labelValues []string) *series {
+	values := make([]string, len(f.labelNames))
+	copy(values, labelValues)
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: values}
+		if f.kind == HistogramType {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *family) add(v float64, labelValues []string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.seriesOf(labelValues).value += v
+}
+
+func (f *family) set(v float64, labelValues []string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.seriesOf(labelValues).value = v
+}
+
+func (f *family) observe(v float64, labelValues []string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	s := f.seriesOf(labelValues)
+	for i, bound := range f.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+func escapeLabelValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return strings.ReplaceAll(v, `"`, `\"`)
+}
+
+func (f *family) labels(s *series, extraName string, extraValue string) string {
+	pairs := make([]string, 0, len(f.labelNames)+1)
+	for i, name := range f.labelNames {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(s.labelValues[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != HistogramType {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, f.labels(s, "", ""), formatFloat(s.value))
+			continue
+		}
+		for i, bound := range f.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labels(s, "le", formatFloat(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labels(s, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, f.labels(s, "", ""), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, f.labels(s, "", ""), s.count)
+	}
+}
+
+// Write writes every family in the prometheus text format, sorted by name
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.lock.Unlock()
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+
+	writer := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(writer)
+	}
+	return writer.Flush()
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	err := r.Write(w)
+	if err != nil {
+		logger.Errorf("write metrics failed: %v", err)
+	}
+}
+
+// CounterVec a counter per combination of label values, the values are given in the order of the label names
+type CounterVec struct {
+	family *family
+}
+
+func (r *Registry) NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{family: r.register(newFamily(name, help, CounterType, labelNames, nil))}
+}
+
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	c.family.add(v, labelValues)
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.family.add(1, labelValues)
+}
+
+type GaugeVec struct {
+	family *family
+}
+
+func (r *Registry) NewGaugeVec(name string, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{family: r.register(newFamily(name, help, GaugeType, labelNames, nil))}
+}
+
+func (g *GaugeVec) Set(v float64, labelValues ...string) {
+	g.family.set(v, labelValues)
+}
+
+type HistogramVec struct {
+	family *family
+}
+
+// NewHistogramVec buckets are the upper bounds in increasing order, a +Inf bucket is always added
+func (r *Registry) NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	return &HistogramVec{family: r.register(newFamily(name, help, HistogramType, labelNames, buckets))}
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	h.family.observe(v, labelValues)
+}
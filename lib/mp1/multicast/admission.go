@@ -0,0 +1,226 @@
+package multicast
+
+import (
+	"context"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"github.com/bamboovir/cs425/lib/mp1/metrics"
+	errors "github.com/pkg/errors"
+)
+
+const (
+	AdmissionReportPeriod = time.Second
+)
+
+var (
+	ErrAdmissionStopped = errors.New("admission is stopped")
+)
+
+// AdmissionConfig caps the TO messages this node knows of that are not delivered yet,
+// MaxInFlightPerNode counts the messages multicast by this node, MaxInFlightPerGroup the messages of every member,
+// 0 is no cap
+type AdmissionConfig struct {
+	MaxInFlightPerNode  int
+	MaxInFlightPerGroup int
+}
+
+func DefaultAdmissionConfig() *AdmissionConfig {
+	return &AdmissionConfig{
+		MaxInFlightPerNode:  256,
+		MaxInFlightPerGroup: 1024,
+	}
+}
+
+type AdmissionStats struct {
+	InFlightOfNode  int    `json:"in_flight_node"`
+	InFlightOfGroup int    `json:"in_flight_group"`
+	Waiting         int    `json:"waiting"`
+	Admitted        uint64 `json:"admitted"`
+	Throttled       uint64 `json:"throttled"`
+	WaitedNanos     int64  `json:"waited_nanos"`
+}
+
+// Admission makes a TO multicast wait until the in-flight messages are below the caps,
+// so the producer is slowed down to the rate the group delivers at, instead of queueing without bound
+type Admission struct {
+	selfID    string
+	config    *AdmissionConfig
+	inFlight  map[string]string
+	exempt    map[string]struct{}
+	ofNode    int
+	waiting   int
+	admitted  uint64
+	throttled uint64
+	waited    time.Duration
+	released  chan struct{}
+	stopped   chan struct{}
+	lock      *sync.Mutex
+}
+
+func NewAdmission(selfID string, config *AdmissionConfig) *Admission {
+	if config == nil {
+		config = DefaultAdmissionConfig()
+	}
+	return &Admission{
+		selfID:   selfID,
+		config:   config,
+		inFlight: map[string]string{},
+		exempt:   map[string]struct{}{},
+		released: make(chan struct{}),
+		stopped:  make(chan struct{}),
+		lock:     &sync.Mutex{},
+	}
+}
+
+// admissible caller should hold lock
+func (a *Admission) admissible() bool {
+	if a.config.MaxInFlightPerNode > 0 && a.ofNode >= a.config.MaxInFlightPerNode {
+		return false
+	}
+	if a.config.MaxInFlightPerGroup > 0 && len(a.inFlight) >= a.config.MaxInFlightPerGroup {
+		return false
+	}
+	return true
+}
+
+// Exempt admits the messages on path without waiting, so the membership can still change the view of a group that is at its cap
+func (a *Admission) Exempt(path string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.exempt[path] = struct{}{}
+}
+
+// Acquire waits until a message of this node on path is admitted, then counts msgID as in flight until Leave,
+// it gives up once ctx is done or the admission is stopped
+func (a *Admission) Acquire(ctx context.Context, path string, msgID string) (err error) {
+	start := time.Now()
+	throttled := false
+
+	a.lock.Lock()
+	_, exempt := a.exempt[path]
+	for !exempt && !a.admissible() {
+		if !throttled {
+			throttled = true
+			a.throttled++
+			a.waiting++
+		}
+		released := a.released
+		a.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-a.stopped:
+			err = ErrAdmissionStopped
+		case <-released:
+		}
+		a.lock.Lock()
+		if err != nil {
+			a.waiting--
+			a.lock.Unlock()
+			return err
+		}
+	}
+	if throttled {
+		a.waiting--
+		a.waited += time.Since(start)
+	}
+	a.admitted++
+	a.enter(msgID, a.selfID)
+	a.lock.Unlock()
+	return nil
+}
+
+// enter caller should hold lock
+func (a *Admission) enter(msgID string, originID string) {
+	if _, ok := a.inFlight[msgID]; ok {
+		return
+	}
+	a.inFlight[msgID] = originID
+	if originID == a.selfID {
+		a.ofNode++
+	}
+}
+
+// Enter counts a message of any member as in flight, a message already counted is ignored
+func (a *Admission) Enter(msgID string, originID string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.enter(msgID, originID)
+}
+
+// Leave is called once msgID is delivered or dropped, it wakes up the waiting producers
+func (a *Admission) Leave(msgID string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	originID, ok := a.inFlight[msgID]
+	if !ok {
+		return
+	}
+	delete(a.inFlight, msgID)
+	if originID == a.selfID {
+		a.ofNode--
+	}
+	close(a.released)
+	a.released = make(chan struct{})
+}
+
+// Drain waits until every message multicast by this node is delivered or dropped, or until ctx is done
+func (a *Admission) Drain(ctx context.Context) (err error) {
+	a.lock.Lock()
+	for a.ofNode > 0 {
+		released := a.released
+		a.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-released:
+		}
+		a.lock.Lock()
+	}
+	a.lock.Unlock()
+	return nil
+}
+
+func (a *Admission) Stats() *AdmissionStats {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return &AdmissionStats{
+		InFlightOfNode:  a.ofNode,
+		InFlightOfGroup: len(a.inFlight),
+		Waiting:         a.waiting,
+		Admitted:        a.admitted,
+		Throttled:       a.throttled,
+		WaitedNanos:     a.waited.Nanoseconds(),
+	}
+}
+
+// Start logs the admission state as metrics until ctx is done, then stops admitting
+func (a *Admission) Start(ctx context.Context) {
+	go a.report(ctx)
+}
+
+func (a *Admission) report(ctx context.Context) {
+	ticker := time.NewTicker(AdmissionReportPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			close(a.stopped)
+			return
+		case <-ticker.C:
+			stats := a.Stats()
+			metrics.NewAdmissionLogEntry(
+				a.selfID,
+				stats.InFlightOfNode,
+				stats.InFlightOfGroup,
+				stats.Waiting,
+				stats.Throttled,
+				stats.WaitedNanos,
+			).Log()
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package multicast
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	errors "github.com/pkg/errors"
+)
+
+func TestMulticastContextGivesUpWaitingForAdmission(t *testing.T) {
+	for _, strategy := range []TotalOrderStrategyKind{ISISStrategy, SequencerStrategy} {
+		group := NewGroupBuilder().
+			WithSelfNodeID("A").
+			AddMember("A", "a").
+			WithTotalOrderStrategy(strategy).
+			WithAdmission(&AdmissionConfig{MaxInFlightPerNode: 1}).
+			Build()
+		err := group.Admission().Acquire(context.Background(), "/deposit", "in-flight")
+		if err != nil {
+			t.Fatalf("acquire: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		done := make(chan error, 1)
+		go func() {
+			done <- group.TO().MulticastContext(ctx, "/deposit", "x")
+		}()
+		select {
+		case err = <-done:
+			if errors.Cause(err) != context.DeadlineExceeded {
+				t.Fatalf("%s multicast returned %v, want the deadline of its ctx", strategy, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s multicast still waits for admission after its ctx is done", strategy)
+		}
+		cancel()
+		if stats := group.Admission().Stats(); stats.Waiting != 0 || stats.InFlightOfNode != 1 {
+			t.Fatalf("%s admission %+v after the multicast gave up, want 1 in flight and none waiting", strategy, stats)
+		}
+	}
+}
@@ -3,13 +3,17 @@ package multicast
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 
 	sync "github.com/sasha-s/go-deadlock"
 
 	"time"
 
 	"github.com/bamboovir/cs425/lib/broker"
+	"github.com/bamboovir/cs425/lib/mp1/metrics"
 	"github.com/bamboovir/cs425/lib/mp1/router"
+	"github.com/bamboovir/cs425/lib/mp1/tracing"
 	errors "github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
 )
@@ -17,42 +21,76 @@ import (
 type BMulticast struct {
 	group              *Group
 	memberUpdate       *broker.Broker
-	senders            map[string]*TCPClient
+	senders            map[string]Sender
+	queues             map[string]*sendQueue
 	senderLock         *sync.Mutex
 	router             *router.Router
+	transport          Transport
 	startSyncWaitGroup *sync.WaitGroup
+	ctx                context.Context
+	done               chan struct{}
 }
 
 func NewBMulticast(group *Group) *BMulticast {
 	return &BMulticast{
 		memberUpdate:       broker.New(),
 		group:              group,
-		senders:            map[string]*TCPClient{},
+		senders:            map[string]Sender{},
+		queues:             map[string]*sendQueue{},
 		senderLock:         &sync.Mutex{},
-		router:             router.New(),
+		router:             NewProtocolRouter("b-multicast", (*BMsg)(nil)),
+		transport:          group.transport,
 		startSyncWaitGroup: &sync.WaitGroup{},
+		ctx:                context.Background(),
+		done:               make(chan struct{}),
 	}
 }
 
 const (
 	BMulticastPath = "/b-multicast"
+	// StartGracePeriod is given to the members started at the same time to connect to each other before the upper layers start
+	StartGracePeriod = 5 * time.Second
+	// ShutdownFlushTimeout bounds the time the send queues are given to hand their messages to the peers on shutdown
+	ShutdownFlushTimeout = 2 * time.Second
 )
 
-func BMsgDecodeWrapper(f func(*BMsg) error) func(interface{}) error {
-	return func(v interface{}) error {
-		msg := v.(*BMsg)
-		return f(msg)
-	}
-}
-
 func (b *BMulticast) Bind(path string, f func(msg *BMsg) error) {
-	b.router.Bind(path, BMsgDecodeWrapper(f))
+	b.router.Bind(path, func(v interface{}) error {
+		return f(v.(*BMsg))
+	})
 }
 
-func (b *BMulticast) AddMember(nodeID string, client *TCPClient) {
+func (b *BMulticast) AddMember(nodeID string, client Sender) {
+	if client != nil {
+		client.OnGiveUp(func(err error) {
+			logger.Errorf("lost node [%s]: %v", nodeID, err)
+			b.EjectMember(nodeID)
+		})
+	}
 	b.senderLock.Lock()
 	defer b.senderLock.Unlock()
 	b.senders[nodeID] = client
+	metrics.Members.Set(float64(len(b.senders)), b.group.SelfNodeID)
+	if queue, ok := b.queues[nodeID]; ok {
+		queue.close()
+		delete(b.queues, nodeID)
+	}
+	if client != nil {
+		b.queues[nodeID] = newSendQueue(nodeID, client, b.sendQueueConfig(), func(err error) {
+			b.EjectMember(nodeID)
+		})
+	}
+}
+
+func (b *BMulticast) sendQueueConfig() *SendQueueConfig {
+	if b.group.sendQueueConfig == nil {
+		return DefaultSendQueueConfig()
+	}
+	return b.group.sendQueueConfig
+}
+
+func (b *BMulticast) SelfNodeID() string {
+	return b.group.SelfNodeID
 }
 
 func (b *BMulticast) MemberCount() int {
@@ -61,6 +99,17 @@ func (b *BMulticast) MemberCount() int {
 	return len(b.senders)
 }
 
+func (b *BMulticast) MemberIDs() []string {
+	b.senderLock.Lock()
+	defer b.senderLock.Unlock()
+	memberIDs := make([]string, 0, len(b.senders))
+	for nodeID := range b.senders {
+		memberIDs = append(memberIDs, nodeID)
+	}
+	sort.Strings(memberIDs)
+	return memberIDs
+}
+
 func (b *BMulticast) IsNodeAlived(nodeID string) bool {
 	b.senderLock.Lock()
 	defer b.senderLock.Unlock()
@@ -68,10 +117,102 @@ func (b *BMulticast) IsNodeAlived(nodeID string) bool {
 	return ok
 }
 
-func (b *BMulticast) Unicast(dstID string, path string, v interface{}) (err error) {
+// remove closes the sender of a member and returns the event to publish once senderLock is released,
+// nil if it is not a member. caller should hold senderLock
+func (b *BMulticast) remove(nodeID string, eventType MemberEventType) *MemberEvent {
+	sender, ok := b.senders[nodeID]
+	if !ok {
+		return nil
+	}
+	if sender != nil {
+		sender.Close()
+	}
+	delete(b.senders, nodeID)
+	metrics.Members.Set(float64(len(b.senders)), b.group.SelfNodeID)
+	if queue, ok := b.queues[nodeID]; ok {
+		queue.close()
+		delete(b.queues, nodeID)
+	}
+	return NewMemberEvent(eventType, nodeID, len(b.senders))
+}
+
+// publish publishes the event of a removed member, the subscribers may call back into BMulticast, so senderLock must not be held
+func (b *BMulticast) publish(event *MemberEvent) {
+	if event != nil {
+		b.memberUpdate.Publish(event)
+	}
+}
+
+// EjectMember removes a member and publishes its death
+func (b *BMulticast) EjectMember(nodeID string) {
+	b.senderLock.Lock()
+	logger.Infof("eject node [%s] from group", nodeID)
+	event := b.remove(nodeID, MemberDead)
+	b.senderLock.Unlock()
+	b.publish(event)
+}
+
+// RemoveMember removes a member that left the group gracefully
+func (b *BMulticast) RemoveMember(nodeID string) {
+	b.senderLock.Lock()
+	logger.Infof("remove node [%s] from group", nodeID)
+	event := b.remove(nodeID, MemberLeave)
+	b.senderLock.Unlock()
+	b.publish(event)
+}
+
+// ConnectMember connects to a member that joins a running group
+func (b *BMulticast) ConnectMember(nodeID string, addr string, attempts int) (err error) {
+	if b.IsNodeAlived(nodeID) {
+		return nil
+	}
+	client, err := b.transport.Dial(b.ctx, b.group.SelfNodeID, nodeID, addr, time.Second, attempts)
+	if err != nil {
+		return err
+	}
+	b.AddMember(nodeID, client)
+	b.memberUpdate.Publish(NewMemberEvent(MemberJoin, nodeID, b.MemberCount()))
+	return nil
+}
+
+func (b *BMulticast) PublishMemberEvent(event *MemberEvent) {
+	b.memberUpdate.Publish(event)
+}
+
+// SendQueueStats returns the send queue of every member, sorted by node id
+func (b *BMulticast) SendQueueStats() []*SendQueueStats {
 	b.senderLock.Lock()
 	defer b.senderLock.Unlock()
-	sender, ok := b.senders[dstID]
+	stats := make([]*SendQueueStats, 0, len(b.queues))
+	for _, queue := range b.queues {
+		stats = append(stats, queue.stats())
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].NodeID < stats[j].NodeID
+	})
+	return stats
+}
+
+// enqueue pushes bmsg to the send queue of a member, a full queue drops the message or ejects the member by policy
+func (b *BMulticast) enqueue(queue *sendQueue, bmsg *BMsg) (err error) {
+	err = queue.push(bmsg)
+	if err != ErrSendQueueFull {
+		return err
+	}
+	if queue.policy == SendQueueEject {
+		logger.Errorf("send queue to [%s] is full, eject it", queue.dstID)
+		b.EjectMember(queue.dstID)
+		return err
+	}
+	logger.Warnf("send queue to [%s] is full, drop msg on path [%s]", queue.dstID, bmsg.Path)
+	return err
+}
+
+// Unicast only holds senderLock to find the queue of dstID, the message is written by the writer of the queue
+func (b *BMulticast) Unicast(dstID string, path string, v interface{}) (err error) {
+	b.senderLock.Lock()
+	queue, ok := b.queues[dstID]
+	b.senderLock.Unlock()
 
 	if !ok {
 		errmsg := fmt.Sprintf("dst node id [%s] sender not exists, unicast failed", dstID)
@@ -84,81 +225,91 @@ func (b *BMulticast) Unicast(dstID string, path string, v interface{}) (err erro
 		return errors.Wrap(err, "b-unicast failed")
 	}
 
-	bmsgBytes, err := bmsg.Encode()
-
+	err = b.enqueue(queue, bmsg)
 	if err != nil {
 		return errors.Wrap(err, "b-unicast failed")
 	}
+	return nil
+}
 
-	err = sender.Send(bmsgBytes)
-	if err != nil {
-		logger.Errorf("client lost connection, write error: %v", err)
-		logger.Infof("eject node [%s] from group", dstID)
-		sender.Close()
-		delete(b.senders, dstID)
-		b.memberUpdate.Publish(len(b.senders))
-		return errors.Wrap(err, "b-unicast failed")
+// MulticastError the members a b-multicast could not queue the message for, Queued members got it
+type MulticastError struct {
+	Queued int
+	Errs   map[string]error
+}
+
+func (e *MulticastError) Error() string {
+	nodeIDs := make([]string, 0, len(e.Errs))
+	for nodeID := range e.Errs {
+		nodeIDs = append(nodeIDs, nodeID)
 	}
-	return nil
+	sort.Strings(nodeIDs)
+	failed := make([]string, 0, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
+		failed = append(failed, fmt.Sprintf("[%s]: %v", nodeID, e.Errs[nodeID]))
+	}
+	return fmt.Sprintf("b-multicast queued for %d members, failed for %s", e.Queued, strings.Join(failed, ", "))
 }
 
+// Multicast returns a *MulticastError if the message could not be queued for some members
 func (b *BMulticast) Multicast(path string, v interface{}) (err error) {
 	b.senderLock.Lock()
-	defer b.senderLock.Unlock()
-
-	bmsg, err := NewBMsg(b.group.SelfNodeID, path, v)
-
-	if err != nil {
-		return errors.Wrap(err, "b-multicast failed")
+	queues := make([]*sendQueue, 0, len(b.queues))
+	for _, queue := range b.queues {
+		queues = append(queues, queue)
 	}
+	b.senderLock.Unlock()
 
-	bmsgBytes, err := bmsg.Encode()
+	bmsg, err := NewBMsg(b.group.SelfNodeID, path, v)
 
 	if err != nil {
 		return errors.Wrap(err, "b-multicast failed")
 	}
 
-	for dstID, sender := range b.senders {
-		err = sender.Send(bmsgBytes)
+	multicastErr := &MulticastError{Errs: map[string]error{}}
+	for _, queue := range queues {
+		err = b.enqueue(queue, bmsg)
 		if err != nil {
-			logger.Errorf("client lost connection, write error: %v", err)
-			logger.Infof("eject node [%s] from group", dstID)
-			sender.Close()
-			delete(b.senders, dstID)
-			b.memberUpdate.Publish(len(b.senders))
+			multicastErr.Errs[queue.dstID] = err
+			continue
 		}
+		multicastErr.Queued++
+	}
+	if len(multicastErr.Errs) != 0 {
+		return multicastErr
 	}
 	return nil
 }
 
-func (b *BMulticast) startServer() (err error) {
-	for range b.group.members {
-		b.startSyncWaitGroup.Add(1)
-	}
-
-	socket, err := startServer(
-		b.group.SelfNodeID,
-		b.group.SelfNodeAddr,
-		b.router,
-	)
-
-	if err != nil {
-		return err
+// reportSendQueues logs the depth of every send queue as metrics
+func (b *BMulticast) reportSendQueues(ctx context.Context) {
+	ticker := time.NewTicker(SendQueueReportPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, stats := range b.SendQueueStats() {
+				metrics.NewSendQueueLogEntry(b.group.SelfNodeID, stats.NodeID, stats.Depth, stats.Dropped).Log()
+			}
+		}
 	}
+}
 
-	go runServer(
-		b.startSyncWaitGroup,
-		b.group.SelfNodeID,
-		socket,
-		b.router,
-	)
+// deliver hands a received message to the router, once a client to every member is started
+func (b *BMulticast) deliver(msg *BMsg) error {
+	b.startSyncWaitGroup.Wait()
+	return b.router.Run(BMulticastPath, msg)
+}
 
-	return nil
+func (b *BMulticast) startServer(ctx context.Context) (err error) {
+	return b.transport.Listen(ctx, b.group.SelfNodeID, b.group.SelfNodeAddr, b.deliver)
 }
 
-func (b *BMulticast) startClients() (err error) {
+func (b *BMulticast) startClients(ctx context.Context) (err error) {
 	for _, m := range b.group.members {
-		err = b.startClient(m.ID, m.Addr, 5*time.Second)
+		err = b.startClient(ctx, m.ID, m.Addr, 5*time.Second)
 		if err != nil {
 			return err
 		}
@@ -167,17 +318,18 @@ func (b *BMulticast) startClients() (err error) {
 }
 
 func (b *BMulticast) startClient(
+	ctx context.Context,
 	dstNodeID string,
 	addr string,
 	retryInterval time.Duration,
 ) (err error) {
-	client, err := NewTCPClient(b.group.SelfNodeID, dstNodeID, addr, 5*time.Second)
-	b.AddMember(dstNodeID, client)
-	b.startSyncWaitGroup.Done()
+	defer b.startSyncWaitGroup.Done()
+	client, err := b.transport.Dial(ctx, b.group.SelfNodeID, dstNodeID, addr, retryInterval, 0)
 	if err != nil {
 		logger.Errorf("init tcp client failed: %v", err)
 		return err
 	}
+	b.AddMember(dstNodeID, client)
 	return nil
 }
 
@@ -188,28 +340,96 @@ func (b *BMulticast) MembersUpdate() chan interface{} {
 func (b *BMulticast) bindBDeliver() {
 	b.router.Bind(BMulticastPath, func(v interface{}) error {
 		msg := v.(*BMsg)
+		if msg.Trace == nil {
+			return b.router.Run(msg.Path, msg)
+		}
+		msg.span = tracing.Start(b.group.SelfNodeID, "b.deliver", msg.Trace)
+		msg.span.SetAttribute("path", msg.Path)
+		msg.span.SetAttribute("src", msg.SrcID)
+		defer msg.span.End()
 		return b.router.Run(msg.Path, msg)
 	})
 }
 
 func (b *BMulticast) Start(ctx context.Context) (err error) {
+	if b.transport == nil {
+		b.transport, err = NewTCPTransport(b.group.tlsConfig)
+		if err != nil {
+			return errors.Wrap(err, "b-multicast start failed")
+		}
+	}
+	for range b.group.members {
+		b.startSyncWaitGroup.Add(1)
+	}
+	b.ctx = ctx
 	b.bindBDeliver()
 	go b.memberUpdate.Start()
+	go b.reportSendQueues(ctx)
+	go b.stop(ctx)
 
+	// the senders outlive the start, so they are dialed with ctx instead of the context of the errgroup
 	errGroup, _ := errgroup.WithContext(ctx)
 	errGroup.Go(
 		func() error {
-			return b.startServer()
+			return b.startServer(ctx)
 		},
 	)
 
 	errGroup.Go(
 		func() error {
-			return b.startClients()
+			return b.startClients(ctx)
 		},
 	)
 
 	err = errGroup.Wait()
-	time.Sleep(time.Second * 5)
-	return err
+	if err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(StartGracePeriod):
+		return nil
+	}
+}
+
+// stop waits until ctx is done, then gives the send queues ShutdownFlushTimeout to hand over what is queued,
+// and closes every sender. The members are not removed one by one, so no member event is published on shutdown
+func (b *BMulticast) stop(ctx context.Context) {
+	<-ctx.Done()
+	defer close(b.done)
+
+	b.senderLock.Lock()
+	queues := make([]*sendQueue, 0, len(b.queues))
+	for _, queue := range b.queues {
+		queues = append(queues, queue)
+	}
+	b.senderLock.Unlock()
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), ShutdownFlushTimeout)
+	defer cancel()
+	for _, queue := range queues {
+		queue.drain(flushCtx)
+	}
+
+	b.memberUpdate.Stop()
+	b.senderLock.Lock()
+	defer b.senderLock.Unlock()
+	for nodeID, queue := range b.queues {
+		queue.close()
+		delete(b.queues, nodeID)
+	}
+	for nodeID, sender := range b.senders {
+		if sender != nil {
+			sender.Close()
+		}
+		delete(b.senders, nodeID)
+	}
+	metrics.Members.Set(0, b.group.SelfNodeID)
+	logger.Infof("node [%s] closed the connections to its peers", b.group.SelfNodeID)
+}
+
+// Done is closed once the senders are closed after the context of Start is done
+func (b *BMulticast) Done() <-chan struct{} {
+	return b.done
 }
@@ -0,0 +1,106 @@
+package multicast
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"github.com/bamboovir/cs425/lib/codec"
+)
+
+// pipeClient is a connected client of node A that writes to conn
+func pipeClient(dstID string, conn net.Conn) *TCPClient {
+	return &TCPClient{
+		srcID:      "A",
+		dstID:      dstID,
+		connection: conn,
+		nextSeq:    1,
+		unacked:    []*outboundFrame{},
+		codec:      codec.JSON,
+		cancel:     func() {},
+		lock:       &sync.Mutex{},
+	}
+}
+
+func TestEjectPublishesOutsideSenderLock(t *testing.T) {
+	group := NewGroupBuilder().WithSelfNodeID("A").AddMember("A", "a").AddMember("B", "b").Build()
+	b := group.B()
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	b.AddMember("B", pipeClient("B", conn))
+	// the broker is not started, so the next publish blocks until it is
+	b.PublishMemberEvent(NewMemberEvent(MemberSuspect, "B", 1))
+
+	ejected := make(chan struct{})
+	go func() {
+		b.EjectMember("B")
+		close(ejected)
+	}()
+
+	alive := make(chan bool)
+	go func() {
+		// a subscriber calling back into BMulticast while the event is published
+		time.Sleep(50 * time.Millisecond)
+		alive <- b.IsNodeAlived("B")
+	}()
+	select {
+	case ok := <-alive:
+		if ok {
+			t.Fatalf("node [B] is alive after eject")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("senderLock is held while the member event is published")
+	}
+
+	go b.memberUpdate.Start()
+	defer b.memberUpdate.Stop()
+	select {
+	case <-ejected:
+	case <-time.After(time.Second):
+		t.Fatalf("eject did not return once the broker started")
+	}
+}
+
+// refusedTransport refuses every dial
+type refusedTransport struct{}
+
+func (refusedTransport) Listen(ctx context.Context, nodeID string, addr string, deliver func(msg *BMsg) error) error {
+	return nil
+}
+
+func (refusedTransport) Dial(ctx context.Context, srcID string, dstID string, addr string, retryInterval time.Duration, attempts int) (Sender, error) {
+	return nil, fmt.Errorf("dial [%s] in [%s] refused", dstID, addr)
+}
+
+func TestStartClientSkipsMemberOnDialError(t *testing.T) {
+	group := NewGroupBuilder().WithSelfNodeID("A").AddMember("A", "a").AddMember("B", "b").WithTransport(refusedTransport{}).Build()
+	b := group.B()
+	b.startSyncWaitGroup.Add(1)
+
+	err := b.startClient(context.Background(), "B", "b", time.Millisecond)
+	if err == nil {
+		t.Fatalf("start client of a refused member succeeded")
+	}
+	if b.IsNodeAlived("B") {
+		t.Fatalf("node [B] is a member without a sender")
+	}
+	// a delivery does not wait for the member that failed to start
+	b.startSyncWaitGroup.Wait()
+}
+
+func TestRemoveMemberWithoutSender(t *testing.T) {
+	group := NewGroupBuilder().WithSelfNodeID("A").AddMember("A", "a").AddMember("B", "b").Build()
+	b := group.B()
+	go b.memberUpdate.Start()
+	defer b.memberUpdate.Stop()
+	b.AddMember("B", nil)
+
+	b.RemoveMember("B")
+	if b.IsNodeAlived("B") {
+		t.Fatalf("node [B] is still a member after it is removed")
+	}
+}
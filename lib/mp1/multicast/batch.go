@@ -0,0 +1,95 @@
+package multicast
+
+import (
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+)
+
+const (
+	AskProposalSeqBatchPath       = "/total-ording/ask-proposal-seq-batch"
+	WaitProposalSeqBatchPath      = "/total-ording/wait-proposal-seq-batch"
+	AnnounceAgreementSeqBatchPath = "/total-ording/announce-agreement-seq-batch"
+)
+
+// BatchConfig an isis message waits up to Window for other messages of the same kind to the same destination,
+// a batch is sent as soon as it has Size entries, a Window of 0 sends every message on its own
+type BatchConfig struct {
+	Window time.Duration
+	Size   int
+}
+
+func DefaultBatchConfig() *BatchConfig {
+	return &BatchConfig{
+		Window: 0,
+		Size:   64,
+	}
+}
+
+type TOAskProposalSeqBatchMsg struct {
+	Asks []*TOAskProposalSeqMsg `json:"asks"`
+}
+
+type TOReplyProposalSeqBatchMsg struct {
+	Replies []*TOReplyProposalSeqMsg `json:"replies"`
+}
+
+type TOAnnounceAgreementSeqBatchMsg struct {
+	Announces []*TOAnnounceAgreementSeqMsg `json:"announces"`
+}
+
+// batcher collects entries by destination, and hands them to flush once Size entries are collected
+// or Window is over since the first entry
+type batcher struct {
+	config  *BatchConfig
+	flush   func(dst string, entries []interface{})
+	pending map[string][]interface{}
+	timers  map[string]*time.Timer
+	lock    *sync.Mutex
+}
+
+func newBatcher(config *BatchConfig, flush func(dst string, entries []interface{})) *batcher {
+	return &batcher{
+		config:  config,
+		flush:   flush,
+		pending: map[string][]interface{}{},
+		timers:  map[string]*time.Timer{},
+		lock:    &sync.Mutex{},
+	}
+}
+
+func (b *batcher) add(dst string, entry interface{}) {
+	b.lock.Lock()
+	entries := append(b.pending[dst], entry)
+	if len(entries) < b.config.Size {
+		b.pending[dst] = entries
+		if len(entries) == 1 {
+			b.timers[dst] = time.AfterFunc(b.config.Window, func() { b.flushDst(dst) })
+		}
+		b.lock.Unlock()
+		return
+	}
+	b.take(dst)
+	b.lock.Unlock()
+	b.flush(dst, entries)
+}
+
+// take removes the pending entries of dst, caller should hold lock
+func (b *batcher) take(dst string) []interface{} {
+	entries := b.pending[dst]
+	delete(b.pending, dst)
+	if timer, ok := b.timers[dst]; ok {
+		timer.Stop()
+		delete(b.timers, dst)
+	}
+	return entries
+}
+
+func (b *batcher) flushDst(dst string) {
+	b.lock.Lock()
+	entries := b.take(dst)
+	b.lock.Unlock()
+	if len(entries) > 0 {
+		b.flush(dst, entries)
+	}
+}
@@ -0,0 +1,90 @@
+package multicast
+
+import (
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+)
+
+// catchUpPeer a joining member the sponsor forwards to until deadline,
+// the messages are kept in backlog until the sponsor is connected to it
+type catchUpPeer struct {
+	deadline  time.Time
+	connected bool
+	backlog   []*RMsg
+}
+
+// catchUp forwards the TO messages a sponsor processes after the state transfer cut to the members that just joined,
+// a joining member misses them until every member is connected to it. It has its own lock,
+// so the strategies forward once their delivery lock is released
+type catchUp struct {
+	bmulticast *BMulticast
+	peers      map[string]*catchUpPeer
+	lock       *sync.Mutex
+}
+
+func newCatchUp(b *BMulticast) *catchUp {
+	return &catchUp{
+		bmulticast: b,
+		peers:      map[string]*catchUpPeer{},
+		lock:       &sync.Mutex{},
+	}
+}
+
+// start is called at the state transfer cut, the messages forwarded before the sponsor is connected to nodeID are kept
+func (c *catchUp) start(nodeID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.peers[nodeID] = &catchUpPeer{
+		deadline: time.Now().Add(JoinCatchUpWindow),
+		backlog:  []*RMsg{},
+	}
+}
+
+// connected sends the backlog of nodeID once the state transfer is sent to it, the window starts over
+func (c *catchUp) connected(nodeID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	peer, ok := c.peers[nodeID]
+	if !ok {
+		return
+	}
+	peer.connected = true
+	peer.deadline = time.Now().Add(JoinCatchUpWindow)
+	for _, msg := range peer.backlog {
+		c.unicast(nodeID, msg)
+	}
+	peer.backlog = nil
+}
+
+// stop forgets nodeID, the sponsor failed to connect to it
+func (c *catchUp) stop(nodeID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.peers, nodeID)
+}
+
+// forward sends a message this node just processed to the members that are still catching up
+func (c *catchUp) forward(msg *RMsg) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for nodeID, peer := range c.peers {
+		if time.Now().After(peer.deadline) {
+			delete(c.peers, nodeID)
+			continue
+		}
+		if !peer.connected {
+			peer.backlog = append(peer.backlog, msg)
+			continue
+		}
+		c.unicast(nodeID, msg)
+	}
+}
+
+// unicast caller should hold lock
+func (c *catchUp) unicast(nodeID string, msg *RMsg) {
+	err := c.bmulticast.Unicast(nodeID, RMulticastPath, msg)
+	if err != nil {
+		logger.Errorf("forward msg [%s] to catching up node [%s] failed: %v", msg.ID, nodeID, err)
+	}
+}
@@ -0,0 +1,62 @@
+package multicast
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"github.com/bamboovir/cs425/lib/codec"
+)
+
+// recordConn counts the frames written to the other end of a pipe
+type recordConn struct {
+	sent int
+	lock sync.Mutex
+}
+
+func (r *recordConn) read(conn net.Conn) {
+	for {
+		_, err := codec.ReadFrame(conn)
+		if err != nil {
+			return
+		}
+		r.lock.Lock()
+		r.sent++
+		r.lock.Unlock()
+	}
+}
+
+func (r *recordConn) count() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.sent
+}
+
+func TestCatchUpKeepsBacklogUntilConnected(t *testing.T) {
+	group := NewGroupBuilder().WithSelfNodeID("A").AddMember("A", "a").Build()
+	c := group.catchUp
+	c.start("D")
+	c.forward(&RMsg{ID: "1"})
+	c.forward(&RMsg{ID: "2"})
+	if held := len(c.peers["D"].backlog); held != 2 {
+		t.Fatalf("%d msgs in backlog, want 2", held)
+	}
+
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	recorder := &recordConn{}
+	go recorder.read(peer)
+	group.B().AddMember("D", pipeClient("D", conn))
+	c.connected("D")
+	c.forward(&RMsg{ID: "3"})
+
+	deadline := time.Now().Add(time.Second)
+	for recorder.count() < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sent := recorder.count(); sent != 3 {
+		t.Fatalf("%d msgs forwarded, want 3", sent)
+	}
+}
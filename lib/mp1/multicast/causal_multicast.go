@@ -0,0 +1,228 @@
+package multicast
+
+import (
+	"context"
+	"time"
+
+	"github.com/bamboovir/cs425/lib/mp1/router"
+	sync "github.com/sasha-s/go-deadlock"
+
+	errors "github.com/pkg/errors"
+)
+
+const (
+	CausalMulticastPath = "/causal-multicast"
+)
+
+type causalHoldbackItem struct {
+	msg *COMsg
+	vc  VectorClock
+}
+
+type CausalMulticast struct {
+	rmulticast       *RMulticast
+	router           *router.Router
+	sentSeqNum       uint64
+	sentSeqNumLock   *sync.Mutex
+	delivered        VectorClock
+	deliveredLock    *sync.Mutex
+	holdback         []*causalHoldbackItem
+	holdbackLock     *sync.Mutex
+	crashNodeTimeout map[string]time.Time
+}
+
+func NewCausalMulticast(r *RMulticast) *CausalMulticast {
+	return &CausalMulticast{
+		rmulticast:       r,
+		router:           NewProtocolRouter("co-multicast", (*COMsg)(nil)),
+		sentSeqNum:       0,
+		sentSeqNumLock:   &sync.Mutex{},
+		delivered:        NewVectorClock(),
+		deliveredLock:    &sync.Mutex{},
+		holdback:         []*causalHoldbackItem{},
+		holdbackLock:     &sync.Mutex{},
+		crashNodeTimeout: map[string]time.Time{},
+	}
+}
+
+func (c *CausalMulticast) Bind(path string, f func(msg *COMsg) error) {
+	c.router.Bind(path, func(v interface{}) error {
+		return f(v.(*COMsg))
+	})
+}
+
+func (c *CausalMulticast) Multicast(path string, v interface{}) (err error) {
+	selfNodeID := c.rmulticast.bmulticast.group.SelfNodeID
+
+	comsg, err := NewCOMsg(selfNodeID, path, v)
+	if err != nil {
+		return errors.Wrap(err, "co-multicast failed")
+	}
+
+	rmsg, err := NewRMsg(CausalMulticastPath, comsg)
+	if err != nil {
+		return errors.Wrap(err, "co-multicast failed")
+	}
+
+	c.sentSeqNumLock.Lock()
+	defer c.sentSeqNumLock.Unlock()
+
+	// handlers may co-multicast while the holdback queue is locked, so only take deliveredLock here
+	c.deliveredLock.Lock()
+	vc := c.delivered.Copy()
+	c.deliveredLock.Unlock()
+
+	vc[selfNodeID] = c.sentSeqNum + 1
+	rmsg.VC = vc
+
+	err = c.rmulticast.MulticastRMsg(rmsg)
+	if err != nil {
+		return errors.Wrap(err, "co-multicast failed")
+	}
+
+	c.sentSeqNum = vc[selfNodeID]
+	return nil
+}
+
+func (c *CausalMulticast) bindCODeliver() {
+	c.rmulticast.Bind(CausalMulticastPath, func(msg *RMsg) error {
+		comsg := &COMsg{}
+		_, err := comsg.Decode(msg.Body)
+		if err != nil {
+			return errors.Wrap(err, "co-deliver failed")
+		}
+		c.receive(comsg, msg.VC)
+		return nil
+	})
+}
+
+// receive holds comsg back until every message it causally depends on is delivered
+func (c *CausalMulticast) receive(comsg *COMsg, vc VectorClock) {
+	c.holdbackLock.Lock()
+	defer c.holdbackLock.Unlock()
+
+	if vc[comsg.SrcID] <= c.delivered[comsg.SrcID] {
+		logger.Infof("drop duplicate co msg [%s] %s", comsg.SrcID, vc)
+		return
+	}
+
+	c.holdback = append(c.holdback, &causalHoldbackItem{
+		msg: comsg,
+		vc:  vc,
+	})
+	c.deliverHoldback()
+	// a message that is still held may wait for a node that crashed before it arrived
+	c.armCrashTimeouts()
+}
+
+// deliverHoldback keeps scanning the holdback queue until no more message becomes deliverable,
+// caller should hold holdbackLock
+func (c *CausalMulticast) deliverHoldback() {
+	for {
+		progress := false
+		for i := 0; i < len(c.holdback); i++ {
+			item := c.holdback[i]
+			if !c.delivered.Deliverable(item.msg.SrcID, item.vc) {
+				continue
+			}
+
+			c.holdback = append(c.holdback[:i], c.holdback[i+1:]...)
+			i--
+			progress = true
+
+			c.deliveredLock.Lock()
+			c.delivered[item.msg.SrcID] = item.vc[item.msg.SrcID]
+			c.deliveredLock.Unlock()
+			err := c.router.Run(item.msg.Path, item.msg)
+			if err != nil {
+				logger.Errorf("process err %v", err)
+			}
+		}
+		if !progress {
+			return
+		}
+	}
+}
+
+// skipOrphans gives up the messages of an ejected node that held messages still wait for,
+// R-Multicast can not supply those messages anymore once the crash timeout has passed,
+// so delivered of the node is advanced to the seq the held message requires and the message is kept
+func (c *CausalMulticast) skipOrphans() {
+	c.holdbackLock.Lock()
+	defer c.holdbackLock.Unlock()
+
+	for _, item := range c.holdback {
+		for nodeID, seqNum := range item.vc {
+			if nodeID == item.msg.SrcID {
+				// the sender's own earlier messages are required, not this one
+				seqNum--
+			}
+			if seqNum <= c.delivered[nodeID] {
+				continue
+			}
+			crashTime, ok := c.crashNodeTimeout[nodeID]
+			if !ok || time.Since(crashTime) <= NodeCrashTimeout {
+				continue
+			}
+			if c.rmulticast.bmulticast.IsNodeAlived(nodeID) {
+				// armed before the node was connected
+				delete(c.crashNodeTimeout, nodeID)
+				continue
+			}
+			logger.Infof("skip co msgs (%d, %d] of crashed process [%s], required by [%s] %s", c.delivered[nodeID], seqNum, nodeID, item.msg.SrcID, item.vc)
+			c.deliveredLock.Lock()
+			c.delivered[nodeID] = seqNum
+			c.deliveredLock.Unlock()
+		}
+	}
+
+	c.deliverHoldback()
+}
+
+// armCrashTimeouts starts the crash timeout of every node that is not alive and that a delivered or held message has an entry of,
+// including a node that only appears in the vector clock of a held message, then schedules skipOrphans.
+// Caller should hold holdbackLock
+func (c *CausalMulticast) armCrashTimeouts() {
+	armed := false
+	arm := func(nodeID string) {
+		if _, ok := c.crashNodeTimeout[nodeID]; ok {
+			return
+		}
+		if c.rmulticast.bmulticast.IsNodeAlived(nodeID) {
+			return
+		}
+		logger.Infof("co-multicast observe crashed process [%s]", nodeID)
+		c.crashNodeTimeout[nodeID] = time.Now()
+		armed = true
+	}
+	for nodeID := range c.delivered {
+		arm(nodeID)
+	}
+	for _, item := range c.holdback {
+		arm(item.msg.SrcID)
+		for nodeID := range item.vc {
+			arm(nodeID)
+		}
+	}
+	if armed {
+		time.AfterFunc(NodeCrashTimeout+time.Second, c.skipOrphans)
+	}
+}
+
+func (c *CausalMulticast) watchMembers(ctx context.Context, memberUpdateChannel chan interface{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-memberUpdateChannel:
+			c.holdbackLock.Lock()
+			c.armCrashTimeouts()
+			c.holdbackLock.Unlock()
+		}
+	}
+}
+
+func (c *CausalMulticast) Start(ctx context.Context) {
+	memberUpdateChannel := c.rmulticast.bmulticast.MembersUpdate()
+	go c.watchMembers(ctx, memberUpdateChannel)
+}
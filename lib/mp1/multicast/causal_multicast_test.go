@@ -0,0 +1,75 @@
+package multicast
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bamboovir/cs425/lib/codec"
+)
+
+func newTestCausal(t *testing.T) (*CausalMulticast, *[]string) {
+	t.Helper()
+	group := NewGroupBuilder().WithSelfNodeID("A").AddMember("A", "a").Build()
+	delivered := &[]string{}
+	group.CO().Bind("/test", func(msg *COMsg) error {
+		body := ""
+		err := codec.Unmarshal(msg.Body, &body)
+		if err != nil {
+			t.Fatalf("decode body: %v", err)
+		}
+		*delivered = append(*delivered, body)
+		return nil
+	})
+	return group.CO(), delivered
+}
+
+func newTestCOMsg(t *testing.T, srcID string, body string) *COMsg {
+	t.Helper()
+	msg, err := NewCOMsg(srcID, "/test", body)
+	if err != nil {
+		t.Fatalf("new co msg: %v", err)
+	}
+	return msg
+}
+
+func TestCausalHoldsBackUntilDependenciesAreDelivered(t *testing.T) {
+	c, delivered := newTestCausal(t)
+	// C replies to the first message of B, the reply arrives first
+	c.receive(newTestCOMsg(t, "C", "reply"), VectorClock{"B": 1, "C": 1})
+	c.receive(newTestCOMsg(t, "B", "second"), VectorClock{"B": 2})
+	c.receive(newTestCOMsg(t, "B", "first"), VectorClock{"B": 1})
+	c.receive(newTestCOMsg(t, "B", "first"), VectorClock{"B": 1})
+	if want := []string{"first", "reply", "second"}; !reflect.DeepEqual(*delivered, want) {
+		t.Fatalf("delivered %v, want %v", *delivered, want)
+	}
+}
+
+func TestCausalSkipsMissingMsgsOfCrashedNodeOnlyInClock(t *testing.T) {
+	c, delivered := newTestCausal(t)
+	// X crashed, its message never arrives, it only appears in the clock of the message of B
+	c.receive(newTestCOMsg(t, "B", "after-x"), VectorClock{"B": 1, "X": 1})
+	c.receive(newTestCOMsg(t, "X", "second-x"), VectorClock{"X": 3})
+	if _, ok := c.crashNodeTimeout["X"]; !ok {
+		t.Fatalf("crash timeout of [X] is not armed")
+	}
+	c.skipOrphans()
+	if len(*delivered) != 0 {
+		t.Fatalf("delivered %v before the crash timeout, want none", *delivered)
+	}
+	c.holdbackLock.Lock()
+	for nodeID := range c.crashNodeTimeout {
+		c.crashNodeTimeout[nodeID] = time.Now().Add(-2 * NodeCrashTimeout)
+	}
+	c.holdbackLock.Unlock()
+	c.skipOrphans()
+	if len(c.holdback) != 0 {
+		t.Fatalf("%d msgs held, want 0", len(c.holdback))
+	}
+	if want := []string{"after-x", "second-x"}; !reflect.DeepEqual(*delivered, want) {
+		t.Fatalf("delivered %v, want %v", *delivered, want)
+	}
+	if c.delivered["X"] != 3 {
+		t.Fatalf("delivered seq of [X] is %d, want 3", c.delivered["X"])
+	}
+}
@@ -1,78 +1,336 @@
 package multicast
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
 	"fmt"
 	"net"
 	"time"
 
+	sync "github.com/sasha-s/go-deadlock"
+
+	"github.com/bamboovir/cs425/lib/codec"
+	"github.com/bamboovir/cs425/lib/mp1/metrics"
 	"github.com/bamboovir/cs425/lib/mp1/types"
 	"github.com/bamboovir/cs425/lib/retry"
+	"github.com/google/uuid"
+	errors "github.com/pkg/errors"
+)
+
+const (
+	MaxUnackedFrames     = 10000
+	ClientWriteTimeout   = 10 * time.Second
+	ReconnectAttempts    = 8
+	ReconnectBaseBackoff = 100 * time.Millisecond
+	ReconnectMaxBackoff  = 5 * time.Second
+)
+
+var (
+	ErrOutboundBufferFull = errors.New("outbound buffer of unacknowledged frames is full")
+	ErrClientClosed       = errors.New("client is closed")
+	ErrReconnecting       = errors.New("client is reconnecting, the frame is resent once it is back")
+)
+
+const (
+	frameSeqSize = 8
 )
 
+// outboundFrame keeps the message, so it can be encoded again if a reconnection negotiates another codec
+type outboundFrame struct {
+	seq       uint64
+	msg       *BMsg
+	data      []byte
+	codecName string
+}
+
+// encode returns the frame payload, the sequence number followed by the message encoded with c
+func (f *outboundFrame) encode(c codec.Codec) (payload []byte, err error) {
+	if f.data != nil && f.codecName == c.Name() {
+		return f.data, nil
+	}
+	body, err := c.Marshal(f.msg)
+	if err != nil {
+		return nil, err
+	}
+	f.data = make([]byte, frameSeqSize, frameSeqSize+len(body))
+	binary.BigEndian.PutUint64(f.data, f.seq)
+	f.data = append(f.data, body...)
+	f.codecName = c.Name()
+	return f.data, nil
+}
+
+// TCPClient keeps every frame until the server acknowledges it,
+// after a write error it reconnects with backoff and resends what the server did not receive
 type TCPClient struct {
 	srcID         string
 	dstID         string
 	addr          string
 	retryInterval time.Duration
+	tlsConfig     *tls.Config
+	session       string
 	connection    net.Conn
+	codec         codec.Codec
+	nextSeq       uint64
+	unacked       []*outboundFrame
+	reconnecting  bool
+	closed        bool
+	failed        error
+	onGiveUp      func(err error)
+	ctx           context.Context
+	cancel        context.CancelFunc
+	lock          *sync.Mutex
 }
 
-func NewTCPClient(srcID string, dstID string, addr string, retryInterval time.Duration) (c *TCPClient, err error) {
-	var connection net.Conn
-	err = retry.Retry(0, retryInterval, func() error {
-		logger.Infof("node [%s] tries to connect to the server [%s] in [%s]", srcID, dstID, addr)
-		connection, err = net.DialTimeout("tcp", addr, time.Second*10)
-		if err != nil {
-			logger.Errorf("node [%s] failed to connect to the server [%s] in [%s], retry", srcID, dstID, addr)
-			return err
-		}
-		return nil
-	})
+// NewTCPClient dials addr every retryInterval until success, or until attempts is reached if attempts is not 0,
+// the connection is wrapped in tls if tlsConfig is not nil, it gives up dialing and reconnecting once ctx is done
+func NewTCPClient(ctx context.Context, srcID string, dstID string, addr string, retryInterval time.Duration, attempts int, tlsConfig *tls.Config) (c *TCPClient, err error) {
+	c = &TCPClient{
+		srcID:         srcID,
+		dstID:         dstID,
+		addr:          addr,
+		retryInterval: retryInterval,
+		tlsConfig:     tlsConfig,
+		session:       uuid.New().String(),
+		codec:         codec.JSON,
+		nextSeq:       1,
+		unacked:       []*outboundFrame{},
+		lock:          &sync.Mutex{},
+	}
+	c.ctx, c.cancel = context.WithCancel(ctx)
 
+	err = retry.RetryContext(c.ctx, attempts, retryInterval, c.connect)
 	if err != nil {
+		c.cancel()
 		return nil, err
 	}
+	return c, nil
+}
+
+// OnGiveUp registers f, which is called once the client gives up reconnecting
+func (c *TCPClient) OnGiveUp(f func(err error)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.onGiveUp = f
+}
+
+// connect dials and runs the session-resume handshake, then resends every frame the server did not receive
+func (c *TCPClient) connect() (err error) {
+	logger.Infof("node [%s] tries to connect to the server [%s] in [%s]", c.srcID, c.dstID, c.addr)
+	connection, err := net.DialTimeout("tcp", c.addr, time.Second*10)
+	if err != nil {
+		logger.Errorf("node [%s] failed to connect to the server [%s] in [%s], retry", c.srcID, c.dstID, c.addr)
+		return err
+	}
 
-	logger.Infof("node [%s] success connect to the server [%s] in [%s]", srcID, dstID, addr)
+	logger.Infof("node [%s] success connect to the server [%s] in [%s]", c.srcID, c.dstID, c.addr)
 	tcpConn := connection.(*net.TCPConn)
 
 	tcpConn.SetReadBuffer(5 * MB)
 	tcpConn.SetWriteBuffer(5 * MB)
 
-	hi, _ := types.NewHi(srcID).Encode()
-	hi = append(hi, '\n')
-	_, err = connection.Write(hi)
+	if c.tlsConfig != nil {
+		tlsConn := tls.Client(connection, c.tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(TLSHandshakeTimeout))
+		err = tlsConn.Handshake()
+		tlsConn.SetDeadline(time.Time{})
+		if err != nil {
+			connection.Close()
+			logger.Errorf("node [%s] tls handshake with [%s] failed: %v", c.srcID, c.dstID, err)
+			return errors.Wrap(err, "tls handshake failed")
+		}
+		connection = tlsConn
+	}
+
+	hi, _ := types.NewHi(c.srcID).WithSession(c.session).WithCodecs(codec.Offer(codec.Default())).Encode()
+	err = codec.WriteFrame(connection, hi)
 	if err != nil {
+		connection.Close()
 		errmsg := fmt.Sprintf("client lost connection, write handshake message error: %v", err)
 		logger.Error(errmsg)
-		return nil, fmt.Errorf(errmsg)
+		return fmt.Errorf(errmsg)
 	}
 
-	return &TCPClient{
-		srcID:         srcID,
-		dstID:         dstID,
-		addr:          addr,
-		retryInterval: retryInterval,
-		connection:    connection,
-	}, nil
+	reader := bufio.NewReader(connection)
+	connection.SetReadDeadline(time.Now().Add(time.Second * 10))
+	reply, err := codec.ReadFrame(reader)
+	connection.SetReadDeadline(time.Time{})
+	if err != nil {
+		connection.Close()
+		return errors.Wrap(err, "read handshake reply failed")
+	}
+	serverHi, err := (&types.Hi{}).Decode(reply)
+	if err != nil {
+		connection.Close()
+		return errors.Wrap(err, "decode handshake reply failed")
+	}
+	linkCodec := codec.JSON
+	if serverHi.Codec != "" {
+		linkCodec, err = codec.Lookup(serverHi.Codec)
+		if err != nil {
+			connection.Close()
+			return errors.Wrap(err, "negotiate codec failed")
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		connection.Close()
+		return nil
+	}
+
+	c.codec = linkCodec
+	if serverHi.UnknownSession {
+		c.restartSession()
+	}
+	c.ack(serverHi.LastReceived)
+	for _, frame := range c.unacked {
+		err = c.write(connection, frame)
+		if err != nil {
+			connection.Close()
+			return errors.Wrap(err, "resend unacknowledged frames failed")
+		}
+	}
+	if len(c.unacked) > 0 {
+		logger.Infof("node [%s] resend %d frames to [%s] from seq %d", c.srcID, len(c.unacked), c.dstID, c.unacked[0].seq)
+	}
+
+	c.connection = connection
+	c.reconnecting = false
+	go c.readAcks(reader, linkCodec)
+	return nil
+}
+
+// restartSession numbers the unacknowledged frames from seq 1 again, the server has no state of the session,
+// the frames it acknowledged before it restarted are lost with it. caller should hold lock
+func (c *TCPClient) restartSession() {
+	if len(c.unacked) > 0 && c.unacked[0].seq != 1 {
+		logger.Infof("server [%s] does not know session [%s], restart at seq 1", c.dstID, c.session)
+	}
+	for i, frame := range c.unacked {
+		frame.seq = uint64(i + 1)
+		frame.data = nil
+	}
+	c.nextSeq = uint64(len(c.unacked) + 1)
 }
 
-func (c *TCPClient) Send(msg []byte) (err error) {
-	msgCopy := make([]byte, len(msg))
-	copy(msgCopy, msg)
-	msgCopy = append(msgCopy, '\n')
-	// c.connection.SetWriteDeadline(time.Now().Add(time.Second * 100))
-	_, err = c.connection.Write(msgCopy)
+// ack drops every frame up to seq, caller should hold lock
+func (c *TCPClient) ack(seq uint64) {
+	i := 0
+	for i < len(c.unacked) && c.unacked[i].seq <= seq {
+		i++
+	}
+	c.unacked = c.unacked[i:]
+}
+
+func (c *TCPClient) readAcks(reader *bufio.Reader, linkCodec codec.Codec) {
+	for {
+		payload, err := codec.ReadFrame(reader)
+		if err != nil {
+			return
+		}
+		ack := &types.Ack{}
+		err = linkCodec.Unmarshal(payload, ack)
+		if err != nil {
+			logger.Errorf("decode ack from [%s] failed: %v", c.dstID, err)
+			continue
+		}
+		c.lock.Lock()
+		c.ack(ack.Seq)
+		c.lock.Unlock()
+	}
+}
+
+// write encodes frame with the codec of the link, caller should hold lock
+func (c *TCPClient) write(connection net.Conn, frame *outboundFrame) (err error) {
+	payload, err := frame.encode(c.codec)
 	if err != nil {
-		// if os.IsTimeout(err) {
-		// 	logger.Errorf("client send timeout: %v", err)
-		// 	return nil
-		// }
 		return err
 	}
+	connection.SetWriteDeadline(time.Now().Add(ClientWriteTimeout))
+	metrics.PeerSentBytes.Add(float64(len(payload)+codec.FrameHeaderSize), c.srcID, c.dstID)
+	metrics.PeerSentMessages.Inc(c.srcID, c.dstID)
+	return codec.WriteFrame(connection, payload)
+}
+
+// Send returns ErrReconnecting while the client reconnects, the frame is kept and resent once it is back
+func (c *TCPClient) Send(msg *BMsg) (err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return ErrClientClosed
+	}
+	if c.failed != nil {
+		return c.failed
+	}
+	if len(c.unacked) >= MaxUnackedFrames {
+		return ErrOutboundBufferFull
+	}
+
+	frame := &outboundFrame{
+		seq: c.nextSeq,
+		msg: msg,
+	}
+	_, err = frame.encode(c.codec)
+	if err != nil {
+		return errors.Wrap(err, "encode frame failed")
+	}
+	c.nextSeq++
+	c.unacked = append(c.unacked, frame)
+
+	if c.reconnecting {
+		return ErrReconnecting
+	}
+
+	err = c.write(c.connection, frame)
+	if err != nil {
+		logger.Errorf("client lost connection to [%s], write error: %v, reconnect", c.dstID, err)
+		c.connection.Close()
+		c.reconnecting = true
+		go c.reconnect()
+		return ErrReconnecting
+	}
 	return nil
 }
 
+func (c *TCPClient) reconnect() {
+	err := retry.RetryWithBackoffContext(c.ctx, ReconnectAttempts, ReconnectBaseBackoff, ReconnectMaxBackoff, c.connect)
+
+	c.lock.Lock()
+	if c.closed || c.ctx.Err() != nil {
+		c.lock.Unlock()
+		logger.Infof("node [%s] stop reconnecting to [%s], client is closed", c.srcID, c.dstID)
+		return
+	}
+	if err == nil {
+		c.lock.Unlock()
+		logger.Infof("node [%s] reconnected to [%s]", c.srcID, c.dstID)
+		return
+	}
+	c.reconnecting = false
+	c.failed = errors.Wrap(err, "reconnect failed")
+	onGiveUp := c.onGiveUp
+	c.lock.Unlock()
+
+	logger.Errorf("node [%s] give up reconnecting to [%s]: %v", c.srcID, c.dstID, err)
+	if onGiveUp != nil {
+		onGiveUp(err)
+	}
+}
+
 func (c *TCPClient) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.cancel()
+	if c.connection == nil {
+		return nil
+	}
 	return c.connection.Close()
 }
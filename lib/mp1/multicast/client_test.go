@@ -0,0 +1,108 @@
+package multicast
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+)
+
+type testServer struct {
+	paths []string
+	lock  sync.Mutex
+}
+
+func (s *testServer) deliver(msg *BMsg) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.paths = append(s.paths, msg.Path)
+	return nil
+}
+
+func (s *testServer) delivered() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.paths...)
+}
+
+func serveTest(t *testing.T, ctx context.Context, addr string) *testServer {
+	t.Helper()
+	socket, err := startServer("B", addr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := &testServer{}
+	go runServer(ctx, "B", socket, server.deliver, newSessionTable(), nil)
+	return server
+}
+
+func waitDelivered(server *testServer, n int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.delivered()) < n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return server.delivered()
+}
+
+func TestClientRestartsSessionWithRestartedServer(t *testing.T) {
+	firstCtx, stopFirst := context.WithCancel(context.Background())
+	socket, err := startServer("B", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := socket.Addr().String()
+	first := &testServer{}
+	go runServer(firstCtx, "B", socket, first.deliver, newSessionTable(), nil)
+
+	client, err := NewTCPClient(context.Background(), "A", "B", addr, 10*time.Millisecond, 0, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	for i := 1; i <= 3; i++ {
+		err = client.Send(&BMsg{SrcID: "A", Path: fmt.Sprintf("/%d", i)})
+		if err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+	if got := waitDelivered(first, 3); len(got) != 3 {
+		t.Fatalf("first server delivered %v, want 3 msgs", got)
+	}
+	time.Sleep(3 * AckInterval)
+
+	// the server restarts without the session, the client must not resume at seq 4
+	stopFirst()
+	time.Sleep(50 * time.Millisecond)
+	secondCtx, stopSecond := context.WithCancel(context.Background())
+	defer stopSecond()
+	second := serveTest(t, secondCtx, addr)
+
+	reconnecting := false
+	for i := 4; i <= 6; i++ {
+		err = client.Send(&BMsg{SrcID: "A", Path: fmt.Sprintf("/%d", i)})
+		if err == ErrReconnecting {
+			reconnecting = true
+			continue
+		}
+		if err != nil {
+			t.Fatalf("send: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !reconnecting {
+		t.Fatalf("send did not report the reconnection")
+	}
+	got := waitDelivered(second, 1)
+	if len(got) == 0 {
+		t.Fatalf("restarted server delivered nothing")
+	}
+	// whatever the first write after the restart lost, the rest arrives in order
+	want := []string{"/4", "/5", "/6"}
+	want = want[len(want)-len(got):]
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("restarted server delivered %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,275 @@
+package multicast
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"github.com/bamboovir/cs425/lib/codec"
+	errors "github.com/pkg/errors"
+)
+
+const (
+	HeartbeatPath = "/failure-detector/heartbeat"
+)
+
+type FailureDetectorMode string
+
+const (
+	FailureDetectorDisabled FailureDetectorMode = "none"
+	AllToAllMode            FailureDetectorMode = "all-to-all"
+	GossipMode              FailureDetectorMode = "gossip"
+)
+
+func ParseFailureDetectorMode(mode string) (FailureDetectorMode, error) {
+	switch FailureDetectorMode(mode) {
+	case FailureDetectorDisabled:
+		return FailureDetectorDisabled, nil
+	case AllToAllMode:
+		return AllToAllMode, nil
+	case GossipMode:
+		return GossipMode, nil
+	default:
+		return "", fmt.Errorf("unrecognized failure detector mode [%s]", mode)
+	}
+}
+
+// FailureDetectorConfig a member is suspected after SuspicionTimeout without a fresh heartbeat,
+// and confirmed dead and ejected after DeadTimeout
+type FailureDetectorConfig struct {
+	Mode             FailureDetectorMode
+	HeartbeatPeriod  time.Duration
+	SuspicionTimeout time.Duration
+	DeadTimeout      time.Duration
+	GossipFanout     int
+}
+
+func DefaultFailureDetectorConfig() *FailureDetectorConfig {
+	return &FailureDetectorConfig{
+		Mode:             FailureDetectorDisabled,
+		HeartbeatPeriod:  time.Second,
+		SuspicionTimeout: 3 * time.Second,
+		DeadTimeout:      NodeCrashTimeout,
+		GossipFanout:     3,
+	}
+}
+
+type HeartbeatMsg struct {
+	SrcID    string            `json:"src"`
+	Counters map[string]uint64 `json:"counters"`
+}
+
+func (m *HeartbeatMsg) Encode() (data []byte, err error) {
+	data, err = codec.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (m *HeartbeatMsg) Decode(data []byte) (msg *HeartbeatMsg, err error) {
+	err = codec.Unmarshal(data, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type heartbeatEntry struct {
+	counter    uint64
+	lastUpdate time.Time
+	suspected  bool
+}
+
+type FailureDetector struct {
+	bmulticast *BMulticast
+	config     *FailureDetectorConfig
+	counter    uint64
+	table      map[string]*heartbeatEntry
+	tableLock  *sync.Mutex
+}
+
+func NewFailureDetector(b *BMulticast, config *FailureDetectorConfig) *FailureDetector {
+	return &FailureDetector{
+		bmulticast: b,
+		config:     config,
+		counter:    0,
+		table:      map[string]*heartbeatEntry{},
+		tableLock:  &sync.Mutex{},
+	}
+}
+
+func (f *FailureDetector) selfNodeID() string {
+	return f.bmulticast.group.SelfNodeID
+}
+
+// heartbeatOf reports when the heartbeat counter of nodeID last increased, ok is false for a node the detector does not watch
+func (f *FailureDetector) heartbeatOf(nodeID string) (lastUpdate time.Time, suspected bool, ok bool) {
+	f.tableLock.Lock()
+	defer f.tableLock.Unlock()
+	entry, ok := f.table[nodeID]
+	if !ok {
+		return time.Time{}, false, false
+	}
+	return entry.lastUpdate, entry.suspected, true
+}
+
+func (f *FailureDetector) bindHeartbeat() {
+	f.bmulticast.Bind(HeartbeatPath, func(msg *BMsg) error {
+		heartbeatMsg := &HeartbeatMsg{}
+		_, err := heartbeatMsg.Decode(msg.Body)
+		if err != nil {
+			return errors.Wrap(err, "heartbeat failed")
+		}
+		f.merge(heartbeatMsg.Counters)
+		return nil
+	})
+}
+
+// merge refresh every entry whose heartbeat counter increased, the events are published once tableLock is released
+func (f *FailureDetector) merge(counters map[string]uint64) {
+	joined := make([]string, 0)
+	defer func() {
+		for _, nodeID := range joined {
+			f.bmulticast.PublishMemberEvent(NewMemberEvent(MemberJoin, nodeID, f.bmulticast.MemberCount()))
+		}
+	}()
+	f.tableLock.Lock()
+	defer f.tableLock.Unlock()
+
+	for nodeID, counter := range counters {
+		if nodeID == f.selfNodeID() {
+			continue
+		}
+		entry, ok := f.table[nodeID]
+		if !ok {
+			if !f.bmulticast.IsNodeAlived(nodeID) {
+				continue
+			}
+			f.table[nodeID] = &heartbeatEntry{
+				counter:    counter,
+				lastUpdate: time.Now(),
+				suspected:  false,
+			}
+			logger.Infof("failure detector observe node [%s] join", nodeID)
+			joined = append(joined, nodeID)
+			continue
+		}
+		if counter <= entry.counter {
+			continue
+		}
+		entry.counter = counter
+		entry.lastUpdate = time.Now()
+		if entry.suspected {
+			entry.suspected = false
+			logger.Infof("failure detector clear suspicion of node [%s]", nodeID)
+			joined = append(joined, nodeID)
+		}
+	}
+}
+
+func (f *FailureDetector) heartbeat() {
+	f.tableLock.Lock()
+	f.counter++
+	counters := map[string]uint64{f.selfNodeID(): f.counter}
+	if f.config.Mode == GossipMode {
+		for nodeID, entry := range f.table {
+			counters[nodeID] = entry.counter
+		}
+	}
+	f.tableLock.Unlock()
+
+	heartbeatMsg := &HeartbeatMsg{
+		SrcID:    f.selfNodeID(),
+		Counters: counters,
+	}
+
+	if f.config.Mode == AllToAllMode {
+		err := f.bmulticast.Multicast(HeartbeatPath, heartbeatMsg)
+		if err != nil {
+			logger.Errorf("multicast heartbeat failed: %v", err)
+		}
+		return
+	}
+
+	peers := make([]string, 0)
+	for _, nodeID := range f.bmulticast.MemberIDs() {
+		if nodeID != f.selfNodeID() {
+			peers = append(peers, nodeID)
+		}
+	}
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if len(peers) > f.config.GossipFanout {
+		peers = peers[:f.config.GossipFanout]
+	}
+	for _, nodeID := range peers {
+		err := f.bmulticast.Unicast(nodeID, HeartbeatPath, heartbeatMsg)
+		if err != nil {
+			logger.Errorf("gossip heartbeat to node [%s] failed: %v", nodeID, err)
+		}
+	}
+}
+
+func (f *FailureDetector) detect() {
+	f.tableLock.Lock()
+	dead := make([]string, 0)
+	suspected := make([]string, 0)
+	for nodeID, entry := range f.table {
+		if !f.bmulticast.IsNodeAlived(nodeID) {
+			delete(f.table, nodeID)
+			continue
+		}
+		silence := time.Since(entry.lastUpdate)
+		if silence > f.config.DeadTimeout {
+			delete(f.table, nodeID)
+			dead = append(dead, nodeID)
+			continue
+		}
+		if silence > f.config.SuspicionTimeout && !entry.suspected {
+			entry.suspected = true
+			logger.Infof("failure detector suspect node [%s], silent for %v", nodeID, silence)
+			suspected = append(suspected, nodeID)
+		}
+	}
+	f.tableLock.Unlock()
+
+	for _, nodeID := range suspected {
+		f.bmulticast.PublishMemberEvent(NewMemberEvent(MemberSuspect, nodeID, f.bmulticast.MemberCount()))
+	}
+	for _, nodeID := range dead {
+		logger.Infof("failure detector confirm node [%s] dead", nodeID)
+		f.bmulticast.EjectMember(nodeID)
+	}
+}
+
+func (f *FailureDetector) Start(ctx context.Context) {
+	f.tableLock.Lock()
+	for _, nodeID := range f.bmulticast.MemberIDs() {
+		if nodeID == f.selfNodeID() {
+			continue
+		}
+		f.table[nodeID] = &heartbeatEntry{
+			counter:    0,
+			lastUpdate: time.Now(),
+			suspected:  false,
+		}
+	}
+	f.tableLock.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(f.config.HeartbeatPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				f.heartbeat()
+				f.detect()
+			}
+		}
+	}()
+}
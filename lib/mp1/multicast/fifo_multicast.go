@@ -0,0 +1,211 @@
+package multicast
+
+import (
+	"context"
+	"time"
+
+	"github.com/bamboovir/cs425/lib/mp1/router"
+	sync "github.com/sasha-s/go-deadlock"
+
+	errors "github.com/pkg/errors"
+)
+
+const (
+	FIFOMulticastPath = "/fifo-multicast"
+)
+
+// fifoSender the delivery state of one incarnation of a sender, departed once it is dead or left,
+// then its held messages are purged and its late messages are dropped
+type fifoSender struct {
+	incarnation int64
+	delivered   uint64
+	holdback    map[uint64]*FIFOMsg
+	departed    bool
+}
+
+func newFIFOSender(incarnation int64) *fifoSender {
+	return &fifoSender{
+		incarnation: incarnation,
+		holdback:    map[uint64]*FIFOMsg{},
+	}
+}
+
+type FIFOMulticast struct {
+	rmulticast   *RMulticast
+	router       *router.Router
+	incarnation  int64
+	seqNum       uint64
+	seqNumLock   *sync.Mutex
+	senders      map[string]*fifoSender
+	holdbackLock *sync.Mutex
+	deliverLock  *sync.Mutex
+}
+
+func NewFIFOMulticast(r *RMulticast) *FIFOMulticast {
+	return &FIFOMulticast{
+		rmulticast:   r,
+		router:       NewProtocolRouter("fifo-multicast", (*FIFOMsg)(nil)),
+		incarnation:  time.Now().UnixNano(),
+		seqNum:       0,
+		seqNumLock:   &sync.Mutex{},
+		senders:      map[string]*fifoSender{},
+		holdbackLock: &sync.Mutex{},
+		deliverLock:  &sync.Mutex{},
+	}
+}
+
+func (f *FIFOMulticast) Bind(path string, h func(msg *FIFOMsg) error) {
+	f.router.Bind(path, func(v interface{}) error {
+		return h(v.(*FIFOMsg))
+	})
+}
+
+// Multicast holds seqNumLock until the message is r-multicast, the seq is only taken once it is sent,
+// so a failed send leaves no gap the receivers would wait for
+func (f *FIFOMulticast) Multicast(path string, v interface{}) (err error) {
+	fifomsg, err := NewFIFOMsg(f.rmulticast.bmulticast.group.SelfNodeID, f.incarnation, 0, path, v)
+	if err != nil {
+		return errors.Wrap(err, "fifo-multicast failed")
+	}
+
+	f.seqNumLock.Lock()
+	defer f.seqNumLock.Unlock()
+
+	fifomsg.Seq = f.seqNum + 1
+	err = f.rmulticast.Multicast(FIFOMulticastPath, fifomsg)
+	if err != nil {
+		return errors.Wrap(err, "fifo-multicast failed")
+	}
+	f.seqNum = fifomsg.Seq
+	return nil
+}
+
+// senderOf returns the state of the incarnation of the sender of fifomsg, nil if the message is of an older incarnation,
+// caller should hold holdbackLock
+func (f *FIFOMulticast) senderOf(fifomsg *FIFOMsg) *fifoSender {
+	sender, ok := f.senders[fifomsg.SrcID]
+	if ok && fifomsg.Incarnation < sender.incarnation {
+		return nil
+	}
+	if !ok || fifomsg.Incarnation > sender.incarnation {
+		if ok {
+			logger.Infof("node [%s] restarted, fifo seqs start over", fifomsg.SrcID)
+		}
+		sender = newFIFOSender(fifomsg.Incarnation)
+		f.senders[fifomsg.SrcID] = sender
+	}
+	return sender
+}
+
+// receive holds fifomsg back until every message its sender multicast before it is delivered.
+// The deliverable messages are collected under holdbackLock and handed to the handlers once it is released,
+// deliverLock keeps the handlers in the order the messages were collected
+func (f *FIFOMulticast) receive(fifomsg *FIFOMsg) {
+	f.deliverLock.Lock()
+	defer f.deliverLock.Unlock()
+
+	for _, msg := range f.hold(fifomsg) {
+		err := f.router.Run(msg.Path, msg)
+		if err != nil {
+			logger.Errorf("process err %v", err)
+		}
+	}
+}
+
+// hold adds fifomsg to the holdback of its sender and returns the messages that became deliverable, in seq order
+func (f *FIFOMulticast) hold(fifomsg *FIFOMsg) []*FIFOMsg {
+	f.holdbackLock.Lock()
+	defer f.holdbackLock.Unlock()
+
+	sender := f.senderOf(fifomsg)
+	if sender == nil {
+		logger.Infof("drop fifo msg [%s:%d] of a previous incarnation", fifomsg.SrcID, fifomsg.Seq)
+		return nil
+	}
+	if sender.departed {
+		logger.Infof("drop fifo msg [%s:%d] of a departed node", fifomsg.SrcID, fifomsg.Seq)
+		return nil
+	}
+	if fifomsg.Seq <= sender.delivered {
+		logger.Infof("drop duplicate fifo msg [%s:%d]", fifomsg.SrcID, fifomsg.Seq)
+		return nil
+	}
+	sender.holdback[fifomsg.Seq] = fifomsg
+
+	ready := []*FIFOMsg{}
+	for {
+		next, ok := sender.holdback[sender.delivered+1]
+		if !ok {
+			break
+		}
+		delete(sender.holdback, next.Seq)
+		sender.delivered = next.Seq
+		ready = append(ready, next)
+	}
+	return ready
+}
+
+// purge drops the held messages of a node that is dead or left, they wait for a message that will never come.
+// A node that is back before the purge is kept
+func (f *FIFOMulticast) purge(nodeID string) {
+	if f.rmulticast.bmulticast.IsNodeAlived(nodeID) {
+		return
+	}
+	f.holdbackLock.Lock()
+	defer f.holdbackLock.Unlock()
+	sender, ok := f.senders[nodeID]
+	if !ok || sender.departed {
+		return
+	}
+	logger.Infof("fifo-multicast purge %d held msgs of departed node [%s]", len(sender.holdback), nodeID)
+	sender.holdback = map[uint64]*FIFOMsg{}
+	sender.departed = true
+}
+
+func (f *FIFOMulticast) bindFIFODeliver() {
+	f.rmulticast.Bind(FIFOMulticastPath, func(msg *RMsg) error {
+		fifomsg := &FIFOMsg{}
+		_, err := fifomsg.Decode(msg.Body)
+		if err != nil {
+			return errors.Wrap(err, "fifo-deliver failed")
+		}
+		f.receive(fifomsg)
+		return nil
+	})
+}
+
+// lostSenders returns the senders this node is no longer connected to
+func (f *FIFOMulticast) lostSenders() []string {
+	f.holdbackLock.Lock()
+	defer f.holdbackLock.Unlock()
+	lost := []string{}
+	for nodeID, sender := range f.senders {
+		if sender.departed || nodeID == f.rmulticast.bmulticast.group.SelfNodeID {
+			continue
+		}
+		if !f.rmulticast.bmulticast.IsNodeAlived(nodeID) {
+			lost = append(lost, nodeID)
+		}
+	}
+	return lost
+}
+
+// watchMembers purges a lost sender after NodeCrashTimeout, so the relays of its last messages still reach the holdback
+func (f *FIFOMulticast) watchMembers(ctx context.Context, memberUpdateChannel chan interface{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-memberUpdateChannel:
+			for _, nodeID := range f.lostSenders() {
+				nodeID := nodeID
+				time.AfterFunc(NodeCrashTimeout, func() { f.purge(nodeID) })
+			}
+		}
+	}
+}
+
+func (f *FIFOMulticast) Start(ctx context.Context) {
+	memberUpdateChannel := f.rmulticast.bmulticast.MembersUpdate()
+	go f.watchMembers(ctx, memberUpdateChannel)
+}
@@ -0,0 +1,122 @@
+package multicast
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestFIFO(t *testing.T) (*FIFOMulticast, *[]uint64) {
+	t.Helper()
+	group := NewGroupBuilder().WithSelfNodeID("A").AddMember("A", "a").Build()
+	delivered := &[]uint64{}
+	group.FIFO().Bind("/test", func(msg *FIFOMsg) error {
+		*delivered = append(*delivered, msg.Seq)
+		return nil
+	})
+	return group.FIFO(), delivered
+}
+
+func newTestFIFOMsg(t *testing.T, srcID string, incarnation int64, seq uint64) *FIFOMsg {
+	t.Helper()
+	msg, err := NewFIFOMsg(srcID, incarnation, seq, "/test", seq)
+	if err != nil {
+		t.Fatalf("new fifo msg: %v", err)
+	}
+	return msg
+}
+
+func TestFIFOHoldsBackUntilGapIsFilled(t *testing.T) {
+	f, delivered := newTestFIFO(t)
+	for _, seq := range []uint64{3, 1, 4, 2, 2, 1} {
+		f.receive(newTestFIFOMsg(t, "B", 1, seq))
+	}
+	if want := []uint64{1, 2, 3, 4}; !reflect.DeepEqual(*delivered, want) {
+		t.Fatalf("delivered %v, want %v", *delivered, want)
+	}
+}
+
+func TestFIFOKeysSeqsByIncarnation(t *testing.T) {
+	f, delivered := newTestFIFO(t)
+	f.receive(newTestFIFOMsg(t, "B", 1, 1))
+	f.receive(newTestFIFOMsg(t, "B", 1, 2))
+	// B restarts, its seqs start over
+	f.receive(newTestFIFOMsg(t, "B", 2, 1))
+	// a late relay of the previous incarnation is dropped
+	f.receive(newTestFIFOMsg(t, "B", 1, 3))
+	f.receive(newTestFIFOMsg(t, "B", 2, 2))
+	if want := []uint64{1, 2, 1, 2}; !reflect.DeepEqual(*delivered, want) {
+		t.Fatalf("delivered %v, want %v", *delivered, want)
+	}
+}
+
+func TestFIFOPurgesDepartedSender(t *testing.T) {
+	f, delivered := newTestFIFO(t)
+	f.receive(newTestFIFOMsg(t, "B", 1, 1))
+	f.receive(newTestFIFOMsg(t, "B", 1, 3))
+	f.purge("B")
+	f.receive(newTestFIFOMsg(t, "B", 1, 2))
+	if want := []uint64{1}; !reflect.DeepEqual(*delivered, want) {
+		t.Fatalf("delivered %v, want %v", *delivered, want)
+	}
+	if held := len(f.senders["B"].holdback); held != 0 {
+		t.Fatalf("%d msgs held after purge, want 0", held)
+	}
+	// a new incarnation of B is delivered again
+	f.receive(newTestFIFOMsg(t, "B", 2, 1))
+	if want := []uint64{1, 1}; !reflect.DeepEqual(*delivered, want) {
+		t.Fatalf("delivered %v, want %v", *delivered, want)
+	}
+}
+
+func TestFIFODeliversOutsideHoldbackLock(t *testing.T) {
+	f, delivered := newTestFIFO(t)
+	// a handler that observes a lost sender takes holdbackLock
+	f.Bind("/purge", func(msg *FIFOMsg) error {
+		f.purge("C")
+		*delivered = append(*delivered, msg.Seq)
+		return nil
+	})
+	msg, err := NewFIFOMsg("B", 1, 1, "/purge", 1)
+	if err != nil {
+		t.Fatalf("new fifo msg: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		f.receive(msg)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("handler is run while holdbackLock is held")
+	}
+	if want := []uint64{1}; !reflect.DeepEqual(*delivered, want) {
+		t.Fatalf("delivered %v, want %v", *delivered, want)
+	}
+}
+
+func TestFIFOTakesSeqOnlyOnceSent(t *testing.T) {
+	// A has no send queue of its own, and the queue to B is full and drops
+	b, sender := newStalledGroup(t, SendQueueDrop)
+	f := b.group.FIFO()
+
+	err := f.Multicast("/test", "lost")
+	if err == nil {
+		t.Fatalf("fifo-multicast to a full queue succeeded")
+	}
+	if f.seqNum != 0 {
+		t.Fatalf("seq is %d after a failed send, want 0", f.seqNum)
+	}
+
+	sender.release <- struct{}{}
+	<-sender.sending
+	err = f.Multicast("/test", "sent")
+	if err != nil {
+		t.Fatalf("fifo-multicast: %v", err)
+	}
+	if f.seqNum != 1 {
+		t.Fatalf("seq is %d after the first sent msg, want 1", f.seqNum)
+	}
+}
@@ -0,0 +1,264 @@
+package multicast
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/bamboovir/cs425/lib/codec"
+	errors "github.com/pkg/errors"
+)
+
+const (
+	GossipDigestPath = "/r-multicast/digest"
+)
+
+// RMulticastMode decides how a first received message is relayed.
+// flood relays it to every member, push relays it to Fanout random members for Rounds hops,
+// push-pull also exchanges digests with one member every AntiEntropyPeriod, and each side pushes the messages the other misses
+type RMulticastMode string
+
+const (
+	FloodMode    RMulticastMode = "flood"
+	PushMode     RMulticastMode = "push"
+	PushPullMode RMulticastMode = "push-pull"
+)
+
+func ParseRMulticastMode(mode string) (RMulticastMode, error) {
+	switch RMulticastMode(mode) {
+	case FloodMode:
+		return FloodMode, nil
+	case PushMode:
+		return PushMode, nil
+	case PushPullMode:
+		return PushPullMode, nil
+	default:
+		return "", fmt.Errorf("unrecognized r-multicast mode [%s]", mode)
+	}
+}
+
+// RMulticastConfig push-pull keeps a message until it is stable at every member, or until History newer messages are kept
+type RMulticastConfig struct {
+	Mode              RMulticastMode
+	Fanout            int
+	Rounds            int
+	AntiEntropyPeriod time.Duration
+	History           int
+}
+
+func DefaultRMulticastConfig() *RMulticastConfig {
+	return &RMulticastConfig{
+		Mode:              FloodMode,
+		Fanout:            3,
+		Rounds:            3,
+		AntiEntropyPeriod: time.Second,
+		History:           4096,
+	}
+}
+
+// gossipHistoryItem a digest leaves out the messages received in the last period of anti-entropy
+type gossipHistoryItem struct {
+	msg        *RMsg
+	receivedAt time.Time
+}
+
+// GossipWatermark the seqs of an incarnation of Origin a member received, every seq up to Seq and the seqs in Above
+type GossipWatermark struct {
+	Origin      string   `json:"origin"`
+	Incarnation int64    `json:"incarnation"`
+	Seq         uint64   `json:"seq"`
+	Above       []uint64 `json:"above,omitempty"`
+}
+
+// GossipDigestMsg carries the watermarks of SrcID, the receiver pushes back the messages SrcID misses,
+// a digest that is not a reply is answered with the digest of the receiver
+type GossipDigestMsg struct {
+	SrcID      string             `json:"src"`
+	Watermarks []*GossipWatermark `json:"watermarks"`
+	Reply      bool               `json:"reply,omitempty"`
+}
+
+// remember keeps msg to push it to members that miss it, caller should hold receivedLock
+func (r *RMulticast) remember(msg *RMsg) {
+	if r.config.Mode != PushPullMode {
+		return
+	}
+	r.history = append(r.history, &gossipHistoryItem{msg: msg, receivedAt: time.Now()})
+	if len(r.history) > r.config.History {
+		r.history = r.history[1:]
+	}
+}
+
+// gossipPeers returns up to Fanout random members, except this node and excluded
+func (r *RMulticast) gossipPeers(excluded string) []string {
+	selfID := r.bmulticast.group.SelfNodeID
+	peers := make([]string, 0)
+	for _, nodeID := range r.bmulticast.MemberIDs() {
+		if nodeID == selfID || nodeID == excluded {
+			continue
+		}
+		peers = append(peers, nodeID)
+	}
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if len(peers) > r.config.Fanout {
+		peers = peers[:r.config.Fanout]
+	}
+	return peers
+}
+
+// relay sends a first received message on, the flood relay goes to every member,
+// the gossip relay goes to Fanout random members until the message made Rounds hops
+func (r *RMulticast) relay(srcID string, rmsg *RMsg) (err error) {
+	if r.config.Mode != FloodMode && rmsg.Hops >= r.config.Rounds {
+		return nil
+	}
+	rmsgCopy := rmsg.relayCopy()
+	rmsgCopy.Hops++
+
+	if r.config.Mode == FloodMode {
+		return r.bmulticast.Multicast(RMulticastPath, rmsgCopy)
+	}
+	for _, nodeID := range r.gossipPeers(srcID) {
+		err = r.bmulticast.Unicast(nodeID, RMulticastPath, rmsgCopy)
+		if err != nil {
+			logger.Errorf("gossip msg [%s] to node [%s] failed: %v", rmsg.ID, nodeID, err)
+		}
+	}
+	return nil
+}
+
+// digest returns the watermarks of every origin, the size of a digest does not grow with the message rate
+func (r *RMulticast) digest() []*GossipWatermark {
+	r.receivedLock.Lock()
+	defer r.receivedLock.Unlock()
+	watermarks := make([]*GossipWatermark, 0, len(r.watermarks))
+	for origin, w := range r.watermarks {
+		above := make([]uint64, 0, len(w.above))
+		for seq := range w.above {
+			above = append(above, seq)
+		}
+		sort.Slice(above, func(i, j int) bool { return above[i] < above[j] })
+		seq := w.contiguous
+		if !w.anchored {
+			seq = 0
+		}
+		watermarks = append(watermarks, &GossipWatermark{
+			Origin:      origin,
+			Incarnation: w.incarnation,
+			Seq:         seq,
+			Above:       above,
+		})
+	}
+	return watermarks
+}
+
+// missedBy returns the kept messages a member with the digest watermarks did not receive,
+// except the messages of the last period, their gossip relays are most likely still on the way
+func (r *RMulticast) missedBy(watermarks []*GossipWatermark) []*RMsg {
+	received := map[string]*originWatermark{}
+	for _, watermark := range watermarks {
+		w := newOriginWatermark(watermark.Incarnation, true)
+		w.contiguous = watermark.Seq
+		for _, seq := range watermark.Above {
+			w.above[seq] = struct{}{}
+		}
+		received[watermark.Origin] = w
+	}
+
+	until := time.Now().Add(-r.config.AntiEntropyPeriod)
+	r.receivedLock.Lock()
+	defer r.receivedLock.Unlock()
+	missed := make([]*RMsg, 0)
+	for _, item := range r.history {
+		if !item.receivedAt.Before(until) {
+			break
+		}
+		msg := item.msg
+		w, ok := received[msg.Origin]
+		if ok && (w.incarnation > msg.Incarnation || (w.incarnation == msg.Incarnation && w.contains(msg.Seq))) {
+			continue
+		}
+		missed = append(missed, msg)
+	}
+	return missed
+}
+
+// nextAntiEntropyPeer walks the members round robin, so every pair of correct members exchanges digests
+func (r *RMulticast) nextAntiEntropyPeer() (string, bool) {
+	selfID := r.bmulticast.group.SelfNodeID
+	peers := make([]string, 0)
+	for _, nodeID := range r.bmulticast.MemberIDs() {
+		if nodeID != selfID {
+			peers = append(peers, nodeID)
+		}
+	}
+	if len(peers) == 0 {
+		return "", false
+	}
+	r.antiEntropyRound++
+	return peers[r.antiEntropyRound%len(peers)], true
+}
+
+func (r *RMulticast) antiEntropy(ctx context.Context) {
+	ticker := time.NewTicker(r.config.AntiEntropyPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			nodeID, ok := r.nextAntiEntropyPeer()
+			if !ok {
+				continue
+			}
+			digestMsg := &GossipDigestMsg{
+				SrcID:      r.bmulticast.group.SelfNodeID,
+				Watermarks: r.digest(),
+			}
+			err := r.bmulticast.Unicast(nodeID, GossipDigestPath, digestMsg)
+			if err != nil {
+				logger.Errorf("send digest to node [%s] failed: %v", nodeID, err)
+			}
+		}
+	}
+}
+
+func (r *RMulticast) bindAntiEntropy() {
+	r.bmulticast.Bind(GossipDigestPath, func(msg *BMsg) error {
+		digestMsg := &GossipDigestMsg{}
+		err := codec.Unmarshal(msg.Body, digestMsg)
+		if err != nil {
+			return errors.Wrap(err, "gossip-digest failed")
+		}
+
+		missed := r.missedBy(digestMsg.Watermarks)
+		if len(missed) > 0 {
+			logger.Infof("push %d msgs node [%s] missed", len(missed), digestMsg.SrcID)
+		}
+		for _, rmsg := range missed {
+			// a pushed message has made its rounds, the receiver does not relay it again
+			rmsgCopy := rmsg.relayCopy()
+			rmsgCopy.Hops = r.config.Rounds
+			err = r.bmulticast.Unicast(digestMsg.SrcID, RMulticastPath, rmsgCopy)
+			if err != nil {
+				return errors.Wrap(err, "gossip-digest failed")
+			}
+		}
+
+		if digestMsg.Reply {
+			return nil
+		}
+		replyMsg := &GossipDigestMsg{
+			SrcID:      r.bmulticast.group.SelfNodeID,
+			Watermarks: r.digest(),
+			Reply:      true,
+		}
+		err = r.bmulticast.Unicast(digestMsg.SrcID, GossipDigestPath, replyMsg)
+		if err != nil {
+			return errors.Wrap(err, "gossip-digest failed")
+		}
+		return nil
+	})
+}
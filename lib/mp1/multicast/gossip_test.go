@@ -0,0 +1,179 @@
+package multicast_test
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bamboovir/cs425/lib/memnet"
+	"github.com/bamboovir/cs425/lib/mp1/multicast"
+)
+
+var gossipNodeIDs = []string{"A", "B", "C", "D", "E", "F", "G", "H"}
+
+func startGossipGroups(t *testing.T, network *memnet.Network, config *multicast.RMulticastConfig, d *deliveries) map[string]*multicast.Group {
+	t.Helper()
+	return startMemnetGroupsOf(t, network, gossipNodeIDs, func(b *multicast.GroupBuilder) {
+		b.WithRMulticast(config)
+	}, func(nodeID string, g *multicast.Group) {
+		g.R().Bind("/test", func(msg *multicast.RMsg) error { return d.record(nodeID, msg.Body) })
+	})
+}
+
+// relayCounter counts the r-multicast msgs the members send, the initial b-multicast and the relays
+type relayCounter struct {
+	*memnet.Network
+	sent *uint64
+}
+
+func (c relayCounter) Dial(ctx context.Context, srcID string, dstID string, addr string, retryInterval time.Duration, attempts int) (multicast.Sender, error) {
+	sender, err := c.Network.Dial(ctx, srcID, dstID, addr, retryInterval, attempts)
+	if err != nil {
+		return nil, err
+	}
+	return countingSender{Sender: sender, sent: c.sent}, nil
+}
+
+type countingSender struct {
+	multicast.Sender
+	sent *uint64
+}
+
+func (s countingSender) Send(msg *multicast.BMsg) error {
+	if msg.Path == multicast.RMulticastPath {
+		atomic.AddUint64(s.sent, 1)
+	}
+	return s.Sender.Send(msg)
+}
+
+// settled waits until the count of sent did not change for a while, and returns it
+func settled(sent *uint64) uint64 {
+	count := atomic.LoadUint64(sent)
+	for {
+		time.Sleep(50 * time.Millisecond)
+		next := atomic.LoadUint64(sent)
+		if next == count {
+			return count
+		}
+		count = next
+	}
+}
+
+// multicastFrom A r-multicasts n msgs, each once the previous one reached every member that is not partitioned away
+func multicastFrom(t *testing.T, groups map[string]*multicast.Group, d *deliveries, reached []string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		err := groups["A"].R().Multicast("/test", fmt.Sprintf("m%d", i))
+		if err != nil {
+			t.Fatalf("r-multicast: %v", err)
+		}
+		d.waitOn(t, reached, i+1)
+	}
+}
+
+func TestPushRelaysToFanoutMembers(t *testing.T) {
+	network := memnet.New(&memnet.Config{Seed: 7, MaxDelay: time.Millisecond})
+	d := newDeliveries()
+	config := &multicast.RMulticastConfig{Mode: multicast.PushMode, Fanout: 2, Rounds: 3, AntiEntropyPeriod: time.Hour, History: 16}
+	counter := relayCounter{Network: network, sent: new(uint64)}
+	groups := startMemnetGroupsOf(t, network, gossipNodeIDs, func(b *multicast.GroupBuilder) {
+		b.WithRMulticast(config).WithTransport(counter)
+	}, func(nodeID string, g *multicast.Group) {
+		g.R().Bind("/test", func(msg *multicast.RMsg) error { return d.record(nodeID, msg.Body) })
+	})
+
+	err := groups["A"].R().Multicast("/test", "m0")
+	if err != nil {
+		t.Fatalf("r-multicast: %v", err)
+	}
+	d.waitOn(t, gossipNodeIDs, 1)
+	sent := settled(counter.sent)
+
+	// the b-multicast of A reaches every member, then every member relays its first copy to Fanout members
+	members := uint64(len(gossipNodeIDs))
+	if max := members + members*uint64(config.Fanout); sent <= members || sent > max {
+		t.Fatalf("one r-multicast sent %d msgs, want more than %d and at most %d", sent, members, max)
+	}
+	for _, nodeID := range gossipNodeIDs {
+		if got := d.of(nodeID); len(got) != 1 {
+			t.Fatalf("node [%s] r-delivered %v, want m0 once", nodeID, got)
+		}
+	}
+}
+
+func TestPushPullConvergesUnderLoss(t *testing.T) {
+	network := memnet.New(&memnet.Config{Seed: 8, MaxDelay: time.Millisecond, DropRate: 0.2})
+	d := newDeliveries()
+	config := &multicast.RMulticastConfig{Mode: multicast.PushPullMode, Fanout: 2, Rounds: 2, AntiEntropyPeriod: 20 * time.Millisecond, History: 64}
+	groups := startGossipGroups(t, network, config, d)
+
+	for i := 0; i < 20; i++ {
+		err := groups[gossipNodeIDs[i%len(gossipNodeIDs)]].R().Multicast("/test", fmt.Sprintf("m%d", i))
+		if err != nil {
+			t.Fatalf("r-multicast: %v", err)
+		}
+	}
+	d.waitOn(t, gossipNodeIDs, 20)
+	time.Sleep(100 * time.Millisecond)
+	if stats := network.Stats(); stats.Dropped == 0 {
+		t.Fatalf("no drop drawn in %+v", stats)
+	}
+	for _, nodeID := range gossipNodeIDs {
+		if got := d.of(nodeID); len(got) != 20 {
+			t.Fatalf("node [%s] r-delivered %d msgs, want 20", nodeID, len(got))
+		}
+	}
+}
+
+func testAntiEntropyAfterPartition(t *testing.T, mode multicast.RMulticastMode, history int) (*deliveries, *multicast.RMulticastConfig) {
+	t.Helper()
+	network := memnet.New(&memnet.Config{Seed: 9, MaxDelay: time.Millisecond})
+	d := newDeliveries()
+	config := &multicast.RMulticastConfig{Mode: mode, Fanout: 2, Rounds: 3, AntiEntropyPeriod: 20 * time.Millisecond, History: history}
+	groups := startGossipGroups(t, network, config, d)
+
+	network.Partition([]string{"H"})
+	multicastFrom(t, groups, d, gossipNodeIDs[:len(gossipNodeIDs)-1], 10)
+	if got := d.of("H"); len(got) != 0 {
+		t.Fatalf("partitioned node [H] r-delivered %v", got)
+	}
+	network.Heal()
+	return d, config
+}
+
+func TestPushDoesNotRepairPartitionedMember(t *testing.T) {
+	d, config := testAntiEntropyAfterPartition(t, multicast.PushMode, 64)
+	time.Sleep(20 * config.AntiEntropyPeriod)
+	if got := d.of("H"); len(got) != 0 {
+		t.Fatalf("node [H] r-delivered %v without anti-entropy", got)
+	}
+}
+
+func TestAntiEntropyRepairsPartitionedMember(t *testing.T) {
+	d, _ := testAntiEntropyAfterPartition(t, multicast.PushPullMode, 64)
+	eventually(t, 10*time.Second, func() bool {
+		return len(d.of("H")) == 10
+	}, "node [H] r-delivered %v after the partition healed, want all 10 msgs", d.of("H"))
+}
+
+func TestAntiEntropyHistoryIsBounded(t *testing.T) {
+	d, config := testAntiEntropyAfterPartition(t, multicast.PushPullMode, 4)
+	// every member kept only the newest History msgs, the older ones H missed are gone
+	eventually(t, 10*time.Second, func() bool {
+		return len(d.of("H")) >= config.History
+	}, "node [H] r-delivered %v after the partition healed, want the newest %d msgs", d.of("H"), config.History)
+	time.Sleep(20 * config.AntiEntropyPeriod)
+	got := d.of("H")
+	if len(got) != config.History {
+		t.Fatalf("node [H] r-delivered %v after the partition healed, want the newest %d msgs", got, config.History)
+	}
+	for _, value := range got {
+		i := 0
+		fmt.Sscanf(value, "m%d", &i)
+		if i < 10-config.History {
+			t.Fatalf("node [H] r-delivered %s, older than the newest %d msgs", value, config.History)
+		}
+	}
+}
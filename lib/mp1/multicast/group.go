@@ -2,22 +2,39 @@ package multicast
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"time"
 
 	sync "github.com/sasha-s/go-deadlock"
 )
 
 type Node struct {
-	ID   string
-	Addr string
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
 }
+
 type Group struct {
-	members      []Node
-	membersLock  *sync.Mutex
-	SelfNodeID   string
-	SelfNodeAddr string
-	bmulticast   *BMulticast
-	rmulticast   *RMulticast
-	totalOrder   *TotalOrding
+	members         []Node
+	membersLock     *sync.Mutex
+	SelfNodeID      string
+	SelfNodeAddr    string
+	AdvertiseAddr   string
+	bmulticast      *BMulticast
+	rmulticast      *RMulticast
+	fifo            *FIFOMulticast
+	causal          *CausalMulticast
+	totalOrder      TotalOrderStrategy
+	rpc             *RPC
+	detector        *FailureDetector
+	membership      *Membership
+	catchUp         *catchUp
+	joining         bool
+	tlsConfig       *TLSConfig
+	sendQueueConfig *SendQueueConfig
+	admission       *Admission
+	batchConfig     *BatchConfig
+	transport       Transport
 }
 
 func (g *Group) B() *BMulticast {
@@ -28,10 +45,153 @@ func (g *Group) R() *RMulticast {
 	return g.rmulticast
 }
 
-func (g *Group) TO() *TotalOrding {
+func (g *Group) FIFO() *FIFOMulticast {
+	return g.fifo
+}
+
+func (g *Group) CO() *CausalMulticast {
+	return g.causal
+}
+
+func (g *Group) TO() TotalOrderStrategy {
 	return g.totalOrder
 }
 
+func (g *Group) RPC() *RPC {
+	return g.rpc
+}
+
+func (g *Group) Admission() *Admission {
+	return g.admission
+}
+
+// advertiseAddr is the address other members dial, it falls back to the listen address
+func (g *Group) advertiseAddr() string {
+	if g.AdvertiseAddr != "" {
+		return g.AdvertiseAddr
+	}
+	return g.SelfNodeAddr
+}
+
+func (g *Group) View() *View {
+	return g.membership.View()
+}
+
+// MemberLiveness Alive is whether this node still sends to the member, the heartbeat fields are only set with a failure detector
+type MemberLiveness struct {
+	ID                  string `json:"id"`
+	Addr                string `json:"addr"`
+	Self                bool   `json:"self"`
+	Alive               bool   `json:"alive"`
+	Suspected           bool   `json:"suspected"`
+	SinceHeartbeatNanos int64  `json:"since_heartbeat_nanos,omitempty"`
+}
+
+// Liveness returns the members of the view and the members this node is connected to, sorted by node id
+func (g *Group) Liveness() []*MemberLiveness {
+	members := map[string]*MemberLiveness{}
+	for _, node := range g.View().Members {
+		members[node.ID] = &MemberLiveness{ID: node.ID, Addr: node.Addr}
+	}
+	for _, nodeID := range g.bmulticast.MemberIDs() {
+		if _, ok := members[nodeID]; !ok {
+			members[nodeID] = &MemberLiveness{ID: nodeID}
+		}
+		members[nodeID].Alive = true
+	}
+
+	liveness := make([]*MemberLiveness, 0, len(members))
+	for nodeID, member := range members {
+		member.Self = nodeID == g.SelfNodeID
+		if g.detector != nil {
+			lastUpdate, suspected, ok := g.detector.heartbeatOf(nodeID)
+			if ok {
+				member.Suspected = suspected
+				member.SinceHeartbeatNanos = time.Since(lastUpdate).Nanoseconds()
+			}
+		}
+		liveness = append(liveness, member)
+	}
+	sort.Slice(liveness, func(i, j int) bool {
+		return liveness[i].ID < liveness[j].ID
+	})
+	return liveness
+}
+
+// SetStateMachine registers the application state that is transferred to joining members
+func (g *Group) SetStateMachine(stateMachine StateMachine) {
+	g.membership.stateMachine = stateMachine
+}
+
+// Leave announces the departure of this node, it returns once every member is told to install the new view
+func (g *Group) Leave(ctx context.Context) (err error) {
+	return g.membership.leave(ctx)
+}
+
+// Left is closed once this node installs the view without itself, after Leave or once another member ejected it
+func (g *Group) Left() <-chan struct{} {
+	return g.membership.leftCh
+}
+
+// Ejected returns ErrEjected once Left is closed if another member ejected this node, nil if it left by itself
+func (g *Group) Ejected() error {
+	select {
+	case <-g.membership.leftCh:
+		return g.membership.ejected
+	default:
+		return nil
+	}
+}
+
+// Drain waits until the TO messages multicast by this node are delivered, so a node that stops reading its input
+// can leave without taking its in-flight messages with it. A strategy without admission control has nothing to drain
+func (g *Group) Drain(ctx context.Context) (err error) {
+	return g.admission.Drain(ctx)
+}
+
+// Done is closed once the context of Start is done and this node has closed the connections to its peers
+func (g *Group) Done() <-chan struct{} {
+	return g.bmulticast.Done()
+}
+
+// Eject removes another member from the group, every member installs the view without it once the view change is TO-delivered.
+// A member found dead is ejected the same way once the crash timeout passed
+func (g *Group) Eject(nodeID string) (err error) {
+	if nodeID == g.SelfNodeID {
+		return fmt.Errorf("node [%s] can not eject itself, it leaves the group instead", nodeID)
+	}
+	return g.membership.eject(context.Background(), nodeID)
+}
+
 func (g *Group) Start(ctx context.Context) (err error) {
-	return g.totalOrder.Start(ctx)
+	g.membership.bindMembership()
+	if g.joining {
+		transferable, err := g.membership.transferable()
+		if err != nil {
+			return err
+		}
+		transferable.pauseDelivery()
+	}
+	g.fifo.bindFIFODeliver()
+	g.causal.bindCODeliver()
+	g.rpc.bindRPC()
+	if g.detector != nil {
+		g.detector.bindHeartbeat()
+	}
+	g.admission.Start(ctx)
+	err = g.totalOrder.Start(ctx)
+	if err != nil {
+		return err
+	}
+	g.membership.Start(ctx)
+	g.fifo.Start(ctx)
+	g.causal.Start(ctx)
+	g.rpc.Start(ctx)
+	if g.detector != nil {
+		g.detector.Start(ctx)
+	}
+	if g.joining {
+		return g.membership.join(ctx)
+	}
+	return nil
 }
@@ -5,14 +5,27 @@ import (
 )
 
 type GroupBuilder struct {
-	SelfNodeID   string
-	SelfNodeAddr string
-	Memebers     []Node
+	SelfNodeID         string
+	SelfNodeAddr       string
+	AdvertiseAddr      string
+	Memebers           []Node
+	TotalOrderStrategy TotalOrderStrategyKind
+	SequencerID        string
+	FailureDetector    *FailureDetectorConfig
+	Join               bool
+	TLS                *TLSConfig
+	TotalOrderFactory  TotalOrderFactory
+	SendQueue          *SendQueueConfig
+	Admission          *AdmissionConfig
+	RMulticast         *RMulticastConfig
+	Batch              *BatchConfig
+	Transport          Transport
 }
 
 func NewGroupBuilder() *GroupBuilder {
 	return &GroupBuilder{
-		Memebers: make([]Node, 0),
+		Memebers:           make([]Node, 0),
+		TotalOrderStrategy: ISISStrategy,
 	}
 }
 
@@ -26,6 +39,11 @@ func (g *GroupBuilder) WithSelfNodeAddr(selfNodeAddr string) *GroupBuilder {
 	return g
 }
 
+func (g *GroupBuilder) WithAdvertiseAddr(advertiseAddr string) *GroupBuilder {
+	g.AdvertiseAddr = advertiseAddr
+	return g
+}
+
 func (g *GroupBuilder) AddMember(id string, addr string) *GroupBuilder {
 	g.Memebers = append(g.Memebers, Node{ID: id, Addr: addr})
 	return g
@@ -36,15 +54,101 @@ func (g *GroupBuilder) WithMembers(members []Node) *GroupBuilder {
 	return g
 }
 
+func (g *GroupBuilder) WithTotalOrderStrategy(strategy TotalOrderStrategyKind) *GroupBuilder {
+	g.TotalOrderStrategy = strategy
+	return g
+}
+
+// WithSequencer fixes the sequencer node of the sequencer strategy, an empty id elects the sequencer
+func (g *GroupBuilder) WithSequencer(sequencerID string) *GroupBuilder {
+	g.SequencerID = sequencerID
+	return g
+}
+
+func (g *GroupBuilder) WithFailureDetector(config *FailureDetectorConfig) *GroupBuilder {
+	g.FailureDetector = config
+	return g
+}
+
+// WithJoin makes the node join a running group, the members are asked to sponsor it instead of starting a new group
+func (g *GroupBuilder) WithJoin(join bool) *GroupBuilder {
+	g.Join = join
+	return g
+}
+
+// WithTotalOrderFactory overrides the total order strategy kind with a strategy built by factory
+func (g *GroupBuilder) WithTotalOrderFactory(factory TotalOrderFactory) *GroupBuilder {
+	g.TotalOrderFactory = factory
+	return g
+}
+
+// WithTLS enables mutual tls on every connection, a nil config keeps plain tcp
+func (g *GroupBuilder) WithTLS(config *TLSConfig) *GroupBuilder {
+	g.TLS = config
+	return g
+}
+
+// WithSendQueue sizes the send queue of every peer and sets what a send does once it is full
+func (g *GroupBuilder) WithSendQueue(config *SendQueueConfig) *GroupBuilder {
+	g.SendQueue = config
+	return g
+}
+
+// WithAdmission caps the in-flight TO messages, a TO multicast waits once a cap is reached
+func (g *GroupBuilder) WithAdmission(config *AdmissionConfig) *GroupBuilder {
+	g.Admission = config
+	return g
+}
+
+// WithRMulticast sets how r-multicast relays a message, a nil config floods every member
+func (g *GroupBuilder) WithRMulticast(config *RMulticastConfig) *GroupBuilder {
+	g.RMulticast = config
+	return g
+}
+
+// WithBatch batches the isis asks, replies and announces, a nil config sends every message on its own
+func (g *GroupBuilder) WithBatch(config *BatchConfig) *GroupBuilder {
+	g.Batch = config
+	return g
+}
+
+// WithTransport replaces the tcp transport, a nil transport keeps tcp
+func (g *GroupBuilder) WithTransport(transport Transport) *GroupBuilder {
+	g.Transport = transport
+	return g
+}
+
 func (g *GroupBuilder) Build() *Group {
 	group := &Group{
-		SelfNodeID:   g.SelfNodeID,
-		SelfNodeAddr: g.SelfNodeAddr,
-		members:      g.Memebers,
-		membersLock:  &sync.Mutex{},
+		SelfNodeID:      g.SelfNodeID,
+		SelfNodeAddr:    g.SelfNodeAddr,
+		AdvertiseAddr:   g.AdvertiseAddr,
+		members:         g.Memebers,
+		membersLock:     &sync.Mutex{},
+		joining:         g.Join,
+		tlsConfig:       g.TLS,
+		sendQueueConfig: g.SendQueue,
+		batchConfig:     g.Batch,
+		transport:       g.Transport,
 	}
+	group.admission = NewAdmission(g.SelfNodeID, g.Admission)
 	group.bmulticast = NewBMulticast(group)
-	group.rmulticast = NewRMulticast(group.bmulticast)
-	group.totalOrder = NewTotalOrder(group.bmulticast, group.rmulticast)
+	group.rmulticast = NewRMulticast(group.bmulticast, g.RMulticast)
+	if g.FailureDetector != nil && g.FailureDetector.Mode != FailureDetectorDisabled {
+		group.detector = NewFailureDetector(group.bmulticast, g.FailureDetector)
+	}
+	group.membership = NewMembership(group)
+	group.catchUp = newCatchUp(group.bmulticast)
+	group.fifo = NewFIFOMulticast(group.rmulticast)
+	group.causal = NewCausalMulticast(group.rmulticast)
+	group.rpc = NewRPC(group.bmulticast)
+	switch {
+	case g.TotalOrderFactory != nil:
+		group.totalOrder = g.TotalOrderFactory(group.bmulticast, group.rmulticast)
+	case g.TotalOrderStrategy == SequencerStrategy:
+		group.totalOrder = NewSequencerTotalOrder(group.bmulticast, group.rmulticast, g.SequencerID)
+	default:
+		group.totalOrder = NewTotalOrder(group.bmulticast, group.rmulticast)
+	}
 	return group
 }
@@ -0,0 +1,25 @@
+package multicast
+
+type MemberEventType string
+
+const (
+	MemberJoin    MemberEventType = "join"
+	MemberSuspect MemberEventType = "suspect"
+	MemberDead    MemberEventType = "dead"
+	MemberLeave   MemberEventType = "leave"
+)
+
+// MemberEvent is published on BMulticast.MembersUpdate whenever the liveness of a member changes
+type MemberEvent struct {
+	Type         MemberEventType
+	NodeID       string
+	MembersCount int
+}
+
+func NewMemberEvent(eventType MemberEventType, nodeID string, membersCount int) *MemberEvent {
+	return &MemberEvent{
+		Type:         eventType,
+		NodeID:       nodeID,
+		MembersCount: membersCount,
+	}
+}
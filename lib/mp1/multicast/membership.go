@@ -0,0 +1,491 @@
+package multicast
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"github.com/bamboovir/cs425/lib/codec"
+	errors "github.com/pkg/errors"
+)
+
+const (
+	JoinRequestPath   = "/membership/join-request"
+	ViewChangePath    = "/membership/view-change"
+	StateTransferPath = "/membership/state-transfer"
+)
+
+const (
+	JoinCatchUpWindow  = 2 * NodeCrashTimeout
+	JoinTimeout        = 30 * time.Second
+	JoinConnectRetries = 3
+)
+
+var (
+	ErrEjected = errors.New("ejected from the group")
+)
+
+type ViewChangeType string
+
+const (
+	ViewJoin  ViewChangeType = "join"
+	ViewLeave ViewChangeType = "leave"
+)
+
+type View struct {
+	ID      uint64 `json:"id"`
+	Members []Node `json:"members"`
+	// JoinedIn the view every member that joined after the initial view was admitted in
+	JoinedIn map[string]uint64 `json:"joined_in,omitempty"`
+}
+
+func (v *View) Copy() *View {
+	members := make([]Node, len(v.Members))
+	copy(members, v.Members)
+	joinedIn := make(map[string]uint64, len(v.JoinedIn))
+	for nodeID, viewID := range v.JoinedIn {
+		joinedIn[nodeID] = viewID
+	}
+	return &View{
+		ID:       v.ID,
+		Members:  members,
+		JoinedIn: joinedIn,
+	}
+}
+
+func (v *View) Contains(nodeID string) bool {
+	for _, member := range v.Members {
+		if member.ID == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *View) Member(nodeID string) (Node, bool) {
+	for _, member := range v.Members {
+		if member.ID == nodeID {
+			return member, true
+		}
+	}
+	return Node{}, false
+}
+
+// without returns the members other than nodeID
+func (v *View) without(nodeID string) []Node {
+	members := make([]Node, 0, len(v.Members))
+	for _, member := range v.Members {
+		if member.ID != nodeID {
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+func (v *View) String() string {
+	return fmt.Sprintf("view [%d] %v", v.ID, v.Members)
+}
+
+// StateMachine is the application state a joining member receives from its sponsor
+type StateMachine interface {
+	Snapshot() ([]byte, error)
+	Restore(data []byte) error
+}
+
+// stateTransferable is implemented by total order strategies that can hand their delivery state to a joining member
+type stateTransferable interface {
+	snapshotDeliveryState() ([]byte, error)
+	restoreDeliveryState(data []byte) error
+	pauseDelivery()
+}
+
+type JoinRequestMsg struct {
+	Node Node `json:"node"`
+}
+
+type ViewChangeMsg struct {
+	Type      ViewChangeType `json:"type"`
+	Node      Node           `json:"node"`
+	SponsorID string         `json:"sponsor"`
+	// Rejoin a join that replaces the member of the same id, the sponsor lost the previous incarnation of it
+	Rejoin bool `json:"rejoin,omitempty"`
+	// ViewID the view a leave is decided in, the leave is stale if the member joined again since
+	ViewID uint64 `json:"view_id,omitempty"`
+}
+
+func (m *ViewChangeMsg) Decode(data []byte) (msg *ViewChangeMsg, err error) {
+	err = codec.Unmarshal(data, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type StateTransferMsg struct {
+	View          *View  `json:"view"`
+	AppState      []byte `json:"app_state"`
+	DeliveryState []byte `json:"delivery_state"`
+}
+
+// Membership installs numbered views, every view change is TO-multicast,
+// so all members install the same views in the same order relative to TO-delivered messages
+type Membership struct {
+	group           *Group
+	stateMachine    StateMachine
+	view            *View
+	viewLock        *sync.Mutex
+	stateTransferCh chan *StateTransferMsg
+	leftCh          chan struct{}
+	leftOnce        *sync.Once
+	// ejected is set before leftCh is closed, nil if this node left by itself
+	ejected error
+}
+
+func NewMembership(group *Group) *Membership {
+	members := make([]Node, len(group.members))
+	copy(members, group.members)
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+
+	return &Membership{
+		group: group,
+		view: &View{
+			ID:       0,
+			Members:  members,
+			JoinedIn: map[string]uint64{},
+		},
+		viewLock:        &sync.Mutex{},
+		stateTransferCh: make(chan *StateTransferMsg, 1),
+		leftCh:          make(chan struct{}),
+		leftOnce:        &sync.Once{},
+	}
+}
+
+func (m *Membership) View() *View {
+	m.viewLock.Lock()
+	defer m.viewLock.Unlock()
+	return m.view.Copy()
+}
+
+func (m *Membership) transferable() (stateTransferable, error) {
+	transferable, ok := m.group.totalOrder.(stateTransferable)
+	if !ok {
+		return nil, fmt.Errorf("total order strategy does not support state transfer")
+	}
+	return transferable, nil
+}
+
+func (m *Membership) bindMembership() {
+	b := m.group.bmulticast
+	m.group.admission.Exempt(ViewChangePath)
+
+	b.Bind(JoinRequestPath, func(msg *BMsg) error {
+		joinRequestMsg := &JoinRequestMsg{}
+		err := codec.Unmarshal(msg.Body, joinRequestMsg)
+		if err != nil {
+			return errors.Wrap(err, "join-request failed")
+		}
+
+		logger.Infof("node [%s] in [%s] asks to join group", joinRequestMsg.Node.ID, joinRequestMsg.Node.Addr)
+		viewChangeMsg := &ViewChangeMsg{
+			Type:      ViewJoin,
+			Node:      joinRequestMsg.Node,
+			SponsorID: m.group.SelfNodeID,
+			// a member that crashed and restarted before its leave was installed
+			Rejoin: m.View().Contains(joinRequestMsg.Node.ID) && !b.IsNodeAlived(joinRequestMsg.Node.ID),
+		}
+		err = m.group.totalOrder.Multicast(ViewChangePath, viewChangeMsg)
+		if err != nil {
+			return errors.Wrap(err, "join-request failed")
+		}
+		return nil
+	})
+
+	b.Bind(StateTransferPath, func(msg *BMsg) error {
+		stateTransferMsg := &StateTransferMsg{}
+		err := codec.Unmarshal(msg.Body, stateTransferMsg)
+		if err != nil {
+			return errors.Wrap(err, "state-transfer failed")
+		}
+		select {
+		case m.stateTransferCh <- stateTransferMsg:
+		default:
+			logger.Errorf("drop duplicate state transfer from [%s]", msg.SrcID)
+		}
+		return nil
+	})
+
+	m.group.totalOrder.Bind(ViewChangePath, func(msg *TOMsg) error {
+		viewChangeMsg := &ViewChangeMsg{}
+		_, err := viewChangeMsg.Decode(msg.Body)
+		if err != nil {
+			return errors.Wrap(err, "view-change failed")
+		}
+		switch viewChangeMsg.Type {
+		case ViewJoin:
+			return m.installJoin(viewChangeMsg)
+		case ViewLeave:
+			return m.installLeave(viewChangeMsg)
+		default:
+			return fmt.Errorf("unrecognized view change type [%s]", viewChangeMsg.Type)
+		}
+	})
+}
+
+// installJoin runs inside TO delivery, so the snapshot of the sponsor is cut exactly at the view change.
+// The view is installed and the snapshot taken before it returns, the joining node is dialed by connectJoined,
+// so a slow dial does not hold up delivery. A rejoin replaces the previous incarnation of the member in the same view change
+func (m *Membership) installJoin(viewChangeMsg *ViewChangeMsg) error {
+	node := viewChangeMsg.Node
+
+	m.viewLock.Lock()
+	if m.view.Contains(node.ID) && !viewChangeMsg.Rejoin {
+		m.viewLock.Unlock()
+		logger.Infof("node [%s] is already a member, ignore join", node.ID)
+		return nil
+	}
+	m.view.ID++
+	m.view.Members = append(m.view.without(node.ID), node)
+	sort.Slice(m.view.Members, func(i, j int) bool { return m.view.Members[i].ID < m.view.Members[j].ID })
+	m.view.JoinedIn[node.ID] = m.view.ID
+	view := m.view.Copy()
+	m.viewLock.Unlock()
+	logger.Infof("install %s", view)
+
+	if viewChangeMsg.Rejoin && node.ID != m.group.SelfNodeID {
+		// the sender to the previous incarnation may not have given up yet
+		m.group.bmulticast.EjectMember(node.ID)
+	}
+
+	if viewChangeMsg.SponsorID != m.group.SelfNodeID {
+		go m.connectJoined(node, nil)
+		return nil
+	}
+
+	transferable, err := m.transferable()
+	if err != nil {
+		return errors.Wrap(err, "install join failed")
+	}
+	m.group.catchUp.start(node.ID)
+
+	deliveryState, err := transferable.snapshotDeliveryState()
+	if err != nil {
+		return errors.Wrap(err, "install join failed")
+	}
+
+	appState := []byte{}
+	if m.stateMachine != nil {
+		appState, err = m.stateMachine.Snapshot()
+		if err != nil {
+			return errors.Wrap(err, "install join failed")
+		}
+	}
+
+	stateTransferMsg := &StateTransferMsg{
+		View:          view,
+		AppState:      appState,
+		DeliveryState: deliveryState,
+	}
+	go m.connectJoined(node, stateTransferMsg)
+	return nil
+}
+
+// connectJoined dials a node that joined, the sponsor then transfers the state cut at the view change
+// and forwards what it processed since
+func (m *Membership) connectJoined(node Node, stateTransferMsg *StateTransferMsg) {
+	err := m.group.bmulticast.ConnectMember(node.ID, node.Addr, JoinConnectRetries)
+	if err != nil {
+		logger.Errorf("connect joined node [%s] failed: %v", node.ID, err)
+		m.group.catchUp.stop(node.ID)
+		return
+	}
+	if stateTransferMsg == nil {
+		return
+	}
+
+	err = m.group.bmulticast.Unicast(node.ID, StateTransferPath, stateTransferMsg)
+	if err != nil {
+		logger.Errorf("transfer state to node [%s] failed: %v", node.ID, err)
+		m.group.catchUp.stop(node.ID)
+		return
+	}
+	m.group.catchUp.connected(node.ID)
+	logger.Infof("transfer state of %s to node [%s]", stateTransferMsg.View, node.ID)
+}
+
+// installLeave removes a member that left, or that was ejected if the leave is sponsored by another member
+func (m *Membership) installLeave(viewChangeMsg *ViewChangeMsg) error {
+	node := viewChangeMsg.Node
+
+	m.viewLock.Lock()
+	if !m.view.Contains(node.ID) {
+		m.viewLock.Unlock()
+		return nil
+	}
+	if viewChangeMsg.ViewID < m.view.JoinedIn[node.ID] {
+		m.viewLock.Unlock()
+		logger.Infof("node [%s] joined again in view [%d] after the leave of view [%d], ignore leave", node.ID, m.view.JoinedIn[node.ID], viewChangeMsg.ViewID)
+		return nil
+	}
+	m.view.ID++
+	m.view.Members = m.view.without(node.ID)
+	delete(m.view.JoinedIn, node.ID)
+	view := m.view.Copy()
+	m.viewLock.Unlock()
+	logger.Infof("install %s", view)
+
+	if node.ID == m.group.SelfNodeID {
+		m.leftOnce.Do(func() {
+			if viewChangeMsg.SponsorID != m.group.SelfNodeID {
+				logger.Errorf("node [%s] is ejected from group by node [%s]", node.ID, viewChangeMsg.SponsorID)
+				m.ejected = errors.Wrapf(ErrEjected, "node [%s] by node [%s]", node.ID, viewChangeMsg.SponsorID)
+			}
+			close(m.leftCh)
+		})
+		return nil
+	}
+
+	m.group.bmulticast.RemoveMember(node.ID)
+	return nil
+}
+
+// join asks the members of the initial view one by one to sponsor this node, then installs the transferred state
+func (m *Membership) join(ctx context.Context) (err error) {
+	self := Node{
+		ID:   m.group.SelfNodeID,
+		Addr: m.group.advertiseAddr(),
+	}
+
+	transferable, err := m.transferable()
+	if err != nil {
+		return errors.Wrap(err, "join failed")
+	}
+
+	for _, member := range m.View().Members {
+		if member.ID == self.ID {
+			continue
+		}
+
+		err = m.group.bmulticast.Unicast(member.ID, JoinRequestPath, &JoinRequestMsg{Node: self})
+		if err != nil {
+			logger.Errorf("ask node [%s] to sponsor join failed: %v", member.ID, err)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(JoinTimeout):
+			logger.Errorf("node [%s] did not transfer state in %v", member.ID, JoinTimeout)
+			continue
+		case stateTransferMsg := <-m.stateTransferCh:
+			m.viewLock.Lock()
+			m.view = stateTransferMsg.View.Copy()
+			m.viewLock.Unlock()
+
+			if m.stateMachine != nil {
+				err = m.stateMachine.Restore(stateTransferMsg.AppState)
+				if err != nil {
+					return errors.Wrap(err, "join failed")
+				}
+			}
+			err = transferable.restoreDeliveryState(stateTransferMsg.DeliveryState)
+			if err != nil {
+				return errors.Wrap(err, "join failed")
+			}
+			logger.Infof("join group, install %s", stateTransferMsg.View)
+			return nil
+		}
+	}
+	return fmt.Errorf("join failed, no member sponsored node [%s]", self.ID)
+}
+
+// eject TO-multicasts the departure of another member on its behalf, so every member removes it at the same point of the total order
+func (m *Membership) eject(ctx context.Context, nodeID string) (err error) {
+	view := m.View()
+	node, ok := view.Member(nodeID)
+	if !ok {
+		return fmt.Errorf("node [%s] is not a member of %s", nodeID, view)
+	}
+
+	viewChangeMsg := &ViewChangeMsg{
+		Type:      ViewLeave,
+		Node:      node,
+		SponsorID: m.group.SelfNodeID,
+		ViewID:    view.ID,
+	}
+	err = m.group.totalOrder.MulticastContext(ctx, ViewChangePath, viewChangeMsg)
+	if err != nil {
+		return errors.Wrap(err, "eject failed")
+	}
+	logger.Infof("ask group to eject node [%s]", nodeID)
+	return nil
+}
+
+// ejectDead ejects a member the failure detector or a sender found dead in view viewID,
+// unless it came back or it is no longer a member
+func (m *Membership) ejectDead(ctx context.Context, nodeID string, viewID uint64) {
+	if ctx.Err() != nil || m.group.bmulticast.IsNodeAlived(nodeID) {
+		return
+	}
+	view := m.View()
+	if !view.Contains(nodeID) || viewID < view.JoinedIn[nodeID] {
+		return
+	}
+	err := m.eject(ctx, nodeID)
+	if err != nil {
+		logger.Errorf("eject dead node [%s] failed: %v", nodeID, err)
+	}
+}
+
+// watchMembers ejects a member that is dead for the crash timeout, so every member removes it from the view
+// at the same point of the total order, and it may join the group again once it restarts
+func (m *Membership) watchMembers(ctx context.Context, memberUpdateChannel chan interface{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case v := <-memberUpdateChannel:
+			event, ok := v.(*MemberEvent)
+			if !ok || event.Type != MemberDead {
+				continue
+			}
+			viewID := m.View().ID
+			time.AfterFunc(NodeCrashTimeout, func() {
+				m.ejectDead(ctx, event.NodeID, viewID)
+			})
+		}
+	}
+}
+
+func (m *Membership) Start(ctx context.Context) {
+	memberUpdateChannel := m.group.bmulticast.MembersUpdate()
+	go m.watchMembers(ctx, memberUpdateChannel)
+}
+
+// leave TO-multicasts the departure of this node and waits until it is delivered
+func (m *Membership) leave(ctx context.Context) (err error) {
+	viewChangeMsg := &ViewChangeMsg{
+		Type: ViewLeave,
+		Node: Node{
+			ID:   m.group.SelfNodeID,
+			Addr: m.group.advertiseAddr(),
+		},
+		SponsorID: m.group.SelfNodeID,
+		ViewID:    m.View().ID,
+	}
+	err = m.group.totalOrder.MulticastContext(ctx, ViewChangePath, viewChangeMsg)
+	if err != nil {
+		return errors.Wrap(err, "leave failed")
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-m.leftCh:
+		logger.Infof("node [%s] left group", m.group.SelfNodeID)
+		return nil
+	}
+}
@@ -0,0 +1,167 @@
+package multicast_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bamboovir/cs425/lib/memnet"
+	"github.com/bamboovir/cs425/lib/mp1/multicast"
+	errors "github.com/pkg/errors"
+)
+
+// crashedMemnetGroups starts A, B and C on one network and crashes C once each of them delivered a TO msg,
+// A TO-multicasts again so its sender to C gives up
+func crashedMemnetGroups(t *testing.T, network *memnet.Network, d *deliveries) map[string]*multicast.Group {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		network.Close()
+	})
+	bind := func(nodeID string, g *multicast.Group) {
+		g.TO().Bind("/test", func(msg *multicast.TOMsg) error { return d.record(nodeID, msg.Body) })
+	}
+
+	groups := map[string]*multicast.Group{}
+	cancels := map[string]context.CancelFunc{}
+	started := make(chan error, len(memnetNodeIDs))
+	for _, nodeID := range memnetNodeIDs {
+		group := newMemnetGroup(network, memnetMembers(memnetNodeIDs), nodeID, nil, bind)
+		groupCtx, groupCancel := context.WithCancel(ctx)
+		groups[nodeID] = group
+		cancels[nodeID] = groupCancel
+		go func() {
+			started <- group.Start(groupCtx)
+		}()
+	}
+	for range memnetNodeIDs {
+		err := <-started
+		if err != nil {
+			t.Fatalf("start group: %v", err)
+		}
+	}
+
+	err := groups["A"].TO().Multicast("/test", "before-crash")
+	if err != nil {
+		t.Fatalf("to-multicast: %v", err)
+	}
+	d.wait(t, 1)
+
+	network.Crash("C")
+	cancels["C"]()
+	err = groups["A"].TO().Multicast("/test", "after-crash")
+	if err != nil {
+		t.Fatalf("to-multicast: %v", err)
+	}
+	eventually(t, 10*time.Second, func() bool {
+		return !groups["A"].B().IsNodeAlived("C") && !groups["B"].B().IsNodeAlived("C")
+	}, "A and B did not give up on C")
+	return groups
+}
+
+// rejoinMemnetGroup restarts C, it joins the group of A and B again
+func rejoinMemnetGroup(t *testing.T, network *memnet.Network, d *deliveries) *multicast.Group {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	group := newMemnetGroup(network, memnetMembers(memnetNodeIDs), "C", func(b *multicast.GroupBuilder) {
+		b.WithJoin(true)
+	}, func(nodeID string, g *multicast.Group) {
+		g.TO().Bind("/test", func(msg *multicast.TOMsg) error { return d.record("C-restarted", msg.Body) })
+	})
+	err := group.Start(ctx)
+	if err != nil {
+		t.Fatalf("rejoin: %v", err)
+	}
+	return group
+}
+
+func assertRejoined(t *testing.T, groups map[string]*multicast.Group, restarted *multicast.Group, d *deliveries) {
+	t.Helper()
+	for _, nodeID := range []string{"A", "B"} {
+		group := groups[nodeID]
+		eventually(t, 10*time.Second, func() bool {
+			return group.View().Contains("C")
+		}, "node [%s] did not install the rejoin of C: %s", nodeID, group.View())
+	}
+
+	err := groups["A"].TO().Multicast("/test", "after-rejoin")
+	if err != nil {
+		t.Fatalf("to-multicast: %v", err)
+	}
+	for _, nodeID := range []string{"A", "B", "C-restarted"} {
+		eventually(t, 10*time.Second, func() bool {
+			delivered := d.of(nodeID)
+			return len(delivered) > 0 && delivered[len(delivered)-1] == "after-rejoin"
+		}, "node [%s] did not deliver the msg sent after the rejoin: %v", nodeID, d.of(nodeID))
+	}
+	if view := restarted.View(); !view.Contains("A") || !view.Contains("B") || !view.Contains("C") {
+		t.Fatalf("restarted C installed %s, want A, B and C", view)
+	}
+}
+
+func TestCrashedMemberIsEjectedAndRejoins(t *testing.T) {
+	network := memnet.New(&memnet.Config{Seed: 3, MaxDelay: time.Millisecond})
+	d := newDeliveries()
+	groups := crashedMemnetGroups(t, network, d)
+
+	for _, nodeID := range []string{"A", "B"} {
+		group := groups[nodeID]
+		eventually(t, multicast.NodeCrashTimeout+10*time.Second, func() bool {
+			return !group.View().Contains("C")
+		}, "node [%s] did not eject crashed C: %s", nodeID, group.View())
+	}
+
+	restarted := rejoinMemnetGroup(t, network, d)
+	assertRejoined(t, groups, restarted, d)
+}
+
+func TestCrashedMemberRejoinsBeforeItIsEjected(t *testing.T) {
+	network := memnet.New(&memnet.Config{Seed: 4, MaxDelay: time.Millisecond})
+	d := newDeliveries()
+	groups := crashedMemnetGroups(t, network, d)
+	if !groups["A"].View().Contains("C") {
+		t.Fatalf("C is ejected before the crash timeout: %s", groups["A"].View())
+	}
+
+	restarted := rejoinMemnetGroup(t, network, d)
+	assertRejoined(t, groups, restarted, d)
+
+	// the leave of the previous incarnation decided before the rejoin is stale once the timeout passes
+	time.Sleep(multicast.NodeCrashTimeout + time.Second)
+	for _, nodeID := range []string{"A", "B"} {
+		if view := groups[nodeID].View(); !view.Contains("C") {
+			t.Fatalf("node [%s] ejected the restarted C: %s", nodeID, view)
+		}
+	}
+}
+
+func TestEjectedMemberLeavesGroup(t *testing.T) {
+	network := memnet.New(&memnet.Config{Seed: 5, MaxDelay: time.Millisecond})
+	groups := startMemnetGroups(t, network, nil, func(nodeID string, g *multicast.Group) {})
+
+	err := groups["A"].Eject("C")
+	if err != nil {
+		t.Fatalf("eject: %v", err)
+	}
+	select {
+	case <-groups["C"].Left():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("ejected node [C] did not install its leave: %s", groups["C"].View())
+	}
+	if err := groups["C"].Ejected(); errors.Cause(err) != multicast.ErrEjected {
+		t.Fatalf("ejected node [C] reports %v, want ErrEjected", err)
+	}
+	for _, nodeID := range []string{"A", "B"} {
+		group := groups[nodeID]
+		eventually(t, 10*time.Second, func() bool {
+			return !group.View().Contains("C")
+		}, "node [%s] did not install the eject of C: %s", nodeID, group.View())
+		select {
+		case <-group.Left():
+			t.Fatalf("node [%s] left the group with the eject of C", nodeID)
+		default:
+		}
+	}
+}
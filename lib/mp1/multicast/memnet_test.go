@@ -0,0 +1,233 @@
+package multicast_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"github.com/bamboovir/cs425/lib/codec"
+	"github.com/bamboovir/cs425/lib/memnet"
+	"github.com/bamboovir/cs425/lib/mp1/multicast"
+	errors "github.com/pkg/errors"
+)
+
+var memnetNodeIDs = []string{"A", "B", "C"}
+
+// deliveries records what every node delivers, in the order it delivers it
+type deliveries struct {
+	byNode map[string][]string
+	lock   sync.Mutex
+}
+
+func newDeliveries() *deliveries {
+	return &deliveries{byNode: map[string][]string{}}
+}
+
+func (d *deliveries) record(nodeID string, body []byte) error {
+	value := ""
+	err := codec.Unmarshal(body, &value)
+	if err != nil {
+		return err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.byNode[nodeID] = append(d.byNode[nodeID], value)
+	return nil
+}
+
+func (d *deliveries) of(nodeID string) []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]string{}, d.byNode[nodeID]...)
+}
+
+// wait waits until every node delivered n msgs, a node that delivers more is reported by the caller
+func (d *deliveries) wait(t *testing.T, n int) {
+	t.Helper()
+	d.waitOn(t, memnetNodeIDs, n)
+}
+
+func (d *deliveries) waitOn(t *testing.T, nodeIDs []string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(20 * time.Second)
+	for _, nodeID := range nodeIDs {
+		for len(d.of(nodeID)) < n && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := len(d.of(nodeID)); got < n {
+			t.Fatalf("node [%s] delivered %d msgs, want %d", nodeID, got, n)
+		}
+	}
+}
+
+func memnetMembers(nodeIDs []string) []multicast.Node {
+	members := make([]multicast.Node, 0, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
+		members = append(members, multicast.Node{ID: nodeID, Addr: "mem-" + nodeID})
+	}
+	return members
+}
+
+// newMemnetGroup builds the group of nodeID on network, bind is called before it is returned
+func newMemnetGroup(network *memnet.Network, members []multicast.Node, nodeID string, configure func(b *multicast.GroupBuilder), bind func(nodeID string, g *multicast.Group)) *multicast.Group {
+	builder := multicast.NewGroupBuilder().
+		WithSelfNodeID(nodeID).
+		WithSelfNodeAddr("mem-" + nodeID).
+		WithMembers(members).
+		WithTransport(network)
+	if configure != nil {
+		configure(builder)
+	}
+	group := builder.Build()
+	bind(nodeID, group)
+	return group
+}
+
+// startMemnetGroups starts a group of every node on network, bind is called before the groups start
+func startMemnetGroups(t *testing.T, network *memnet.Network, configure func(b *multicast.GroupBuilder), bind func(nodeID string, g *multicast.Group)) map[string]*multicast.Group {
+	t.Helper()
+	return startMemnetGroupsOf(t, network, memnetNodeIDs, configure, bind)
+}
+
+func startMemnetGroupsOf(t *testing.T, network *memnet.Network, nodeIDs []string, configure func(b *multicast.GroupBuilder), bind func(nodeID string, g *multicast.Group)) map[string]*multicast.Group {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		network.Close()
+	})
+
+	members := memnetMembers(nodeIDs)
+	groups := map[string]*multicast.Group{}
+	started := make(chan error, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
+		group := newMemnetGroup(network, members, nodeID, configure, bind)
+		groups[nodeID] = group
+		go func() {
+			started <- group.Start(ctx)
+		}()
+	}
+	for range nodeIDs {
+		err := <-started
+		if err != nil {
+			t.Fatalf("start group: %v", err)
+		}
+	}
+	return groups
+}
+
+// eventually fails the test if ok does not hold within timeout
+func eventually(t *testing.T, timeout time.Duration, ok func() bool, format string, args ...interface{}) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestBAndRMulticastOnMemnet a duplicate reaches b-deliver, r-deliver drops it
+func TestBAndRMulticastOnMemnet(t *testing.T) {
+	network := memnet.New(&memnet.Config{Seed: 5, MaxDelay: 5 * time.Millisecond, DupRate: 0.3})
+	bDeliveries := newDeliveries()
+	rDeliveries := newDeliveries()
+	groups := startMemnetGroups(t, network, nil, func(nodeID string, g *multicast.Group) {
+		g.B().Bind("/test", func(msg *multicast.BMsg) error { return bDeliveries.record(nodeID, msg.Body) })
+		g.R().Bind("/test", func(msg *multicast.RMsg) error { return rDeliveries.record(nodeID, msg.Body) })
+	})
+
+	for _, nodeID := range memnetNodeIDs {
+		for i := 0; i < 10; i++ {
+			value := fmt.Sprintf("%s%d", nodeID, i)
+			err := groups[nodeID].B().Multicast("/test", value)
+			if err != nil {
+				t.Fatalf("b-multicast: %v", err)
+			}
+			err = groups[nodeID].R().Multicast("/test", value)
+			if err != nil {
+				t.Fatalf("r-multicast: %v", err)
+			}
+		}
+	}
+	bDeliveries.wait(t, 30)
+	rDeliveries.wait(t, 30)
+	time.Sleep(100 * time.Millisecond)
+	if stats := network.Stats(); stats.Duplicated == 0 {
+		t.Fatalf("no duplicate drawn in %+v", stats)
+	}
+
+	for _, nodeID := range memnetNodeIDs {
+		// a link keeps the order of its msgs when no reorder is drawn, a duplicate follows its original
+		last := map[byte]int{}
+		for _, value := range bDeliveries.of(nodeID) {
+			i := 0
+			fmt.Sscanf(value[1:], "%d", &i)
+			if prev, ok := last[value[0]]; ok && i != prev && i != prev+1 {
+				t.Fatalf("node [%s] b-delivered %s after %c%d", nodeID, value, value[0], prev)
+			}
+			last[value[0]] = i
+		}
+
+		seen := map[string]struct{}{}
+		for _, value := range rDeliveries.of(nodeID) {
+			if _, ok := seen[value]; ok {
+				t.Fatalf("node [%s] r-delivered %s twice", nodeID, value)
+			}
+			seen[value] = struct{}{}
+		}
+		if len(seen) != 30 {
+			t.Fatalf("node [%s] r-delivered %d msgs, want 30", nodeID, len(seen))
+		}
+	}
+}
+
+func testTotalOrderOnMemnet(t *testing.T, strategy multicast.TotalOrderStrategyKind) {
+	network := memnet.New(&memnet.Config{Seed: 11, MaxDelay: 5 * time.Millisecond, DupRate: 0.1, ReorderRate: 0.2})
+	d := newDeliveries()
+	groups := startMemnetGroups(t, network, func(b *multicast.GroupBuilder) {
+		b.WithTotalOrderStrategy(strategy)
+	}, func(nodeID string, g *multicast.Group) {
+		g.TO().Bind("/test", func(msg *multicast.TOMsg) error { return d.record(nodeID, msg.Body) })
+	})
+
+	var wg sync.WaitGroup
+	for _, nodeID := range memnetNodeIDs {
+		wg.Add(1)
+		go func(nodeID string) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				err := groups[nodeID].TO().Multicast("/test", fmt.Sprintf("%s%d", nodeID, i))
+				if err != nil {
+					t.Errorf("to-multicast: %v", errors.Wrap(err, nodeID))
+				}
+			}
+		}(nodeID)
+	}
+	wg.Wait()
+	d.wait(t, 60)
+	time.Sleep(100 * time.Millisecond)
+
+	first := d.of(memnetNodeIDs[0])
+	if len(first) != 60 {
+		t.Fatalf("node [%s] delivered %d msgs, want 60", memnetNodeIDs[0], len(first))
+	}
+	for _, nodeID := range memnetNodeIDs[1:] {
+		if got := d.of(nodeID); !reflect.DeepEqual(got, first) {
+			t.Fatalf("node [%s] delivered\n%v\nnode [%s] delivered\n%v", nodeID, got, memnetNodeIDs[0], first)
+		}
+	}
+}
+
+func TestISISTotalOrderOnMemnet(t *testing.T) {
+	testTotalOrderOnMemnet(t, multicast.ISISStrategy)
+}
+
+func TestSequencerTotalOrderOnMemnet(t *testing.T) {
+	testTotalOrderOnMemnet(t, multicast.SequencerStrategy)
+}
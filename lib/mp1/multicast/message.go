@@ -3,15 +3,32 @@ package multicast
 import (
 	"crypto/sha1"
 	"encoding/hex"
-	"encoding/json"
 
+	"github.com/bamboovir/cs425/lib/codec"
+	"github.com/bamboovir/cs425/lib/mp1/tracing"
 	"github.com/google/uuid"
 )
 
+// traceCarrier a message that carries a span context, the envelope it is sent in carries the context too
+type traceCarrier interface {
+	traceContext() *tracing.SpanContext
+}
+
+func traceContextOf(v interface{}) *tracing.SpanContext {
+	carrier, ok := v.(traceCarrier)
+	if !ok {
+		return nil
+	}
+	return carrier.traceContext()
+}
+
+// BMsg span is the b-deliver span of a received message, the layers above parent their spans on it
 type BMsg struct {
-	SrcID string `json:"src"`
-	Path  string `json:"path"`
-	Body  []byte `json:"body"`
+	SrcID string               `json:"src"`
+	Path  string               `json:"path"`
+	Body  []byte               `json:"body"`
+	Trace *tracing.SpanContext `json:"trace,omitempty"`
+	span  *tracing.Span
 }
 
 // SHA1 hashes using sha1 algorithm
@@ -22,7 +39,7 @@ func SHA1(text string) string {
 }
 
 func NewBMsg(srcID string, path string, v interface{}) (msg *BMsg, err error) {
-	data, err := json.Marshal(v)
+	data, err := codec.Marshal(v)
 	if err != nil {
 		return nil, err
 	}
@@ -31,11 +48,20 @@ func NewBMsg(srcID string, path string, v interface{}) (msg *BMsg, err error) {
 		SrcID: srcID,
 		Path:  path,
 		Body:  data,
+		Trace: traceContextOf(v),
 	}, nil
 }
 
+// parentSpan the span the handlers of the message run in, its b-deliver span or else the context it carries
+func (m *BMsg) parentSpan() *tracing.SpanContext {
+	if m.span != nil {
+		return m.span.Context()
+	}
+	return m.Trace
+}
+
 func (m *BMsg) Encode() (data []byte, err error) {
-	data, err = json.Marshal(m)
+	data, err = codec.Marshal(m)
 	if err != nil {
 		return nil, err
 	}
@@ -43,21 +69,51 @@ func (m *BMsg) Encode() (data []byte, err error) {
 }
 
 func (m *BMsg) Decode(data []byte) (msg *BMsg, err error) {
-	err = json.Unmarshal(data, m)
+	err = codec.Unmarshal(data, m)
 	if err != nil {
 		return nil, err
 	}
 	return m, nil
 }
 
+// RMsg Seq numbers the messages of an Incarnation of Origin, Hops counts the gossip relays the message made,
+// Acks are the acks of Acker, the origin piggybacks them on its own copy
 type RMsg struct {
-	ID   string `json:"id"`
-	Path string `json:"path"`
-	Body []byte `json:"body"`
+	ID          string               `json:"id"`
+	Path        string               `json:"path"`
+	Body        []byte               `json:"body"`
+	VC          VectorClock          `json:"vc,omitempty"`
+	Hops        int                  `json:"hops,omitempty"`
+	Origin      string               `json:"origin"`
+	Incarnation int64                `json:"incarnation"`
+	Seq         uint64               `json:"seq"`
+	Acker       string               `json:"acker,omitempty"`
+	Acks        []*RAck              `json:"acks,omitempty"`
+	Trace       *tracing.SpanContext `json:"trace,omitempty"`
+	span        *tracing.Span
+}
+
+func (m *RMsg) traceContext() *tracing.SpanContext {
+	return m.Trace
+}
+
+// relayCopy copies the message as it was r-multicast by its origin, the acks are only carried by the copy of the origin
+func (m *RMsg) relayCopy() *RMsg {
+	return &RMsg{
+		ID:          m.ID,
+		Path:        m.Path,
+		Body:        m.Body,
+		VC:          m.VC,
+		Hops:        m.Hops,
+		Origin:      m.Origin,
+		Incarnation: m.Incarnation,
+		Seq:         m.Seq,
+		Trace:       m.Trace,
+	}
 }
 
 func NewRMsg(path string, v interface{}) (*RMsg, error) {
-	data, err := json.Marshal(v)
+	data, err := codec.Marshal(v)
 	if err != nil {
 		return nil, err
 	}
@@ -65,14 +121,15 @@ func NewRMsg(path string, v interface{}) (*RMsg, error) {
 	id := uuid.New().String() + "-" + SHA1(string(data))
 
 	return &RMsg{
-		ID:   id,
-		Path: path,
-		Body: data,
+		ID:    id,
+		Path:  path,
+		Body:  data,
+		Trace: traceContextOf(v),
 	}, nil
 }
 
 func (m *RMsg) Encode() (data []byte, err error) {
-	data, err = json.Marshal(m)
+	data, err = codec.Marshal(m)
 	if err != nil {
 		return nil, err
 	}
@@ -80,7 +137,7 @@ func (m *RMsg) Encode() (data []byte, err error) {
 }
 
 func (m *RMsg) Decode(data []byte) (msg *RMsg, err error) {
-	err = json.Unmarshal(data, m)
+	err = codec.Unmarshal(data, m)
 	if err != nil {
 		return nil, err
 	}
@@ -88,9 +145,14 @@ func (m *RMsg) Decode(data []byte) (msg *RMsg, err error) {
 }
 
 type TOAskProposalSeqMsg struct {
-	SrcID string `json:"src"`
-	MsgID string `json:"msg_id"`
-	Body  []byte `json:"body"`
+	SrcID string               `json:"src"`
+	MsgID string               `json:"msg_id"`
+	Body  []byte               `json:"body"`
+	Trace *tracing.SpanContext `json:"trace,omitempty"`
+}
+
+func (m *TOAskProposalSeqMsg) traceContext() *tracing.SpanContext {
+	return m.Trace
 }
 
 func NewTOAskProposalSeqMsg(srcID string, body []byte) *TOAskProposalSeqMsg {
@@ -103,7 +165,7 @@ func NewTOAskProposalSeqMsg(srcID string, body []byte) *TOAskProposalSeqMsg {
 }
 
 func (m *TOAskProposalSeqMsg) Encode() (data []byte, err error) {
-	data, err = json.Marshal(m)
+	data, err = codec.Marshal(m)
 	if err != nil {
 		return nil, err
 	}
@@ -111,7 +173,7 @@ func (m *TOAskProposalSeqMsg) Encode() (data []byte, err error) {
 }
 
 func (m *TOAskProposalSeqMsg) Decode(data []byte) (msg *TOAskProposalSeqMsg, err error) {
-	err = json.Unmarshal(data, m)
+	err = codec.Unmarshal(data, m)
 	if err != nil {
 		return nil, err
 	}
@@ -119,9 +181,14 @@ func (m *TOAskProposalSeqMsg) Decode(data []byte) (msg *TOAskProposalSeqMsg, err
 }
 
 type TOReplyProposalSeqMsg struct {
-	ProcessID   string `json:"pid"`
-	MsgID       string `json:"msg_id"`
-	ProposalSeq uint64 `json:"proposal_seq"`
+	ProcessID   string               `json:"pid"`
+	MsgID       string               `json:"msg_id"`
+	ProposalSeq uint64               `json:"proposal_seq"`
+	Trace       *tracing.SpanContext `json:"trace,omitempty"`
+}
+
+func (m *TOReplyProposalSeqMsg) traceContext() *tracing.SpanContext {
+	return m.Trace
 }
 
 func NewTOReplyProposalSeqMsg(processID string, msgID string, proposalSeqNum uint64) *TOReplyProposalSeqMsg {
@@ -133,7 +200,7 @@ func NewTOReplyProposalSeqMsg(processID string, msgID string, proposalSeqNum uin
 }
 
 func (m *TOReplyProposalSeqMsg) Encode() (data []byte, err error) {
-	data, err = json.Marshal(m)
+	data, err = codec.Marshal(m)
 	if err != nil {
 		return nil, err
 	}
@@ -141,7 +208,7 @@ func (m *TOReplyProposalSeqMsg) Encode() (data []byte, err error) {
 }
 
 func (m *TOReplyProposalSeqMsg) Decode(data []byte) (msg *TOReplyProposalSeqMsg, err error) {
-	err = json.Unmarshal(data, m)
+	err = codec.Unmarshal(data, m)
 	if err != nil {
 		return nil, err
 	}
@@ -149,9 +216,14 @@ func (m *TOReplyProposalSeqMsg) Decode(data []byte) (msg *TOReplyProposalSeqMsg,
 }
 
 type TOAnnounceAgreementSeqMsg struct {
-	ProcessID    string `json:"pid"`
-	AgreementSeq uint64 `json:"agreement_seq"`
-	MsgID        string `json:"msg_id"`
+	ProcessID    string               `json:"pid"`
+	AgreementSeq uint64               `json:"agreement_seq"`
+	MsgID        string               `json:"msg_id"`
+	Trace        *tracing.SpanContext `json:"trace,omitempty"`
+}
+
+func (m *TOAnnounceAgreementSeqMsg) traceContext() *tracing.SpanContext {
+	return m.Trace
 }
 
 func NewTOAnnounceAgreementSeqMsg(processID string, agreementSeq uint64, msgID string) *TOAnnounceAgreementSeqMsg {
@@ -163,7 +235,7 @@ func NewTOAnnounceAgreementSeqMsg(processID string, agreementSeq uint64, msgID s
 }
 
 func (m *TOAnnounceAgreementSeqMsg) Encode() (data []byte, err error) {
-	data, err = json.Marshal(m)
+	data, err = codec.Marshal(m)
 	if err != nil {
 		return nil, err
 	}
@@ -171,20 +243,22 @@ func (m *TOAnnounceAgreementSeqMsg) Encode() (data []byte, err error) {
 }
 
 func (m *TOAnnounceAgreementSeqMsg) Decode(data []byte) (msg *TOAnnounceAgreementSeqMsg, err error) {
-	err = json.Unmarshal(data, m)
+	err = codec.Unmarshal(data, m)
 	if err != nil {
 		return nil, err
 	}
 	return m, nil
 }
 
+// TOMsg Trace is the context of the to-multicast span of the origin, every node delivers the message in its trace
 type TOMsg struct {
-	Path string `json:"path"`
-	Body []byte `json:"body"`
+	Path  string               `json:"path"`
+	Body  []byte               `json:"body"`
+	Trace *tracing.SpanContext `json:"trace,omitempty"`
 }
 
 func NewTOMsg(path string, v interface{}) (msg *TOMsg, err error) {
-	data, err := json.Marshal(v)
+	data, err := codec.Marshal(v)
 	if err != nil {
 		return nil, err
 	}
@@ -196,7 +270,7 @@ func NewTOMsg(path string, v interface{}) (msg *TOMsg, err error) {
 }
 
 func (m *TOMsg) Encode() (data []byte, err error) {
-	data, err = json.Marshal(m)
+	data, err = codec.Marshal(m)
 	if err != nil {
 		return nil, err
 	}
@@ -204,9 +278,167 @@ func (m *TOMsg) Encode() (data []byte, err error) {
 }
 
 func (m *TOMsg) Decode(data []byte) (msg *TOMsg, err error) {
-	err = json.Unmarshal(data, m)
+	err = codec.Unmarshal(data, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// FIFOMsg the seqs of a sender restart at 1 with every incarnation of it
+type FIFOMsg struct {
+	SrcID       string `json:"src"`
+	Incarnation int64  `json:"incarnation"`
+	Seq         uint64 `json:"seq"`
+	Path        string `json:"path"`
+	Body        []byte `json:"body"`
+}
+
+func NewFIFOMsg(srcID string, incarnation int64, seq uint64, path string, v interface{}) (msg *FIFOMsg, err error) {
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FIFOMsg{
+		SrcID:       srcID,
+		Incarnation: incarnation,
+		Seq:         seq,
+		Path:        path,
+		Body:        data,
+	}, nil
+}
+
+func (m *FIFOMsg) Encode() (data []byte, err error) {
+	data, err = codec.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (m *FIFOMsg) Decode(data []byte) (msg *FIFOMsg, err error) {
+	err = codec.Unmarshal(data, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type COMsg struct {
+	SrcID string `json:"src"`
+	Path  string `json:"path"`
+	Body  []byte `json:"body"`
+}
+
+func NewCOMsg(srcID string, path string, v interface{}) (msg *COMsg, err error) {
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return &COMsg{
+		SrcID: srcID,
+		Path:  path,
+		Body:  data,
+	}, nil
+}
+
+func (m *COMsg) Encode() (data []byte, err error) {
+	data, err = codec.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (m *COMsg) Decode(data []byte) (msg *COMsg, err error) {
+	err = codec.Unmarshal(data, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type SequencerDataMsg struct {
+	SrcID string               `json:"src"`
+	MsgID string               `json:"msg_id"`
+	Body  []byte               `json:"body"`
+	Trace *tracing.SpanContext `json:"trace,omitempty"`
+}
+
+func (m *SequencerDataMsg) traceContext() *tracing.SpanContext {
+	return m.Trace
+}
+
+func NewSequencerDataMsg(srcID string, body []byte) *SequencerDataMsg {
+	msgID := uuid.New().String() + SHA1(string(body))
+	return &SequencerDataMsg{
+		SrcID: srcID,
+		MsgID: msgID,
+		Body:  body,
+	}
+}
+
+func (m *SequencerDataMsg) Encode() (data []byte, err error) {
+	data, err = codec.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (m *SequencerDataMsg) Decode(data []byte) (msg *SequencerDataMsg, err error) {
+	err = codec.Unmarshal(data, m)
 	if err != nil {
 		return nil, err
 	}
 	return m, nil
 }
+
+// SequencerOrderMsg Epoch counts the sequencers of the group, EpochStart is the first seq the sequencer of Epoch assigns,
+// an order of an older epoch at or after it is superseded
+type SequencerOrderMsg struct {
+	SequencerID string `json:"sequencer"`
+	Epoch       uint64 `json:"epoch"`
+	EpochStart  uint64 `json:"epoch_start"`
+	MsgID       string `json:"msg_id"`
+	Seq         uint64 `json:"seq"`
+}
+
+func NewSequencerOrderMsg(sequencerID string, epoch uint64, epochStart uint64, msgID string, seq uint64) *SequencerOrderMsg {
+	return &SequencerOrderMsg{
+		SequencerID: sequencerID,
+		Epoch:       epoch,
+		EpochStart:  epochStart,
+		MsgID:       msgID,
+		Seq:         seq,
+	}
+}
+
+func (m *SequencerOrderMsg) Encode() (data []byte, err error) {
+	data, err = codec.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (m *SequencerOrderMsg) Decode(data []byte) (msg *SequencerOrderMsg, err error) {
+	err = codec.Unmarshal(data, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SequencerTakeoverMsg asks a survivor for the orders it delivered from Since on
+type SequencerTakeoverMsg struct {
+	Since uint64 `json:"since"`
+}
+
+// SequencerDeliveredMsg the highest seq a survivor delivered, and the orders it delivered from Since on that it still remembers
+type SequencerDeliveredMsg struct {
+	MaxDeliveredSeqNum uint64            `json:"max_delivered_seq"`
+	Orders             map[uint64]string `json:"orders"`
+}
@@ -1,9 +1,34 @@
 package multicast
 
 import (
+	"fmt"
+	"reflect"
+
+	"github.com/bamboovir/cs425/lib/mp1/router"
+	errors "github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
 	logger = log.WithField("src", "multicast")
 )
+
+// NewProtocolRouter the router of a protocol layer that only runs msgs of the type of sample, such as (*BMsg)(nil).
+// A handler that panics, a msg of another type and a path nobody bound fail the msg instead of the node
+func NewProtocolRouter(layer string, sample interface{}) *router.Router {
+	msgType := reflect.TypeOf(sample)
+	r := router.New()
+	r.Use(
+		router.Recover(),
+		router.Decode(func(route *router.Route, msg interface{}) (interface{}, error) {
+			if reflect.TypeOf(msg) != msgType {
+				return nil, fmt.Errorf("%s expects %s, got %T", layer, msgType, msg)
+			}
+			return msg, nil
+		}),
+	)
+	r.Fallback(func(route *router.Route, msg interface{}) error {
+		return errors.Wrapf(ErrNoHandler, "%s path [%s]", layer, route.Path)
+	})
+	return r
+}
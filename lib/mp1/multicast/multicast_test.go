@@ -0,0 +1,41 @@
+package multicast
+
+import (
+	"strings"
+	"testing"
+
+	errors "github.com/pkg/errors"
+)
+
+func TestProtocolRouterFailsBadMsgsInsteadOfNode(t *testing.T) {
+	r := NewProtocolRouter("b-multicast", (*BMsg)(nil))
+	delivered := []string{}
+	r.Bind("/test", func(v interface{}) error {
+		msg := v.(*BMsg)
+		if msg.Path == "/panic" {
+			panic("bad msg")
+		}
+		delivered = append(delivered, msg.SrcID)
+		return nil
+	})
+
+	err := r.Run("/test", &BMsg{SrcID: "A"})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	err = r.Run("/test", &RMsg{})
+	if err == nil || !strings.Contains(err.Error(), "got *multicast.RMsg") {
+		t.Fatalf("run of a msg of another layer returned %v", err)
+	}
+	err = r.Run("/test", &BMsg{SrcID: "B", Path: "/panic"})
+	if err == nil || !strings.Contains(err.Error(), "panicked") {
+		t.Fatalf("run of a panicking handler returned %v", err)
+	}
+	err = r.Run("/unbound", &BMsg{SrcID: "C"})
+	if errors.Cause(err) != ErrNoHandler {
+		t.Fatalf("run of an unbound path returned %v, want %v", err, ErrNoHandler)
+	}
+	if len(delivered) != 1 || delivered[0] != "A" {
+		t.Fatalf("delivered %v, want only the msg of A", delivered)
+	}
+}
@@ -2,8 +2,10 @@ package multicast
 
 import (
 	"context"
+	"time"
 
 	"github.com/bamboovir/cs425/lib/mp1/router"
+	"github.com/bamboovir/cs425/lib/mp1/tracing"
 	sync "github.com/sasha-s/go-deadlock"
 
 	errors "github.com/pkg/errors"
@@ -13,32 +15,50 @@ const (
 	RMulticastPath = "/r-multicast"
 )
 
+// RMulticast dedupes by the per-origin watermarks of the received seqs,
+// the acks piggybacked on every message tell when a message is stable at every member
 type RMulticast struct {
-	bmulticast   *BMulticast
-	received     map[string]struct{}
-	receivedLock *sync.Mutex
-	router       *router.Router
+	bmulticast       *BMulticast
+	config           *RMulticastConfig
+	incarnation      int64
+	nextSeq          uint64
+	watermarks       map[string]*originWatermark
+	peerAcks         map[string]map[string]*RAck
+	lastAckAt        time.Time
+	history          []*gossipHistoryItem
+	receivedLock     *sync.Mutex
+	antiEntropyRound int
+	router           *router.Router
 }
 
-func NewRMulticast(b *BMulticast) *RMulticast {
-
+// NewRMulticast relays by flooding if config is nil
+func NewRMulticast(b *BMulticast, config *RMulticastConfig) *RMulticast {
+	if config == nil {
+		config = DefaultRMulticastConfig()
+	}
 	return &RMulticast{
 		bmulticast:   b,
-		received:     map[string]struct{}{},
+		config:       config,
+		incarnation:  time.Now().UnixNano(),
+		nextSeq:      1,
+		watermarks:   map[string]*originWatermark{},
+		peerAcks:     map[string]map[string]*RAck{},
+		history:      []*gossipHistoryItem{},
 		receivedLock: &sync.Mutex{},
-		router:       router.New(),
+		router:       NewProtocolRouter("r-multicast", (*RMsg)(nil)),
 	}
 }
 
-func (r *RMulticast) AddMsgIfNotExist(msgID string) bool {
+// AddMsgIfNotExist records the acks the message carries, and reports whether it is received for the first time
+func (r *RMulticast) AddMsgIfNotExist(msg *RMsg) bool {
 	r.receivedLock.Lock()
 	defer r.receivedLock.Unlock()
-	_, ok := r.received[msgID]
-	if !ok {
-		r.received[msgID] = struct{}{}
-		return true
+	r.recordAcks(msg.Acker, msg.Acks)
+	if r.received(msg) {
+		return false
 	}
-	return false
+	r.remember(msg)
+	return true
 }
 
 func (r *RMulticast) Multicast(path string, v interface{}) (err error) {
@@ -48,7 +68,25 @@ func (r *RMulticast) Multicast(path string, v interface{}) (err error) {
 		return errors.Wrap(err, "r-multicast failed")
 	}
 
+	return r.MulticastRMsg(rmsg)
+}
+
+// MulticastRMsg numbers rmsg with the next seq of this node
+func (r *RMulticast) MulticastRMsg(rmsg *RMsg) (err error) {
+	r.receivedLock.Lock()
+	rmsg.Origin = r.bmulticast.group.SelfNodeID
+	rmsg.Incarnation = r.incarnation
+	rmsg.Seq = r.nextSeq
+	r.nextSeq++
+	r.piggyback(rmsg)
+	r.receivedLock.Unlock()
+
 	err = r.bmulticast.Multicast(RMulticastPath, rmsg)
+	if multicastErr, ok := err.(*MulticastError); ok && multicastErr.Queued != 0 {
+		// the relays of the members that got it reach the others, a member ejected for its full queue is not waited for
+		logger.Warnf("r-multicast msg [%s] partially failed: %v", rmsg.ID, err)
+		return nil
+	}
 	if err != nil {
 		return errors.Wrap(err, "r-multicast failed")
 	}
@@ -56,15 +94,10 @@ func (r *RMulticast) Multicast(path string, v interface{}) (err error) {
 	return nil
 }
 
-func RMsgDecodeWrapper(f func(*RMsg) error) func(interface{}) error {
-	return func(v interface{}) error {
-		msg := v.(*RMsg)
-		return f(msg)
-	}
-}
-
 func (r *RMulticast) Bind(path string, f func(msg *RMsg) error) {
-	r.router.Bind(path, RMsgDecodeWrapper(f))
+	r.router.Bind(path, func(v interface{}) error {
+		return f(v.(*RMsg))
+	})
 }
 
 func (r *RMulticast) bindRDeliver() {
@@ -74,20 +107,21 @@ func (r *RMulticast) bindRDeliver() {
 		if err != nil {
 			return errors.Wrap(err, "r-deliver failed")
 		}
-		ok := r.AddMsgIfNotExist(rmsg.ID)
+		ok := r.AddMsgIfNotExist(rmsg)
 		if ok {
 			if msg.SrcID != r.bmulticast.group.SelfNodeID {
-				rmsgCopy := &RMsg{
-					ID:   rmsg.ID,
-					Path: rmsg.Path,
-					Body: rmsg.Body,
-				}
-				err = r.bmulticast.Multicast(RMulticastPath, rmsgCopy)
+				err = r.relay(msg.SrcID, rmsg)
 
 				if err != nil {
 					return errors.Wrap(err, "r-deliver failed")
 				}
 			}
+			if rmsg.Trace != nil {
+				rmsg.span = tracing.Start(r.bmulticast.group.SelfNodeID, "r.deliver", msg.parentSpan())
+				rmsg.span.SetAttribute("path", rmsg.Path)
+				rmsg.span.SetAttribute("origin", rmsg.Origin)
+				defer rmsg.span.End()
+			}
 			return r.router.Run(rmsg.Path, rmsg)
 		}
 		return nil
@@ -97,5 +131,17 @@ func (r *RMulticast) bindRDeliver() {
 
 func (r *RMulticast) Start(ctx context.Context) (err error) {
 	r.bindRDeliver()
-	return r.bmulticast.Start(ctx)
+	r.bindStability()
+	if r.config.Mode == PushPullMode {
+		r.bindAntiEntropy()
+	}
+	err = r.bmulticast.Start(ctx)
+	if err != nil {
+		return err
+	}
+	go r.stability(ctx)
+	if r.config.Mode == PushPullMode {
+		go r.antiEntropy(ctx)
+	}
+	return nil
 }
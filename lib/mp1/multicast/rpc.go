@@ -0,0 +1,277 @@
+package multicast
+
+import (
+	"context"
+	"fmt"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"github.com/bamboovir/cs425/lib/codec"
+	"github.com/bamboovir/cs425/lib/mp1/router"
+	"github.com/google/uuid"
+	errors "github.com/pkg/errors"
+)
+
+const (
+	RPCRequestPath  = "/rpc/request"
+	RPCResponsePath = "/rpc/response"
+	// MaxRPCHandlers bounds the requests a node serves at once, a request beyond it is answered with ErrRPCBusy
+	MaxRPCHandlers = 64
+)
+
+var (
+	ErrCalleeLost = errors.New("callee left the group")
+	ErrNoHandler  = errors.New("no handler")
+	ErrRPCBusy    = errors.New("too many rpc requests in progress")
+)
+
+// RPCError is returned by Call when the handler of the callee failed, or the callee has no handler for the path
+type RPCError struct {
+	NodeID  string
+	Path    string
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc [%s] on node [%s] failed: %s", e.Path, e.NodeID, e.Message)
+}
+
+// RPCRequestMsg ID correlates the response with the call
+type RPCRequestMsg struct {
+	ID    string `json:"id"`
+	SrcID string `json:"src"`
+	Path  string `json:"path"`
+	Body  []byte `json:"body"`
+}
+
+// RPCResponseMsg Error is the error of the handler, Body is only set if Error is empty
+type RPCResponseMsg struct {
+	ID    string `json:"id"`
+	SrcID string `json:"src"`
+	Body  []byte `json:"body,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func NewRPCRequestMsg(srcID string, path string, v interface{}) (msg *RPCRequestMsg, err error) {
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &RPCRequestMsg{
+		ID:    uuid.New().String(),
+		SrcID: srcID,
+		Path:  path,
+		Body:  data,
+	}, nil
+}
+
+func (m *RPCRequestMsg) Decode(data []byte) (msg *RPCRequestMsg, err error) {
+	err = codec.Unmarshal(data, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *RPCResponseMsg) Decode(data []byte) (msg *RPCResponseMsg, err error) {
+	err = codec.Unmarshal(data, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// rpcInvocation carries a request through the router and the result of its handler back
+type rpcInvocation struct {
+	request *RPCRequestMsg
+	resp    interface{}
+}
+
+// rpcCall an outstanding call, done receives exactly one response, or nil if the callee left the group
+type rpcCall struct {
+	dstID string
+	done  chan *RPCResponseMsg
+}
+
+// RPC request/response over B-unicast, every call waits for the response with its correlation id,
+// so any number of calls may be outstanding, to the same or to different members
+type RPC struct {
+	bmulticast  *BMulticast
+	router      *router.Router
+	pending     map[string]*rpcCall
+	pendingLock *sync.Mutex
+	handlers    chan struct{}
+}
+
+func NewRPC(b *BMulticast) *RPC {
+	r := &RPC{
+		bmulticast:  b,
+		router:      router.New(),
+		pending:     map[string]*rpcCall{},
+		pendingLock: &sync.Mutex{},
+		handlers:    make(chan struct{}, MaxRPCHandlers),
+	}
+	r.router.Use(router.Recover())
+	r.router.Fallback(func(route *router.Route, msg interface{}) error {
+		return ErrNoHandler
+	})
+	return r
+}
+
+// Handle binds the handler of path, path may be a pattern of the router, its response is encoded with the codec and its error is returned to the caller as an RPCError.
+// Every request runs in its own goroutine, so a handler may block or call other members,
+// up to MaxRPCHandlers of them run at once
+func (r *RPC) Handle(path string, f func(req *RPCRequestMsg) (resp interface{}, err error)) {
+	r.router.Bind(path, func(v interface{}) (err error) {
+		invocation := v.(*rpcInvocation)
+		invocation.resp, err = f(invocation.request)
+		return err
+	})
+}
+
+// Call sends req to path of dstID and waits for the response until ctx is done,
+// the body of the response is decoded with codec.Unmarshal
+func (r *RPC) Call(ctx context.Context, dstID string, path string, req interface{}) (resp *RPCResponseMsg, err error) {
+	request, err := NewRPCRequestMsg(r.bmulticast.group.SelfNodeID, path, req)
+	if err != nil {
+		return nil, errors.Wrap(err, "rpc call failed")
+	}
+	call := &rpcCall{
+		dstID: dstID,
+		done:  make(chan *RPCResponseMsg, 1),
+	}
+
+	r.pendingLock.Lock()
+	r.pending[request.ID] = call
+	r.pendingLock.Unlock()
+	defer func() {
+		r.pendingLock.Lock()
+		delete(r.pending, request.ID)
+		r.pendingLock.Unlock()
+	}()
+
+	err = r.bmulticast.Unicast(dstID, RPCRequestPath, request)
+	if err != nil {
+		return nil, errors.Wrap(err, "rpc call failed")
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, errors.Wrapf(ctx.Err(), "rpc [%s] on node [%s] failed", path, dstID)
+	case resp = <-call.done:
+	}
+	if resp == nil {
+		return nil, errors.Wrapf(ErrCalleeLost, "rpc [%s] on node [%s] failed", path, dstID)
+	}
+	if resp.Error != "" {
+		return resp, &RPCError{NodeID: dstID, Path: path, Message: resp.Error}
+	}
+	return resp, nil
+}
+
+// serve runs the handler of a request in a goroutine of its own, a request beyond MaxRPCHandlers is refused at once,
+// the deliver loop is never blocked on a handler, it also delivers the responses the handlers wait for
+func (r *RPC) serve(request *RPCRequestMsg) {
+	select {
+	case r.handlers <- struct{}{}:
+	default:
+		logger.Warnf("refuse rpc [%s] of node [%s]: %v", request.Path, request.SrcID, ErrRPCBusy)
+		r.respond(request, nil, ErrRPCBusy)
+		return
+	}
+	go func() {
+		defer func() { <-r.handlers }()
+		invocation := &rpcInvocation{request: request}
+		err := r.router.Run(request.Path, invocation)
+		r.respond(request, invocation.resp, err)
+	}()
+}
+
+// respond sends the result of the handler of a request back to its caller
+func (r *RPC) respond(request *RPCRequestMsg, resp interface{}, err error) {
+	response := &RPCResponseMsg{
+		ID:    request.ID,
+		SrcID: r.bmulticast.group.SelfNodeID,
+	}
+	if err == nil {
+		response.Body, err = codec.Marshal(resp)
+	}
+	if err != nil {
+		response.Body = nil
+		response.Error = err.Error()
+	}
+
+	err = r.bmulticast.Unicast(request.SrcID, RPCResponsePath, response)
+	if err != nil {
+		logger.Errorf("send response of rpc [%s] to node [%s] failed: %v", request.Path, request.SrcID, err)
+	}
+}
+
+// complete hands a response to its outstanding call, a response whose call already gave up is dropped
+func (r *RPC) complete(response *RPCResponseMsg) {
+	r.pendingLock.Lock()
+	call, ok := r.pending[response.ID]
+	if ok {
+		delete(r.pending, response.ID)
+	}
+	r.pendingLock.Unlock()
+	if !ok {
+		return
+	}
+	call.done <- response
+}
+
+// failCallsTo fails the outstanding calls to a member that left the group, instead of waiting for their deadline
+func (r *RPC) failCallsTo(nodeID string) {
+	r.pendingLock.Lock()
+	defer r.pendingLock.Unlock()
+	for id, call := range r.pending {
+		if call.dstID != nodeID {
+			continue
+		}
+		delete(r.pending, id)
+		call.done <- nil
+	}
+}
+
+func (r *RPC) watchMembers(ctx context.Context, memberUpdateChannel chan interface{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case v := <-memberUpdateChannel:
+			event, ok := v.(*MemberEvent)
+			if !ok || (event.Type != MemberDead && event.Type != MemberLeave) {
+				continue
+			}
+			r.failCallsTo(event.NodeID)
+		}
+	}
+}
+
+func (r *RPC) bindRPC() {
+	r.bmulticast.Bind(RPCRequestPath, func(msg *BMsg) error {
+		request := &RPCRequestMsg{}
+		_, err := request.Decode(msg.Body)
+		if err != nil {
+			return errors.Wrap(err, "rpc request failed")
+		}
+		r.serve(request)
+		return nil
+	})
+
+	r.bmulticast.Bind(RPCResponsePath, func(msg *BMsg) error {
+		response := &RPCResponseMsg{}
+		_, err := response.Decode(msg.Body)
+		if err != nil {
+			return errors.Wrap(err, "rpc response failed")
+		}
+		r.complete(response)
+		return nil
+	})
+}
+
+func (r *RPC) Start(ctx context.Context) {
+	memberUpdateChannel := r.bmulticast.MembersUpdate()
+	go r.watchMembers(ctx, memberUpdateChannel)
+}
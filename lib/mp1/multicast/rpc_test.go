@@ -0,0 +1,98 @@
+package multicast_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"github.com/bamboovir/cs425/lib/codec"
+	"github.com/bamboovir/cs425/lib/memnet"
+	"github.com/bamboovir/cs425/lib/mp1/multicast"
+	errors "github.com/pkg/errors"
+)
+
+// startRPCGroups starts A and B, B echoes /echo and blocks /block until release is closed
+func startRPCGroups(t *testing.T, release chan struct{}, blocked *sync.WaitGroup) map[string]*multicast.Group {
+	t.Helper()
+	network := memnet.New(&memnet.Config{Seed: 10, MaxDelay: time.Millisecond})
+	return startMemnetGroupsOf(t, network, []string{"A", "B"}, nil, func(nodeID string, g *multicast.Group) {
+		g.RPC().Handle("/echo", func(req *multicast.RPCRequestMsg) (interface{}, error) {
+			body := ""
+			err := codec.Unmarshal(req.Body, &body)
+			if err != nil {
+				return nil, err
+			}
+			return nodeID + ":" + body, nil
+		})
+		g.RPC().Handle("/block", func(req *multicast.RPCRequestMsg) (interface{}, error) {
+			blocked.Done()
+			<-release
+			return "released", nil
+		})
+	})
+}
+
+func TestRPC(t *testing.T) {
+	release := make(chan struct{})
+	blocked := &sync.WaitGroup{}
+	groups := startRPCGroups(t, release, blocked)
+	t.Cleanup(func() { close(release) })
+	call := func(timeout time.Duration, path string, req interface{}) (*multicast.RPCResponseMsg, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return groups["A"].RPC().Call(ctx, "B", path, req)
+	}
+
+	t.Run("request and response", func(t *testing.T) {
+		resp, err := call(5*time.Second, "/echo", "ping")
+		if err != nil {
+			t.Fatalf("call: %v", err)
+		}
+		body := ""
+		err = codec.Unmarshal(resp.Body, &body)
+		if err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		if body != "B:ping" || resp.SrcID != "B" {
+			t.Fatalf("response %q from node [%s], want B:ping from node [B]", body, resp.SrcID)
+		}
+	})
+
+	t.Run("unknown path", func(t *testing.T) {
+		_, err := call(5*time.Second, "/unknown", "ping")
+		rpcErr, ok := err.(*multicast.RPCError)
+		if !ok {
+			t.Fatalf("call of an unknown path returned %v, want an RPCError", err)
+		}
+		if rpcErr.NodeID != "B" || rpcErr.Path != "/unknown" || rpcErr.Message != multicast.ErrNoHandler.Error() {
+			t.Fatalf("call of an unknown path failed with %+v, want no handler on node [B]", rpcErr)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		blocked.Add(1)
+		_, err := call(100*time.Millisecond, "/block", "ping")
+		if errors.Cause(err) != context.DeadlineExceeded {
+			t.Fatalf("call of a blocked handler returned %v, want the deadline exceeded", err)
+		}
+		blocked.Wait()
+	})
+
+	t.Run("busy", func(t *testing.T) {
+		// the handler of the timeout case still blocks, fill up the others
+		blocked.Add(multicast.MaxRPCHandlers - 1)
+		for i := 1; i < multicast.MaxRPCHandlers; i++ {
+			go call(10*time.Second, "/block", "ping")
+		}
+		blocked.Wait()
+
+		_, err := call(5*time.Second, "/echo", "ping")
+		rpcErr, ok := err.(*multicast.RPCError)
+		if !ok || !strings.Contains(rpcErr.Message, multicast.ErrRPCBusy.Error()) {
+			t.Fatalf("call beyond the handler cap returned %v, want %v", err, multicast.ErrRPCBusy)
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package multicast
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	errors "github.com/pkg/errors"
+)
+
+const (
+	SendQueueReportPeriod = time.Second
+	SendQueueDrainPeriod  = 10 * time.Millisecond
+)
+
+var (
+	ErrSendQueueFull   = errors.New("send queue is full")
+	ErrSendQueueClosed = errors.New("send queue is closed")
+)
+
+// SendQueuePolicy decides what a send does once the queue of a peer is full
+type SendQueuePolicy string
+
+const (
+	SendQueueBlock SendQueuePolicy = "block"
+	SendQueueDrop  SendQueuePolicy = "drop"
+	SendQueueEject SendQueuePolicy = "eject"
+)
+
+func ParseSendQueuePolicy(policy string) (SendQueuePolicy, error) {
+	switch SendQueuePolicy(policy) {
+	case SendQueueBlock:
+		return SendQueueBlock, nil
+	case SendQueueDrop:
+		return SendQueueDrop, nil
+	case SendQueueEject:
+		return SendQueueEject, nil
+	default:
+		return "", fmt.Errorf("unrecognized send queue policy [%s]", policy)
+	}
+}
+
+// SendQueueConfig every peer has its own queue of Size messages,
+// block waits for room, drop discards the message, eject removes the peer from the group.
+// The protocols send while they hold their locks, so with block one slow peer stalls the node
+type SendQueueConfig struct {
+	Size   int
+	Policy SendQueuePolicy
+}
+
+func DefaultSendQueueConfig() *SendQueueConfig {
+	return &SendQueueConfig{
+		Size:   4096,
+		Policy: SendQueueEject,
+	}
+}
+
+// SendQueueStats is the state of the send queue of one peer
+type SendQueueStats struct {
+	NodeID   string `json:"node_id"`
+	Depth    int    `json:"depth"`
+	Capacity int    `json:"capacity"`
+	Dropped  uint64 `json:"dropped"`
+	Resend   uint64 `json:"resend"`
+}
+
+// sendQueue hands the messages of one peer to its Sender on a writer goroutine,
+// so a slow peer only stalls its own queue
+type sendQueue struct {
+	dstID   string
+	client  Sender
+	policy  SendQueuePolicy
+	queue   chan *BMsg
+	done    chan struct{}
+	dropped uint64
+	resend  uint64
+	onFail  func(err error)
+}
+
+func newSendQueue(dstID string, client Sender, config *SendQueueConfig, onFail func(err error)) *sendQueue {
+	q := &sendQueue{
+		dstID:  dstID,
+		client: client,
+		policy: config.Policy,
+		queue:  make(chan *BMsg, config.Size),
+		done:   make(chan struct{}),
+		onFail: onFail,
+	}
+	go q.run()
+	return q
+}
+
+// push returns ErrSendQueueFull if the queue is full, unless the policy blocks
+func (q *sendQueue) push(msg *BMsg) (err error) {
+	if q.policy == SendQueueBlock {
+		select {
+		case q.queue <- msg:
+			return nil
+		case <-q.done:
+			return ErrSendQueueClosed
+		}
+	}
+
+	select {
+	case q.queue <- msg:
+		return nil
+	case <-q.done:
+		return ErrSendQueueClosed
+	default:
+		atomic.AddUint64(&q.dropped, 1)
+		return ErrSendQueueFull
+	}
+}
+
+func (q *sendQueue) run() {
+	for {
+		select {
+		case <-q.done:
+			return
+		case msg := <-q.queue:
+			err := q.client.Send(msg)
+			if err == ErrReconnecting {
+				// the sender keeps it, a sender that gives up ejects the peer through OnGiveUp
+				atomic.AddUint64(&q.resend, 1)
+				continue
+			}
+			if err != nil {
+				logger.Errorf("client lost connection to [%s], write error: %v", q.dstID, err)
+				q.onFail(err)
+				return
+			}
+		}
+	}
+}
+
+func (q *sendQueue) stats() *SendQueueStats {
+	return &SendQueueStats{
+		NodeID:   q.dstID,
+		Depth:    len(q.queue),
+		Capacity: cap(q.queue),
+		Dropped:  atomic.LoadUint64(&q.dropped),
+		Resend:   atomic.LoadUint64(&q.resend),
+	}
+}
+
+// drain waits until the writer has handed every queued message to the sender, or the queue is closed, or ctx is done
+func (q *sendQueue) drain(ctx context.Context) {
+	ticker := time.NewTicker(SendQueueDrainPeriod)
+	defer ticker.Stop()
+	for len(q.queue) > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// close stops the writer, the messages left in the queue are discarded
+func (q *sendQueue) close() {
+	close(q.done)
+}
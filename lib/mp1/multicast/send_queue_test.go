@@ -0,0 +1,122 @@
+package multicast
+
+import (
+	"testing"
+	"time"
+)
+
+// stalledSender blocks every send until it is released, sending receives a signal once a send started
+type stalledSender struct {
+	sending chan struct{}
+	release chan struct{}
+}
+
+func newStalledSender() *stalledSender {
+	return &stalledSender{
+		sending: make(chan struct{}, 16),
+		release: make(chan struct{}),
+	}
+}
+
+func (s *stalledSender) Send(msg *BMsg) error {
+	s.sending <- struct{}{}
+	<-s.release
+	return nil
+}
+
+func (s *stalledSender) OnGiveUp(f func(err error)) {}
+
+func (s *stalledSender) Close() error {
+	return nil
+}
+
+// newStalledGroup is the b-multicast of node A whose send queue to B holds one message, the writer is stalled on the first one
+func newStalledGroup(t *testing.T, policy SendQueuePolicy) (*BMulticast, *stalledSender) {
+	t.Helper()
+	group := NewGroupBuilder().
+		WithSelfNodeID("A").
+		AddMember("A", "a").
+		AddMember("B", "b").
+		WithSendQueue(&SendQueueConfig{Size: 1, Policy: policy}).
+		Build()
+	b := group.B()
+	go b.memberUpdate.Start()
+	t.Cleanup(b.memberUpdate.Stop)
+
+	sender := newStalledSender()
+	t.Cleanup(func() { close(sender.release) })
+	b.AddMember("B", sender)
+	err := b.Multicast("/test", "taken by the writer")
+	if err != nil {
+		t.Fatalf("b-multicast: %v", err)
+	}
+	<-sender.sending
+	err = b.Multicast("/test", "queued")
+	if err != nil {
+		t.Fatalf("b-multicast: %v", err)
+	}
+	return b, sender
+}
+
+func TestSendQueueBlockWaitsForRoom(t *testing.T) {
+	b, sender := newStalledGroup(t, SendQueueBlock)
+
+	sent := make(chan error)
+	go func() {
+		sent <- b.Multicast("/test", "waits")
+	}()
+	select {
+	case err := <-sent:
+		t.Fatalf("b-multicast to a full queue returned %v, want it to wait", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	sender.release <- struct{}{}
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatalf("b-multicast: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("b-multicast still waits once the queue has room")
+	}
+}
+
+func TestSendQueueDropDiscardsMsg(t *testing.T) {
+	b, _ := newStalledGroup(t, SendQueueDrop)
+
+	err := b.Multicast("/test", "dropped")
+	multicastErr, ok := err.(*MulticastError)
+	if !ok {
+		t.Fatalf("b-multicast to a full queue returned %v, want a MulticastError", err)
+	}
+	if multicastErr.Errs["B"] != ErrSendQueueFull {
+		t.Fatalf("b-multicast failed for %v, want [B] with a full queue", multicastErr.Errs)
+	}
+	if !b.IsNodeAlived("B") {
+		t.Fatalf("node [B] is removed by the drop policy")
+	}
+	if stats := b.SendQueueStats(); len(stats) != 1 || stats[0].Dropped != 1 {
+		t.Fatalf("send queue stats %+v, want 1 msg dropped for [B]", stats[0])
+	}
+}
+
+func TestSendQueueEjectRemovesPeer(t *testing.T) {
+	b, _ := newStalledGroup(t, SendQueueEject)
+
+	err := b.Multicast("/test", "ejects")
+	multicastErr, ok := err.(*MulticastError)
+	if !ok {
+		t.Fatalf("b-multicast to a full queue returned %v, want a MulticastError", err)
+	}
+	if multicastErr.Errs["B"] != ErrSendQueueFull {
+		t.Fatalf("b-multicast failed for %v, want [B] with a full queue", multicastErr.Errs)
+	}
+	if b.IsNodeAlived("B") {
+		t.Fatalf("node [B] is still a member after its queue was full")
+	}
+	err = b.Unicast("B", "/test", "after eject")
+	if err == nil {
+		t.Fatalf("b-unicast to the ejected node [B] succeeded")
+	}
+}
@@ -0,0 +1,652 @@
+package multicast
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"github.com/bamboovir/cs425/lib/codec"
+	"github.com/bamboovir/cs425/lib/mp1/metrics"
+	"github.com/bamboovir/cs425/lib/mp1/router"
+	"github.com/bamboovir/cs425/lib/mp1/tracing"
+	errors "github.com/pkg/errors"
+)
+
+const (
+	SequencerDataPath  = "/sequencer/data"
+	SequencerOrderPath = "/sequencer/order"
+	// SequencerTakeoverPath the rpc a new sequencer calls on every survivor before it assigns a seq
+	SequencerTakeoverPath = "/sequencer/takeover"
+)
+
+const (
+	RecentDeliveredMax = 4096
+	// TakeoverTimeout bounds the wait for the delivered seqs of a survivor, a survivor that does not answer is left out
+	TakeoverTimeout = 2 * time.Second
+)
+
+// SequencerTotalOrding orders messages through a single sequencer node.
+// With a fixed sequencer the group stalls once the sequencer crashes,
+// with an elected sequencer every crash starts a new epoch, its sequencer is picked from the view by the epoch number,
+// so the members agree on it without talking to each other. A member adopts a newer epoch at its first order.
+// The new sequencer asks the survivors for the orders they delivered first, so it never assigns a seq one of them delivered.
+type SequencerTotalOrding struct {
+	bmulticast        *BMulticast
+	rmulticast        *RMulticast
+	router            *router.Router
+	fixedSequencerID  string
+	sequencerID       string
+	epoch             uint64
+	epochStart        uint64
+	pending           map[string]*SequencerDataMsg
+	orders            map[uint64]string
+	ordered           map[string]uint64
+	nextAssignSeqNum  uint64
+	nextDeliverSeqNum uint64
+	maxOrderSeqNum    uint64
+	recentDelivered   []string
+	delivered         map[string]uint64
+	deliveryPaused    bool
+	admission         *Admission
+	sequencerLock     *sync.Mutex
+}
+
+func NewSequencerTotalOrder(b *BMulticast, r *RMulticast, sequencerID string) *SequencerTotalOrding {
+	return &SequencerTotalOrding{
+		bmulticast:        b,
+		rmulticast:        r,
+		router:            NewProtocolRouter("to-multicast", (*TOMsg)(nil)),
+		fixedSequencerID:  sequencerID,
+		sequencerID:       sequencerID,
+		pending:           map[string]*SequencerDataMsg{},
+		orders:            map[uint64]string{},
+		ordered:           map[string]uint64{},
+		nextAssignSeqNum:  1,
+		nextDeliverSeqNum: 1,
+		maxOrderSeqNum:    0,
+		recentDelivered:   []string{},
+		delivered:         map[string]uint64{},
+		deliveryPaused:    false,
+		admission:         b.group.admission,
+		sequencerLock:     &sync.Mutex{},
+	}
+}
+
+func (s *SequencerTotalOrding) Start(ctx context.Context) (err error) {
+	s.bindTODeliver()
+	s.bmulticast.group.rpc.Handle(SequencerTakeoverPath, s.serveTakeover)
+
+	// elect before the first order can arrive
+	s.sequencerLock.Lock()
+	if s.sequencerID == "" {
+		s.sequencerID = s.sequencerOf(s.epoch)
+	}
+	logger.Infof("sequencer of group is [%s]", s.sequencerID)
+	s.sequencerLock.Unlock()
+
+	err = s.rmulticast.Start(ctx)
+	if err != nil {
+		return err
+	}
+
+	memberUpdateChannel := s.bmulticast.MembersUpdate()
+	go s.watchSequencer(ctx, memberUpdateChannel)
+	return nil
+}
+
+func (s *SequencerTotalOrding) Bind(path string, f func(msg *TOMsg) error) {
+	s.router.Bind(path, func(v interface{}) error {
+		return f(v.(*TOMsg))
+	})
+}
+
+// Multicast waits for admission without a deadline
+func (s *SequencerTotalOrding) Multicast(path string, v interface{}) (err error) {
+	return s.MulticastContext(context.Background(), path, v)
+}
+
+func (s *SequencerTotalOrding) MulticastContext(ctx context.Context, path string, v interface{}) (err error) {
+	tomsg, err := NewTOMsg(path, v)
+	if err != nil {
+		return errors.Wrap(err, "to-multicast failed")
+	}
+	span := tracing.Start(s.bmulticast.group.SelfNodeID, "to.multicast", nil)
+	tomsg.Trace = span.Context()
+	tomsgBytes, err := tomsg.Encode()
+	if err != nil {
+		return errors.Wrap(err, "to-multicast failed")
+	}
+	dataMsg := NewSequencerDataMsg(s.bmulticast.group.SelfNodeID, tomsgBytes)
+	dataMsg.Trace = span.Context()
+	span.SetAttribute("msg_id", dataMsg.MsgID)
+	span.SetAttribute("path", path)
+
+	err = s.admission.Acquire(ctx, path, dataMsg.MsgID)
+	if err != nil {
+		span.SetAttribute("error", err.Error())
+		span.End()
+		return errors.Wrap(err, "to-multicast failed")
+	}
+	tracing.Park(dataMsg.MsgID, span)
+	metrics.NewMulticastLogEntry(s.bmulticast.group.SelfNodeID, dataMsg.MsgID, SHA1(string(tomsgBytes))).Log()
+	metrics.TrackTOMulticast(s.bmulticast.group.SelfNodeID, dataMsg.MsgID)
+	err = s.rmulticast.Multicast(SequencerDataPath, dataMsg)
+	if err != nil {
+		s.admission.Leave(dataMsg.MsgID)
+		metrics.ForgetTOMulticast(s.bmulticast.group.SelfNodeID, dataMsg.MsgID)
+		span.SetAttribute("error", err.Error())
+		tracing.Unpark(dataMsg.MsgID).End()
+		return errors.Wrap(err, "to-multicast failed")
+	}
+	return nil
+}
+
+// sequencerOf returns the sequencer of epoch, the member of the view at index epoch
+func (s *SequencerTotalOrding) sequencerOf(epoch uint64) string {
+	members := s.bmulticast.group.membership.View().Members
+	if len(members) == 0 {
+		return s.bmulticast.group.SelfNodeID
+	}
+	return members[epoch%uint64(len(members))].ID
+}
+
+// electSequencer returns the first epoch after the current one whose sequencer this node still reaches, and its sequencer,
+// caller should hold sequencerLock
+func (s *SequencerTotalOrding) electSequencer() (epoch uint64, sequencerID string) {
+	members := s.bmulticast.group.membership.View().Members
+	for i := 1; i <= len(members); i++ {
+		epoch = s.epoch + uint64(i)
+		sequencerID = s.sequencerOf(epoch)
+		if sequencerID == s.bmulticast.group.SelfNodeID || s.bmulticast.IsNodeAlived(sequencerID) {
+			return epoch, sequencerID
+		}
+	}
+	return s.epoch + 1, s.bmulticast.group.SelfNodeID
+}
+
+// adoptEpoch switches to a newer epoch, the orders of older epochs at or after start are superseded,
+// their messages are ordered again by the new sequencer. caller should hold sequencerLock
+func (s *SequencerTotalOrding) adoptEpoch(epoch uint64, sequencerID string, start uint64) {
+	logger.Infof("adopt epoch [%d] of sequencer [%s] from seq %d, previous sequencer [%s]", epoch, sequencerID, start, s.sequencerID)
+	s.epoch = epoch
+	s.epochStart = start
+	s.sequencerID = sequencerID
+	for seq, msgID := range s.orders {
+		if seq < start {
+			continue
+		}
+		delete(s.orders, seq)
+		if s.ordered[msgID] == seq {
+			delete(s.ordered, msgID)
+		}
+	}
+	if start > 0 {
+		s.maxOrderSeqNum = MinUint64(s.maxOrderSeqNum, start-1)
+	}
+}
+
+func (s *SequencerTotalOrding) isSequencer() bool {
+	return s.sequencerID == s.bmulticast.group.SelfNodeID
+}
+
+// assignSeq is called by the sequencer only, caller should hold sequencerLock
+func (s *SequencerTotalOrding) assignSeq(msgID string) error {
+	if _, ok := s.ordered[msgID]; ok {
+		return nil
+	}
+	orderMsg := NewSequencerOrderMsg(s.sequencerID, s.epoch, s.epochStart, msgID, s.nextAssignSeqNum)
+	s.nextAssignSeqNum++
+	return s.rmulticast.Multicast(SequencerOrderPath, orderMsg)
+}
+
+// deliver hands every message that is both ordered and received to the router, caller should hold sequencerLock
+func (s *SequencerTotalOrding) deliver() {
+	defer func() {
+		metrics.HoldQueueDepth.Set(float64(len(s.pending)), s.bmulticast.group.SelfNodeID)
+	}()
+	if s.deliveryPaused {
+		return
+	}
+
+	for {
+		msgID, ok := s.orders[s.nextDeliverSeqNum]
+		if !ok {
+			return
+		}
+		if _, ok := s.delivered[msgID]; ok {
+			// ordered by an older epoch before the new sequencer ordered it again
+			logger.Infof("skip seq %d of delivered msg [%s]", s.nextDeliverSeqNum, msgID)
+			delete(s.orders, s.nextDeliverSeqNum)
+			s.nextDeliverSeqNum++
+			continue
+		}
+		dataMsg, ok := s.pending[msgID]
+		if !ok {
+			return
+		}
+
+		logger.Infof("TO deliver [%d:%s][%s]", s.nextDeliverSeqNum, s.sequencerID, msgID)
+		metrics.NewDelayLogEntry(s.bmulticast.group.SelfNodeID, msgID).Log()
+		metrics.NewDeliverLogEntry(s.bmulticast.group.SelfNodeID, msgID, s.nextDeliverSeqNum, s.sequencerID, SHA1(string(dataMsg.Body))).Log()
+		metrics.ObserveTODelivery(s.bmulticast.group.SelfNodeID, msgID)
+		delete(s.pending, msgID)
+		delete(s.ordered, msgID)
+		delete(s.orders, s.nextDeliverSeqNum)
+		s.admission.Leave(msgID)
+		s.nextDeliverSeqNum++
+		s.remember(msgID, s.nextDeliverSeqNum-1)
+
+		tomsg := &TOMsg{}
+		_, err := tomsg.Decode(dataMsg.Body)
+		if err != nil {
+			logger.Errorf("decode to msg [%s] failed: %v", msgID, err)
+			continue
+		}
+		span := tracing.Start(s.bmulticast.group.SelfNodeID, "to.deliver", tomsg.Trace)
+		span.SetAttribute("path", tomsg.Path)
+		span.SetAttribute("seq", strconv.FormatUint(s.nextDeliverSeqNum-1, 10))
+		err = s.router.Run(tomsg.Path, tomsg)
+		span.End()
+		tracing.Unpark(msgID).End()
+		if err != nil {
+			logger.Errorf("process err %v", err)
+		}
+	}
+}
+
+// remember records a delivered msg id and its seq, 0 if the seq is unknown, caller should hold sequencerLock
+func (s *SequencerTotalOrding) remember(msgID string, seq uint64) {
+	s.recentDelivered = append(s.recentDelivered, msgID)
+	s.delivered[msgID] = seq
+	if len(s.recentDelivered) > RecentDeliveredMax {
+		delete(s.delivered, s.recentDelivered[0])
+		s.recentDelivered = s.recentDelivered[1:]
+	}
+}
+
+// receiveData caller should hold sequencerLock
+func (s *SequencerTotalOrding) receiveData(dataMsg *SequencerDataMsg) (err error) {
+	if _, ok := s.delivered[dataMsg.MsgID]; ok {
+		return nil
+	}
+	s.pending[dataMsg.MsgID] = dataMsg
+	s.admission.Enter(dataMsg.MsgID, dataMsg.SrcID)
+	if s.isSequencer() {
+		err = s.assignSeq(dataMsg.MsgID)
+		if err != nil {
+			return err
+		}
+	}
+	s.deliver()
+	return nil
+}
+
+// receiveOrder caller should hold sequencerLock
+func (s *SequencerTotalOrding) receiveOrder(orderMsg *SequencerOrderMsg) {
+	switch {
+	case orderMsg.Epoch > s.epoch:
+		s.adoptEpoch(orderMsg.Epoch, orderMsg.SequencerID, orderMsg.EpochStart)
+	case orderMsg.Epoch < s.epoch && orderMsg.Seq >= s.epochStart:
+		logger.Infof("ignore order [%d][%s] of epoch [%d] superseded by epoch [%d]", orderMsg.Seq, orderMsg.MsgID, orderMsg.Epoch, s.epoch)
+		return
+	case orderMsg.Epoch == s.epoch && orderMsg.SequencerID != s.sequencerID:
+		logger.Errorf("ignore order [%d][%s] from sequencer [%s], sequencer of epoch [%d] is [%s]", orderMsg.Seq, orderMsg.MsgID, orderMsg.SequencerID, s.epoch, s.sequencerID)
+		return
+	}
+
+	if orderMsg.Seq < s.nextDeliverSeqNum {
+		return
+	}
+
+	s.orders[orderMsg.Seq] = orderMsg.MsgID
+	s.ordered[orderMsg.MsgID] = orderMsg.Seq
+	s.maxOrderSeqNum = MaxUint64(s.maxOrderSeqNum, orderMsg.Seq)
+	s.deliver()
+}
+
+func (s *SequencerTotalOrding) bindTODeliver() {
+	s.rmulticast.Bind(SequencerDataPath, func(msg *RMsg) error {
+		dataMsg := &SequencerDataMsg{}
+		_, err := dataMsg.Decode(msg.Body)
+		if err != nil {
+			return errors.Wrap(err, "sequencer-data failed")
+		}
+
+		defer s.bmulticast.group.catchUp.forward(msg)
+		s.sequencerLock.Lock()
+		defer s.sequencerLock.Unlock()
+
+		err = s.receiveData(dataMsg)
+		if err != nil {
+			return errors.Wrap(err, "sequencer-data failed")
+		}
+		return nil
+	})
+
+	s.rmulticast.Bind(SequencerOrderPath, func(msg *RMsg) error {
+		orderMsg := &SequencerOrderMsg{}
+		_, err := orderMsg.Decode(msg.Body)
+		if err != nil {
+			return errors.Wrap(err, "sequencer-order failed")
+		}
+
+		defer s.bmulticast.group.catchUp.forward(msg)
+		s.sequencerLock.Lock()
+		defer s.sequencerLock.Unlock()
+
+		s.receiveOrder(orderMsg)
+		return nil
+	})
+}
+
+// Stats reports the received messages waiting for their order or for the messages before them,
+// the head of line is the next seq to deliver, its msg id is empty until the sequencer orders it
+func (s *SequencerTotalOrding) Stats() *TotalOrderStats {
+	s.sequencerLock.Lock()
+	defer s.sequencerLock.Unlock()
+
+	stats := &TotalOrderStats{
+		Strategy:        string(SequencerStrategy),
+		MaxAgreementSeq: s.maxOrderSeqNum,
+		DeliveryPaused:  s.deliveryPaused,
+		HoldQueue:       make([]*HoldQueueItemStats, 0, len(s.pending)),
+		PendingVotes:    []*PendingVotesStats{},
+	}
+	if s.isSequencer() {
+		stats.MaxProposalSeq = s.nextAssignSeqNum - 1
+	}
+	for msgID, dataMsg := range s.pending {
+		seq, ordered := s.ordered[msgID]
+		stats.HoldQueue = append(stats.HoldQueue, &HoldQueueItemStats{
+			MsgID:     msgID,
+			OriginID:  dataMsg.SrcID,
+			Seq:       seq,
+			ProcessID: s.sequencerID,
+			Agreed:    ordered,
+		})
+	}
+	sort.Slice(stats.HoldQueue, func(i, j int) bool {
+		a, b := stats.HoldQueue[i], stats.HoldQueue[j]
+		if a.Agreed != b.Agreed {
+			return a.Agreed
+		}
+		if a.Seq != b.Seq {
+			return a.Seq < b.Seq
+		}
+		return a.MsgID < b.MsgID
+	})
+
+	head := &HoldQueueItemStats{
+		MsgID:     s.orders[s.nextDeliverSeqNum],
+		Seq:       s.nextDeliverSeqNum,
+		ProcessID: s.sequencerID,
+		Agreed:    s.orders[s.nextDeliverSeqNum] != "",
+	}
+	if dataMsg, ok := s.pending[head.MsgID]; ok {
+		head.OriginID = dataMsg.SrcID
+	}
+	if head.Agreed || len(s.pending) > 0 {
+		stats.HeadOfLine = head
+	}
+	return stats
+}
+
+// serveTakeover answers a new sequencer with the highest seq this node delivered and the orders it delivered from since on
+func (s *SequencerTotalOrding) serveTakeover(req *RPCRequestMsg) (resp interface{}, err error) {
+	takeoverMsg := &SequencerTakeoverMsg{}
+	err = codec.Unmarshal(req.Body, takeoverMsg)
+	if err != nil {
+		return nil, errors.Wrap(err, "sequencer-takeover failed")
+	}
+
+	s.sequencerLock.Lock()
+	defer s.sequencerLock.Unlock()
+	deliveredMsg := &SequencerDeliveredMsg{
+		MaxDeliveredSeqNum: s.nextDeliverSeqNum - 1,
+		Orders:             map[uint64]string{},
+	}
+	for msgID, seq := range s.delivered {
+		if seq != 0 && seq >= takeoverMsg.Since {
+			deliveredMsg.Orders[seq] = msgID
+		}
+	}
+	return deliveredMsg, nil
+}
+
+// collectDelivered asks every survivor for the orders it delivered from since on, and merges their answers
+func (s *SequencerTotalOrding) collectDelivered(ctx context.Context, since uint64) *SequencerDeliveredMsg {
+	collected := &SequencerDeliveredMsg{Orders: map[uint64]string{}}
+	lock := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for _, nodeID := range s.bmulticast.MemberIDs() {
+		if nodeID == s.bmulticast.group.SelfNodeID {
+			continue
+		}
+		wg.Add(1)
+		go func(nodeID string) {
+			defer wg.Done()
+			callCtx, cancel := context.WithTimeout(ctx, TakeoverTimeout)
+			defer cancel()
+			resp, err := s.bmulticast.group.rpc.Call(callCtx, nodeID, SequencerTakeoverPath, &SequencerTakeoverMsg{Since: since})
+			if err != nil {
+				logger.Errorf("collect delivered seqs of node [%s] failed: %v", nodeID, err)
+				return
+			}
+			deliveredMsg := &SequencerDeliveredMsg{}
+			err = codec.Unmarshal(resp.Body, deliveredMsg)
+			if err != nil {
+				logger.Errorf("decode delivered seqs of node [%s] failed: %v", nodeID, err)
+				return
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			collected.MaxDeliveredSeqNum = MaxUint64(collected.MaxDeliveredSeqNum, deliveredMsg.MaxDeliveredSeqNum)
+			for seq, msgID := range deliveredMsg.Orders {
+				collected.Orders[seq] = msgID
+			}
+		}(nodeID)
+	}
+	wg.Wait()
+	return collected
+}
+
+// takeOver starts epoch with this node as sequencer after the highest seq any survivor delivered.
+// The orders a survivor delivered and this node lost are installed and announced again under epoch, so every survivor
+// delivers them before the new orders, then every message the old sequencer left behind is ordered.
+// caller should hold sequencerLock
+func (s *SequencerTotalOrding) takeOver(epoch uint64, survivors *SequencerDeliveredMsg) {
+	for seq, msgID := range survivors.Orders {
+		if seq < s.nextDeliverSeqNum {
+			continue
+		}
+		if previous, ok := s.ordered[msgID]; ok && previous != seq {
+			delete(s.orders, previous)
+		}
+		if previous, ok := s.orders[seq]; ok && previous != msgID {
+			delete(s.ordered, previous)
+		}
+		s.orders[seq] = msgID
+		s.ordered[msgID] = seq
+		s.maxOrderSeqNum = MaxUint64(s.maxOrderSeqNum, seq)
+	}
+
+	s.nextAssignSeqNum = MaxUint64(MaxUint64(s.maxOrderSeqNum, s.nextDeliverSeqNum-1), survivors.MaxDeliveredSeqNum) + 1
+	s.adoptEpoch(epoch, s.bmulticast.group.SelfNodeID, s.nextAssignSeqNum)
+
+	seqs := make([]uint64, 0, len(s.orders))
+	for seq := range s.orders {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	for _, seq := range seqs {
+		orderMsg := NewSequencerOrderMsg(s.sequencerID, s.epoch, s.epochStart, s.orders[seq], seq)
+		err := s.rmulticast.Multicast(SequencerOrderPath, orderMsg)
+		if err != nil {
+			logger.Errorf("sequencer take over failed to announce order [%d][%s] again: %v", seq, orderMsg.MsgID, err)
+		}
+	}
+
+	unordered := make([]string, 0)
+	for msgID := range s.pending {
+		if _, ok := s.ordered[msgID]; !ok {
+			unordered = append(unordered, msgID)
+		}
+	}
+	sort.Strings(unordered)
+
+	logger.Infof("node [%s] take over sequencer of epoch [%d], announce %d orders again, order %d pending msgs from seq %d", s.sequencerID, s.epoch, len(seqs), len(unordered), s.nextAssignSeqNum)
+	for _, msgID := range unordered {
+		err := s.assignSeq(msgID)
+		if err != nil {
+			logger.Errorf("sequencer take over failed to order msg [%s]: %v", msgID, err)
+		}
+	}
+	s.deliver()
+}
+
+func (s *SequencerTotalOrding) watchSequencer(ctx context.Context, memberUpdateChannel chan interface{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-memberUpdateChannel:
+			s.sequencerLock.Lock()
+			sequencerID := s.sequencerID
+			s.sequencerLock.Unlock()
+
+			if s.bmulticast.IsNodeAlived(sequencerID) {
+				continue
+			}
+
+			if s.fixedSequencerID != "" {
+				logger.Errorf("fixed sequencer [%s] crashed, total ording stalls", sequencerID)
+				continue
+			}
+
+			// give the relays of the crashed sequencer's last orders time to arrive
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(NodeCrashTimeout):
+			}
+
+			s.sequencerLock.Lock()
+			if s.sequencerID != sequencerID || s.bmulticast.IsNodeAlived(sequencerID) {
+				// a newer epoch is adopted already
+				s.sequencerLock.Unlock()
+				continue
+			}
+			epoch, electedID := s.electSequencer()
+			since := s.nextDeliverSeqNum
+			s.sequencerLock.Unlock()
+			logger.Infof("sequencer [%s] crashed, sequencer of epoch [%d] is [%s]", sequencerID, epoch, electedID)
+			if electedID != s.bmulticast.group.SelfNodeID {
+				continue
+			}
+
+			// the survivors answer without sequencerLock held here, their orders may still arrive meanwhile
+			survivors := s.collectDelivered(ctx, since)
+			s.sequencerLock.Lock()
+			if s.epoch >= epoch {
+				// a newer epoch is adopted already
+				s.sequencerLock.Unlock()
+				continue
+			}
+			s.takeOver(epoch, survivors)
+			s.sequencerLock.Unlock()
+		}
+	}
+}
+
+type sequencerState struct {
+	SequencerID       string              `json:"sequencer"`
+	Epoch             uint64              `json:"epoch"`
+	EpochStart        uint64              `json:"epoch_start"`
+	Pending           []*SequencerDataMsg `json:"pending"`
+	Orders            map[uint64]string   `json:"orders"`
+	NextDeliverSeqNum uint64              `json:"next_deliver_seq"`
+	MaxOrderSeqNum    uint64              `json:"max_order_seq"`
+	RecentDelivered   []string            `json:"recent_delivered"`
+}
+
+// snapshotDeliveryState is called by a TO handler, sequencerLock is already held
+func (s *SequencerTotalOrding) snapshotDeliveryState() ([]byte, error) {
+	state := &sequencerState{
+		SequencerID:       s.sequencerID,
+		Epoch:             s.epoch,
+		EpochStart:        s.epochStart,
+		Pending:           make([]*SequencerDataMsg, 0, len(s.pending)),
+		Orders:            map[uint64]string{},
+		NextDeliverSeqNum: s.nextDeliverSeqNum,
+		MaxOrderSeqNum:    s.maxOrderSeqNum,
+		RecentDelivered:   s.recentDelivered,
+	}
+	for _, dataMsg := range s.pending {
+		state.Pending = append(state.Pending, dataMsg)
+	}
+	for seq, msgID := range s.orders {
+		state.Orders[seq] = msgID
+	}
+	return json.Marshal(state)
+}
+
+func (s *SequencerTotalOrding) restoreDeliveryState(data []byte) error {
+	state := &sequencerState{}
+	err := json.Unmarshal(data, state)
+	if err != nil {
+		return err
+	}
+
+	s.sequencerLock.Lock()
+	defer s.sequencerLock.Unlock()
+
+	if state.Epoch > s.epoch {
+		s.adoptEpoch(state.Epoch, state.SequencerID, state.EpochStart)
+	} else if state.Epoch == s.epoch {
+		s.sequencerID = state.SequencerID
+	}
+	s.nextDeliverSeqNum = state.NextDeliverSeqNum
+	s.maxOrderSeqNum = MaxUint64(s.maxOrderSeqNum, state.MaxOrderSeqNum)
+	s.recentDelivered = []string{}
+	s.delivered = map[string]uint64{}
+	for _, msgID := range state.RecentDelivered {
+		s.remember(msgID, 0)
+	}
+
+	for seq, msgID := range s.orders {
+		if seq < s.nextDeliverSeqNum {
+			delete(s.orders, seq)
+			delete(s.ordered, msgID)
+			delete(s.pending, msgID)
+			s.admission.Leave(msgID)
+		}
+	}
+	for _, msgID := range state.RecentDelivered {
+		delete(s.pending, msgID)
+		delete(s.ordered, msgID)
+		s.admission.Leave(msgID)
+	}
+	for _, dataMsg := range state.Pending {
+		s.pending[dataMsg.MsgID] = dataMsg
+		s.admission.Enter(dataMsg.MsgID, dataMsg.SrcID)
+	}
+	for seq, msgID := range state.Orders {
+		s.orders[seq] = msgID
+		s.ordered[msgID] = seq
+	}
+
+	s.deliveryPaused = false
+	s.deliver()
+	return nil
+}
+
+func (s *SequencerTotalOrding) pauseDelivery() {
+	s.sequencerLock.Lock()
+	defer s.sequencerLock.Unlock()
+	s.deliveryPaused = true
+}
@@ -0,0 +1,235 @@
+package multicast
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"github.com/bamboovir/cs425/lib/codec"
+)
+
+func newTestSequencer(t *testing.T, selfID string) (*SequencerTotalOrding, *[]string) {
+	t.Helper()
+	group := NewGroupBuilder().
+		WithSelfNodeID(selfID).
+		AddMember("A", "a").
+		AddMember("B", "b").
+		AddMember("C", "c").
+		WithTotalOrderStrategy(SequencerStrategy).
+		Build()
+	s := group.TO().(*SequencerTotalOrding)
+	s.sequencerID = s.sequencerOf(0)
+	delivered := &[]string{}
+	s.Bind("/test", func(msg *TOMsg) error {
+		body := ""
+		err := codec.Unmarshal(msg.Body, &body)
+		if err != nil {
+			t.Fatalf("decode body: %v", err)
+		}
+		*delivered = append(*delivered, body)
+		return nil
+	})
+	return s, delivered
+}
+
+func newTestSequencerData(t *testing.T, s *SequencerTotalOrding, body string) string {
+	t.Helper()
+	tomsg, err := NewTOMsg("/test", body)
+	if err != nil {
+		t.Fatalf("new to msg: %v", err)
+	}
+	data, err := tomsg.Encode()
+	if err != nil {
+		t.Fatalf("encode to msg: %v", err)
+	}
+	dataMsg := NewSequencerDataMsg("A", data)
+	s.sequencerLock.Lock()
+	defer s.sequencerLock.Unlock()
+	err = s.receiveData(dataMsg)
+	if err != nil {
+		t.Fatalf("receive data: %v", err)
+	}
+	return dataMsg.MsgID
+}
+
+func receiveTestOrder(s *SequencerTotalOrding, sequencerID string, epoch uint64, epochStart uint64, msgID string, seq uint64) {
+	s.sequencerLock.Lock()
+	defer s.sequencerLock.Unlock()
+	s.receiveOrder(NewSequencerOrderMsg(sequencerID, epoch, epochStart, msgID, seq))
+}
+
+func TestSequencerAdoptsNewerEpoch(t *testing.T) {
+	s, delivered := newTestSequencer(t, "B")
+	if s.sequencerID != "A" {
+		t.Fatalf("sequencer of epoch 0 is [%s], want [A]", s.sequencerID)
+	}
+	m1 := newTestSequencerData(t, s, "m1")
+	m2 := newTestSequencerData(t, s, "m2")
+	m3 := newTestSequencerData(t, s, "m3")
+
+	receiveTestOrder(s, "A", 0, 0, m1, 1)
+	// C took over in epoch 2 before this node found A crashed
+	receiveTestOrder(s, "C", 2, 2, m3, 2)
+	// a late order of A is superseded by epoch 2
+	receiveTestOrder(s, "A", 0, 0, m2, 2)
+	receiveTestOrder(s, "C", 2, 2, m2, 3)
+
+	if want := []string{"m1", "m3", "m2"}; !reflect.DeepEqual(*delivered, want) {
+		t.Fatalf("delivered %v, want %v", *delivered, want)
+	}
+	if s.epoch != 2 || s.sequencerID != "C" {
+		t.Fatalf("epoch [%d] of sequencer [%s], want epoch [2] of sequencer [C]", s.epoch, s.sequencerID)
+	}
+}
+
+func TestSequencerSkipsMsgOrderedByTwoEpochs(t *testing.T) {
+	s, delivered := newTestSequencer(t, "B")
+	m1 := newTestSequencerData(t, s, "m1")
+	m2 := newTestSequencerData(t, s, "m2")
+
+	// C only saw the order of m2, it orders m1 again from seq 3
+	receiveTestOrder(s, "C", 1, 3, m1, 3)
+	receiveTestOrder(s, "A", 0, 0, m1, 1)
+	receiveTestOrder(s, "A", 0, 0, m2, 2)
+
+	if want := []string{"m1", "m2"}; !reflect.DeepEqual(*delivered, want) {
+		t.Fatalf("delivered %v, want %v", *delivered, want)
+	}
+	if s.nextDeliverSeqNum != 4 {
+		t.Fatalf("next deliver seq %d, want 4", s.nextDeliverSeqNum)
+	}
+}
+
+func TestSequencerElectsFromView(t *testing.T) {
+	s, _ := newTestSequencer(t, "C")
+	s.sequencerLock.Lock()
+	defer s.sequencerLock.Unlock()
+	// neither A nor B is reached, the sequencer of epoch 1 is B, so C is the sequencer of epoch 2
+	epoch, sequencerID := s.electSequencer()
+	if epoch != 2 || sequencerID != "C" {
+		t.Fatalf("elect epoch [%d] of sequencer [%s], want epoch [2] of sequencer [C]", epoch, sequencerID)
+	}
+}
+
+// orderRecorder a sender that records the sequencer orders sent to a member
+type orderRecorder struct {
+	orders []*SequencerOrderMsg
+	lock   *sync.Mutex
+}
+
+func newOrderRecorder() *orderRecorder {
+	return &orderRecorder{orders: []*SequencerOrderMsg{}, lock: &sync.Mutex{}}
+}
+
+func (r *orderRecorder) Send(msg *BMsg) error {
+	rmsg := &RMsg{}
+	_, err := rmsg.Decode(msg.Body)
+	if err != nil || rmsg.Path != SequencerOrderPath {
+		return err
+	}
+	orderMsg := &SequencerOrderMsg{}
+	_, err = orderMsg.Decode(rmsg.Body)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.orders = append(r.orders, orderMsg)
+	return nil
+}
+
+func (r *orderRecorder) OnGiveUp(f func(err error)) {}
+
+func (r *orderRecorder) Close() error {
+	return nil
+}
+
+func (r *orderRecorder) wait(t *testing.T, n int) []*SequencerOrderMsg {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.lock.Lock()
+		orders := append([]*SequencerOrderMsg{}, r.orders...)
+		r.lock.Unlock()
+		if len(orders) >= n {
+			return orders
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d orders sent, want %d", len(orders), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSequencerTakeoverDeliversOrderLostBySelf(t *testing.T) {
+	s, delivered := newTestSequencer(t, "B")
+	recorder := newOrderRecorder()
+	s.bmulticast.AddMember("C", recorder)
+	m1 := newTestSequencerData(t, s, "m1")
+	m2 := newTestSequencerData(t, s, "m2")
+	m3 := newTestSequencerData(t, s, "m3")
+	receiveTestOrder(s, "A", 0, 0, m1, 1)
+
+	// A crashed, B lost its order of m2 that C delivered
+	s.sequencerLock.Lock()
+	s.takeOver(1, &SequencerDeliveredMsg{MaxDeliveredSeqNum: 2, Orders: map[uint64]string{2: m2}})
+	s.sequencerLock.Unlock()
+
+	if want := []string{"m1", "m2"}; !reflect.DeepEqual(*delivered, want) {
+		t.Fatalf("delivered %v, want %v", *delivered, want)
+	}
+	orders := recorder.wait(t, 2)
+	if order := orders[0]; order.MsgID != m2 || order.Seq != 2 || order.Epoch != 1 || order.EpochStart != 3 {
+		t.Fatalf("first order of the takeover %+v, want the lost order of m2 at seq 2 announced in epoch 1 from 3", order)
+	}
+	// seq 2 is delivered by C, m3 is ordered after it
+	if order := orders[1]; order.MsgID != m3 || order.Seq != 3 {
+		t.Fatalf("second order of the takeover %+v, want m3 at seq 3", order)
+	}
+}
+
+func TestSequencerTakeoverAnnouncesOrderLostBySurvivor(t *testing.T) {
+	s, _ := newTestSequencer(t, "B")
+	recorder := newOrderRecorder()
+	s.bmulticast.AddMember("C", recorder)
+	m1 := newTestSequencerData(t, s, "m1")
+	m2 := newTestSequencerData(t, s, "m2")
+	receiveTestOrder(s, "A", 0, 0, m1, 1)
+	// the order of m2 is held behind the data B misses, C lost both
+	receiveTestOrder(s, "A", 0, 0, "missing", 2)
+	receiveTestOrder(s, "A", 0, 0, m2, 3)
+
+	s.sequencerLock.Lock()
+	s.takeOver(1, &SequencerDeliveredMsg{MaxDeliveredSeqNum: 1, Orders: map[uint64]string{}})
+	s.sequencerLock.Unlock()
+
+	orders := recorder.wait(t, 2)
+	for i, want := range []string{"missing", m2} {
+		if order := orders[i]; order.MsgID != want || order.Seq != uint64(i+2) || order.Epoch != 1 || order.EpochStart != 4 {
+			t.Fatalf("order %d of the takeover %+v, want [%s] at seq %d announced in epoch 1 from 4", i, order, want, i+2)
+		}
+	}
+}
+
+func TestSequencerServesDeliveredOrders(t *testing.T) {
+	s, _ := newTestSequencer(t, "C")
+	m1 := newTestSequencerData(t, s, "m1")
+	m2 := newTestSequencerData(t, s, "m2")
+	receiveTestOrder(s, "A", 0, 0, m1, 1)
+	receiveTestOrder(s, "A", 0, 0, m2, 2)
+
+	request, err := NewRPCRequestMsg("B", SequencerTakeoverPath, &SequencerTakeoverMsg{Since: 2})
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	resp, err := s.serveTakeover(request)
+	if err != nil {
+		t.Fatalf("serve takeover: %v", err)
+	}
+	deliveredMsg := resp.(*SequencerDeliveredMsg)
+	if deliveredMsg.MaxDeliveredSeqNum != 2 || !reflect.DeepEqual(deliveredMsg.Orders, map[uint64]string{2: m2}) {
+		t.Fatalf("served %+v, want seq 2 delivered with the order of m2", deliveredMsg)
+	}
+}
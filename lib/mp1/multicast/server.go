@@ -1,15 +1,17 @@
 package multicast
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
 	"net"
-
-	sync "github.com/sasha-s/go-deadlock"
+	"time"
 
 	"bufio"
-	"encoding/json"
 
+	"github.com/bamboovir/cs425/lib/codec"
 	"github.com/bamboovir/cs425/lib/mp1/metrics"
-	"github.com/bamboovir/cs425/lib/mp1/router"
 	"github.com/bamboovir/cs425/lib/mp1/types"
 	log "github.com/sirupsen/logrus"
 )
@@ -19,7 +21,8 @@ var (
 )
 
 const (
-	CONN_TYPE = "tcp"
+	CONN_TYPE   = "tcp"
+	AckInterval = 100 * time.Millisecond
 )
 
 const (
@@ -32,7 +35,7 @@ const (
 	EB
 )
 
-func startServer(nodeID string, addr string, router *router.Router) (socket net.Listener, err error) {
+func startServer(nodeID string, addr string) (socket net.Listener, err error) {
 	socket, err = net.Listen(CONN_TYPE, addr)
 
 	if err != nil {
@@ -44,66 +47,174 @@ func startServer(nodeID string, addr string, router *router.Router) (socket net.
 	return socket, nil
 }
 
-func runServer(startSyncWaitGroup *sync.WaitGroup, nodeID string, socket net.Listener, router *router.Router) {
-	defer socket.Close()
+// runServer accepts until ctx is done, closing the socket is what wakes up the pending Accept
+func runServer(ctx context.Context, nodeID string, socket net.Listener, deliver func(msg *BMsg) error, sessions *sessionTable, tlsConfig *tls.Config) {
+	go func() {
+		<-ctx.Done()
+		socket.Close()
+	}()
 	for {
 		conn, err := socket.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				serverLogger.Infof("node [%s] stop listening on: %s", nodeID, socket.Addr())
+				return
+			}
 			serverLogger.Errorf("node [%s] error accepting: %v", nodeID, err)
 			continue
 		}
 
-		go handleConn(startSyncWaitGroup, nodeID, conn, router)
+		go handleConn(ctx, nodeID, conn, deliver, sessions, tlsConfig)
 	}
 }
 
-func handleConn(startSyncWaitGroup *sync.WaitGroup, nodeID string, conn net.Conn, router *router.Router) {
+func ackLoop(conn net.Conn, link *linkSession, linkCodec codec.Codec, done chan struct{}) {
+	ticker := time.NewTicker(AckInterval)
+	defer ticker.Stop()
+	lastAcked := uint64(0)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			lastReceived := link.LastReceived()
+			if lastReceived == lastAcked {
+				continue
+			}
+			ack, err := linkCodec.Marshal(&types.Ack{Seq: lastReceived})
+			if err != nil {
+				serverLogger.Errorf("encode ack failed: %v", err)
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(ClientWriteTimeout))
+			err = codec.WriteFrame(conn, ack)
+			if err != nil {
+				return
+			}
+			lastAcked = lastReceived
+		}
+	}
+}
+
+// handleConn serves one peer until it disconnects or ctx is done
+func handleConn(ctx context.Context, nodeID string, conn net.Conn, deliver func(msg *BMsg) error, sessions *sessionTable, tlsConfig *tls.Config) {
+	done := make(chan struct{})
+	defer close(done)
+	go func(rawConn net.Conn) {
+		select {
+		case <-ctx.Done():
+			rawConn.Close()
+		case <-done:
+		}
+	}(conn)
 	defer conn.Close()
 	tcpConn := conn.(*net.TCPConn)
 
 	tcpConn.SetReadBuffer(5 * MB)
 	tcpConn.SetWriteBuffer(5 * MB)
 
-	scanner := bufio.NewScanner(conn)
-	hi := &types.Hi{}
-	if scanner.Scan() {
-		firstLine := scanner.Text()
-		err := json.Unmarshal([]byte(firstLine), hi)
-		if err != nil || hi.From == "" {
-			serverLogger.Errorf("unrecognized event message, except hi")
+	var tlsConn *tls.Conn
+	if tlsConfig != nil {
+		tlsConn = tls.Server(conn, tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(TLSHandshakeTimeout))
+		err := tlsConn.Handshake()
+		tlsConn.SetDeadline(time.Time{})
+		if err != nil {
+			serverLogger.Errorf("tls handshake with [%s] failed: %v", conn.RemoteAddr(), err)
 			return
 		}
-		serverLogger.Infof("node [%s] connected", hi.From)
+		conn = tlsConn
 	}
 
-	// wait for all client ready
-	startSyncWaitGroup.Wait()
+	reader := bufio.NewReaderSize(conn, 64*KB)
+	firstFrame, err := codec.ReadFrame(reader)
+	if err != nil {
+		serverLogger.Errorf("connection closed before handshake: %v", err)
+		return
+	}
+	hi := &types.Hi{}
+	_, err = hi.Decode(firstFrame)
+	if err != nil || hi.From == "" {
+		serverLogger.Errorf("unrecognized event message, except hi")
+		return
+	}
+	if tlsConn != nil && peerNodeID(tlsConn) != hi.From {
+		serverLogger.Errorf("refuse connection from [%s], hi from node [%s] but certificate belongs to node [%s]", conn.RemoteAddr(), hi.From, peerNodeID(tlsConn))
+		return
+	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		lineBytes := []byte(line)
-		metrics.NewBandwidthLogEntry(nodeID, len(lineBytes)).Log()
+	linkCodec := codec.Negotiate(hi.Codecs, codec.Default())
+	link, known := sessions.resume(hi.From, hi.Session, conn)
+	reply, _ := types.NewHi(nodeID).
+		WithSession(hi.Session).
+		WithLastReceived(link.LastReceived()).
+		WithUnknownSession(!known).
+		WithCodec(linkCodec.Name()).
+		Encode()
+	err = codec.WriteFrame(conn, reply)
+	if err != nil {
+		serverLogger.Errorf("node [%s] write handshake reply failed: %v", hi.From, err)
+		return
+	}
+	serverLogger.Infof("node [%s] connected with codec [%s], session [%s] resume after seq %d", hi.From, linkCodec.Name(), hi.Session, link.LastReceived())
 
-		msg := &BMsg{}
-		_, err := msg.Decode(lineBytes)
+	go ackLoop(conn, link, linkCodec, done)
+
+	for {
+		payload, err := codec.ReadFrame(reader)
 		if err != nil {
-			serverLogger.Errorf("server decode msg failed: %v", err)
+			if ctx.Err() != nil {
+				serverLogger.Infof("node [%s] connection closed on shutdown", hi.From)
+			} else if err == io.EOF {
+				serverLogger.Infof("node [%s] connection reach EOF", hi.From)
+			} else {
+				serverLogger.Errorf("node [%s] connection err: %v", hi.From, err)
+			}
+			return
 		}
-		err = router.Run(BMulticastPath, msg)
-		if err != nil {
-			serverLogger.Errorf("server process msg failed: %v", err)
+		metrics.NewBandwidthLogEntry(nodeID, len(payload)+codec.FrameHeaderSize).Log()
+		metrics.PeerReceivedBytes.Add(float64(len(payload)+codec.FrameHeaderSize), nodeID, hi.From)
+		metrics.PeerReceivedMessages.Inc(nodeID, hi.From)
+
+		if len(payload) < frameSeqSize {
+			serverLogger.Errorf("server decode frame failed, missing seq")
+			continue
+		}
+		seq := binary.BigEndian.Uint64(payload[:frameSeqSize])
+		if !receiveFrame(hi.From, link, seq, payload[frameSeqSize:], linkCodec, deliver) {
+			return
 		}
 	}
+}
+
+// receiveFrame delivers the frame seq of link, it returns false on a frame gap.
+// lock is released before deliver, so ackLoop still acknowledges while a slow handler runs
+func receiveFrame(srcID string, link *linkSession, seq uint64, body []byte, linkCodec codec.Codec, deliver func(msg *BMsg) error) bool {
+	link.deliverLock.Lock()
+	defer link.deliverLock.Unlock()
 
-	err := scanner.Err()
+	link.lock.Lock()
+	if seq <= link.lastReceived {
+		link.lock.Unlock()
+		return true
+	}
+	if seq != link.lastReceived+1 {
+		serverLogger.Errorf("node [%s] frame gap, expect seq %d, got %d, drop connection", srcID, link.lastReceived+1, seq)
+		link.lock.Unlock()
+		return false
+	}
+	link.lastReceived = seq
+	link.lock.Unlock()
 
+	msg := &BMsg{}
+	err := linkCodec.Unmarshal(body, msg)
 	if err != nil {
-		if hi.From != "" {
-			serverLogger.Errorf("node [%s] connection err: %v", hi.From, err)
-		}
-	} else {
-		if hi.From != "" {
-			serverLogger.Infof("node [%s] connection reach EOF", hi.From)
-		}
+		serverLogger.Errorf("server decode msg failed: %v", err)
+		return true
+	}
+	err = deliver(msg)
+	if err != nil {
+		serverLogger.Errorf("server process msg failed: %v", err)
 	}
+	return true
 }
@@ -0,0 +1,45 @@
+package multicast
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bamboovir/cs425/lib/codec"
+)
+
+func TestReceiveFrameAcksWhileDelivering(t *testing.T) {
+	sessions := newSessionTable()
+	link, known := sessions.resume("A", "session", nil)
+	if known {
+		t.Fatalf("a new session is known")
+	}
+	body, err := codec.JSON.Marshal(&BMsg{SrcID: "A", Path: "/slow"})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	release := make(chan struct{})
+	go receiveFrame("A", link, 1, body, codec.JSON, func(msg *BMsg) error {
+		<-release
+		return nil
+	})
+	defer close(release)
+
+	lastReceived := make(chan uint64)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		lastReceived <- link.LastReceived()
+	}()
+	select {
+	case seq := <-lastReceived:
+		if seq != 1 {
+			t.Fatalf("last received %d, want 1", seq)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the link lock is held while the frame is delivered")
+	}
+
+	if _, known := sessions.resume("A", "session", nil); !known {
+		t.Fatalf("a resumed session is unknown")
+	}
+}
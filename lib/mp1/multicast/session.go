@@ -0,0 +1,61 @@
+package multicast
+
+import (
+	"net"
+
+	sync "github.com/sasha-s/go-deadlock"
+)
+
+// linkSession tracks the frames received from one client session, lock guards lastReceived only,
+// frames are delivered under deliverLock so a resumed connection never races the connection it replaces
+type linkSession struct {
+	session      string
+	lastReceived uint64
+	connection   net.Conn
+	lock         *sync.Mutex
+	deliverLock  *sync.Mutex
+}
+
+type sessionTable struct {
+	sessions map[string]*linkSession
+	lock     *sync.Mutex
+}
+
+func newSessionTable() *sessionTable {
+	return &sessionTable{
+		sessions: map[string]*linkSession{},
+		lock:     &sync.Mutex{},
+	}
+}
+
+// resume binds connection to the session of nodeID, a different session id means the client restarted.
+// known is false if the session is new to this server
+func (s *sessionTable) resume(nodeID string, session string, connection net.Conn) (link *linkSession, known bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	link, ok := s.sessions[nodeID]
+	if !ok || link.session != session {
+		link = &linkSession{
+			session:      session,
+			lastReceived: 0,
+			connection:   connection,
+			lock:         &sync.Mutex{},
+			deliverLock:  &sync.Mutex{},
+		}
+		s.sessions[nodeID] = link
+		return link, false
+	}
+
+	if link.connection != nil && link.connection != connection {
+		link.connection.Close()
+	}
+	link.connection = connection
+	return link, true
+}
+
+func (l *linkSession) LastReceived() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.lastReceived
+}
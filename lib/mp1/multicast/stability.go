@@ -0,0 +1,288 @@
+package multicast
+
+import (
+	"context"
+	"time"
+
+	"github.com/bamboovir/cs425/lib/codec"
+	errors "github.com/pkg/errors"
+)
+
+const (
+	RAckPath        = "/r-multicast/ack"
+	StabilityPeriod = time.Second
+	// AckPiggybackInterval bounds the bytes acks add to a busy node
+	AckPiggybackInterval = 100 * time.Millisecond
+)
+
+// RAck every message of the Incarnation of Origin up to Seq was received by the member that sends it
+type RAck struct {
+	Origin      string `json:"origin"`
+	Incarnation int64  `json:"incarnation"`
+	Seq         uint64 `json:"seq"`
+}
+
+// RAckMsg carries the acks of a member that did not r-multicast for a StabilityPeriod
+type RAckMsg struct {
+	Acker string  `json:"acker"`
+	Acks  []*RAck `json:"acks"`
+}
+
+// originWatermark dedupes the messages of one incarnation of an origin,
+// every seq up to contiguous was received, above keeps the seqs received after a gap.
+// A joining node does not know the seqs sent before it joined, so its watermarks keep every seq in above,
+// until the catch up window is over and the watermark is anchored below the first seq it received.
+// The gaps of an origin that departed are given up after the crash timeout, so above does not grow forever
+type originWatermark struct {
+	incarnation int64
+	contiguous  uint64
+	above       map[uint64]struct{}
+	anchored    bool
+	createdAt   time.Time
+	departedAt  time.Time
+}
+
+func newOriginWatermark(incarnation int64, anchored bool) *originWatermark {
+	return &originWatermark{
+		incarnation: incarnation,
+		above:       map[uint64]struct{}{},
+		anchored:    anchored,
+		createdAt:   time.Now(),
+	}
+}
+
+func (w *originWatermark) contains(seq uint64) bool {
+	if w.anchored && seq <= w.contiguous {
+		return true
+	}
+	_, ok := w.above[seq]
+	return ok
+}
+
+func (w *originWatermark) add(seq uint64) {
+	w.above[seq] = struct{}{}
+	w.advance()
+}
+
+func (w *originWatermark) advance() {
+	if !w.anchored {
+		return
+	}
+	for {
+		if _, ok := w.above[w.contiguous+1]; !ok {
+			return
+		}
+		delete(w.above, w.contiguous+1)
+		w.contiguous++
+	}
+}
+
+// anchorIfDue anchors the watermark of a joining node once the catch up window is over
+func (w *originWatermark) anchorIfDue() {
+	if w.anchored || time.Since(w.createdAt) < JoinCatchUpWindow {
+		return
+	}
+	var first uint64
+	for seq := range w.above {
+		if first == 0 || seq < first {
+			first = seq
+		}
+	}
+	w.anchored = true
+	if first > 0 {
+		w.contiguous = first - 1
+	}
+	w.advance()
+}
+
+// skipGaps moves the watermark above every seq received, the seqs missing below it are never delivered
+func (w *originWatermark) skipGaps() {
+	for seq := range w.above {
+		if seq > w.contiguous {
+			w.contiguous = seq
+		}
+	}
+	w.above = map[uint64]struct{}{}
+	w.anchored = true
+}
+
+// trimDeparted skips the gaps of an origin that is not a member for the crash timeout,
+// the relays of its last messages had the time to arrive. caller should hold receivedLock
+func (r *RMulticast) trimDeparted(members map[string]struct{}) {
+	for origin, w := range r.watermarks {
+		if _, ok := members[origin]; ok || origin == r.bmulticast.group.SelfNodeID {
+			w.departedAt = time.Time{}
+			continue
+		}
+		if w.departedAt.IsZero() {
+			w.departedAt = time.Now()
+			continue
+		}
+		if len(w.above) == 0 || time.Since(w.departedAt) <= NodeCrashTimeout {
+			continue
+		}
+		logger.Infof("skip the gaps below %d seqs of departed node [%s]", len(w.above), origin)
+		w.skipGaps()
+	}
+}
+
+// received reports whether msg is a duplicate and records it otherwise, caller should hold receivedLock
+func (r *RMulticast) received(msg *RMsg) bool {
+	w, ok := r.watermarks[msg.Origin]
+	if !ok || w.incarnation < msg.Incarnation {
+		w = newOriginWatermark(msg.Incarnation, !r.bmulticast.group.joining)
+		r.watermarks[msg.Origin] = w
+	}
+	w.anchorIfDue()
+	if w.incarnation > msg.Incarnation || w.contains(msg.Seq) {
+		return true
+	}
+	w.add(msg.Seq)
+	return false
+}
+
+// acks returns the contiguous seq of every anchored origin, caller should hold receivedLock
+func (r *RMulticast) acks() []*RAck {
+	acks := make([]*RAck, 0, len(r.watermarks))
+	for origin, w := range r.watermarks {
+		if !w.anchored {
+			continue
+		}
+		acks = append(acks, &RAck{
+			Origin:      origin,
+			Incarnation: w.incarnation,
+			Seq:         w.contiguous,
+		})
+	}
+	return acks
+}
+
+// piggyback stamps msg with the acks of this node at most once every AckPiggybackInterval, caller should hold receivedLock
+func (r *RMulticast) piggyback(msg *RMsg) {
+	if time.Since(r.lastAckAt) < AckPiggybackInterval {
+		return
+	}
+	msg.Acker = r.bmulticast.group.SelfNodeID
+	msg.Acks = r.acks()
+	r.lastAckAt = time.Now()
+}
+
+// recordAcks caller should hold receivedLock
+func (r *RMulticast) recordAcks(acker string, acks []*RAck) {
+	if acker == "" {
+		return
+	}
+	peerAcks := map[string]*RAck{}
+	for _, ack := range acks {
+		peerAcks[ack.Origin] = ack
+	}
+	r.peerAcks[acker] = peerAcks
+}
+
+// stableSeq returns the seq up to which every message of the incarnation of origin was received by every member,
+// caller should hold receivedLock
+func (r *RMulticast) stableSeq(memberIDs []string, origin string, incarnation int64) uint64 {
+	selfID := r.bmulticast.group.SelfNodeID
+	var stable uint64
+	for i, memberID := range memberIDs {
+		var seq uint64
+		if memberID == selfID {
+			w, ok := r.watermarks[origin]
+			if ok && w.anchored && w.incarnation == incarnation {
+				seq = w.contiguous
+			}
+		} else {
+			ack, ok := r.peerAcks[memberID][origin]
+			if ok && ack.Incarnation == incarnation {
+				seq = ack.Seq
+			}
+		}
+		if i == 0 || seq < stable {
+			stable = seq
+		}
+	}
+	return stable
+}
+
+// collect drops the acks of departed members, the gaps of departed origins and the stable messages kept for anti-entropy
+func (r *RMulticast) collect() {
+	memberIDs := r.bmulticast.MemberIDs()
+	members := map[string]struct{}{}
+	for _, memberID := range memberIDs {
+		members[memberID] = struct{}{}
+	}
+
+	r.receivedLock.Lock()
+	defer r.receivedLock.Unlock()
+	for _, w := range r.watermarks {
+		w.anchorIfDue()
+	}
+	r.trimDeparted(members)
+	for acker := range r.peerAcks {
+		if _, ok := members[acker]; !ok {
+			delete(r.peerAcks, acker)
+		}
+	}
+
+	stable := map[RAck]uint64{}
+	history := make([]*gossipHistoryItem, 0, len(r.history))
+	for _, item := range r.history {
+		msg := item.msg
+		key := RAck{Origin: msg.Origin, Incarnation: msg.Incarnation}
+		seq, ok := stable[key]
+		if !ok {
+			seq = r.stableSeq(memberIDs, msg.Origin, msg.Incarnation)
+			stable[key] = seq
+		}
+		if msg.Seq <= seq {
+			continue
+		}
+		history = append(history, item)
+	}
+	r.history = history
+}
+
+// stability sends the acks of this node if it did not r-multicast for a StabilityPeriod, and collects stable messages
+func (r *RMulticast) stability(ctx context.Context) {
+	ticker := time.NewTicker(StabilityPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.receivedLock.Lock()
+			idle := time.Since(r.lastAckAt) >= StabilityPeriod
+			ackMsg := &RAckMsg{
+				Acker: r.bmulticast.group.SelfNodeID,
+				Acks:  r.acks(),
+			}
+			if idle {
+				r.lastAckAt = time.Now()
+			}
+			r.receivedLock.Unlock()
+
+			if idle {
+				err := r.bmulticast.Multicast(RAckPath, ackMsg)
+				if err != nil {
+					logger.Errorf("multicast acks failed: %v", err)
+				}
+			}
+			r.collect()
+		}
+	}
+}
+
+func (r *RMulticast) bindStability() {
+	r.bmulticast.Bind(RAckPath, func(msg *BMsg) error {
+		ackMsg := &RAckMsg{}
+		err := codec.Unmarshal(msg.Body, ackMsg)
+		if err != nil {
+			return errors.Wrap(err, "r-ack failed")
+		}
+		r.receivedLock.Lock()
+		defer r.receivedLock.Unlock()
+		r.recordAcks(ackMsg.Acker, ackMsg.Acks)
+		return nil
+	})
+}
@@ -0,0 +1,115 @@
+package multicast
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestRMulticast is the r-multicast of node A, connected to the members in memberIDs
+func newTestRMulticast(t *testing.T, memberIDs ...string) *RMulticast {
+	t.Helper()
+	builder := NewGroupBuilder().WithSelfNodeID("A")
+	for _, memberID := range memberIDs {
+		builder.AddMember(memberID, memberID)
+	}
+	group := builder.Build()
+	for _, memberID := range memberIDs {
+		sender := newStalledSender()
+		t.Cleanup(func() { close(sender.release) })
+		group.B().AddMember(memberID, sender)
+	}
+	return group.R()
+}
+
+func newTestRMsg(origin string, incarnation int64, seq uint64) *RMsg {
+	return &RMsg{
+		ID:          origin + "-" + time.Now().String(),
+		Origin:      origin,
+		Incarnation: incarnation,
+		Seq:         seq,
+	}
+}
+
+func TestWatermarkDedupesAcrossGaps(t *testing.T) {
+	r := newTestRMulticast(t, "A", "B")
+	for _, c := range []struct {
+		seq       uint64
+		duplicate bool
+	}{{1, false}, {3, false}, {3, true}, {2, false}, {1, true}, {4, false}} {
+		if got := r.received(newTestRMsg("B", 1, c.seq)); got != c.duplicate {
+			t.Fatalf("seq %d reported duplicate %v, want %v", c.seq, got, c.duplicate)
+		}
+	}
+	w := r.watermarks["B"]
+	if w.contiguous != 4 || len(w.above) != 0 {
+		t.Fatalf("watermark at %d with %d seqs above, want 4 with none", w.contiguous, len(w.above))
+	}
+}
+
+func TestWatermarkOfNewIncarnationStartsOver(t *testing.T) {
+	r := newTestRMulticast(t, "A", "B")
+	r.received(newTestRMsg("B", 1, 1))
+	r.received(newTestRMsg("B", 1, 5))
+	// B restarts, the seqs above the gap of the previous incarnation are dropped with its watermark
+	if r.received(newTestRMsg("B", 2, 1)) {
+		t.Fatalf("first msg of the new incarnation reported duplicate")
+	}
+	if w := r.watermarks["B"]; w.incarnation != 2 || w.contiguous != 1 || len(w.above) != 0 {
+		t.Fatalf("watermark of incarnation %d at %d with %d seqs above, want incarnation 2 at 1 with none", w.incarnation, w.contiguous, len(w.above))
+	}
+	if !r.received(newTestRMsg("B", 1, 2)) {
+		t.Fatalf("late msg of the previous incarnation is not reported duplicate")
+	}
+}
+
+func TestWatermarkSkipsGapsOfDepartedOrigin(t *testing.T) {
+	r := newTestRMulticast(t, "A", "B")
+	r.received(newTestRMsg("C", 1, 1))
+	r.received(newTestRMsg("C", 1, 3))
+	r.received(newTestRMsg("C", 1, 4))
+
+	// C is not a member, its gap is kept until the crash timeout passed
+	r.collect()
+	w := r.watermarks["C"]
+	if len(w.above) != 2 {
+		t.Fatalf("%d seqs above the gap right after C departed, want 2", len(w.above))
+	}
+	w.departedAt = time.Now().Add(-2 * NodeCrashTimeout)
+	r.collect()
+	if w.contiguous != 4 || len(w.above) != 0 {
+		t.Fatalf("watermark at %d with %d seqs above, want the gap skipped to 4", w.contiguous, len(w.above))
+	}
+	if !r.received(newTestRMsg("C", 1, 2)) {
+		t.Fatalf("msg in the skipped gap is not reported duplicate")
+	}
+}
+
+func TestStableMsgsAreCollected(t *testing.T) {
+	r := newTestRMulticast(t, "A", "B", "C")
+	for seq := uint64(1); seq <= 3; seq++ {
+		r.AddMsgIfNotExist(newTestRMsg("B", 1, seq))
+	}
+	if acks := r.acks(); len(acks) != 1 || acks[0].Origin != "B" || acks[0].Seq != 3 {
+		t.Fatalf("acks %+v, want B up to 3", acks)
+	}
+
+	r.recordAcks("B", []*RAck{{Origin: "B", Incarnation: 1, Seq: 3}})
+	// the ack of another incarnation does not count
+	r.recordAcks("C", []*RAck{{Origin: "B", Incarnation: 2, Seq: 3}})
+	if stable := r.stableSeq(r.bmulticast.MemberIDs(), "B", 1); stable != 0 {
+		t.Fatalf("stable seq %d with an ack of another incarnation, want 0", stable)
+	}
+	r.recordAcks("C", []*RAck{{Origin: "B", Incarnation: 1, Seq: 2}})
+	if stable := r.stableSeq(r.bmulticast.MemberIDs(), "B", 1); stable != 2 {
+		t.Fatalf("stable seq %d, want 2, the lowest ack", stable)
+	}
+
+	r.history = []*gossipHistoryItem{}
+	for seq := uint64(1); seq <= 3; seq++ {
+		r.history = append(r.history, &gossipHistoryItem{msg: newTestRMsg("B", 1, seq), receivedAt: time.Now()})
+	}
+	r.collect()
+	if len(r.history) != 1 || r.history[0].msg.Seq != 3 {
+		t.Fatalf("%d msgs kept after collect, want only seq 3 that C did not ack", len(r.history))
+	}
+}
@@ -0,0 +1,109 @@
+package multicast
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	errors "github.com/pkg/errors"
+)
+
+const (
+	TLSHandshakeTimeout = 10 * time.Second
+)
+
+// TLSConfig is the CA that signs the certificate of every member, and the certificate of this node,
+// the common name of a member certificate is its node id
+type TLSConfig struct {
+	CAPath   string
+	CertPath string
+	KeyPath  string
+}
+
+type nodeTLS struct {
+	roots       *x509.CertPool
+	certificate tls.Certificate
+}
+
+func loadNodeTLS(config *TLSConfig) (*nodeTLS, error) {
+	caPEM, err := ioutil.ReadFile(config.CAPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "read ca certificate failed")
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificate found in [%s]", config.CAPath)
+	}
+	certificate, err := tls.LoadX509KeyPair(config.CertPath, config.KeyPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "load node certificate failed")
+	}
+	return &nodeTLS{
+		roots:       roots,
+		certificate: certificate,
+	}, nil
+}
+
+// serverConfig requires a client certificate signed by the CA, its node id is checked against Hi.From after the handshake,
+// a nil nodeTLS is plain tcp
+func (n *nodeTLS) serverConfig() *tls.Config {
+	if n == nil {
+		return nil
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{n.certificate},
+		ClientCAs:    n.roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// clientConfig verifies the server certificate against the CA and the node id the client dials,
+// instead of a host name, so members can be reached by any address
+func (n *nodeTLS) clientConfig(dstID string) *tls.Config {
+	if n == nil {
+		return nil
+	}
+	return &tls.Config{
+		Certificates:       []tls.Certificate{n.certificate},
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return verifyPeerNodeID(state, n.roots, dstID)
+		},
+	}
+}
+
+func verifyPeerNodeID(state tls.ConnectionState, roots *x509.CertPool, nodeID string) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("peer presented no certificate")
+	}
+	leaf := state.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return errors.Wrap(err, "verify peer certificate failed")
+	}
+	if leaf.Subject.CommonName != nodeID {
+		return fmt.Errorf("peer certificate belongs to node [%s], expect node [%s]", leaf.Subject.CommonName, nodeID)
+	}
+	return nil
+}
+
+// peerNodeID is the node id in the certificate the peer presented, the chain is already verified by the handshake
+func peerNodeID(conn *tls.Conn) string {
+	peerCertificates := conn.ConnectionState().PeerCertificates
+	if len(peerCertificates) == 0 {
+		return ""
+	}
+	return peerCertificates[0].Subject.CommonName
+}
@@ -0,0 +1,146 @@
+package multicast_test
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bamboovir/cs425/cmd/mp1"
+	"github.com/bamboovir/cs425/lib/mp1/multicast"
+)
+
+// genCerts issues the certificates of nodeIDs with the test CA of a new directory, and returns it
+func genCerts(t *testing.T, nodeIDs ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	err := mp1.GenCertCMDMain(dir, nodeIDs, []string{"127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatalf("generate certificates: %v", err)
+	}
+	return dir
+}
+
+func certPaths(dir string, nodeID string) (certPath string, keyPath string) {
+	return filepath.Join(dir, fmt.Sprintf(mp1.CertFileTmpl, nodeID)), filepath.Join(dir, fmt.Sprintf(mp1.KeyFileTmpl, nodeID))
+}
+
+func tlsTransport(t *testing.T, dir string, nodeID string) *multicast.TCPTransport {
+	t.Helper()
+	certPath, keyPath := certPaths(dir, nodeID)
+	transport, err := multicast.NewTCPTransport(&multicast.TLSConfig{
+		CAPath:   filepath.Join(dir, mp1.CACertFile),
+		CertPath: certPath,
+		KeyPath:  keyPath,
+	})
+	if err != nil {
+		t.Fatalf("new transport of node [%s]: %v", nodeID, err)
+	}
+	return transport
+}
+
+// listenTLS serves node B over mutual tls on a free port, and returns its address and the msgs it delivers
+func listenTLS(t *testing.T, dir string) (string, chan *multicast.BMsg) {
+	t.Helper()
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("find a free port: %v", err)
+	}
+	addr := socket.Addr().String()
+	socket.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	delivered := make(chan *multicast.BMsg, 16)
+	err = tlsTransport(t, dir, "B").Listen(ctx, "B", addr, func(msg *multicast.BMsg) error {
+		delivered <- msg
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	return addr, delivered
+}
+
+// assertRefused fails the test unless B ends the connection of a client that presents certificates,
+// a client does not find out before its first read, the server verifies it last
+func assertRefused(t *testing.T, addr string, certificates []tls.Certificate) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		Certificates:       certificates,
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Fatalf("node [B] kept the connection of a client without a trusted certificate")
+	}
+	if err == nil {
+		t.Fatalf("node [B] sent data to a client without a trusted certificate")
+	}
+}
+
+func TestMutualTLSDeliversWithValidClientCert(t *testing.T) {
+	dir := genCerts(t, "A", "B")
+	addr, delivered := listenTLS(t, dir)
+
+	sender, err := tlsTransport(t, dir, "A").Dial(context.Background(), "A", "B", addr, 10*time.Millisecond, 100)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer sender.Close()
+	msg, err := multicast.NewBMsg("A", "/test", "over tls")
+	if err != nil {
+		t.Fatalf("new msg: %v", err)
+	}
+	err = sender.Send(msg)
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	select {
+	case got := <-delivered:
+		if got.SrcID != "A" || got.Path != "/test" {
+			t.Fatalf("delivered msg of node [%s] on [%s], want node [A] on [/test]", got.SrcID, got.Path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("msg sent over mutual tls is not delivered")
+	}
+}
+
+func TestMutualTLSRefusesMissingClientCert(t *testing.T) {
+	dir := genCerts(t, "B")
+	addr, _ := listenTLS(t, dir)
+	assertRefused(t, addr, nil)
+}
+
+func TestMutualTLSRefusesUntrustedClientCert(t *testing.T) {
+	dir := genCerts(t, "B")
+	addr, delivered := listenTLS(t, dir)
+
+	// A has a certificate of its own node id, signed by another CA
+	untrusted := genCerts(t, "A")
+	certPath, keyPath := certPaths(untrusted, "A")
+	certificate, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("load certificate: %v", err)
+	}
+	assertRefused(t, addr, []tls.Certificate{certificate})
+
+	_, err = tlsTransport(t, untrusted, "A").Dial(context.Background(), "A", "B", addr, 10*time.Millisecond, 3)
+	if err == nil {
+		t.Fatalf("node [A] with an untrusted certificate connected to node [B]")
+	}
+	select {
+	case msg := <-delivered:
+		t.Fatalf("node [B] delivered msg of node [%s] from an untrusted client", msg.SrcID)
+	default:
+	}
+}
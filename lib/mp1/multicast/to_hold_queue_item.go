@@ -3,16 +3,22 @@ package multicast
 import (
 	"container/heap"
 	"fmt"
+	"sort"
 	"strings"
+
+	"github.com/bamboovir/cs425/lib/mp1/tracing"
 )
 
+// TOHoldQueueItem span lasts from the proposal of this node to the delivery of the message
 type TOHoldQueueItem struct {
 	body           []byte
 	proposalSeqNum uint64
 	processID      string
+	originID       string
 	agreed         bool
 	msgID          string
 	index          int
+	span           *tracing.Span
 }
 
 type TOHoldPriorityQueue []*TOHoldQueueItem
@@ -29,6 +35,24 @@ func (pq TOHoldPriorityQueue) Snapshot() string {
 	return builder.String()
 }
 
+// Stats returns every item in delivery order
+func (pq TOHoldPriorityQueue) Stats() []*HoldQueueItemStats {
+	sorted := make(TOHoldPriorityQueue, len(pq))
+	copy(sorted, pq)
+	sort.Slice(sorted, sorted.Less)
+	stats := make([]*HoldQueueItemStats, 0, len(sorted))
+	for _, item := range sorted {
+		stats = append(stats, &HoldQueueItemStats{
+			MsgID:     item.msgID,
+			OriginID:  item.originID,
+			Seq:       item.proposalSeqNum,
+			ProcessID: item.processID,
+			Agreed:    item.agreed,
+		})
+	}
+	return stats
+}
+
 func (pq TOHoldPriorityQueue) Len() int { return len(pq) }
 
 func (pq TOHoldPriorityQueue) Less(i, j int) bool {
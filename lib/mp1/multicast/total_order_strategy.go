@@ -0,0 +1,70 @@
+package multicast
+
+import (
+	"context"
+	"fmt"
+)
+
+type TotalOrderStrategyKind string
+
+const (
+	ISISStrategy      TotalOrderStrategyKind = "isis"
+	SequencerStrategy TotalOrderStrategyKind = "sequencer"
+)
+
+// TotalOrderStrategy is implemented by every total ording protocol that Group can be built with
+type TotalOrderStrategy interface {
+	Start(ctx context.Context) error
+	Bind(path string, f func(msg *TOMsg) error)
+	Multicast(path string, v interface{}) error
+	// MulticastContext is Multicast that gives up waiting for admission once ctx is done
+	MulticastContext(ctx context.Context, path string, v interface{}) error
+}
+
+// HoldQueueItemStats Seq is the proposal of this node until the message is agreed, then the agreed seq
+type HoldQueueItemStats struct {
+	MsgID     string `json:"msg_id"`
+	OriginID  string `json:"origin"`
+	Seq       uint64 `json:"seq"`
+	ProcessID string `json:"pid"`
+	Agreed    bool   `json:"agreed"`
+}
+
+type PendingVotesStats struct {
+	MsgID       string   `json:"msg_id"`
+	Voters      int      `json:"voters"`
+	Votes       int      `json:"votes"`
+	Missing     []string `json:"missing"`
+	Retries     int      `json:"retries"`
+	WaitedNanos int64    `json:"waited_nanos"`
+}
+
+// TotalOrderStats the ordering state of a node, HeadOfLine is the message every message behind it waits for
+type TotalOrderStats struct {
+	Strategy        string                `json:"strategy"`
+	MaxProposalSeq  uint64                `json:"max_proposal_seq"`
+	MaxAgreementSeq uint64                `json:"max_agreement_seq"`
+	DeliveryPaused  bool                  `json:"delivery_paused"`
+	HoldQueue       []*HoldQueueItemStats `json:"hold_queue"`
+	HeadOfLine      *HoldQueueItemStats   `json:"head_of_line,omitempty"`
+	PendingVotes    []*PendingVotesStats  `json:"pending_votes"`
+}
+
+// TotalOrderInspector is implemented by the total order strategies that report their ordering state
+type TotalOrderInspector interface {
+	Stats() *TotalOrderStats
+}
+
+// TotalOrderFactory builds a total order strategy that lives outside this package on the transport of a group
+type TotalOrderFactory func(b *BMulticast, r *RMulticast) TotalOrderStrategy
+
+func ParseTotalOrderStrategyKind(kind string) (TotalOrderStrategyKind, error) {
+	switch TotalOrderStrategyKind(kind) {
+	case ISISStrategy:
+		return ISISStrategy, nil
+	case SequencerStrategy:
+		return SequencerStrategy, nil
+	default:
+		return "", fmt.Errorf("unrecognized total order strategy [%s]", kind)
+	}
+}
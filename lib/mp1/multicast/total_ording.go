@@ -3,12 +3,16 @@ package multicast
 import (
 	"container/heap"
 	"context"
+	"sort"
+	"strconv"
 	"time"
 
 	sync "github.com/sasha-s/go-deadlock"
 
+	"github.com/bamboovir/cs425/lib/codec"
 	"github.com/bamboovir/cs425/lib/mp1/metrics"
 	"github.com/bamboovir/cs425/lib/mp1/router"
+	"github.com/bamboovir/cs425/lib/mp1/tracing"
 	errors "github.com/pkg/errors"
 )
 
@@ -16,11 +20,21 @@ const (
 	AskProposalSeqPath       = "/total-ording/ask-proposal-seq"
 	WaitProposalSeqPath      = "/total-ording/wait-proposal-seq"
 	AnnounceAgreementSeqPath = "/total-ording/announce-agreement-seq"
+	ReAskProposalSeqPath     = "/total-ording/re-ask-proposal-seq"
 )
 
 const (
 	RetryRemoveMax   = 25
 	NodeCrashTimeout = 6 * time.Second
+	// VoteTimeout a voter that did not vote is asked again, the wait doubles with every retry,
+	// a voter that still did not vote after MaxVoteRetries is ejected so the sender can announce, and a view change removes it from the group
+	VoteTimeout     = 2 * time.Second
+	MaxVoteRetries  = 3
+	VoteCheckPeriod = 500 * time.Millisecond
+)
+
+var (
+	ErrNoVoterLeft = errors.New("no voter left")
 )
 
 type ProposalItem struct {
@@ -30,6 +44,17 @@ type ProposalItem struct {
 	Body           []byte
 }
 
+// voteCollector collects the proposals of the members the ask was multicast to, span lasts until every vote is in
+type voteCollector struct {
+	ask      *TOAskProposalSeqMsg
+	voters   map[string]struct{}
+	votes    map[string]*ProposalItem
+	start    time.Time
+	deadline time.Time
+	retries  int
+	span     *tracing.Span
+}
+
 type TotalOrding struct {
 	bmulticast                      *BMulticast
 	rmulticast                      *RMulticast
@@ -41,20 +66,32 @@ type TotalOrding struct {
 	maxAgreementSeqNumOfGroupLocker *sync.Mutex
 	maxProposalSeqNumOfSelf         uint64
 	maxProposalSeqNumOfSelfLocker   *sync.Mutex
-	waitProposalCounter             map[string][]*ProposalItem
+	waitProposalCounter             map[string]*voteCollector
 	waitProposalCounterLock         *sync.Mutex
 	waitVotesChannel                chan *ProposalItem
 	crashNodeTimeout                map[string]time.Time
+	orphanRounds                    map[string]*orphanRound
+	orphanDecisions                 map[string]*TOOrphanDecisionMsg
+	delivered                       []*deliveredItem
+	deliveredMsgIDs                 map[string]struct{}
+	deliveryPaused                  bool
+	deliveryCutoff                  *ProposalItem
+	delivering                      *ProposalItem
+	admission                       *Admission
+	askBatcher                      *batcher
+	replyBatcher                    *batcher
+	announceBatcher                 *batcher
+	ctx                             context.Context
 }
 
 func NewTotalOrder(b *BMulticast, r *RMulticast) *TotalOrding {
 	holdQueue := &TOHoldPriorityQueue{}
 	heap.Init(holdQueue)
 
-	return &TotalOrding{
+	t := &TotalOrding{
 		bmulticast:                      b,
 		rmulticast:                      r,
-		router:                          router.New(),
+		router:                          NewProtocolRouter("to-multicast", (*TOMsg)(nil)),
 		holdQueueMap:                    map[string]*TOHoldQueueItem{},
 		holdQueue:                       holdQueue,
 		holdQueueLocker:                 &sync.Mutex{},
@@ -62,21 +99,98 @@ func NewTotalOrder(b *BMulticast, r *RMulticast) *TotalOrding {
 		maxAgreementSeqNumOfGroupLocker: &sync.Mutex{},
 		maxProposalSeqNumOfSelf:         0,
 		maxProposalSeqNumOfSelfLocker:   &sync.Mutex{},
-		waitProposalCounter:             map[string][]*ProposalItem{},
+		waitProposalCounter:             map[string]*voteCollector{},
 		waitProposalCounterLock:         &sync.Mutex{},
 		waitVotesChannel:                make(chan *ProposalItem, 10000),
 		crashNodeTimeout:                map[string]time.Time{},
+		orphanRounds:                    map[string]*orphanRound{},
+		orphanDecisions:                 map[string]*TOOrphanDecisionMsg{},
+		delivered:                       make([]*deliveredItem, 0),
+		deliveredMsgIDs:                 map[string]struct{}{},
+		deliveryPaused:                  false,
+		deliveryCutoff:                  nil,
+		delivering:                      nil,
+		admission:                       b.group.admission,
+		ctx:                             context.Background(),
 	}
+	batchConfig := b.group.batchConfig
+	if batchConfig != nil && batchConfig.Window > 0 {
+		t.askBatcher = newBatcher(batchConfig, t.flushAsks)
+		t.replyBatcher = newBatcher(batchConfig, t.flushReplies)
+		t.announceBatcher = newBatcher(batchConfig, t.flushAnnounces)
+	}
+	return t
+}
+
+func (t *TotalOrding) flushAsks(dst string, entries []interface{}) {
+	batchMsg := &TOAskProposalSeqBatchMsg{Asks: make([]*TOAskProposalSeqMsg, 0, len(entries))}
+	for _, entry := range entries {
+		batchMsg.Asks = append(batchMsg.Asks, entry.(*TOAskProposalSeqMsg))
+	}
+	err := t.rmulticast.Multicast(AskProposalSeqBatchPath, batchMsg)
+	if err != nil {
+		logger.Errorf("multicast batch of %d asks failed: %v", len(entries), err)
+		for _, askMsg := range batchMsg.Asks {
+			t.dropMulticast(askMsg.MsgID, err)
+		}
+	}
+}
+
+func (t *TotalOrding) flushReplies(dst string, entries []interface{}) {
+	batchMsg := &TOReplyProposalSeqBatchMsg{Replies: make([]*TOReplyProposalSeqMsg, 0, len(entries))}
+	for _, entry := range entries {
+		batchMsg.Replies = append(batchMsg.Replies, entry.(*TOReplyProposalSeqMsg))
+	}
+	err := t.bmulticast.Unicast(dst, WaitProposalSeqBatchPath, batchMsg)
+	if err != nil {
+		logger.Errorf("unicast batch of %d replies to node [%s] failed: %v", len(entries), dst, err)
+	}
+}
+
+func (t *TotalOrding) flushAnnounces(dst string, entries []interface{}) {
+	batchMsg := &TOAnnounceAgreementSeqBatchMsg{Announces: make([]*TOAnnounceAgreementSeqMsg, 0, len(entries))}
+	for _, entry := range entries {
+		batchMsg.Announces = append(batchMsg.Announces, entry.(*TOAnnounceAgreementSeqMsg))
+	}
+	err := t.rmulticast.Multicast(AnnounceAgreementSeqBatchPath, batchMsg)
+	if err != nil {
+		logger.Errorf("multicast batch of %d announces failed: %v", len(entries), err)
+		for _, announceMsg := range batchMsg.Announces {
+			t.dropMulticast(announceMsg.MsgID, err)
+		}
+	}
+}
+
+// dropMulticast releases what this node holds for a message of its own whose ask or announce could not be multicast,
+// its admission, its vote collector, its tracked start and its parked span
+func (t *TotalOrding) dropMulticast(msgID string, err error) {
+	t.waitProposalCounterLock.Lock()
+	collector, ok := t.waitProposalCounter[msgID]
+	if ok {
+		delete(t.waitProposalCounter, msgID)
+		collector.span.SetAttribute("dropped", err.Error())
+		collector.span.End()
+	}
+	t.waitProposalCounterLock.Unlock()
+
+	t.admission.Leave(msgID)
+	metrics.ForgetTOMulticast(t.bmulticast.group.SelfNodeID, msgID)
+	span := tracing.Unpark(msgID)
+	span.SetAttribute("error", err.Error())
+	span.End()
 }
 
 func (t *TotalOrding) Start(ctx context.Context) (err error) {
+	t.ctx = ctx
 	t.bindTODeliver()
+	t.bindOrphans()
 	err = t.rmulticast.Start(ctx)
 	if err != nil {
 		return err
 	}
 	memberUpdateChannel := t.bmulticast.MembersUpdate()
-	go t.collectVotes(memberUpdateChannel)
+	go t.collectVotes(ctx, memberUpdateChannel)
+	go t.sweep(ctx)
 	return nil
 }
 
@@ -91,92 +205,498 @@ func (t *TotalOrding) aggregateVotesAndMulticast(votes []*ProposalItem) error {
 		agreementSeqItem.ProposalSeqNum,
 		agreementSeqItem.MsgID,
 	)
+	announceAgreementMsg.Trace = tracing.Parked(agreementSeqItem.MsgID).Context()
 
 	// logger.Infof("announce %s %d", announceAgreementMsg.MsgID, announceAgreementMsg.AgreementSeq)
+	if t.announceBatcher != nil {
+		t.announceBatcher.add("", announceAgreementMsg)
+		return nil
+	}
 	err = t.rmulticast.Multicast(AnnounceAgreementSeqPath, announceAgreementMsg)
 	if err != nil {
+		t.dropMulticast(announceAgreementMsg.MsgID, err)
 		return err
 	}
 
 	return nil
 }
 
-func (t *TotalOrding) collectVotes(memberUpdateChannel chan interface{}) {
+func (t *TotalOrding) registerVoters(askMsg *TOAskProposalSeqMsg, voterIDs []string) {
+	t.waitProposalCounterLock.Lock()
+	defer t.waitProposalCounterLock.Unlock()
+
+	voters := map[string]struct{}{}
+	for _, voterID := range voterIDs {
+		voters[voterID] = struct{}{}
+	}
+	span := tracing.Start(t.bmulticast.group.SelfNodeID, "isis.votes", askMsg.Trace)
+	span.SetAttribute("msg_id", askMsg.MsgID)
+	t.waitProposalCounter[askMsg.MsgID] = &voteCollector{
+		ask:      askMsg,
+		voters:   voters,
+		votes:    map[string]*ProposalItem{},
+		start:    time.Now(),
+		deadline: time.Now().Add(VoteTimeout),
+		span:     span,
+	}
+}
+
+// missingVoters returns the alive voters of msgID that did not vote yet, caller should hold waitProposalCounterLock
+func (t *TotalOrding) missingVoters(collector *voteCollector) []string {
+	missing := make([]string, 0)
+	for voterID := range collector.voters {
+		if _, ok := collector.votes[voterID]; ok {
+			continue
+		}
+		if t.bmulticast.IsNodeAlived(voterID) {
+			missing = append(missing, voterID)
+		}
+	}
+	return missing
+}
+
+// expireVotes asks the voters that missed the deadline of a message again, and ejects the voters that are out of retries
+func (t *TotalOrding) expireVotes() {
+	now := time.Now()
+	reasks := map[string][]*TOAskProposalSeqMsg{}
+	ejected := map[string]struct{}{}
+	completed := map[string][]*ProposalItem{}
+	dropped := []string{}
+
+	t.waitProposalCounterLock.Lock()
+	for msgID, collector := range t.waitProposalCounter {
+		votes, ok := t.completedVotes(msgID)
+		if ok {
+			completed[msgID] = votes
+			t.closeVotes(msgID)
+			continue
+		}
+		if now.Before(collector.deadline) {
+			continue
+		}
+
+		missing := t.missingVoters(collector)
+		if len(missing) == 0 {
+			// every voter is gone without a vote, nothing can be announced
+			dropped = append(dropped, msgID)
+			continue
+		}
+
+		collector.retries++
+		collector.span.SetAttribute("retry", strconv.Itoa(collector.retries))
+		collector.deadline = now.Add(VoteTimeout << uint(collector.retries))
+		for _, voterID := range missing {
+			if collector.retries > MaxVoteRetries {
+				ejected[voterID] = struct{}{}
+				continue
+			}
+			reasks[voterID] = append(reasks[voterID], collector.ask)
+		}
+	}
+	t.waitProposalCounterLock.Unlock()
+
+	for _, msgID := range dropped {
+		logger.Errorf("drop votes of msg [%s], no voter left", msgID)
+		t.dropMulticast(msgID, ErrNoVoterLeft)
+	}
+	for voterID, askMsgs := range reasks {
+		logger.Infof("ask node [%s] again for %d proposals", voterID, len(askMsgs))
+		for _, askMsg := range askMsgs {
+			err := t.bmulticast.Unicast(voterID, ReAskProposalSeqPath, askMsg)
+			if err != nil {
+				logger.Errorf("ask node [%s] again for msg [%s] failed: %v", voterID, askMsg.MsgID, err)
+			}
+		}
+	}
+	for voterID := range ejected {
+		logger.Errorf("node [%s] did not vote after %d retries", voterID, MaxVoteRetries)
+		// it stops holding up the votes at once, the view change removes it at the same point on every member
+		t.bmulticast.EjectMember(voterID)
+		go t.ejectVoter(voterID)
+	}
+	for msgID, votes := range completed {
+		err := t.aggregateVotesAndMulticast(votes)
+		if err != nil {
+			logger.Errorf("aggregate votes and multicast failed for msg [%s]: %v", msgID, err)
+		}
+	}
+}
+
+// ejectVoter TO-multicasts the leave of a voter that is out of retries, like an eject through the admin api.
+// It runs on its own goroutine, as the votes of the view change are collected by collectVotes
+func (t *TotalOrding) ejectVoter(voterID string) {
+	err := t.bmulticast.group.membership.eject(t.ctx, voterID)
+	if err != nil {
+		logger.Errorf("eject node [%s] that did not vote failed: %v", voterID, err)
+	}
+}
+
+// pushVote hands a vote to collectVotes, it gives up once the node is stopped
+func (t *TotalOrding) pushVote(vote *ProposalItem) {
+	select {
+	case t.waitVotesChannel <- vote:
+	case <-t.ctx.Done():
+		logger.Infof("drop vote of [%s] for msg [%s], node is stopped", vote.ProcessID, vote.MsgID)
+	}
+}
+
+// closeVotes stops collecting the votes of msgID once they are complete, caller should hold waitProposalCounterLock
+func (t *TotalOrding) closeVotes(msgID string) {
+	collector, ok := t.waitProposalCounter[msgID]
+	if !ok {
+		return
+	}
+	delete(t.waitProposalCounter, msgID)
+	metrics.VoteWait.Observe(time.Since(collector.start).Seconds(), t.bmulticast.group.SelfNodeID)
+	collector.span.SetAttribute("votes", strconv.Itoa(len(collector.votes)))
+	collector.span.End()
+}
+
+// completedVotes returns the votes of msgID once every alive voter has voted, caller should hold waitProposalCounterLock
+func (t *TotalOrding) completedVotes(msgID string) ([]*ProposalItem, bool) {
+	collector, ok := t.waitProposalCounter[msgID]
+	if !ok {
+		return nil, false
+	}
+
+	for voterID := range collector.voters {
+		if _, ok := collector.votes[voterID]; ok {
+			continue
+		}
+		if t.bmulticast.IsNodeAlived(voterID) {
+			return nil, false
+		}
+	}
+
+	votes := make([]*ProposalItem, 0, len(collector.votes))
+	for _, vote := range collector.votes {
+		votes = append(votes, vote)
+	}
+	return votes, len(votes) > 0
+}
+
+func (t *TotalOrding) collectVotes(ctx context.Context, memberUpdateChannel chan interface{}) {
+	ticker := time.NewTicker(VoteCheckPeriod)
+	defer ticker.Stop()
 	for {
 		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.expireVotes()
 		case vote := <-t.waitVotesChannel:
 			// logger.Errorf("get vote: [%s]", vote.MsgID)
-			_, ok := t.waitProposalCounter[vote.MsgID]
+			t.waitProposalCounterLock.Lock()
+			collector, ok := t.waitProposalCounter[vote.MsgID]
 			if !ok {
-				t.waitProposalCounter[vote.MsgID] = []*ProposalItem{}
+				t.waitProposalCounterLock.Unlock()
+				continue
 			}
+			if _, ok := collector.voters[vote.ProcessID]; !ok {
+				logger.Infof("ignore vote from [%s] for msg [%s], not a voter", vote.ProcessID, vote.MsgID)
+				t.waitProposalCounterLock.Unlock()
+				continue
+			}
+			collector.votes[vote.ProcessID] = vote
 
-			membersCount := t.bmulticast.MemberCount()
-
-			t.waitProposalCounter[vote.MsgID] = append(t.waitProposalCounter[vote.MsgID], vote)
-			// logger.Errorf("curr vote: [%d]", len(t.waitProposalCounter[vote.MsgID]))
-			if len(t.waitProposalCounter[vote.MsgID]) < membersCount {
+			votes, ok := t.completedVotes(vote.MsgID)
+			if ok {
+				t.closeVotes(vote.MsgID)
+			}
+			t.waitProposalCounterLock.Unlock()
+			if !ok {
 				continue
 			}
 
-			err := t.aggregateVotesAndMulticast(t.waitProposalCounter[vote.MsgID])
+			err := t.aggregateVotesAndMulticast(votes)
 			if err != nil {
 				logger.Errorf("aggregate votes and multicast failed for msg [%s]: %v", vote.MsgID, err)
 			}
-			delete(t.waitProposalCounter, vote.MsgID)
-		case membersCountI := <-memberUpdateChannel:
-			var membersCount int
-			switch t := membersCountI.(type) {
-			case int:
-				membersCount = t
-			default:
-				membersCount = -1
+		case memberEventI := <-memberUpdateChannel:
+			memberEvent, ok := memberEventI.(*MemberEvent)
+			if !ok || memberEvent.Type == MemberSuspect {
+				continue
 			}
+			t.onMemberEvent(memberEvent)
+			membersCount := memberEvent.MembersCount
 
 			logger.Infof("members count update to %d, re-check vote count", membersCount)
-			for msgID, votes := range t.waitProposalCounter {
-				if len(votes) < membersCount {
+			completed := map[string][]*ProposalItem{}
+			t.waitProposalCounterLock.Lock()
+			for msgID := range t.waitProposalCounter {
+				votes, ok := t.completedVotes(msgID)
+				if !ok {
 					continue
 				}
+				completed[msgID] = votes
+				t.closeVotes(msgID)
+			}
+			t.waitProposalCounterLock.Unlock()
+
+			for msgID, votes := range completed {
 				err := t.aggregateVotesAndMulticast(votes)
 				if err != nil {
 					logger.Errorf("aggregate votes and multicast failed for msg [%s]: %v", msgID, err)
 				}
-				delete(t.waitProposalCounter, msgID)
 			}
 		}
 	}
 }
 
-func TOMsgDecodeWrapper(f func(*TOMsg) error) func(interface{}) error {
-	return func(v interface{}) error {
-		msg := v.(*TOMsg)
-		return f(msg)
-	}
-}
-
 func (r *TotalOrding) Bind(path string, f func(msg *TOMsg) error) {
-	r.router.Bind(path, TOMsgDecodeWrapper(f))
+	r.router.Bind(path, func(v interface{}) error {
+		return f(v.(*TOMsg))
+	})
 }
 
+// Multicast waits for admission without a deadline
 func (t *TotalOrding) Multicast(path string, v interface{}) (err error) {
+	return t.MulticastContext(context.Background(), path, v)
+}
+
+// MulticastContext starts the trace of the message, its root span lasts until this node delivers it,
+// it gives up waiting for admission once ctx is done
+func (t *TotalOrding) MulticastContext(ctx context.Context, path string, v interface{}) (err error) {
 	tomsg, err := NewTOMsg(path, v)
 	if err != nil {
 		return errors.Wrap(err, "to-multicast failed")
 	}
+	span := tracing.Start(t.bmulticast.group.SelfNodeID, "to.multicast", nil)
+	tomsg.Trace = span.Context()
 	tomsgBytes, err := tomsg.Encode()
 	if err != nil {
 		return errors.Wrap(err, "to-multicast failed")
 	}
 	askMsg := NewTOAskProposalSeqMsg(t.bmulticast.group.SelfNodeID, tomsgBytes)
+	askMsg.Trace = span.Context()
+	span.SetAttribute("msg_id", askMsg.MsgID)
+	span.SetAttribute("path", path)
 
+	err = t.admission.Acquire(ctx, path, askMsg.MsgID)
+	if err != nil {
+		span.SetAttribute("error", err.Error())
+		span.End()
+		return errors.Wrap(err, "to-multicast failed")
+	}
+	tracing.Park(askMsg.MsgID, span)
+	t.registerVoters(askMsg, t.bmulticast.MemberIDs())
+	metrics.NewMulticastLogEntry(t.bmulticast.group.SelfNodeID, askMsg.MsgID, SHA1(string(tomsgBytes))).Log()
+	metrics.TrackTOMulticast(t.bmulticast.group.SelfNodeID, askMsg.MsgID)
+	if t.askBatcher != nil {
+		t.askBatcher.add("", askMsg)
+		return nil
+	}
 	err = t.rmulticast.Multicast(AskProposalSeqPath, askMsg)
 	if err != nil {
+		t.dropMulticast(askMsg.MsgID, err)
 		return errors.Wrap(err, "to-multicast failed")
 	}
 	return nil
 }
 
+func (t *TotalOrding) nextProposalSeqNum() uint64 {
+	t.maxAgreementSeqNumOfGroupLocker.Lock()
+	t.maxProposalSeqNumOfSelfLocker.Lock()
+	defer t.maxAgreementSeqNumOfGroupLocker.Unlock()
+	defer t.maxProposalSeqNumOfSelfLocker.Unlock()
+
+	proposalSeqNum := MaxUint64(t.maxAgreementSeqNumOfGroup, t.maxProposalSeqNumOfSelf) + 1
+	t.maxProposalSeqNumOfSelf = proposalSeqNum
+	return proposalSeqNum
+}
+
+// beforeCutoff reports whether an agreed item was already part of the state this node restored from, caller should hold holdQueueLocker
+func (t *TotalOrding) beforeCutoff(item *TOHoldQueueItem) bool {
+	if t.deliveryCutoff == nil {
+		return false
+	}
+	if item.proposalSeqNum != t.deliveryCutoff.ProposalSeqNum {
+		return item.proposalSeqNum < t.deliveryCutoff.ProposalSeqNum
+	}
+	return item.processID <= t.deliveryCutoff.ProcessID
+}
+
+// reportHoldQueue caller should hold holdQueueLocker
+func (t *TotalOrding) reportHoldQueue() {
+	metrics.HoldQueueDepth.Set(float64(t.holdQueue.Len()), t.bmulticast.group.SelfNodeID)
+}
+
+// Stats reports the hold queue, whose head blocks the delivery of the items behind it, and the votes this node waits for
+func (t *TotalOrding) Stats() *TotalOrderStats {
+	stats := &TotalOrderStats{Strategy: string(ISISStrategy)}
+
+	t.maxAgreementSeqNumOfGroupLocker.Lock()
+	stats.MaxAgreementSeq = t.maxAgreementSeqNumOfGroup
+	t.maxAgreementSeqNumOfGroupLocker.Unlock()
+	t.maxProposalSeqNumOfSelfLocker.Lock()
+	stats.MaxProposalSeq = t.maxProposalSeqNumOfSelf
+	t.maxProposalSeqNumOfSelfLocker.Unlock()
+
+	t.holdQueueLocker.Lock()
+	stats.DeliveryPaused = t.deliveryPaused
+	stats.HoldQueue = t.holdQueue.Stats()
+	t.holdQueueLocker.Unlock()
+	if len(stats.HoldQueue) > 0 {
+		stats.HeadOfLine = stats.HoldQueue[0]
+	}
+
+	t.waitProposalCounterLock.Lock()
+	stats.PendingVotes = make([]*PendingVotesStats, 0, len(t.waitProposalCounter))
+	for msgID, collector := range t.waitProposalCounter {
+		missing := t.missingVoters(collector)
+		sort.Strings(missing)
+		stats.PendingVotes = append(stats.PendingVotes, &PendingVotesStats{
+			MsgID:       msgID,
+			Voters:      len(collector.voters),
+			Votes:       len(collector.votes),
+			Missing:     missing,
+			Retries:     collector.retries,
+			WaitedNanos: time.Since(collector.start).Nanoseconds(),
+		})
+	}
+	t.waitProposalCounterLock.Unlock()
+	sort.Slice(stats.PendingVotes, func(i, j int) bool {
+		return stats.PendingVotes[i].WaitedNanos > stats.PendingVotes[j].WaitedNanos
+	})
+	return stats
+}
+
+// deliverHoldQueue delivers agreed items from the head of the hold queue, caller should hold holdQueueLocker
+func (t *TotalOrding) deliverHoldQueue() (err error) {
+	defer t.reportHoldQueue()
+	if t.deliveryPaused {
+		return nil
+	}
+
+	for t.holdQueue.Len() > 0 {
+		// logger.Infof("hold queue %s", t.holdQueue.Snapshot())
+		item := t.holdQueue.Peek().(*TOHoldQueueItem)
+		if !item.agreed {
+			// the undecided messages of a crashed origin wait for the decision of the survivors, see sweepHoldQueue
+			break
+		}
+
+		// a msg that does not decode stays at the head, it is not taken out half delivered
+		tomsg := &TOMsg{}
+		_, err = tomsg.Decode(item.body)
+		if err != nil {
+			return err
+		}
+
+		delete(t.holdQueueMap, item.msgID)
+		heap.Pop(t.holdQueue)
+		t.admission.Leave(item.msgID)
+		t.rememberDelivered(item)
+		if t.beforeCutoff(item) {
+			logger.Infof("skip [%d:%s][%s], already part of restored state", item.proposalSeqNum, item.processID, item.msgID)
+			item.span.SetAttribute("skipped", "restored state")
+			item.span.End()
+			span := tracing.Unpark(item.msgID)
+			span.SetAttribute("skipped", "restored state")
+			span.End()
+			continue
+		}
+
+		logger.Infof("TO deliver [%d:%s][%s]", item.proposalSeqNum, item.processID, item.msgID)
+		item.span.SetAttribute("seq", strconv.FormatUint(item.proposalSeqNum, 10))
+		item.span.End()
+		metrics.NewDelayLogEntry(t.bmulticast.group.SelfNodeID, item.msgID).Log()
+		metrics.NewDeliverLogEntry(t.bmulticast.group.SelfNodeID, item.msgID, item.proposalSeqNum, item.processID, SHA1(string(item.body))).Log()
+		metrics.ObserveTODelivery(t.bmulticast.group.SelfNodeID, item.msgID)
+		t.delivering = &ProposalItem{
+			ProposalSeqNum: item.proposalSeqNum,
+			ProcessID:      item.processID,
+			MsgID:          item.msgID,
+		}
+		span := tracing.Start(t.bmulticast.group.SelfNodeID, "to.deliver", tomsg.Trace)
+		span.SetAttribute("path", tomsg.Path)
+		span.SetAttribute("seq", strconv.FormatUint(item.proposalSeqNum, 10))
+		err = t.router.Run(tomsg.Path, tomsg)
+		span.End()
+		tracing.Unpark(item.msgID).End()
+		t.delivering = nil
+		if err != nil {
+			logger.Errorf("process err %v", err)
+		}
+	}
+	return nil
+}
+
+// propose puts the asked message in the hold queue with proposalSeqNum, and returns the reply to the asker,
+// caller should hold holdQueueLocker
+func (t *TotalOrding) propose(askMsg *TOAskProposalSeqMsg, proposalSeqNum uint64) (*TOReplyProposalSeqMsg, bool) {
+	if t.orphaned(askMsg.SrcID) {
+		logger.Infof("ignore ask [%s] of crashed node [%s], its msgs are settled", askMsg.MsgID, askMsg.SrcID)
+		return nil, false
+	}
+
+	item, ok := t.holdQueueMap[askMsg.MsgID]
+	if ok && item.agreed {
+		return nil, false
+	}
+
+	if ok {
+		// the item came with a state transfer, propose again on behalf of this node
+		item.proposalSeqNum = proposalSeqNum
+		heap.Fix(t.holdQueue, item.index)
+	} else {
+		item = &TOHoldQueueItem{
+			body:           askMsg.Body,
+			proposalSeqNum: proposalSeqNum,
+			msgID:          askMsg.MsgID,
+			processID:      askMsg.SrcID,
+			originID:       askMsg.SrcID,
+			agreed:         false,
+			span:           tracing.Start(t.bmulticast.group.SelfNodeID, "to.hold", askMsg.Trace),
+		}
+		t.holdQueueMap[askMsg.MsgID] = item
+		heap.Push(t.holdQueue, item)
+		t.admission.Enter(askMsg.MsgID, askMsg.SrcID)
+		t.reportHoldQueue()
+	}
+
+	// logger.Errorf("send proposal seq [%s] [%d] to [%s]", askMsg.MsgID, proposalSeqNum, askMsg.SrcID)
+	span := tracing.Start(t.bmulticast.group.SelfNodeID, "isis.propose", askMsg.Trace)
+	span.SetAttribute("msg_id", askMsg.MsgID)
+	span.SetAttribute("proposal_seq", strconv.FormatUint(proposalSeqNum, 10))
+	defer span.End()
+	replyProposalMsg := NewTOReplyProposalSeqMsg(t.bmulticast.group.SelfNodeID, askMsg.MsgID, proposalSeqNum)
+	replyProposalMsg.Trace = span.Context()
+	return replyProposalMsg, true
+}
+
+func (t *TotalOrding) reply(dstID string, replyProposalMsg *TOReplyProposalSeqMsg) error {
+	if t.replyBatcher != nil {
+		t.replyBatcher.add(dstID, replyProposalMsg)
+		return nil
+	}
+	return t.bmulticast.Unicast(dstID, WaitProposalSeqPath, replyProposalMsg)
+}
+
+// agree fixes the agreed seq of an announced message, caller should hold holdQueueLocker
+func (t *TotalOrding) agree(announceAgreementMsg *TOAnnounceAgreementSeqMsg) error {
+	item, ok := t.holdQueueMap[announceAgreementMsg.MsgID]
+	if !ok {
+		logger.Errorf("msg id [%s] not exist in hold queue map", announceAgreementMsg.MsgID)
+		return errors.New("announce-agreement-seq failed")
+	}
+	if !item.agreed && t.frozen(item.originID) {
+		logger.Infof("hold back announce of msg [%s], node [%s] crashed and its msgs wait for the decision", item.msgID, item.originID)
+		round := t.orphanRounds[item.originID]
+		round.held = append(round.held, announceAgreementMsg)
+		return nil
+	}
+
+	t.holdQueue.Update(item, announceAgreementMsg.ProcessID, announceAgreementMsg.AgreementSeq)
+	return nil
+}
+
+func (t *TotalOrding) raiseMaxAgreementSeqNum(agreementSeq uint64) {
+	t.maxAgreementSeqNumOfGroupLocker.Lock()
+	defer t.maxAgreementSeqNumOfGroupLocker.Unlock()
+	t.maxAgreementSeqNumOfGroup = MaxUint64(t.maxAgreementSeqNumOfGroup, agreementSeq)
+}
+
 func (t *TotalOrding) bindTODeliver() {
 	rRouter := t.rmulticast
 	bRouter := t.bmulticast
@@ -188,32 +708,83 @@ func (t *TotalOrding) bindTODeliver() {
 			return errors.Wrap(err, "ask-proposal-seq failed")
 		}
 
-		t.maxAgreementSeqNumOfGroupLocker.Lock()
-		t.maxProposalSeqNumOfSelfLocker.Lock()
+		proposalSeqNum := t.nextProposalSeqNum()
+
+		defer t.bmulticast.group.catchUp.forward(msg)
+		t.holdQueueLocker.Lock()
+		defer t.holdQueueLocker.Unlock()
+
+		replyProposalMsg, ok := t.propose(askMsg, proposalSeqNum)
+		if !ok {
+			return nil
+		}
+		err = t.reply(askMsg.SrcID, replyProposalMsg)
+		if err != nil {
+			return errors.Wrap(err, "ask-proposal-seq failed")
+		}
+		return nil
+	})
 
-		proposalSeqNum := MaxUint64(t.maxAgreementSeqNumOfGroup, t.maxProposalSeqNumOfSelf) + 1
-		t.maxProposalSeqNumOfSelf = proposalSeqNum
-		t.maxAgreementSeqNumOfGroupLocker.Unlock()
-		t.maxProposalSeqNumOfSelfLocker.Unlock()
+	rRouter.Bind(AskProposalSeqBatchPath, func(msg *RMsg) error {
+		batchMsg := &TOAskProposalSeqBatchMsg{}
+		err := codec.Unmarshal(msg.Body, batchMsg)
+		if err != nil {
+			return errors.Wrap(err, "ask-proposal-seq-batch failed")
+		}
 
+		proposalSeqNums := make([]uint64, len(batchMsg.Asks))
+		for i := range batchMsg.Asks {
+			proposalSeqNums[i] = t.nextProposalSeqNum()
+		}
+
+		defer t.bmulticast.group.catchUp.forward(msg)
 		t.holdQueueLocker.Lock()
 		defer t.holdQueueLocker.Unlock()
 
-		item := &TOHoldQueueItem{
-			body:           askMsg.Body,
-			proposalSeqNum: proposalSeqNum,
-			msgID:          askMsg.MsgID,
-			processID:      askMsg.SrcID,
-			agreed:         false,
+		for i, askMsg := range batchMsg.Asks {
+			replyProposalMsg, ok := t.propose(askMsg, proposalSeqNums[i])
+			if !ok {
+				continue
+			}
+			err = t.reply(askMsg.SrcID, replyProposalMsg)
+			if err != nil {
+				return errors.Wrap(err, "ask-proposal-seq-batch failed")
+			}
 		}
-		t.holdQueueMap[askMsg.MsgID] = item
-		heap.Push(t.holdQueue, item)
+		return nil
+	})
 
-		// logger.Errorf("send proposal seq [%s] [%d] to [%s]", askMsg.MsgID, proposalSeqNum, askMsg.SrcID)
-		replyProposalMsg := NewTOReplyProposalSeqMsg(t.bmulticast.group.SelfNodeID, askMsg.MsgID, proposalSeqNum)
-		err = t.bmulticast.Unicast(askMsg.SrcID, WaitProposalSeqPath, replyProposalMsg)
+	bRouter.Bind(ReAskProposalSeqPath, func(msg *BMsg) error {
+		askMsg := &TOAskProposalSeqMsg{}
+		_, err := askMsg.Decode(msg.Body)
 		if err != nil {
-			return errors.Wrap(err, "ask-proposal-seq failed")
+			return errors.Wrap(err, "re-ask-proposal-seq failed")
+		}
+
+		proposalSeqNum := t.nextProposalSeqNum()
+
+		t.holdQueueLocker.Lock()
+		defer t.holdQueueLocker.Unlock()
+
+		// the vote of this node was lost, the proposal it already made is sent again,
+		// a late ask of a message already delivered is ignored
+		var replyProposalMsg *TOReplyProposalSeqMsg
+		item, ok := t.holdQueueMap[askMsg.MsgID]
+		_, delivered := t.deliveredMsgIDs[askMsg.MsgID]
+		switch {
+		case delivered || (ok && item.agreed):
+			return nil
+		case ok:
+			replyProposalMsg = NewTOReplyProposalSeqMsg(t.bmulticast.group.SelfNodeID, askMsg.MsgID, item.proposalSeqNum)
+		default:
+			replyProposalMsg, ok = t.propose(askMsg, proposalSeqNum)
+			if !ok {
+				return nil
+			}
+		}
+		err = t.reply(askMsg.SrcID, replyProposalMsg)
+		if err != nil {
+			return errors.Wrap(err, "re-ask-proposal-seq failed")
 		}
 		return nil
 	})
@@ -225,12 +796,28 @@ func (t *TotalOrding) bindTODeliver() {
 			return errors.Wrap(err, "wait-proposal-seq failed")
 		}
 		// logger.Infof("get proposal seq: %s", replyProposalMsg.MsgID)
-		t.waitVotesChannel <- &ProposalItem{
+		t.pushVote(&ProposalItem{
 			ProposalSeqNum: replyProposalMsg.ProposalSeq,
 			ProcessID:      replyProposalMsg.ProcessID,
 			MsgID:          replyProposalMsg.MsgID,
-		}
+		})
+
+		return nil
+	})
 
+	bRouter.Bind(WaitProposalSeqBatchPath, func(msg *BMsg) error {
+		batchMsg := &TOReplyProposalSeqBatchMsg{}
+		err := codec.Unmarshal(msg.Body, batchMsg)
+		if err != nil {
+			return errors.Wrap(err, "wait-proposal-seq-batch failed")
+		}
+		for _, replyProposalMsg := range batchMsg.Replies {
+			t.pushVote(&ProposalItem{
+				ProposalSeqNum: replyProposalMsg.ProposalSeq,
+				ProcessID:      replyProposalMsg.ProcessID,
+				MsgID:          replyProposalMsg.MsgID,
+			})
+		}
 		return nil
 	})
 
@@ -242,62 +829,50 @@ func (t *TotalOrding) bindTODeliver() {
 		}
 
 		// logger.Infof("get announce [%d:%s] %s", announceAgreementMsg.AgreementSeq, announceAgreementMsg.ProcessID, announceAgreementMsg.MsgID)
+		t.raiseMaxAgreementSeqNum(announceAgreementMsg.AgreementSeq)
 
-		t.maxAgreementSeqNumOfGroupLocker.Lock()
-		t.maxAgreementSeqNumOfGroup = MaxUint64(t.maxAgreementSeqNumOfGroup, announceAgreementMsg.AgreementSeq)
-		t.maxAgreementSeqNumOfGroupLocker.Unlock()
-
+		defer t.bmulticast.group.catchUp.forward(msg)
 		t.holdQueueLocker.Lock()
 		defer t.holdQueueLocker.Unlock()
 
-		item, ok := t.holdQueueMap[announceAgreementMsg.MsgID]
-		if !ok {
-			logger.Errorf("msg id [%s] not exist in hold queue map", announceAgreementMsg.MsgID)
-			return errors.New("announce-agreement-seq failed")
+		err = t.agree(announceAgreementMsg)
+		if err != nil {
+			return err
 		}
 
-		t.holdQueue.Update(item, announceAgreementMsg.ProcessID, announceAgreementMsg.AgreementSeq)
-
-		for t.holdQueue.Len() > 0 {
-			// logger.Infof("hold queue %s", t.holdQueue.Snapshot())
-			item := t.holdQueue.Peek().(*TOHoldQueueItem)
-			if !item.agreed {
-				ok := t.bmulticast.IsNodeAlived(item.processID)
-				if !ok {
-					crashTime, tok := t.crashNodeTimeout[item.processID]
+		err = t.deliverHoldQueue()
+		if err != nil {
+			return errors.Wrap(err, "announce-agreement-seq failed")
+		}
+		return nil
+	})
 
-					if !tok {
-						t.crashNodeTimeout[item.processID] = time.Now()
-						break
-					}
+	rRouter.Bind(AnnounceAgreementSeqBatchPath, func(msg *RMsg) error {
+		batchMsg := &TOAnnounceAgreementSeqBatchMsg{}
+		err := codec.Unmarshal(msg.Body, batchMsg)
+		if err != nil {
+			return errors.Wrap(err, "announce-agreement-seq-batch failed")
+		}
 
-					timeDiff := time.Since(crashTime)
+		for _, announceAgreementMsg := range batchMsg.Announces {
+			t.raiseMaxAgreementSeqNum(announceAgreementMsg.AgreementSeq)
+		}
 
-					if timeDiff > NodeCrashTimeout {
-						delete(t.holdQueueMap, item.msgID)
-						heap.Pop(t.holdQueue)
-						logger.Infof("skip crashed process [%s] msg", item.processID)
-						break
-					}
-				}
-				break
-			}
+		defer t.bmulticast.group.catchUp.forward(msg)
+		t.holdQueueLocker.Lock()
+		defer t.holdQueueLocker.Unlock()
 
-			logger.Infof("TO deliver [%d:%s][%s]", item.proposalSeqNum, item.processID, item.msgID)
-			metrics.NewDelayLogEntry(t.bmulticast.group.SelfNodeID, item.msgID).Log()
-			delete(t.holdQueueMap, item.msgID)
-			heap.Pop(t.holdQueue)
-			tomsg := &TOMsg{}
-			_, err = tomsg.Decode(item.body)
+		for _, announceAgreementMsg := range batchMsg.Announces {
+			err = t.agree(announceAgreementMsg)
 			if err != nil {
-				return errors.Wrap(err, "announce-agreement-seq failed")
-			}
-			err = t.router.Run(tomsg.Path, tomsg)
-			if err != nil {
-				logger.Errorf("process err %v", err)
+				logger.Errorf("agree msg [%s] failed: %v", announceAgreementMsg.MsgID, err)
 			}
 		}
 
+		err = t.deliverHoldQueue()
+		if err != nil {
+			return errors.Wrap(err, "announce-agreement-seq-batch failed")
+		}
 		return nil
 	})
 }
@@ -0,0 +1,442 @@
+package multicast
+
+import (
+	"container/heap"
+	"context"
+	"time"
+
+	"github.com/bamboovir/cs425/lib/codec"
+	errors "github.com/pkg/errors"
+)
+
+const (
+	OrphanQueryPath    = "/total-ording/orphan-query"
+	OrphanReportPath   = "/total-ording/orphan-report"
+	OrphanDecisionPath = "/total-ording/orphan-decision"
+)
+
+const (
+	HoldQueueSweepPeriod = time.Second
+	// DeliveredHistory delivered items are kept, so a survivor can report a message it delivered before the origin crashed
+	DeliveredHistory = 4096
+)
+
+// TOOrphanItem a message of a crashed origin, Agreed items carry the agreed seq ProcessID announced
+type TOOrphanItem struct {
+	MsgID     string `json:"msg_id"`
+	ProcessID string `json:"pid"`
+	Seq       uint64 `json:"seq"`
+	Agreed    bool   `json:"agreed"`
+}
+
+// TOOrphanQueryMsg the coordinator asks a survivor for its report on the messages of Origin
+type TOOrphanQueryMsg struct {
+	Origin        string `json:"origin"`
+	CoordinatorID string `json:"coordinator"`
+}
+
+// TOOrphanReportMsg the messages of Origin a survivor knows of,
+// a survivor that already applied a decision sends it along, so a new coordinator decides the same
+type TOOrphanReportMsg struct {
+	Origin     string               `json:"origin"`
+	ReporterID string               `json:"reporter"`
+	Items      []*TOOrphanItem      `json:"items"`
+	Decision   *TOOrphanDecisionMsg `json:"decision,omitempty"`
+}
+
+// TOOrphanDecisionMsg every survivor delivers the Agreed items at their seq, and discards every other undecided message of Origin
+type TOOrphanDecisionMsg struct {
+	Origin string          `json:"origin"`
+	Items  []*TOOrphanItem `json:"items"`
+}
+
+// orphanRound collects the reports on the messages of a crashed origin, once this node reported,
+// announces of the undecided messages of origin are held back, only the decision settles them
+type orphanRound struct {
+	reported bool
+	reports  map[string][]*TOOrphanItem
+	decision *TOOrphanDecisionMsg
+	held     []*TOAnnounceAgreementSeqMsg
+}
+
+type deliveredItem struct {
+	origin string
+	item   *TOOrphanItem
+}
+
+// orphanRoundOf caller should hold holdQueueLocker
+func (t *TotalOrding) orphanRoundOf(origin string) *orphanRound {
+	round, ok := t.orphanRounds[origin]
+	if !ok {
+		round = &orphanRound{reports: map[string][]*TOOrphanItem{}}
+		t.orphanRounds[origin] = round
+	}
+	return round
+}
+
+// frozen reports whether the undecided messages of origin only wait for the decision, caller should hold holdQueueLocker
+func (t *TotalOrding) frozen(origin string) bool {
+	round, ok := t.orphanRounds[origin]
+	return ok && round.reported
+}
+
+// orphaned reports whether the messages of origin were settled by a decision, caller should hold holdQueueLocker
+func (t *TotalOrding) orphaned(origin string) bool {
+	_, ok := t.orphanDecisions[origin]
+	return ok
+}
+
+// rememberDelivered caller should hold holdQueueLocker
+func (t *TotalOrding) rememberDelivered(item *TOHoldQueueItem) {
+	t.delivered = append(t.delivered, &deliveredItem{
+		origin: item.originID,
+		item: &TOOrphanItem{
+			MsgID:     item.msgID,
+			ProcessID: item.processID,
+			Seq:       item.proposalSeqNum,
+			Agreed:    true,
+		},
+	})
+	t.deliveredMsgIDs[item.msgID] = struct{}{}
+	if len(t.delivered) > DeliveredHistory {
+		delete(t.deliveredMsgIDs, t.delivered[0].item.MsgID)
+		t.delivered = t.delivered[1:]
+	}
+}
+
+// orphanReport returns the messages of origin in the hold queue and the delivered ones, caller should hold holdQueueLocker
+func (t *TotalOrding) orphanReport(origin string) []*TOOrphanItem {
+	items := make([]*TOOrphanItem, 0)
+	for _, item := range *t.holdQueue {
+		if item.originID != origin {
+			continue
+		}
+		items = append(items, &TOOrphanItem{
+			MsgID:     item.msgID,
+			ProcessID: item.processID,
+			Seq:       item.proposalSeqNum,
+			Agreed:    item.agreed,
+		})
+	}
+	for _, delivered := range t.delivered {
+		if delivered.origin == origin {
+			items = append(items, delivered.item)
+		}
+	}
+	return items
+}
+
+// survivors returns the alive members except origin, sorted by node id
+func (t *TotalOrding) survivors(origin string) []string {
+	survivors := make([]string, 0)
+	for _, nodeID := range t.bmulticast.MemberIDs() {
+		if nodeID != origin {
+			survivors = append(survivors, nodeID)
+		}
+	}
+	return survivors
+}
+
+// report freezes the undecided messages of origin and returns the report of this node, caller should hold holdQueueLocker
+func (t *TotalOrding) report(origin string) *TOOrphanReportMsg {
+	selfID := t.bmulticast.group.SelfNodeID
+	reportMsg := &TOOrphanReportMsg{
+		Origin:     origin,
+		ReporterID: selfID,
+		Decision:   t.orphanDecisions[origin],
+	}
+	if reportMsg.Decision != nil {
+		return reportMsg
+	}
+	round := t.orphanRoundOf(origin)
+	round.reported = true
+	reportMsg.Items = t.orphanReport(origin)
+	round.reports[selfID] = reportMsg.Items
+	return reportMsg
+}
+
+// resolveOrphans reports the messages of a crashed origin to the coordinator, the survivor with the smallest id,
+// the coordinator queries the survivors that did not report yet, caller should hold holdQueueLocker
+func (t *TotalOrding) resolveOrphans(origin string) {
+	selfID := t.bmulticast.group.SelfNodeID
+	reportMsg := t.report(origin)
+	survivors := t.survivors(origin)
+	if len(survivors) == 0 {
+		return
+	}
+
+	coordinatorID := survivors[0]
+	if coordinatorID != selfID {
+		err := t.bmulticast.Unicast(coordinatorID, OrphanReportPath, reportMsg)
+		if err != nil {
+			logger.Errorf("report msgs of crashed node [%s] to coordinator [%s] failed: %v", origin, coordinatorID, err)
+		}
+		return
+	}
+
+	round := t.orphanRoundOf(origin)
+	for _, nodeID := range survivors {
+		if _, ok := round.reports[nodeID]; ok || round.decision != nil {
+			continue
+		}
+		err := t.bmulticast.Unicast(nodeID, OrphanQueryPath, &TOOrphanQueryMsg{Origin: origin, CoordinatorID: selfID})
+		if err != nil {
+			logger.Errorf("query node [%s] for msgs of crashed node [%s] failed: %v", nodeID, origin, err)
+		}
+	}
+	t.decideOrphans(origin)
+}
+
+// finalizeOrphans decides the messages of origin from the reports of every survivor. A message a survivor saw agreed is delivered at its agreed seq.
+// A message no survivor saw agreed was never delivered, if every survivor holds it, the survivors take over the sender
+// and agree on the max of their proposals, as the sender would have, otherwise it is discarded
+func finalizeOrphans(origin string, survivors []string, reports map[string][]*TOOrphanItem) *TOOrphanDecisionMsg {
+	isSurvivor := map[string]struct{}{}
+	for _, nodeID := range survivors {
+		isSurvivor[nodeID] = struct{}{}
+	}
+
+	agreed := map[string]*TOOrphanItem{}
+	proposals := map[string][]*ProposalItem{}
+	for reporterID, items := range reports {
+		for _, item := range items {
+			if item.Agreed {
+				agreed[item.MsgID] = item
+				continue
+			}
+			if _, ok := isSurvivor[reporterID]; !ok {
+				continue
+			}
+			proposals[item.MsgID] = append(proposals[item.MsgID], &ProposalItem{
+				ProposalSeqNum: item.Seq,
+				ProcessID:      reporterID,
+				MsgID:          item.MsgID,
+			})
+		}
+	}
+
+	decision := &TOOrphanDecisionMsg{
+		Origin: origin,
+		Items:  make([]*TOOrphanItem, 0, len(agreed)+len(proposals)),
+	}
+	for _, item := range agreed {
+		decision.Items = append(decision.Items, item)
+	}
+	for msgID, votes := range proposals {
+		if _, ok := agreed[msgID]; ok {
+			continue
+		}
+		if len(votes) < len(survivors) {
+			decision.Items = append(decision.Items, &TOOrphanItem{MsgID: msgID})
+			continue
+		}
+		max, _ := MaxOfArrayProposalItem(votes)
+		decision.Items = append(decision.Items, &TOOrphanItem{
+			MsgID:     msgID,
+			ProcessID: max.ProcessID,
+			Seq:       max.ProposalSeqNum,
+			Agreed:    true,
+		})
+	}
+	return decision
+}
+
+// decideOrphans multicasts the decision once every survivor reported, caller should hold holdQueueLocker
+func (t *TotalOrding) decideOrphans(origin string) {
+	round, ok := t.orphanRounds[origin]
+	if !ok || t.orphaned(origin) {
+		return
+	}
+	if _, ok := round.reports[t.bmulticast.group.SelfNodeID]; !ok {
+		return
+	}
+
+	decision := round.decision
+	if decision == nil {
+		survivors := t.survivors(origin)
+		for _, nodeID := range survivors {
+			if _, ok := round.reports[nodeID]; !ok {
+				return
+			}
+		}
+		decision = finalizeOrphans(origin, survivors, round.reports)
+	}
+
+	t.applyOrphanDecision(decision)
+	err := t.rmulticast.Multicast(OrphanDecisionPath, decision)
+	if err != nil {
+		logger.Errorf("multicast decision on msgs of crashed node [%s] failed: %v", origin, err)
+	}
+}
+
+// applyOrphanDecision settles the undecided messages of the crashed origin, caller should hold holdQueueLocker
+func (t *TotalOrding) applyOrphanDecision(decision *TOOrphanDecisionMsg) {
+	if t.orphaned(decision.Origin) {
+		return
+	}
+	t.orphanDecisions[decision.Origin] = decision
+	delete(t.orphanRounds, decision.Origin)
+
+	decided := map[string]*TOOrphanItem{}
+	for _, item := range decision.Items {
+		decided[item.MsgID] = item
+	}
+
+	undecided := make([]*TOHoldQueueItem, 0)
+	for _, item := range t.holdQueueMap {
+		if item.originID == decision.Origin && !item.agreed {
+			undecided = append(undecided, item)
+		}
+	}
+
+	delivered, discarded := 0, 0
+	for _, item := range undecided {
+		decidedItem, ok := decided[item.msgID]
+		if ok && decidedItem.Agreed {
+			t.holdQueue.Update(item, decidedItem.ProcessID, decidedItem.Seq)
+			t.raiseMaxAgreementSeqNum(decidedItem.Seq)
+			delivered++
+			continue
+		}
+		delete(t.holdQueueMap, item.msgID)
+		heap.Remove(t.holdQueue, item.index)
+		t.admission.Leave(item.msgID)
+		discarded++
+	}
+	logger.Infof("settle msgs of crashed node [%s], %d agreed, %d discarded", decision.Origin, delivered, discarded)
+}
+
+// forgetOrphans is called once origin is alive again, the announces held back while it was taken for crashed are applied,
+// caller should hold holdQueueLocker
+func (t *TotalOrding) forgetOrphans(origin string) {
+	round, ok := t.orphanRounds[origin]
+	delete(t.crashNodeTimeout, origin)
+	delete(t.orphanRounds, origin)
+	delete(t.orphanDecisions, origin)
+	if !ok {
+		return
+	}
+	for _, announceAgreementMsg := range round.held {
+		err := t.agree(announceAgreementMsg)
+		if err != nil {
+			logger.Errorf("agree msg [%s] failed: %v", announceAgreementMsg.MsgID, err)
+		}
+	}
+}
+
+func (t *TotalOrding) onMemberEvent(memberEvent *MemberEvent) {
+	t.holdQueueLocker.Lock()
+	defer t.holdQueueLocker.Unlock()
+	switch memberEvent.Type {
+	case MemberJoin:
+		t.forgetOrphans(memberEvent.NodeID)
+	case MemberDead, MemberLeave:
+		if _, ok := t.crashNodeTimeout[memberEvent.NodeID]; !ok {
+			t.crashNodeTimeout[memberEvent.NodeID] = time.Now()
+		}
+	}
+}
+
+// sweepHoldQueue resolves the messages of the origins that crashed NodeCrashTimeout ago,
+// and delivers the hold queue even if no message arrives
+func (t *TotalOrding) sweepHoldQueue() {
+	t.holdQueueLocker.Lock()
+	defer t.holdQueueLocker.Unlock()
+
+	for _, item := range *t.holdQueue {
+		if item.agreed || t.bmulticast.IsNodeAlived(item.originID) {
+			continue
+		}
+		if _, ok := t.crashNodeTimeout[item.originID]; !ok {
+			t.crashNodeTimeout[item.originID] = time.Now()
+		}
+	}
+
+	for origin, crashTime := range t.crashNodeTimeout {
+		if t.orphaned(origin) {
+			continue
+		}
+		if t.bmulticast.IsNodeAlived(origin) {
+			t.forgetOrphans(origin)
+			continue
+		}
+		if time.Since(crashTime) < NodeCrashTimeout {
+			continue
+		}
+		t.resolveOrphans(origin)
+	}
+
+	err := t.deliverHoldQueue()
+	if err != nil {
+		logger.Errorf("sweep hold queue failed: %v", err)
+	}
+}
+
+func (t *TotalOrding) sweep(ctx context.Context) {
+	ticker := time.NewTicker(HoldQueueSweepPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.sweepHoldQueue()
+		}
+	}
+}
+
+func (t *TotalOrding) bindOrphans() {
+	t.bmulticast.Bind(OrphanQueryPath, func(msg *BMsg) error {
+		queryMsg := &TOOrphanQueryMsg{}
+		err := codec.Unmarshal(msg.Body, queryMsg)
+		if err != nil {
+			return errors.Wrap(err, "orphan-query failed")
+		}
+
+		t.holdQueueLocker.Lock()
+		defer t.holdQueueLocker.Unlock()
+		if _, ok := t.crashNodeTimeout[queryMsg.Origin]; !ok {
+			t.crashNodeTimeout[queryMsg.Origin] = time.Now()
+		}
+		err = t.bmulticast.Unicast(queryMsg.CoordinatorID, OrphanReportPath, t.report(queryMsg.Origin))
+		if err != nil {
+			return errors.Wrap(err, "orphan-query failed")
+		}
+		return nil
+	})
+
+	t.bmulticast.Bind(OrphanReportPath, func(msg *BMsg) error {
+		reportMsg := &TOOrphanReportMsg{}
+		err := codec.Unmarshal(msg.Body, reportMsg)
+		if err != nil {
+			return errors.Wrap(err, "orphan-report failed")
+		}
+
+		t.holdQueueLocker.Lock()
+		defer t.holdQueueLocker.Unlock()
+		if t.orphaned(reportMsg.Origin) {
+			return nil
+		}
+		round := t.orphanRoundOf(reportMsg.Origin)
+		round.reports[reportMsg.ReporterID] = reportMsg.Items
+		if reportMsg.Decision != nil {
+			round.decision = reportMsg.Decision
+		}
+		t.decideOrphans(reportMsg.Origin)
+		return t.deliverHoldQueue()
+	})
+
+	t.rmulticast.Bind(OrphanDecisionPath, func(msg *RMsg) error {
+		decision := &TOOrphanDecisionMsg{}
+		err := codec.Unmarshal(msg.Body, decision)
+		if err != nil {
+			return errors.Wrap(err, "orphan-decision failed")
+		}
+
+		defer t.bmulticast.group.catchUp.forward(msg)
+		t.holdQueueLocker.Lock()
+		defer t.holdQueueLocker.Unlock()
+		t.applyOrphanDecision(decision)
+		return t.deliverHoldQueue()
+	})
+}
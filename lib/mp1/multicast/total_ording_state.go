@@ -0,0 +1,111 @@
+package multicast
+
+import (
+	"container/heap"
+	"encoding/json"
+)
+
+type isisStateItem struct {
+	Body           []byte `json:"body"`
+	ProposalSeqNum uint64 `json:"proposal_seq"`
+	ProcessID      string `json:"pid"`
+	Agreed         bool   `json:"agreed"`
+	MsgID          string `json:"msg_id"`
+	OriginID       string `json:"origin,omitempty"`
+}
+
+type isisState struct {
+	Items              []*isisStateItem `json:"items"`
+	MaxAgreementSeqNum uint64           `json:"max_agreement_seq"`
+	MaxProposalSeqNum  uint64           `json:"max_proposal_seq"`
+	CutoffSeqNum       uint64           `json:"cutoff_seq"`
+	CutoffProcessID    string           `json:"cutoff_pid"`
+}
+
+// snapshotDeliveryState is called by a TO handler, holdQueueLocker is already held
+func (t *TotalOrding) snapshotDeliveryState() ([]byte, error) {
+	state := &isisState{
+		Items: make([]*isisStateItem, 0, t.holdQueue.Len()),
+	}
+	for _, item := range *t.holdQueue {
+		state.Items = append(state.Items, &isisStateItem{
+			Body:           item.body,
+			ProposalSeqNum: item.proposalSeqNum,
+			ProcessID:      item.processID,
+			Agreed:         item.agreed,
+			MsgID:          item.msgID,
+			OriginID:       item.originID,
+		})
+	}
+
+	t.maxAgreementSeqNumOfGroupLocker.Lock()
+	state.MaxAgreementSeqNum = t.maxAgreementSeqNumOfGroup
+	t.maxAgreementSeqNumOfGroupLocker.Unlock()
+	t.maxProposalSeqNumOfSelfLocker.Lock()
+	state.MaxProposalSeqNum = t.maxProposalSeqNumOfSelf
+	t.maxProposalSeqNumOfSelfLocker.Unlock()
+
+	if t.delivering != nil {
+		state.CutoffSeqNum = t.delivering.ProposalSeqNum
+		state.CutoffProcessID = t.delivering.ProcessID
+	}
+
+	return json.Marshal(state)
+}
+
+func (t *TotalOrding) restoreDeliveryState(data []byte) error {
+	state := &isisState{}
+	err := json.Unmarshal(data, state)
+	if err != nil {
+		return err
+	}
+
+	t.maxAgreementSeqNumOfGroupLocker.Lock()
+	t.maxAgreementSeqNumOfGroup = MaxUint64(t.maxAgreementSeqNumOfGroup, state.MaxAgreementSeqNum)
+	t.maxAgreementSeqNumOfGroupLocker.Unlock()
+	t.maxProposalSeqNumOfSelfLocker.Lock()
+	t.maxProposalSeqNumOfSelf = MaxUint64(t.maxProposalSeqNumOfSelf, state.MaxProposalSeqNum)
+	t.maxProposalSeqNumOfSelfLocker.Unlock()
+
+	t.holdQueueLocker.Lock()
+	defer t.holdQueueLocker.Unlock()
+
+	t.deliveryCutoff = &ProposalItem{
+		ProposalSeqNum: state.CutoffSeqNum,
+		ProcessID:      state.CutoffProcessID,
+	}
+
+	for _, stateItem := range state.Items {
+		item, ok := t.holdQueueMap[stateItem.MsgID]
+		if ok {
+			if stateItem.Agreed && !item.agreed {
+				t.holdQueue.Update(item, stateItem.ProcessID, stateItem.ProposalSeqNum)
+			}
+			continue
+		}
+		originID := stateItem.OriginID
+		if originID == "" {
+			originID = stateItem.ProcessID
+		}
+		item = &TOHoldQueueItem{
+			body:           stateItem.Body,
+			proposalSeqNum: stateItem.ProposalSeqNum,
+			processID:      stateItem.ProcessID,
+			originID:       originID,
+			agreed:         stateItem.Agreed,
+			msgID:          stateItem.MsgID,
+		}
+		t.holdQueueMap[item.msgID] = item
+		heap.Push(t.holdQueue, item)
+		t.admission.Enter(item.msgID, originID)
+	}
+
+	t.deliveryPaused = false
+	return t.deliverHoldQueue()
+}
+
+func (t *TotalOrding) pauseDelivery() {
+	t.holdQueueLocker.Lock()
+	defer t.holdQueueLocker.Unlock()
+	t.deliveryPaused = true
+}
@@ -0,0 +1,269 @@
+package multicast
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bamboovir/cs425/lib/codec"
+	"github.com/bamboovir/cs425/lib/mp1/tracing"
+)
+
+// failingCodec fails to encode the batches, as a codec would on a body it does not support
+type failingCodec struct{}
+
+func (failingCodec) Name() string { return codec.JSONName }
+
+func (failingCodec) Marshal(v interface{}) ([]byte, error) {
+	switch v.(type) {
+	case *TOAskProposalSeqBatchMsg, *TOAnnounceAgreementSeqBatchMsg:
+		return nil, fmt.Errorf("unsupported %T", v)
+	}
+	return codec.JSON.Marshal(v)
+}
+
+func (failingCodec) Unmarshal(data []byte, v interface{}) error { return codec.JSON.Unmarshal(data, v) }
+
+func newBatchedTotalOrding() (*Group, *TotalOrding) {
+	group := NewGroupBuilder().
+		WithSelfNodeID("A").
+		AddMember("A", "a").
+		WithBatch(&BatchConfig{Window: time.Hour, Size: 64}).
+		Build()
+	return group, group.TO().(*TotalOrding)
+}
+
+func failEncoding(t *testing.T) {
+	previous := codec.Default()
+	codec.SetDefault(failingCodec{})
+	t.Cleanup(func() { codec.SetDefault(previous) })
+}
+
+func TestFailedAskBatchReleasesEveryEntry(t *testing.T) {
+	group, to := newBatchedTotalOrding()
+	for i := 0; i < 3; i++ {
+		err := to.MulticastContext(context.Background(), "/deposit", i)
+		if err != nil {
+			t.Fatalf("multicast: %v", err)
+		}
+	}
+	if inFlight := group.Admission().Stats().InFlightOfNode; inFlight != 3 {
+		t.Fatalf("%d msgs in flight before the flush, want 3", inFlight)
+	}
+
+	failEncoding(t)
+	to.askBatcher.flushDst("")
+	if inFlight := group.Admission().Stats().InFlightOfNode; inFlight != 0 {
+		t.Fatalf("%d msgs still in flight after their batch failed", inFlight)
+	}
+	to.waitProposalCounterLock.Lock()
+	pending := len(to.waitProposalCounter)
+	to.waitProposalCounterLock.Unlock()
+	if pending != 0 {
+		t.Fatalf("%d vote collectors left after their batch failed", pending)
+	}
+}
+
+func TestFailedAnnounceBatchReleasesEveryEntry(t *testing.T) {
+	group, to := newBatchedTotalOrding()
+	for _, msgID := range []string{"m1", "m2"} {
+		err := group.Admission().Acquire(context.Background(), "/deposit", msgID)
+		if err != nil {
+			t.Fatalf("acquire: %v", err)
+		}
+		err = to.aggregateVotesAndMulticast([]*ProposalItem{{ProposalSeqNum: 1, ProcessID: "A", MsgID: msgID}})
+		if err != nil {
+			t.Fatalf("announce: %v", err)
+		}
+	}
+
+	failEncoding(t)
+	to.announceBatcher.flushDst("")
+	if inFlight := group.Admission().Stats().InFlightOfNode; inFlight != 0 {
+		t.Fatalf("%d msgs still in flight after their announce batch failed", inFlight)
+	}
+}
+
+// expireCollector sets the vote collector of msgID past its deadline after retries retries
+func expireCollector(to *TotalOrding, msgID string, retries int) {
+	to.waitProposalCounterLock.Lock()
+	defer to.waitProposalCounterLock.Unlock()
+	collector := to.waitProposalCounter[msgID]
+	collector.retries = retries
+	collector.deadline = time.Now().Add(-time.Second)
+}
+
+func TestExpireVotesDropsMsgWithNoVoterLeft(t *testing.T) {
+	group := NewGroupBuilder().WithSelfNodeID("A").AddMember("A", "a").AddMember("B", "b").Build()
+	to := group.TO().(*TotalOrding)
+	askMsg := NewTOAskProposalSeqMsg("A", []byte("body"))
+	err := group.Admission().Acquire(context.Background(), "/deposit", askMsg.MsgID)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	// B is the only voter, and it is not connected
+	to.registerVoters(askMsg, []string{"B"})
+	expireCollector(to, askMsg.MsgID, 0)
+
+	to.expireVotes()
+	to.waitProposalCounterLock.Lock()
+	_, pending := to.waitProposalCounter[askMsg.MsgID]
+	to.waitProposalCounterLock.Unlock()
+	if pending {
+		t.Fatalf("votes of msg [%s] are still collected with no voter left", askMsg.MsgID)
+	}
+	if inFlight := group.Admission().Stats().InFlightOfNode; inFlight != 0 {
+		t.Fatalf("%d msgs still in flight after their votes were dropped", inFlight)
+	}
+}
+
+func TestExpireVotesEjectsVoterThroughViewChange(t *testing.T) {
+	b, _ := newStalledGroup(t, SendQueueDrop)
+	to := b.group.TO().(*TotalOrding)
+	askMsg := NewTOAskProposalSeqMsg("A", []byte("body"))
+	to.registerVoters(askMsg, []string{"B"})
+	expireCollector(to, askMsg.MsgID, MaxVoteRetries)
+
+	to.expireVotes()
+	if b.IsNodeAlived("B") {
+		t.Fatalf("node [B] is still a member after %d retries", MaxVoteRetries)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		leave := &ViewChangeMsg{}
+		to.waitProposalCounterLock.Lock()
+		for _, collector := range to.waitProposalCounter {
+			tomsg := &TOMsg{}
+			_, err := tomsg.Decode(collector.ask.Body)
+			if err == nil && tomsg.Path == ViewChangePath {
+				codec.Unmarshal(tomsg.Body, leave)
+			}
+		}
+		to.waitProposalCounterLock.Unlock()
+		if leave.Type == ViewLeave && leave.Node.ID == "B" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no view change to eject node [B] is TO-multicast")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestVoteIsDroppedOnceStopped(t *testing.T) {
+	group := NewGroupBuilder().WithSelfNodeID("A").AddMember("A", "a").Build()
+	to := group.TO().(*TotalOrding)
+	to.waitVotesChannel = make(chan *ProposalItem)
+	ctx, cancel := context.WithCancel(context.Background())
+	to.ctx = ctx
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		to.pushVote(&ProposalItem{ProposalSeqNum: 1, ProcessID: "B", MsgID: "m1"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("a vote is pushed to the full channel of a stopped node")
+	}
+}
+
+// traceTo makes the default tracer write to a file of the test, and returns the path
+func traceTo(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "trace.json")
+	exporter, err := tracing.NewFileExporter(path)
+	if err != nil {
+		t.Fatalf("new exporter: %v", err)
+	}
+	previous := tracing.Default
+	tracing.Default = tracing.NewTracer(exporter)
+	t.Cleanup(func() { tracing.Default = previous })
+	return path
+}
+
+// holdAgreed puts an agreed item in the hold queue whose multicast span is parked, as an announced msg is
+func holdAgreed(t *testing.T, to *TotalOrding, msgID string, seqNum uint64, body []byte) {
+	t.Helper()
+	tracing.Park(msgID, tracing.Start("A", "to.multicast", nil))
+	item := &TOHoldQueueItem{
+		body:           body,
+		proposalSeqNum: seqNum,
+		msgID:          msgID,
+		processID:      "A",
+		originID:       "A",
+		agreed:         true,
+		span:           tracing.Start("A", "to.hold", nil),
+	}
+	to.holdQueueMap[msgID] = item
+	heap.Push(to.holdQueue, item)
+}
+
+func TestSkippedItemEndsItsSpans(t *testing.T) {
+	path := traceTo(t)
+	group := NewGroupBuilder().WithSelfNodeID("A").AddMember("A", "a").Build()
+	to := group.TO().(*TotalOrding)
+	tomsg, err := NewTOMsg("/deposit", 1)
+	if err != nil {
+		t.Fatalf("new to msg: %v", err)
+	}
+	body, err := tomsg.Encode()
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	to.holdQueueLocker.Lock()
+	to.deliveryCutoff = &ProposalItem{ProposalSeqNum: 1, ProcessID: "A"}
+	holdAgreed(t, to, "restored", 1, body)
+	err = to.deliverHoldQueue()
+	to.holdQueueLocker.Unlock()
+	if err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	if tracing.Parked("restored") != nil {
+		t.Fatalf("span of the skipped msg is still parked")
+	}
+
+	err = tracing.Default.Close()
+	if err != nil {
+		t.Fatalf("close tracer: %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read trace: %v", err)
+	}
+	for _, name := range []string{"to.hold", "to.multicast"} {
+		found := false
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.Contains(line, `"name":"`+name+`"`) {
+				found = strings.Contains(line, `"key":"skipped"`)
+			}
+		}
+		if !found {
+			t.Fatalf("span [%s] of the skipped msg is not exported with a skipped attribute: %s", name, data)
+		}
+	}
+}
+
+func TestUndecodableItemStaysInHoldQueue(t *testing.T) {
+	group := NewGroupBuilder().WithSelfNodeID("A").AddMember("A", "a").Build()
+	to := group.TO().(*TotalOrding)
+
+	to.holdQueueLocker.Lock()
+	defer to.holdQueueLocker.Unlock()
+	holdAgreed(t, to, "corrupted", 1, []byte("not a to msg"))
+	err := to.deliverHoldQueue()
+	if err == nil {
+		t.Fatalf("deliver of an undecodable msg succeeded")
+	}
+	if _, ok := to.holdQueueMap["corrupted"]; !ok || to.holdQueue.Len() != 1 {
+		t.Fatalf("undecodable msg is taken out of the hold queue")
+	}
+}
@@ -0,0 +1,61 @@
+package multicast
+
+import (
+	"context"
+	"time"
+)
+
+// Sender carries the messages of this node to one member, a Send error means the member is unreachable,
+// except ErrReconnecting, the message is kept and sent once the sender is back
+type Sender interface {
+	Send(msg *BMsg) error
+	// OnGiveUp registers f, which is called once the sender stops retrying a member it lost
+	OnGiveUp(f func(err error))
+	Close() error
+}
+
+// Transport moves messages between the members of a group, every message a member receives is handed to deliver,
+// the messages of one sender are delivered in order by one goroutine
+type Transport interface {
+	// Listen serves addr until ctx is done, then stops accepting and closes the connections it accepted
+	Listen(ctx context.Context, nodeID string, addr string, deliver func(msg *BMsg) error) error
+	// Dial retries every retryInterval until addr is reached, or until attempts is reached if attempts is not 0,
+	// it gives up once ctx is done, and the returned sender stops reconnecting once ctx is done
+	Dial(ctx context.Context, srcID string, dstID string, addr string, retryInterval time.Duration, attempts int) (Sender, error)
+}
+
+// TCPTransport length-prefixed frames over tcp, wrapped in mutual tls if the group has a TLSConfig
+type TCPTransport struct {
+	tls *nodeTLS
+}
+
+// NewTCPTransport a nil config keeps plain tcp
+func NewTCPTransport(config *TLSConfig) (*TCPTransport, error) {
+	t := &TCPTransport{}
+	if config == nil {
+		return t, nil
+	}
+	tls, err := loadNodeTLS(config)
+	if err != nil {
+		return nil, err
+	}
+	t.tls = tls
+	return t, nil
+}
+
+func (t *TCPTransport) Listen(ctx context.Context, nodeID string, addr string, deliver func(msg *BMsg) error) error {
+	socket, err := startServer(nodeID, addr)
+	if err != nil {
+		return err
+	}
+	go runServer(ctx, nodeID, socket, deliver, newSessionTable(), t.tls.serverConfig())
+	return nil
+}
+
+func (t *TCPTransport) Dial(ctx context.Context, srcID string, dstID string, addr string, retryInterval time.Duration, attempts int) (Sender, error) {
+	client, err := NewTCPClient(ctx, srcID, dstID, addr, retryInterval, attempts, t.tls.clientConfig(dstID))
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
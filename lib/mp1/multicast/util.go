@@ -9,6 +9,13 @@ func MaxUint64(x uint64, y uint64) uint64 {
 	return y
 }
 
+func MinUint64(x uint64, y uint64) uint64 {
+	if x < y {
+		return x
+	}
+	return y
+}
+
 func MaxOfArrayUint64(arr []uint64) (uint64, error) {
 	if len(arr) < 1 {
 		return 0, fmt.Errorf("arr is an empty sequence")
@@ -0,0 +1,57 @@
+package multicast
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type VectorClock map[string]uint64
+
+func NewVectorClock() VectorClock {
+	return VectorClock{}
+}
+
+func (vc VectorClock) Copy() VectorClock {
+	vcCopy := VectorClock{}
+	for nodeID, seqNum := range vc {
+		vcCopy[nodeID] = seqNum
+	}
+	return vcCopy
+}
+
+// Deliverable reports whether a message from srcID stamped with msgVC is the next one from srcID
+// and every message it causally depends on has already been delivered under vc
+func (vc VectorClock) Deliverable(srcID string, msgVC VectorClock) bool {
+	for nodeID, seqNum := range msgVC {
+		if nodeID == srcID {
+			if seqNum != vc[nodeID]+1 {
+				return false
+			}
+			continue
+		}
+		if seqNum > vc[nodeID] {
+			return false
+		}
+	}
+	return true
+}
+
+func (vc VectorClock) String() string {
+	nodeIDs := make([]string, 0, len(vc))
+	for nodeID := range vc {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+
+	builder := strings.Builder{}
+	builder.WriteString("[")
+	for i, nodeID := range nodeIDs {
+		if i != 0 {
+			builder.WriteString(" ")
+		}
+		builder.WriteString(fmt.Sprintf("%s:%d", nodeID, vc[nodeID]))
+	}
+	builder.WriteString("]")
+	return builder.String()
+}
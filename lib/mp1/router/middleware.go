@@ -0,0 +1,76 @@
+package router
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Logger traces every msg with its route, and logs the error of a handler
+func Logger(entry *log.Entry) Middleware {
+	return func(next Handler) Handler {
+		return func(route *Route, msg interface{}) error {
+			entry.Tracef("run [%s] on route [%s]", route.Path, route.Pattern)
+			err := next(route, msg)
+			if err != nil {
+				entry.Errorf("run [%s] failed: %v", route.Path, err)
+			}
+			return err
+		}
+	}
+}
+
+// Recover turns a panic of a handler into its error, so one bad msg does not take the node down
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(route *Route, msg interface{}) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Errorf("handler of [%s] panicked: %v\n%s", route.Path, r, debug.Stack())
+					err = fmt.Errorf("handler of [%s] panicked: %v", route.Path, r)
+				}
+			}()
+			return next(route, msg)
+		}
+	}
+}
+
+// Observe calls f after every handler with its duration and error, for metrics
+func Observe(f func(route *Route, elapsed time.Duration, err error)) Middleware {
+	return func(next Handler) Handler {
+		return func(route *Route, msg interface{}) error {
+			start := time.Now()
+			err := next(route, msg)
+			f(route, time.Since(start), err)
+			return err
+		}
+	}
+}
+
+// Authorize only runs the handler if allow returns nil, its error is returned otherwise
+func Authorize(allow func(route *Route, msg interface{}) error) Middleware {
+	return func(next Handler) Handler {
+		return func(route *Route, msg interface{}) error {
+			err := allow(route, msg)
+			if err != nil {
+				return err
+			}
+			return next(route, msg)
+		}
+	}
+}
+
+// Decode hands the handler the msg returned by decode, the msg is dropped with an error if it can not be decoded
+func Decode(decode func(route *Route, msg interface{}) (interface{}, error)) Middleware {
+	return func(next Handler) Handler {
+		return func(route *Route, msg interface{}) error {
+			decoded, err := decode(route, msg)
+			if err != nil {
+				return fmt.Errorf("decode msg of [%s] failed: %v", route.Path, err)
+			}
+			return next(route, decoded)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMiddlewaresRunInTheOrderTheyWereAdded(t *testing.T) {
+	r := New()
+	calls := []string{}
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(route *Route, msg interface{}) error {
+				calls = append(calls, name+" in")
+				err := next(route, msg)
+				calls = append(calls, name+" out")
+				return err
+			}
+		}
+	}
+	r.Use(trace("first"), trace("second"))
+	r.Bind("/x", func(msg interface{}) error {
+		calls = append(calls, "handler")
+		return nil
+	})
+
+	err := r.Run("/x", nil)
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	want := []string{"first in", "second in", "handler", "second out", "first out"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Fatalf("ran %v, want %v", calls, want)
+	}
+}
+
+func TestRecoverTurnsPanicIntoError(t *testing.T) {
+	r := New()
+	r.Use(Recover())
+	r.Bind("/x", func(msg interface{}) error {
+		panic("bad msg")
+	})
+
+	err := r.Run("/x", nil)
+	if err == nil || !strings.Contains(err.Error(), "bad msg") {
+		t.Fatalf("run returned %v, want the panic", err)
+	}
+}
+
+func TestDecodeHandsHandlerTheDecodedMsg(t *testing.T) {
+	r := New()
+	r.Use(Decode(func(route *Route, msg interface{}) (interface{}, error) {
+		raw, ok := msg.(string)
+		if !ok {
+			return nil, fmt.Errorf("not a string")
+		}
+		return strings.ToUpper(raw), nil
+	}))
+	got := []interface{}{}
+	r.Bind("/x", func(msg interface{}) error {
+		got = append(got, msg)
+		return nil
+	})
+
+	err := r.Run("/x", "msg")
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	err = r.Run("/x", 1)
+	if err == nil {
+		t.Fatalf("run of a msg that can not be decoded succeeded")
+	}
+	if !reflect.DeepEqual(got, []interface{}{"MSG"}) {
+		t.Fatalf("handler got %v, want only the decoded msg", got)
+	}
+}
+
+func TestAuthorizeSkipsHandlerOnError(t *testing.T) {
+	denied := errors.New("denied")
+	r := New()
+	r.Use(Authorize(func(route *Route, msg interface{}) error {
+		if route.Params["id"] != "A" {
+			return denied
+		}
+		return nil
+	}))
+	ran := []string{}
+	r.BindHandler("/account/:id", func(route *Route, msg interface{}) error {
+		ran = append(ran, route.Params["id"])
+		return nil
+	})
+
+	if err := r.Run("/account/A", nil); err != nil {
+		t.Fatalf("run of an allowed msg: %v", err)
+	}
+	if err := r.Run("/account/B", nil); err != denied {
+		t.Fatalf("run of a denied msg returned %v, want %v", err, denied)
+	}
+	if !reflect.DeepEqual(ran, []string{"A"}) {
+		t.Fatalf("handler ran for %v, want only A", ran)
+	}
+}
+
+func TestObserveSeesRouteAndError(t *testing.T) {
+	failed := errors.New("failed")
+	r := New()
+	observed := []string{}
+	r.Use(Observe(func(route *Route, elapsed time.Duration, err error) {
+		observed = append(observed, fmt.Sprintf("%s %s %v", route.Pattern, route.Path, err))
+	}))
+	r.Bind("/transaction/*", func(msg interface{}) error {
+		return failed
+	})
+
+	if err := r.Run("/transaction/deposit", nil); err != failed {
+		t.Fatalf("run returned %v, want the error of the handler", err)
+	}
+	want := []string{"/transaction/* /transaction/deposit failed"}
+	if !reflect.DeepEqual(observed, want) {
+		t.Fatalf("observed %v, want %v", observed, want)
+	}
+}
+
+func TestFallbackRunsUnmatchedPathsThroughMiddlewares(t *testing.T) {
+	r := New()
+	r.Use(Recover())
+	r.Fallback(func(route *Route, msg interface{}) error {
+		if route.Pattern != "" {
+			t.Errorf("fallback got pattern [%s], want none", route.Pattern)
+		}
+		panic("unmatched " + route.Path)
+	})
+	r.Bind("/x", func(msg interface{}) error { return nil })
+
+	if err := r.Run("/x", nil); err != nil {
+		t.Fatalf("run of a bound path: %v", err)
+	}
+	err := r.Run("/y", nil)
+	if err == nil || !strings.Contains(err.Error(), "unmatched /y") {
+		t.Fatalf("run of an unmatched path returned %v, want the recovered fallback panic", err)
+	}
+}
@@ -2,6 +2,8 @@ package router
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	sync "github.com/sasha-s/go-deadlock"
 
@@ -12,6 +14,13 @@ var (
 	logger = log.WithField("src", "router")
 )
 
+const (
+	// ParamPrefix a segment ":name" matches any one segment, it is found in Route.Params by name
+	ParamPrefix = ":"
+	// Wildcard a last segment "*" matches the rest of the path, one segment or more, it is found in Route.Params by "*"
+	Wildcard = "*"
+)
+
 type Msg struct {
 	Path string
 	Body interface{}
@@ -24,33 +33,197 @@ func NewMsg(path string, v interface{}) *Msg {
 	}
 }
 
+// Route the route a msg was run on, Pattern is empty for the fallback handler
+type Route struct {
+	Pattern string
+	Path    string
+	Params  map[string]string
+}
+
+type Handler func(route *Route, msg interface{}) error
+
+// Middleware wraps a handler, it may run code around next, pass another msg to it, or not call it at all
+type Middleware func(next Handler) Handler
+
+// pattern a bound path split into segments
+type pattern struct {
+	raw      string
+	segments []string
+	handler  Handler
+}
+
+func newPattern(raw string, handler Handler) *pattern {
+	return &pattern{
+		raw:      raw,
+		segments: splitPath(raw),
+		handler:  handler,
+	}
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+func segmentRank(segment string) int {
+	switch {
+	case segment == Wildcard:
+		return 2
+	case strings.HasPrefix(segment, ParamPrefix):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// moreSpecific a literal segment wins over a param, and a param over a wildcard, the first segment that differs decides
+func (p *pattern) moreSpecific(other *pattern) bool {
+	for i := 0; i < len(p.segments) && i < len(other.segments); i++ {
+		rank, otherRank := segmentRank(p.segments[i]), segmentRank(other.segments[i])
+		if rank != otherRank {
+			return rank < otherRank
+		}
+	}
+	if len(p.segments) != len(other.segments) {
+		return len(p.segments) > len(other.segments)
+	}
+	return p.raw < other.raw
+}
+
+func (p *pattern) match(segments []string) (params map[string]string, ok bool) {
+	params = map[string]string{}
+	for i, segment := range p.segments {
+		if segment == Wildcard && i == len(p.segments)-1 {
+			if i >= len(segments) {
+				return nil, false
+			}
+			params[Wildcard] = strings.Join(segments[i:], "/")
+			return params, true
+		}
+		if i >= len(segments) {
+			return nil, false
+		}
+		switch {
+		case strings.HasPrefix(segment, ParamPrefix):
+			params[strings.TrimPrefix(segment, ParamPrefix)] = segments[i]
+		case segment != segments[i]:
+			return nil, false
+		}
+	}
+	if len(segments) != len(p.segments) {
+		return nil, false
+	}
+	return params, true
+}
+
+// Router exact paths are looked up first, then the patterns with params or a wildcard, the most specific pattern wins.
+// A msg that matches nothing goes to the fallback handler, every msg passes the middlewares in the order they were added
 type Router struct {
-	routers    map[string]func(interface{}) error
-	routerLock *sync.Mutex
+	routers     map[string]Handler
+	patterns    []*pattern
+	fallback    Handler
+	middlewares []Middleware
+	routerLock  *sync.Mutex
 }
 
 func New() *Router {
 	d := &Router{
-		routers:    map[string]func(interface{}) error{},
-		routerLock: &sync.Mutex{},
+		routers:     map[string]Handler{},
+		patterns:    []*pattern{},
+		fallback:    NotFound,
+		middlewares: []Middleware{},
+		routerLock:  &sync.Mutex{},
 	}
 	return d
 }
 
+// NotFound the default fallback handler, it logs and returns an error
+func NotFound(route *Route, msg interface{}) error {
+	errmsg := fmt.Sprintf("path [%s] with body [%s] don't match any router", route.Path, msg)
+	logger.Errorf("%s", errmsg)
+	return fmt.Errorf(errmsg)
+}
+
+func isPattern(path string) bool {
+	for _, segment := range splitPath(path) {
+		if segmentRank(segment) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *Router) Bind(path string, f func(msg interface{}) error) {
+	d.BindHandler(path, func(route *Route, msg interface{}) error {
+		return f(msg)
+	})
+}
+
+// BindHandler binds a handler that reads the params of its route
+func (d *Router) BindHandler(path string, h Handler) {
 	d.routerLock.Lock()
 	defer d.routerLock.Unlock()
-	d.routers[path] = f
+	if !isPattern(path) {
+		d.routers[path] = h
+		return
+	}
+
+	patterns := make([]*pattern, 0, len(d.patterns)+1)
+	for _, p := range d.patterns {
+		if p.raw != path {
+			patterns = append(patterns, p)
+		}
+	}
+	patterns = append(patterns, newPattern(path, h))
+	sort.SliceStable(patterns, func(i, j int) bool {
+		return patterns[i].moreSpecific(patterns[j])
+	})
+	d.patterns = patterns
+}
+
+// Fallback replaces the handler of the msgs that match no path
+func (d *Router) Fallback(h Handler) {
+	d.routerLock.Lock()
+	defer d.routerLock.Unlock()
+	d.fallback = h
+}
+
+// Use appends middlewares, the first one added is the outermost
+func (d *Router) Use(middlewares ...Middleware) {
+	d.routerLock.Lock()
+	defer d.routerLock.Unlock()
+	d.middlewares = append(d.middlewares, middlewares...)
+}
+
+// match caller should hold routerLock
+func (d *Router) match(path string) (route *Route, h Handler) {
+	if h, ok := d.routers[path]; ok {
+		return &Route{Pattern: path, Path: path}, h
+	}
+	segments := splitPath(path)
+	for _, p := range d.patterns {
+		if params, ok := p.match(segments); ok {
+			return &Route{Pattern: p.raw, Path: path, Params: params}, p.handler
+		}
+	}
+	return &Route{Path: path}, d.fallback
+}
+
+// Match reports the route path would run on, the Pattern of an unmatched path is empty
+func (d *Router) Match(path string) *Route {
+	d.routerLock.Lock()
+	defer d.routerLock.Unlock()
+	route, _ := d.match(path)
+	return route
 }
 
 func (d *Router) Run(path string, msg interface{}) error {
 	d.routerLock.Lock()
-	f, ok := d.routers[path]
+	route, h := d.match(path)
+	middlewares := d.middlewares
 	d.routerLock.Unlock()
-	if !ok {
-		errmsg := fmt.Sprintf("path [%s] with body [%s] don't match any router", path, msg)
-		logger.Errorf("%s", errmsg)
-		return fmt.Errorf(errmsg)
+
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
 	}
-	return f(msg)
+	return h(route, msg)
 }
@@ -0,0 +1,174 @@
+package tracing
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strconv"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ExportQueueSize bounds the ended spans waiting to be written, a span ended on a full queue is dropped
+	ExportQueueSize = 4096
+	ScopeName       = "mp1"
+	ServicePrefix   = "mp1-"
+	// SpanKindInternal the OTLP kind of every span, the layers talk through their own envelopes
+	SpanKindInternal = 1
+)
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+// otlpTraces one line of the file, the OTLP/JSON encoding of an export request
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func newOTLPTraces(s *Span) *otlpTraces {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	attrs := make([]otlpAttribute, 0, len(s.attrs))
+	for _, attr := range s.attrs {
+		attrs = append(attrs, otlpAttribute{Key: attr.Key, Value: otlpValue{StringValue: attr.Value}})
+	}
+	return &otlpTraces{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{
+					{Key: "service.name", Value: otlpValue{StringValue: ServicePrefix + s.nodeID}},
+					{Key: "node.id", Value: otlpValue{StringValue: s.nodeID}},
+				},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: ScopeName},
+				Spans: []otlpSpan{{
+					TraceID:           s.context.TraceID,
+					SpanID:            s.context.SpanID,
+					ParentSpanID:      s.parentID,
+					Name:              s.name,
+					Kind:              SpanKindInternal,
+					StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+					EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+					Attributes:        attrs,
+				}},
+			}},
+		}},
+	}
+}
+
+// FileExporter writes every ended span as a line of OTLP/JSON, the file can be loaded by an OTLP collector or converted for jaeger
+type FileExporter struct {
+	file   *os.File
+	spans  chan *Span
+	done   chan struct{}
+	closed bool
+	lock   *sync.RWMutex
+}
+
+func NewFileExporter(path string) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open trace file [%s] failed", path)
+	}
+	e := &FileExporter{
+		file:  file,
+		spans: make(chan *Span, ExportQueueSize),
+		done:  make(chan struct{}),
+		lock:  &sync.RWMutex{},
+	}
+	go e.run()
+	return e, nil
+}
+
+// export drops the spans ended after Close, such as the ones of messages delivered while the node leaves
+func (e *FileExporter) export(s *Span) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.spans <- s:
+	default:
+		logger.Warnf("export queue is full, drop span [%s]", s.name)
+	}
+}
+
+func (e *FileExporter) run() {
+	defer close(e.done)
+	writer := bufio.NewWriter(e.file)
+	encoder := json.NewEncoder(writer)
+	for {
+		s, ok := <-e.spans
+		if !ok {
+			break
+		}
+		err := encoder.Encode(newOTLPTraces(s))
+		if err != nil {
+			logger.Errorf("export span [%s] failed: %v", s.name, err)
+		}
+		if len(e.spans) == 0 {
+			err = writer.Flush()
+			if err != nil {
+				logger.Errorf("flush trace file failed: %v", err)
+			}
+		}
+	}
+	err := writer.Flush()
+	if err != nil {
+		logger.Errorf("flush trace file failed: %v", err)
+	}
+}
+
+// Close writes the spans already ended and closes the file
+func (e *FileExporter) Close() error {
+	e.lock.Lock()
+	if e.closed {
+		e.lock.Unlock()
+		return nil
+	}
+	e.closed = true
+	close(e.spans)
+	e.lock.Unlock()
+	<-e.done
+	return errors.Wrap(e.file.Close(), "close trace file failed")
+}
@@ -0,0 +1,230 @@
+package tracing
+
+import (
+	"container/list"
+	"encoding/hex"
+	"math/rand"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	logger = log.WithField("src", "tracing")
+	// Default is disabled until Setup, a disabled tracer starts nil spans, and every method of a nil span is a no-op
+	Default = NewTracer(nil)
+)
+
+const (
+	// MaxParkedSpans bounds the spans waiting for a later event to end them, the oldest one is ended to park another
+	MaxParkedSpans = 65536
+)
+
+// SpanContext is carried by the envelopes of the layers, so the spans of every node join the trace of the message
+type SpanContext struct {
+	TraceID string `json:"trace_id"`
+	SpanID  string `json:"span_id"`
+}
+
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+type Span struct {
+	tracer   *Tracer
+	nodeID   string
+	name     string
+	context  SpanContext
+	parentID string
+	start    time.Time
+	end      time.Time
+	attrs    []Attribute
+	ended    bool
+	lock     *sync.Mutex
+}
+
+func (s *Span) Context() *SpanContext {
+	if s == nil {
+		return nil
+	}
+	return &s.context
+}
+
+func (s *Span) SetAttribute(key string, value string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attrs = append(s.attrs, Attribute{Key: key, Value: value})
+}
+
+// End exports the span, a span ends once
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.lock.Unlock()
+	s.tracer.exporter.export(s)
+}
+
+// Tracer starts spans and hands the ended ones to its exporter
+type Tracer struct {
+	exporter *FileExporter
+	parked   map[string]*list.Element
+	order    *list.List
+	rand     *rand.Rand
+	lock     *sync.Mutex
+}
+
+func NewTracer(exporter *FileExporter) *Tracer {
+	return &Tracer{
+		exporter: exporter,
+		parked:   map[string]*list.Element{},
+		order:    list.New(),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		lock:     &sync.Mutex{},
+	}
+}
+
+func (t *Tracer) Enabled() bool {
+	return t.exporter != nil
+}
+
+func (t *Tracer) newID(size int) string {
+	id := make([]byte, size)
+	t.lock.Lock()
+	t.rand.Read(id)
+	t.lock.Unlock()
+	return hex.EncodeToString(id)
+}
+
+// Start starts a span of nodeID, a span without parent starts a new trace
+func (t *Tracer) Start(nodeID string, name string, parent *SpanContext) *Span {
+	if !t.Enabled() {
+		return nil
+	}
+	span := &Span{
+		tracer: t,
+		nodeID: nodeID,
+		name:   name,
+		start:  time.Now(),
+		lock:   &sync.Mutex{},
+	}
+	if parent != nil {
+		span.context.TraceID = parent.TraceID
+		span.parentID = parent.SpanID
+	} else {
+		span.context.TraceID = t.newID(16)
+	}
+	span.context.SpanID = t.newID(8)
+	return span
+}
+
+// parkedSpan an element of order, the span parked first is at the front
+type parkedSpan struct {
+	key  string
+	span *Span
+}
+
+// Park keeps a span under key until a later event looks it up or ends it.
+// A span whose event never comes, such as the delivery of a message lost with a crashed member, is ended once
+// MaxParkedSpans newer spans are parked
+func (t *Tracer) Park(key string, span *Span) {
+	if span == nil {
+		return
+	}
+	evicted := []*Span{}
+	t.lock.Lock()
+	t.unpark(key)
+	for len(t.parked) >= MaxParkedSpans {
+		evicted = append(evicted, t.unpark(t.order.Front().Value.(*parkedSpan).key))
+	}
+	t.parked[key] = t.order.PushBack(&parkedSpan{key: key, span: span})
+	t.lock.Unlock()
+
+	for _, span := range evicted {
+		span.SetAttribute("evicted", "too many parked spans")
+		span.End()
+	}
+}
+
+func (t *Tracer) Parked(key string) *Span {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	element, ok := t.parked[key]
+	if !ok {
+		return nil
+	}
+	return element.Value.(*parkedSpan).span
+}
+
+func (t *Tracer) Unpark(key string) *Span {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.unpark(key)
+}
+
+// unpark caller should hold lock
+func (t *Tracer) unpark(key string) *Span {
+	element, ok := t.parked[key]
+	if !ok {
+		return nil
+	}
+	delete(t.parked, key)
+	t.order.Remove(element)
+	return element.Value.(*parkedSpan).span
+}
+
+// Close writes the spans already ended, the spans ended after it are dropped
+func (t *Tracer) Close() error {
+	if !t.Enabled() {
+		return nil
+	}
+	return t.exporter.Close()
+}
+
+// Setup enables the default tracer, ended spans are written to path
+func Setup(path string) error {
+	exporter, err := NewFileExporter(path)
+	if err != nil {
+		return err
+	}
+	Default = NewTracer(exporter)
+	logger.Infof("export spans to %s", path)
+	return nil
+}
+
+func Enabled() bool {
+	return Default.Enabled()
+}
+
+func Start(nodeID string, name string, parent *SpanContext) *Span {
+	return Default.Start(nodeID, name, parent)
+}
+
+func Park(key string, span *Span) {
+	Default.Park(key, span)
+}
+
+func Parked(key string) *Span {
+	return Default.Parked(key)
+}
+
+func Unpark(key string) *Span {
+	return Default.Unpark(key)
+}
+
+func Close() error {
+	return Default.Close()
+}
@@ -0,0 +1,63 @@
+package tracing
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func newTestTracer(t *testing.T) *Tracer {
+	t.Helper()
+	exporter, err := NewFileExporter(filepath.Join(t.TempDir(), "trace.json"))
+	if err != nil {
+		t.Fatalf("new exporter: %v", err)
+	}
+	tracer := NewTracer(exporter)
+	t.Cleanup(func() { tracer.Close() })
+	return tracer
+}
+
+func ended(s *Span) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.ended
+}
+
+func TestParkEndsOldestSpanOnceFull(t *testing.T) {
+	tracer := newTestTracer(t)
+	oldest := tracer.Start("A", "to.multicast", nil)
+	tracer.Park("0", oldest)
+	for i := 1; i < MaxParkedSpans; i++ {
+		tracer.Park(strconv.Itoa(i), tracer.Start("A", "to.multicast", nil))
+	}
+	if ended(oldest) || tracer.Parked("0") != oldest {
+		t.Fatalf("oldest span is evicted before the limit is reached")
+	}
+
+	newest := tracer.Start("A", "to.multicast", nil)
+	tracer.Park("new", newest)
+	if tracer.Parked("new") != newest {
+		t.Fatalf("span parked on a full tracer is refused")
+	}
+	if tracer.Unpark("0") != nil || !ended(oldest) {
+		t.Fatalf("oldest span is still parked once the limit is reached")
+	}
+	if oldest.attrs[len(oldest.attrs)-1].Key != "evicted" {
+		t.Fatalf("evicted span has attributes %v", oldest.attrs)
+	}
+	if tracer.Parked("1") == nil {
+		t.Fatalf("more than the oldest span was evicted")
+	}
+}
+
+func TestUnparkForgetsSpan(t *testing.T) {
+	tracer := newTestTracer(t)
+	span := tracer.Start("A", "to.multicast", nil)
+	tracer.Park("m1", span)
+	if got := tracer.Unpark("m1"); got != span {
+		t.Fatalf("unparked %v, want the parked span", got)
+	}
+	if tracer.Parked("m1") != nil || len(tracer.parked) != 0 || tracer.order.Len() != 0 {
+		t.Fatalf("unparked span is still kept")
+	}
+}
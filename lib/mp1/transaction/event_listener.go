@@ -2,8 +2,8 @@ package transaction
 
 import (
 	"bufio"
+	"context"
 	"io"
-	"os"
 
 	"github.com/bamboovir/cs425/lib/mp1/router"
 	log "github.com/sirupsen/logrus"
@@ -13,29 +13,61 @@ var (
 	transactionEventListenerLogger = log.WithField("src", "event_listener")
 )
 
-func TransactionEventListenerPipeline(reader io.Reader) <-chan *router.Msg {
-	out := make(chan *router.Msg, 100000)
+const (
+	// EventBufferSize is small, so the reader stops reading once the consumer is held back by admission control
+	EventBufferSize = 64
+)
+
+// TransactionEventListenerPipeline emits the transactions read from reader until EOF or until ctx is done,
+// then closes the channel. A read that is blocked when ctx is done is abandoned, its line is never emitted
+func TransactionEventListenerPipeline(ctx context.Context, reader io.Reader) <-chan *router.Msg {
+	out := make(chan *router.Msg, EventBufferSize)
+	lines := make(chan string)
+	readErr := make(chan error, 1)
 
 	go func() {
-		scanner := bufio.NewScanner(os.Stdin)
+		scanner := bufio.NewScanner(reader)
 		for scanner.Scan() {
-			line := scanner.Text()
-			eventMsg, err := EncodeTransactionsMsg(line)
-			if err != nil {
-				transactionEventListenerLogger.Errorf("encode input msg failed with err :%v, skip", err)
-				continue
+			select {
+			case lines <- scanner.Text():
+			case <-ctx.Done():
+				return
 			}
-			out <- eventMsg
 		}
+		readErr <- scanner.Err()
+		close(lines)
+	}()
 
-		err := scanner.Err()
-
-		if err != nil {
-			transactionEventListenerLogger.Errorf("read err: %v", err)
-		} else {
-			transactionEventListenerLogger.Info("reach EOF")
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case <-ctx.Done():
+				transactionEventListenerLogger.Info("stop reading transactions")
+				return
+			case line, ok := <-lines:
+				if !ok {
+					err := <-readErr
+					if err != nil {
+						transactionEventListenerLogger.Errorf("read err: %v", err)
+					} else {
+						transactionEventListenerLogger.Info("reach EOF")
+					}
+					return
+				}
+				eventMsg, err := EncodeTransactionsMsg(line)
+				if err != nil {
+					transactionEventListenerLogger.Errorf("encode input msg failed with err :%v, skip", err)
+					continue
+				}
+				select {
+				case out <- eventMsg:
+				case <-ctx.Done():
+					transactionEventListenerLogger.Info("stop reading transactions")
+					return
+				}
+			}
 		}
-		close(out)
 	}()
 
 	return out
@@ -1,37 +1,223 @@
 package transaction
 
 import (
+	"encoding/json"
 	"fmt"
 
+	sync "github.com/sasha-s/go-deadlock"
+
+	"github.com/bamboovir/cs425/lib/mp1/metrics"
 	"github.com/bamboovir/cs425/lib/mp1/multicast"
 	"github.com/pkg/errors"
 )
 
+var (
+	ErrNoWAL       = errors.New("no write-ahead log, balances are only kept in memory")
+	ErrFailStopped = errors.New("processor is fail-stopped, a delivered transaction could not be logged")
+)
+
+// Processor applies the delivered transactions, lock keeps a snapshot from being cut between the append of an entry and its apply.
+// Once an append fails the processor fail-stops, it applies nothing more, a replica that skipped a transaction must not go on
 type Processor struct {
+	nodeID      string
 	transaction *Transaction
+	wal         *WAL
+	failed      error
+	failedCh    chan struct{}
+	lock        *sync.Mutex
 }
 
-func NewProcessor() *Processor {
+func NewProcessor(nodeID string) *Processor {
 	return &Processor{
+		nodeID:      nodeID,
 		transaction: NewTransaction(),
+		failedCh:    make(chan struct{}),
+		lock:        &sync.Mutex{},
 	}
 }
 
-func (p *Processor) RegisteTransactionHandler(d *multicast.TotalOrding) {
+// Failed is closed once the processor fail-stops, Err returns why
+func (p *Processor) Failed() <-chan struct{} {
+	return p.failedCh
+}
+
+func (p *Processor) Err() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.failed
+}
+
+// failStop caller should hold lock
+func (p *Processor) failStop(err error) {
+	if p.failed != nil {
+		return
+	}
+	logger.Errorf("node [%s] fail-stops, it applies no more transactions: %v", p.nodeID, err)
+	p.failed = err
+	close(p.failedCh)
+}
+
+func (p *Processor) RegisteTransactionHandler(d multicast.TotalOrderStrategy) {
 	d.Bind(DepositPath, p.processDeposit)
 	d.Bind(TransferPath, p.processTransfer)
 }
 
+// Snapshot encodes the balances, so a joining node can start from the state of its sponsor
+func (p *Processor) Snapshot() ([]byte, error) {
+	return json.Marshal(p.transaction.BalancesSnapshot())
+}
+
+func (p *Processor) Restore(data []byte) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	balances := map[string]int{}
+	if len(data) != 0 {
+		err := json.Unmarshal(data, &balances)
+		if err != nil {
+			return errors.Wrap(err, "restore balances failed")
+		}
+	}
+	p.transaction.RestoreBalances(balances)
+	if p.wal != nil {
+		err := p.wal.Snapshot(balances)
+		if err != nil {
+			return errors.Wrap(err, "restore balances failed")
+		}
+	}
+	return nil
+}
+
+// OpenWAL recovers the balances from the write-ahead log in dir, then logs every transaction delivered afterwards
+func (p *Processor) OpenWAL(dir string) error {
+	wal, err := OpenWAL(dir)
+	if err != nil {
+		return err
+	}
+	balances, entries, err := wal.Load()
+	if err != nil {
+		wal.Close()
+		return errors.Wrap(err, "recover from wal failed")
+	}
+	p.transaction.RestoreBalances(balances)
+	for _, entry := range entries {
+		err = p.replay(entry)
+		if err != nil {
+			wal.Close()
+			return errors.Wrapf(err, "replay wal entry %d failed", entry.Index)
+		}
+	}
+	p.wal = wal
+	logger.Infof("recover %d accounts from wal, replay %d entries", len(p.transaction.BalancesSnapshot()), len(entries))
+	return nil
+}
+
+// replay applies an entry without printing it, an entry that does not decode fails the replay.
+// A transaction that was rejected when it was delivered is rejected again, that is no failure
+func (p *Processor) replay(entry *WALEntry) error {
+	switch entry.Path {
+	case DepositPath:
+		deposit := &Deposit{}
+		_, err := deposit.Decode(entry.Body)
+		if err != nil {
+			return errors.Wrap(err, "decode deposit failed")
+		}
+		err = p.transaction.Deposit(deposit.Account, deposit.Amount)
+		if err != nil {
+			logger.Infof("replay wal entry %d, deposit is rejected again: %v", entry.Index, err)
+		}
+		return nil
+	case TransferPath:
+		transfer := &Transfer{}
+		_, err := transfer.Decode(entry.Body)
+		if err != nil {
+			return errors.Wrap(err, "decode transfer failed")
+		}
+		err = p.transaction.Transfer(transfer.FromAccount, transfer.ToAccount, transfer.Amount)
+		if err != nil {
+			logger.Infof("replay wal entry %d, transfer is rejected again: %v", entry.Index, err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unrecognized wal entry path [%s]", entry.Path)
+	}
+}
+
+// logDelivered appends a delivered transaction to the wal before it is applied, a failed append fail-stops the processor.
+// caller should hold lock
+func (p *Processor) logDelivered(path string, body []byte) error {
+	if p.failed != nil {
+		return ErrFailStopped
+	}
+	if p.wal == nil {
+		return nil
+	}
+	_, err := p.wal.Append(path, body)
+	if err != nil {
+		p.failStop(err)
+		return err
+	}
+	return nil
+}
+
+// snapshotIfDue is called after a transaction is applied, so the snapshot covers every appended entry
+func (p *Processor) snapshotIfDue() {
+	if p.wal == nil || !p.wal.ShouldSnapshot() {
+		return
+	}
+	err := p.wal.Snapshot(p.transaction.BalancesSnapshot())
+	if err != nil {
+		logger.Errorf("%v", err)
+	}
+}
+
+func (p *Processor) Balances() map[string]int {
+	return p.transaction.BalancesSnapshot()
+}
+
+// TakeSnapshot snapshots the balances to the write-ahead log now, instead of after the next SnapshotEvery entries
+func (p *Processor) TakeSnapshot() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.wal == nil {
+		return ErrNoWAL
+	}
+	return p.wal.Snapshot(p.transaction.BalancesSnapshot())
+}
+
+// count counts a delivered transaction as accepted, or as rejected if applying it failed
+func (p *Processor) count(kind string, err error) {
+	result := metrics.TransactionAccepted
+	if err != nil {
+		result = metrics.TransactionRejected
+	}
+	metrics.Transactions.Inc(p.nodeID, kind, result)
+}
+
+func (p *Processor) Close() error {
+	if p.wal == nil {
+		return nil
+	}
+	return p.wal.Close()
+}
+
 func (p *Processor) processDeposit(msg *multicast.TOMsg) error {
 	deposit := &Deposit{}
 	_, err := deposit.Decode(msg.Body)
 	if err != nil {
 		return errors.Wrap(err, "process deposit failed")
 	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	err = p.logDelivered(DepositPath, msg.Body)
+	if err != nil {
+		return errors.Wrap(err, "process deposit failed")
+	}
+	defer p.snapshotIfDue()
 
 	// logger.Infof("deposit: %s -> %d", deposit.Account, deposit.Amount)
 	fmt.Printf("DEPOSIT %s %d\n", deposit.Account, deposit.Amount)
 	err = p.transaction.Deposit(deposit.Account, deposit.Amount)
+	p.count(DepositEventTypeID, err)
 	if err != nil {
 		return errors.Wrap(err, "process deposit failed")
 	}
@@ -47,10 +233,18 @@ func (p *Processor) processTransfer(msg *multicast.TOMsg) error {
 	if err != nil {
 		return errors.Wrap(err, "process transfer failed")
 	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	err = p.logDelivered(TransferPath, msg.Body)
+	if err != nil {
+		return errors.Wrap(err, "process transfer failed")
+	}
+	defer p.snapshotIfDue()
 
 	// logger.Infof("tranfer: %s -> %s %d", transfer.FromAccount, transfer.ToAccount, transfer.Amount)
 	fmt.Printf("TRANSFER %s %s %d\n", transfer.FromAccount, transfer.ToAccount, transfer.Amount)
 	err = p.transaction.Transfer(transfer.FromAccount, transfer.ToAccount, transfer.Amount)
+	p.count(TransferID, err)
 	if err != nil {
 		return errors.Wrap(err, "process transfer failed")
 	}
@@ -91,6 +91,15 @@ func (t *Transaction) BalancesSnapshot() map[string]int {
 	return balancesSnapshot
 }
 
+func (t *Transaction) RestoreBalances(balances map[string]int) {
+	t.balancesLock.Lock()
+	defer t.balancesLock.Unlock()
+	t.balances = map[string]int{}
+	for account, amount := range balances {
+		t.balances[account] = amount
+	}
+}
+
 func (t *Transaction) BalancesSnapshotStdString() string {
 	builder := &strings.Builder{}
 
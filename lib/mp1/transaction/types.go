@@ -1,11 +1,11 @@
 package transaction
 
 import (
-	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
 
+	"github.com/bamboovir/cs425/lib/codec"
 	"github.com/bamboovir/cs425/lib/mp1/router"
 )
 
@@ -20,7 +20,7 @@ type Deposit struct {
 }
 
 func (d *Deposit) Encode() (data []byte, err error) {
-	data, err = json.Marshal(d)
+	data, err = codec.Marshal(d)
 	if err != nil {
 		return nil, err
 	}
@@ -28,7 +28,7 @@ func (d *Deposit) Encode() (data []byte, err error) {
 }
 
 func (d *Deposit) Decode(data []byte) (*Deposit, error) {
-	err := json.Unmarshal(data, d)
+	err := codec.Unmarshal(data, d)
 	if err != nil {
 		return d, err
 	}
@@ -42,7 +42,7 @@ type Transfer struct {
 }
 
 func (t *Transfer) Encode() (data []byte, err error) {
-	data, err = json.Marshal(t)
+	data, err = codec.Marshal(t)
 	if err != nil {
 		return nil, err
 	}
@@ -50,7 +50,7 @@ func (t *Transfer) Encode() (data []byte, err error) {
 }
 
 func (t *Transfer) Decode(data []byte) (*Transfer, error) {
-	err := json.Unmarshal(data, t)
+	err := codec.Unmarshal(data, t)
 	if err != nil {
 		return t, err
 	}
@@ -0,0 +1,286 @@
+package transaction
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	WALFileName      = "wal.log"
+	SnapshotFileName = "snapshot"
+	SnapshotEvery    = 1000
+	walHeaderSize    = 8
+	maxWALRecordSize = 64 << 20
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// WALEntry is one TO-delivered transaction, Body is the body of the TO message delivered on Path
+type WALEntry struct {
+	Index uint64 `json:"index"`
+	Path  string `json:"path"`
+	Body  []byte `json:"body"`
+}
+
+// walSnapshot covers every entry up to Index
+type walSnapshot struct {
+	Index    uint64         `json:"index"`
+	Balances map[string]int `json:"balances"`
+}
+
+// WAL appends every entry as a record of a 4 bytes length, a 4 bytes crc32 of the payload and the payload,
+// every append is fsync'd. A snapshot of the balances replaces the records it covers
+type WAL struct {
+	dir           string
+	file          *os.File
+	lastIndex     uint64
+	sinceSnapshot int
+	lock          *sync.Mutex
+}
+
+func OpenWAL(dir string) (*WAL, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "open wal failed")
+	}
+	file, err := os.OpenFile(filepath.Join(dir, WALFileName), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "open wal failed")
+	}
+	return &WAL{
+		dir:  dir,
+		file: file,
+		lock: &sync.Mutex{},
+	}, nil
+}
+
+func encodeRecord(payload []byte) []byte {
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	copy(record[walHeaderSize:], payload)
+	return record
+}
+
+// decodeRecord returns the payload of the record at the head of data and the size of the record,
+// ok is false for a torn or corrupted record
+func decodeRecord(data []byte) (payload []byte, size int, ok bool) {
+	if len(data) < walHeaderSize {
+		return nil, 0, false
+	}
+	length := binary.BigEndian.Uint32(data[0:4])
+	checksum := binary.BigEndian.Uint32(data[4:8])
+	if length > maxWALRecordSize || int(length) > len(data)-walHeaderSize {
+		return nil, 0, false
+	}
+	payload = data[walHeaderSize : walHeaderSize+int(length)]
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return nil, 0, false
+	}
+	return payload, walHeaderSize + int(length), true
+}
+
+// tailRecord reports whether the record at the head of data reaches the end of the log, so it may be torn by a crash in the middle of an append
+func tailRecord(data []byte) bool {
+	if len(data) < walHeaderSize {
+		return true
+	}
+	length := binary.BigEndian.Uint32(data[0:4])
+	return walHeaderSize+int64(length) >= int64(len(data))
+}
+
+func (w *WAL) loadSnapshot() (*walSnapshot, error) {
+	data, err := ioutil.ReadFile(filepath.Join(w.dir, SnapshotFileName))
+	if os.IsNotExist(err) {
+		return &walSnapshot{Balances: map[string]int{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	payload, _, ok := decodeRecord(data)
+	if !ok {
+		return nil, fmt.Errorf("snapshot is corrupted")
+	}
+	snapshot := &walSnapshot{}
+	err = json.Unmarshal(payload, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot.Balances == nil {
+		snapshot.Balances = map[string]int{}
+	}
+	return snapshot, nil
+}
+
+// Load returns the latest snapshot and the entries appended after it,
+// a torn record at the tail left by a crash in the middle of an append is truncated,
+// a corrupted record followed by other records fails the load, truncating it would lose the entries after it
+func (w *WAL) Load() (balances map[string]int, entries []*WALEntry, err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	snapshot, err := w.loadSnapshot()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "load snapshot failed")
+	}
+	w.lastIndex = snapshot.Index
+
+	data, err := ioutil.ReadFile(w.file.Name())
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "read wal failed")
+	}
+
+	entries = make([]*WALEntry, 0)
+	offset := 0
+	for offset < len(data) {
+		payload, size, ok := decodeRecord(data[offset:])
+		if !ok && !tailRecord(data[offset:]) {
+			return nil, nil, fmt.Errorf("wal record at offset %d is corrupted and is not the last record", offset)
+		}
+		if !ok {
+			logger.Errorf("wal record at offset %d is torn or corrupted, truncate %d bytes", offset, len(data)-offset)
+			err = w.file.Truncate(int64(offset))
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "truncate wal failed")
+			}
+			err = w.file.Sync()
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "truncate wal failed")
+			}
+			break
+		}
+		offset += size
+
+		entry := &WALEntry{}
+		err = json.Unmarshal(payload, entry)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "decode wal entry failed")
+		}
+		// entries covered by the snapshot survive if the node crashed before the log was truncated
+		if entry.Index <= snapshot.Index {
+			continue
+		}
+		entries = append(entries, entry)
+		w.lastIndex = entry.Index
+	}
+	w.sinceSnapshot = len(entries)
+	return snapshot.Balances, entries, nil
+}
+
+// Append writes the entry and fsyncs the log before the caller applies it
+func (w *WAL) Append(path string, body []byte) (entry *WALEntry, err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	entry = &WALEntry{
+		Index: w.lastIndex + 1,
+		Path:  path,
+		Body:  body,
+	}
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return nil, errors.Wrap(err, "append wal failed")
+	}
+	_, err = w.file.Write(encodeRecord(payload))
+	if err != nil {
+		return nil, errors.Wrap(err, "append wal failed")
+	}
+	err = w.file.Sync()
+	if err != nil {
+		return nil, errors.Wrap(err, "append wal failed")
+	}
+	w.lastIndex = entry.Index
+	w.sinceSnapshot++
+	return entry, nil
+}
+
+func (w *WAL) ShouldSnapshot() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.sinceSnapshot >= SnapshotEvery
+}
+
+// Snapshot atomically replaces the snapshot with balances, which must include every appended entry, then truncates the log
+func (w *WAL) Snapshot(balances map[string]int) (err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	payload, err := json.Marshal(&walSnapshot{
+		Index:    w.lastIndex,
+		Balances: balances,
+	})
+	if err != nil {
+		return errors.Wrap(err, "snapshot failed")
+	}
+
+	path := filepath.Join(w.dir, SnapshotFileName)
+	tmpPath := path + ".tmp"
+	err = writeFileSync(tmpPath, encodeRecord(payload))
+	if err != nil {
+		return errors.Wrap(err, "snapshot failed")
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return errors.Wrap(err, "snapshot failed")
+	}
+	err = syncDir(w.dir)
+	if err != nil {
+		return errors.Wrap(err, "snapshot failed")
+	}
+
+	err = w.file.Truncate(0)
+	if err != nil {
+		return errors.Wrap(err, "truncate wal failed")
+	}
+	err = w.file.Sync()
+	if err != nil {
+		return errors.Wrap(err, "truncate wal failed")
+	}
+	w.sinceSnapshot = 0
+	logger.Infof("snapshot balances at wal index %d", w.lastIndex)
+	return nil
+}
+
+func (w *WAL) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.file.Close()
+}
+
+func writeFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
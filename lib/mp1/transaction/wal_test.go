@@ -0,0 +1,226 @@
+package transaction
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bamboovir/cs425/lib/mp1/multicast"
+)
+
+func depositBody(t *testing.T, account string, amount int) []byte {
+	t.Helper()
+	body, err := (&Deposit{Account: account, Amount: amount}).Encode()
+	if err != nil {
+		t.Fatalf("encode deposit: %v", err)
+	}
+	return body
+}
+
+func transferBody(t *testing.T, from string, to string, amount int) []byte {
+	t.Helper()
+	body, err := (&Transfer{FromAccount: from, ToAccount: to, Amount: amount}).Encode()
+	if err != nil {
+		t.Fatalf("encode transfer: %v", err)
+	}
+	return body
+}
+
+func appendEntries(t *testing.T, dir string, entries ...*WALEntry) {
+	t.Helper()
+	wal, err := OpenWAL(dir)
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	defer wal.Close()
+	_, _, err = wal.Load()
+	if err != nil {
+		t.Fatalf("load wal: %v", err)
+	}
+	for _, entry := range entries {
+		_, err = wal.Append(entry.Path, entry.Body)
+		if err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	dir := t.TempDir()
+	appendEntries(t, dir,
+		&WALEntry{Path: DepositPath, Body: depositBody(t, "a", 10)},
+		&WALEntry{Path: TransferPath, Body: transferBody(t, "a", "b", 4)},
+		// rejected when it was delivered, rejected again on replay
+		&WALEntry{Path: TransferPath, Body: transferBody(t, "a", "b", 100)},
+	)
+
+	p := NewProcessor("A")
+	err := p.OpenWAL(dir)
+	if err != nil {
+		t.Fatalf("open processor wal: %v", err)
+	}
+	defer p.Close()
+	if want := map[string]int{"a": 6, "b": 4}; !reflect.DeepEqual(p.Balances(), want) {
+		t.Fatalf("replayed balances %v, want %v", p.Balances(), want)
+	}
+}
+
+func TestWALTruncatesTornTail(t *testing.T) {
+	dir := t.TempDir()
+	appendEntries(t, dir,
+		&WALEntry{Path: DepositPath, Body: depositBody(t, "a", 1)},
+		&WALEntry{Path: DepositPath, Body: depositBody(t, "a", 2)},
+	)
+	path := filepath.Join(dir, WALFileName)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat wal: %v", err)
+	}
+	// a crash in the middle of the third append
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("open wal file: %v", err)
+	}
+	file.Write(encodeRecord([]byte(`{"index":3}`))[:10])
+	file.Close()
+
+	wal, err := OpenWAL(dir)
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	defer wal.Close()
+	_, entries, err := wal.Load()
+	if err != nil {
+		t.Fatalf("load wal: %v", err)
+	}
+	if len(entries) != 2 || entries[1].Index != 2 {
+		t.Fatalf("loaded %d entries, want the 2 complete ones", len(entries))
+	}
+	truncated, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat wal: %v", err)
+	}
+	if truncated.Size() != info.Size() {
+		t.Fatalf("wal of %d bytes after load, want the torn record truncated to %d", truncated.Size(), info.Size())
+	}
+}
+
+func TestWALFailsOnCorruptedMiddleRecord(t *testing.T) {
+	dir := t.TempDir()
+	appendEntries(t, dir,
+		&WALEntry{Path: DepositPath, Body: depositBody(t, "a", 1)},
+		&WALEntry{Path: DepositPath, Body: depositBody(t, "a", 2)},
+		&WALEntry{Path: DepositPath, Body: depositBody(t, "a", 3)},
+	)
+	path := filepath.Join(dir, WALFileName)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read wal: %v", err)
+	}
+	// flip a byte in the payload of the second record
+	_, first, ok := decodeRecord(data)
+	if !ok {
+		t.Fatalf("first record does not decode")
+	}
+	data[first+walHeaderSize+1] ^= 0xff
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatalf("write wal: %v", err)
+	}
+
+	wal, err := OpenWAL(dir)
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	defer wal.Close()
+	_, _, err = wal.Load()
+	if err == nil {
+		t.Fatalf("wal with a corrupted middle record loaded")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat wal: %v", err)
+	}
+	if info.Size() != int64(len(data)) {
+		t.Fatalf("wal of %d bytes after a failed load, want it left at %d", info.Size(), len(data))
+	}
+}
+
+func TestWALReplaysAfterSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	appendEntries(t, dir, &WALEntry{Path: DepositPath, Body: depositBody(t, "a", 1)})
+	wal, err := OpenWAL(dir)
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	_, _, err = wal.Load()
+	if err != nil {
+		t.Fatalf("load wal: %v", err)
+	}
+	err = wal.Snapshot(map[string]int{"a": 1})
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	_, err = wal.Append(DepositPath, depositBody(t, "b", 2))
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	wal.Close()
+
+	p := NewProcessor("A")
+	err = p.OpenWAL(dir)
+	if err != nil {
+		t.Fatalf("open processor wal: %v", err)
+	}
+	defer p.Close()
+	if want := map[string]int{"a": 1, "b": 2}; !reflect.DeepEqual(p.Balances(), want) {
+		t.Fatalf("replayed balances %v, want %v", p.Balances(), want)
+	}
+}
+
+func TestOpenWALFailsOnUndecodableEntry(t *testing.T) {
+	dir := t.TempDir()
+	appendEntries(t, dir, &WALEntry{Path: DepositPath, Body: []byte("not a deposit")})
+	p := NewProcessor("A")
+	err := p.OpenWAL(dir)
+	if err == nil {
+		p.Close()
+		t.Fatalf("wal with an undecodable entry opened")
+	}
+}
+
+func TestProcessorFailStopsOnAppendFailure(t *testing.T) {
+	p := NewProcessor("A")
+	err := p.OpenWAL(t.TempDir())
+	if err != nil {
+		t.Fatalf("open processor wal: %v", err)
+	}
+	deposit := func(account string) error {
+		return p.processDeposit(&multicast.TOMsg{Path: DepositPath, Body: depositBody(t, account, 1)})
+	}
+	if err = deposit("a"); err != nil {
+		t.Fatalf("deposit: %v", err)
+	}
+
+	// every append fails once the log is closed
+	p.wal.Close()
+	if err = deposit("b"); err == nil {
+		t.Fatalf("deposit applied without being logged")
+	}
+	select {
+	case <-p.Failed():
+	default:
+		t.Fatalf("processor did not fail-stop")
+	}
+	if err = deposit("c"); err != ErrFailStopped && err == nil {
+		t.Fatalf("deposit applied after fail-stop")
+	}
+	if want := map[string]int{"a": 1}; !reflect.DeepEqual(p.Balances(), want) {
+		t.Fatalf("balances %v after fail-stop, want %v", p.Balances(), want)
+	}
+	if p.Err() == nil {
+		t.Fatalf("fail-stopped processor has no error")
+	}
+}
@@ -4,8 +4,16 @@ import (
 	"encoding/json"
 )
 
+// Hi is the handshake of a connection, it is always JSON. The client sends its session and the codecs it offers,
+// the server answers with the last sequence number it received in that session and the codec it picked.
+// UnknownSession tells the client the server has no state of its session, it was restarted, so the client starts over at seq 1
 type Hi struct {
-	From string `json:"from"`
+	From           string   `json:"from"`
+	Session        string   `json:"session,omitempty"`
+	LastReceived   uint64   `json:"last_received"`
+	UnknownSession bool     `json:"unknown_session,omitempty"`
+	Codecs         []string `json:"codecs,omitempty"`
+	Codec          string   `json:"codec,omitempty"`
 }
 
 func NewHi(from string) *Hi {
@@ -14,6 +22,44 @@ func NewHi(from string) *Hi {
 	}
 }
 
+func (h *Hi) WithSession(session string) *Hi {
+	h.Session = session
+	return h
+}
+
+func (h *Hi) WithLastReceived(lastReceived uint64) *Hi {
+	h.LastReceived = lastReceived
+	return h
+}
+
+func (h *Hi) WithUnknownSession(unknown bool) *Hi {
+	h.UnknownSession = unknown
+	return h
+}
+
+func (h *Hi) WithCodecs(codecs []string) *Hi {
+	h.Codecs = codecs
+	return h
+}
+
+func (h *Hi) WithCodec(codec string) *Hi {
+	h.Codec = codec
+	return h
+}
+
 func (h *Hi) Encode() (data []byte, err error) {
 	return json.Marshal(h)
 }
+
+func (h *Hi) Decode(data []byte) (*Hi, error) {
+	err := json.Unmarshal(data, h)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Ack acknowledges every frame up to Seq, it is encoded with the codec negotiated in Hi
+type Ack struct {
+	Seq uint64 `json:"ack"`
+}
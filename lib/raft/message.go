@@ -0,0 +1,65 @@
+package raft
+
+const (
+	RequestVotePath        = "/raft/request-vote"
+	RequestVoteReplyPath   = "/raft/request-vote-reply"
+	AppendEntriesPath      = "/raft/append-entries"
+	AppendEntriesReplyPath = "/raft/append-entries-reply"
+	ForwardPath            = "/raft/forward"
+)
+
+// LogEntry a nil Command is the no-op a new leader appends to commit the entries of previous terms,
+// ClientID and Seq name the submission of the command, so a forward that is retried is appended once
+type LogEntry struct {
+	Term     uint64 `json:"term"`
+	Index    uint64 `json:"index"`
+	Command  []byte `json:"command"`
+	ClientID string `json:"client,omitempty"`
+	Seq      uint64 `json:"seq,omitempty"`
+}
+
+type RequestVoteMsg struct {
+	Term         uint64 `json:"term"`
+	CandidateID  string `json:"candidate"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+type RequestVoteReplyMsg struct {
+	Term    uint64 `json:"term"`
+	VoterID string `json:"voter"`
+	Granted bool   `json:"granted"`
+}
+
+type AppendEntriesMsg struct {
+	Term         uint64      `json:"term"`
+	LeaderID     string      `json:"leader"`
+	PrevLogIndex uint64      `json:"prev_log_index"`
+	PrevLogTerm  uint64      `json:"prev_log_term"`
+	Entries      []*LogEntry `json:"entries"`
+	LeaderCommit uint64      `json:"leader_commit"`
+}
+
+// AppendEntriesReplyMsg on failure ConflictIndex is where the leader retries from, instead of stepping back one entry at a time
+type AppendEntriesReplyMsg struct {
+	Term          uint64 `json:"term"`
+	FollowerID    string `json:"follower"`
+	Success       bool   `json:"success"`
+	MatchIndex    uint64 `json:"match_index"`
+	ConflictIndex uint64 `json:"conflict_index"`
+}
+
+// ForwardMsg carries a command a follower received to the leader, ClientID and Seq are the node that submitted it
+// and its submission number, the follower resends it until the command commits
+type ForwardMsg struct {
+	ClientID string `json:"client"`
+	Seq      uint64 `json:"seq"`
+	Command  []byte `json:"command"`
+}
+
+// ApplyMsg is a committed command, delivered in log order on the Apply channel
+type ApplyMsg struct {
+	Index   uint64
+	Term    uint64
+	Command []byte
+}
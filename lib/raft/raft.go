@@ -0,0 +1,665 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"github.com/bamboovir/cs425/lib/codec"
+	"github.com/bamboovir/cs425/lib/mp1/multicast"
+	errors "github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	logger = log.WithField("src", "raft")
+)
+
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	switch s {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	default:
+		return "leader"
+	}
+}
+
+// Config a submitted command is resent every ForwardRetryInterval until it commits
+type Config struct {
+	HeartbeatInterval    time.Duration
+	ElectionTimeoutMin   time.Duration
+	ElectionTimeoutMax   time.Duration
+	ForwardRetryInterval time.Duration
+	MaxEntriesPerAppend  int
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		HeartbeatInterval:    100 * time.Millisecond,
+		ElectionTimeoutMin:   500 * time.Millisecond,
+		ElectionTimeoutMax:   1000 * time.Millisecond,
+		ForwardRetryInterval: 1000 * time.Millisecond,
+		MaxEntriesPerAppend:  256,
+	}
+}
+
+type outbound struct {
+	dstID string
+	path  string
+	msg   interface{}
+}
+
+// submission names a command by the node that submitted it and its submission number
+type submission struct {
+	clientID string
+	seq      uint64
+}
+
+// Raft replicates a log of commands among the members of a BMulticast, RPCs are one-way messages over its TCP clients.
+// The cluster is the members at start, a crashed member still counts towards the quorum.
+// The log and the vote are kept in memory, so a restarted member must come back with a new node id.
+// A submitted command is resent until it commits, the leader appends a submission once, by its client id and seq
+type Raft struct {
+	bmulticast       *multicast.BMulticast
+	config           *Config
+	peers            []string
+	state            State
+	currentTerm      uint64
+	votedFor         string
+	leaderID         string
+	log              []*LogEntry
+	commitIndex      uint64
+	lastApplied      uint64
+	nextIndex        map[string]uint64
+	matchIndex       map[string]uint64
+	votes            map[string]struct{}
+	electionDeadline time.Time
+	lastBroadcast    time.Time
+	clientSeq        uint64
+	unacked          map[uint64]*ForwardMsg
+	appended         map[submission]uint64
+	lastForward      time.Time
+	commitNotify     chan struct{}
+	applyCh          chan ApplyMsg
+	lock             *sync.Mutex
+}
+
+func New(b *multicast.BMulticast, config *Config) *Raft {
+	return &Raft{
+		bmulticast:   b,
+		config:       config,
+		peers:        []string{},
+		state:        Follower,
+		log:          []*LogEntry{{Term: 0, Index: 0}},
+		nextIndex:    map[string]uint64{},
+		matchIndex:   map[string]uint64{},
+		votes:        map[string]struct{}{},
+		unacked:      map[uint64]*ForwardMsg{},
+		appended:     map[submission]uint64{},
+		commitNotify: make(chan struct{}, 1),
+		applyCh:      make(chan ApplyMsg, 1024),
+		lock:         &sync.Mutex{},
+	}
+}
+
+func (r *Raft) selfID() string {
+	return r.bmulticast.SelfNodeID()
+}
+
+// Apply delivers every committed command once, in log order
+func (r *Raft) Apply() <-chan ApplyMsg {
+	return r.applyCh
+}
+
+func (r *Raft) Status() (state State, term uint64, leaderID string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.state, r.currentTerm, r.leaderID
+}
+
+func (r *Raft) CommitIndex() uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.commitIndex
+}
+
+// Submit appends command on the leader, a follower forwards it to the leader it knows.
+// The command is resent every ForwardRetryInterval until it commits, so a lost forward or a crashed leader does not lose it
+func (r *Raft) Submit(command []byte) {
+	if command == nil {
+		command = []byte{}
+	}
+
+	r.lock.Lock()
+	r.clientSeq++
+	forwardMsg := &ForwardMsg{ClientID: r.selfID(), Seq: r.clientSeq, Command: command}
+	r.unacked[forwardMsg.Seq] = forwardMsg
+	outs := r.submit(forwardMsg)
+	r.lock.Unlock()
+
+	r.send(outs)
+}
+
+func (r *Raft) Bind() {
+	bind := func(path string, f func(msg *multicast.BMsg) ([]*outbound, error)) {
+		r.bmulticast.Bind(path, func(msg *multicast.BMsg) error {
+			outs, err := f(msg)
+			if err != nil {
+				return errors.Wrapf(err, "raft handle [%s] failed", path)
+			}
+			r.send(outs)
+			return nil
+		})
+	}
+	bind(RequestVotePath, r.handleRequestVote)
+	bind(RequestVoteReplyPath, r.handleRequestVoteReply)
+	bind(AppendEntriesPath, r.handleAppendEntries)
+	bind(AppendEntriesReplyPath, r.handleAppendEntriesReply)
+	bind(ForwardPath, r.handleForward)
+}
+
+// Start should be called once the BMulticast is started, its members are the cluster
+func (r *Raft) Start(ctx context.Context) {
+	r.lock.Lock()
+	r.peers = r.bmulticast.MemberIDs()
+	r.resetElectionDeadline()
+	r.lock.Unlock()
+	logger.Infof("raft cluster %v", r.peers)
+
+	go r.run(ctx)
+	go r.applyLoop(ctx)
+}
+
+func (r *Raft) run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.HeartbeatInterval / 5)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.lock.Lock()
+			var outs []*outbound
+			now := time.Now()
+			if len(r.unacked) > 0 && now.Sub(r.lastForward) >= r.config.ForwardRetryInterval {
+				outs = r.retryForwards()
+			}
+			if r.state == Leader {
+				if now.Sub(r.lastBroadcast) >= r.config.HeartbeatInterval {
+					outs = append(outs, r.broadcastAppendEntries()...)
+				}
+			} else if now.After(r.electionDeadline) {
+				outs = append(outs, r.becomeCandidate()...)
+			}
+			r.lock.Unlock()
+			r.send(outs)
+		}
+	}
+}
+
+func (r *Raft) applyLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.commitNotify:
+		}
+
+		r.lock.Lock()
+		entries := make([]*LogEntry, 0, r.commitIndex-r.lastApplied)
+		for i := r.lastApplied + 1; i <= r.commitIndex; i++ {
+			entries = append(entries, r.log[i])
+			if r.log[i].ClientID == r.selfID() {
+				delete(r.unacked, r.log[i].Seq)
+			}
+		}
+		r.lastApplied = r.commitIndex
+		r.lock.Unlock()
+
+		for _, entry := range entries {
+			if entry.Command == nil {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case r.applyCh <- ApplyMsg{Index: entry.Index, Term: entry.Term, Command: entry.Command}:
+			}
+		}
+	}
+}
+
+func (r *Raft) send(outs []*outbound) error {
+	var lastErr error
+	for _, out := range outs {
+		err := r.bmulticast.Unicast(out.dstID, out.path, out.msg)
+		if err != nil {
+			logger.Debugf("send [%s] to node [%s] failed: %v", out.path, out.dstID, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// the helpers below are called with lock held
+
+func (r *Raft) lastIndex() uint64 {
+	return r.log[len(r.log)-1].Index
+}
+
+func (r *Raft) lastTerm() uint64 {
+	return r.log[len(r.log)-1].Term
+}
+
+func (r *Raft) quorum() int {
+	return len(r.peers)/2 + 1
+}
+
+func (r *Raft) resetElectionDeadline() {
+	spread := int64(r.config.ElectionTimeoutMax - r.config.ElectionTimeoutMin)
+	timeout := r.config.ElectionTimeoutMin
+	if spread > 0 {
+		timeout += time.Duration(rand.Int63n(spread))
+	}
+	r.electionDeadline = time.Now().Add(timeout)
+}
+
+func (r *Raft) notifyCommit() {
+	select {
+	case r.commitNotify <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Raft) becomeFollower(term uint64) {
+	if term > r.currentTerm {
+		r.currentTerm = term
+		r.votedFor = ""
+	}
+	if r.state != Follower {
+		logger.Infof("node [%s] become follower in term %d", r.selfID(), r.currentTerm)
+	}
+	r.state = Follower
+	r.resetElectionDeadline()
+}
+
+func (r *Raft) becomeCandidate() []*outbound {
+	r.state = Candidate
+	r.currentTerm++
+	r.votedFor = r.selfID()
+	r.leaderID = ""
+	r.votes = map[string]struct{}{r.selfID(): {}}
+	r.resetElectionDeadline()
+	logger.Infof("node [%s] start election in term %d", r.selfID(), r.currentTerm)
+
+	if len(r.votes) >= r.quorum() {
+		return r.becomeLeader()
+	}
+
+	requestVoteMsg := &RequestVoteMsg{
+		Term:         r.currentTerm,
+		CandidateID:  r.selfID(),
+		LastLogIndex: r.lastIndex(),
+		LastLogTerm:  r.lastTerm(),
+	}
+	outs := make([]*outbound, 0, len(r.peers))
+	for _, peer := range r.peers {
+		if peer == r.selfID() {
+			continue
+		}
+		outs = append(outs, &outbound{dstID: peer, path: RequestVotePath, msg: requestVoteMsg})
+	}
+	return outs
+}
+
+// becomeLeader appends a no-op, so the entries of previous terms commit once it does
+func (r *Raft) becomeLeader() []*outbound {
+	r.state = Leader
+	r.leaderID = r.selfID()
+	logger.Infof("node [%s] become leader in term %d", r.selfID(), r.currentTerm)
+	for _, peer := range r.peers {
+		r.nextIndex[peer] = r.lastIndex() + 1
+		r.matchIndex[peer] = 0
+	}
+	r.appendCommand(nil, "", 0)
+	r.retryForwards()
+	return r.broadcastAppendEntries()
+}
+
+// submit appends forwardMsg on the leader unless its submission is in the log already,
+// a follower forwards it to the leader it knows, without a leader it waits for the next retry
+func (r *Raft) submit(forwardMsg *ForwardMsg) []*outbound {
+	switch {
+	case r.state == Leader:
+		if _, ok := r.appended[submission{clientID: forwardMsg.ClientID, seq: forwardMsg.Seq}]; !ok {
+			r.appendCommand(forwardMsg.Command, forwardMsg.ClientID, forwardMsg.Seq)
+		}
+		return r.broadcastAppendEntries()
+	case r.leaderID != "" && r.leaderID != r.selfID():
+		return []*outbound{{dstID: r.leaderID, path: ForwardPath, msg: forwardMsg}}
+	default:
+		return nil
+	}
+}
+
+// retryForwards resends the commands of this node that did not commit yet in submission order,
+// the leader appends the ones missing from its log and replicates them with the next append entries
+func (r *Raft) retryForwards() []*outbound {
+	r.lastForward = time.Now()
+	seqs := make([]uint64, 0, len(r.unacked))
+	for seq := range r.unacked {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	outs := make([]*outbound, 0, len(seqs))
+	for _, seq := range seqs {
+		forwardMsg := r.unacked[seq]
+		switch {
+		case r.state == Leader:
+			if _, ok := r.appended[submission{clientID: forwardMsg.ClientID, seq: forwardMsg.Seq}]; !ok {
+				r.appendCommand(forwardMsg.Command, forwardMsg.ClientID, forwardMsg.Seq)
+			}
+		case r.leaderID != "" && r.leaderID != r.selfID():
+			outs = append(outs, &outbound{dstID: r.leaderID, path: ForwardPath, msg: forwardMsg})
+		}
+	}
+	return outs
+}
+
+func (r *Raft) appendCommand(command []byte, clientID string, seq uint64) {
+	r.appendEntry(&LogEntry{
+		Term:     r.currentTerm,
+		Index:    r.lastIndex() + 1,
+		Command:  command,
+		ClientID: clientID,
+		Seq:      seq,
+	})
+	r.advanceCommitIndex()
+}
+
+func (r *Raft) appendEntry(entry *LogEntry) {
+	r.log = append(r.log, entry)
+	if entry.ClientID != "" {
+		r.appended[submission{clientID: entry.ClientID, seq: entry.Seq}] = entry.Index
+	}
+}
+
+// truncate drops the entries from index on
+func (r *Raft) truncate(index uint64) {
+	for _, entry := range r.log[index:] {
+		if entry.ClientID != "" {
+			delete(r.appended, submission{clientID: entry.ClientID, seq: entry.Seq})
+		}
+	}
+	r.log = r.log[:index]
+}
+
+// appendEntriesTo optimistically advances nextIndex of the peer, a rejection moves it back
+func (r *Raft) appendEntriesTo(peer string) *outbound {
+	nextIndex := r.nextIndex[peer]
+	if nextIndex < 1 {
+		nextIndex = 1
+	}
+	if nextIndex > r.lastIndex()+1 {
+		nextIndex = r.lastIndex() + 1
+	}
+	prev := r.log[nextIndex-1]
+	end := r.lastIndex() + 1
+	if end-nextIndex > uint64(r.config.MaxEntriesPerAppend) {
+		end = nextIndex + uint64(r.config.MaxEntriesPerAppend)
+	}
+	entries := make([]*LogEntry, 0, end-nextIndex)
+	entries = append(entries, r.log[nextIndex:end]...)
+	r.nextIndex[peer] = end
+
+	return &outbound{
+		dstID: peer,
+		path:  AppendEntriesPath,
+		msg: &AppendEntriesMsg{
+			Term:         r.currentTerm,
+			LeaderID:     r.selfID(),
+			PrevLogIndex: prev.Index,
+			PrevLogTerm:  prev.Term,
+			Entries:      entries,
+			LeaderCommit: r.commitIndex,
+		},
+	}
+}
+
+func (r *Raft) broadcastAppendEntries() []*outbound {
+	r.lastBroadcast = time.Now()
+	outs := make([]*outbound, 0, len(r.peers))
+	for _, peer := range r.peers {
+		if peer == r.selfID() {
+			continue
+		}
+		outs = append(outs, r.appendEntriesTo(peer))
+	}
+	return outs
+}
+
+// advanceCommitIndex commits the last entry of the current term stored on a quorum
+func (r *Raft) advanceCommitIndex() {
+	if r.state != Leader {
+		return
+	}
+	for n := r.lastIndex(); n > r.commitIndex; n-- {
+		if r.log[n].Term != r.currentTerm {
+			return
+		}
+		count := 1
+		for _, peer := range r.peers {
+			if peer != r.selfID() && r.matchIndex[peer] >= n {
+				count++
+			}
+		}
+		if count >= r.quorum() {
+			r.commitIndex = n
+			r.notifyCommit()
+			return
+		}
+	}
+}
+
+func (r *Raft) isUpToDate(lastLogTerm uint64, lastLogIndex uint64) bool {
+	if lastLogTerm != r.lastTerm() {
+		return lastLogTerm > r.lastTerm()
+	}
+	return lastLogIndex >= r.lastIndex()
+}
+
+func (r *Raft) handleRequestVote(msg *multicast.BMsg) ([]*outbound, error) {
+	requestVoteMsg := &RequestVoteMsg{}
+	err := codec.Unmarshal(msg.Body, requestVoteMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if requestVoteMsg.Term > r.currentTerm {
+		r.becomeFollower(requestVoteMsg.Term)
+		r.leaderID = ""
+	}
+	granted := false
+	if requestVoteMsg.Term == r.currentTerm &&
+		(r.votedFor == "" || r.votedFor == requestVoteMsg.CandidateID) &&
+		r.isUpToDate(requestVoteMsg.LastLogTerm, requestVoteMsg.LastLogIndex) {
+		granted = true
+		r.votedFor = requestVoteMsg.CandidateID
+		r.resetElectionDeadline()
+		logger.Infof("node [%s] vote for node [%s] in term %d", r.selfID(), requestVoteMsg.CandidateID, r.currentTerm)
+	}
+
+	reply := &RequestVoteReplyMsg{
+		Term:    r.currentTerm,
+		VoterID: r.selfID(),
+		Granted: granted,
+	}
+	return []*outbound{{dstID: requestVoteMsg.CandidateID, path: RequestVoteReplyPath, msg: reply}}, nil
+}
+
+func (r *Raft) handleRequestVoteReply(msg *multicast.BMsg) ([]*outbound, error) {
+	reply := &RequestVoteReplyMsg{}
+	err := codec.Unmarshal(msg.Body, reply)
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if reply.Term > r.currentTerm {
+		r.becomeFollower(reply.Term)
+		return nil, nil
+	}
+	if r.state != Candidate || reply.Term != r.currentTerm || !reply.Granted {
+		return nil, nil
+	}
+	r.votes[reply.VoterID] = struct{}{}
+	if len(r.votes) >= r.quorum() {
+		return r.becomeLeader(), nil
+	}
+	return nil, nil
+}
+
+func (r *Raft) handleAppendEntries(msg *multicast.BMsg) ([]*outbound, error) {
+	appendEntriesMsg := &AppendEntriesMsg{}
+	err := codec.Unmarshal(msg.Body, appendEntriesMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	reply := &AppendEntriesReplyMsg{
+		FollowerID: r.selfID(),
+		Success:    false,
+	}
+	outs := []*outbound{{dstID: appendEntriesMsg.LeaderID, path: AppendEntriesReplyPath, msg: reply}}
+
+	if appendEntriesMsg.Term < r.currentTerm {
+		reply.Term = r.currentTerm
+		return outs, nil
+	}
+	r.becomeFollower(appendEntriesMsg.Term)
+	reply.Term = r.currentTerm
+	if r.leaderID != appendEntriesMsg.LeaderID {
+		r.leaderID = appendEntriesMsg.LeaderID
+		logger.Infof("node [%s] follow leader [%s] in term %d", r.selfID(), r.leaderID, r.currentTerm)
+		outs = append(outs, r.retryForwards()...)
+	}
+
+	prevLogIndex := appendEntriesMsg.PrevLogIndex
+	if prevLogIndex > r.lastIndex() {
+		reply.ConflictIndex = r.lastIndex() + 1
+		return outs, nil
+	}
+	if r.log[prevLogIndex].Term != appendEntriesMsg.PrevLogTerm {
+		conflictTerm := r.log[prevLogIndex].Term
+		conflictIndex := prevLogIndex
+		for conflictIndex > 1 && r.log[conflictIndex-1].Term == conflictTerm {
+			conflictIndex--
+		}
+		reply.ConflictIndex = conflictIndex
+		return outs, nil
+	}
+
+	for i, entry := range appendEntriesMsg.Entries {
+		index := prevLogIndex + 1 + uint64(i)
+		if index <= r.lastIndex() {
+			if r.log[index].Term == entry.Term {
+				continue
+			}
+			if index <= r.commitIndex {
+				return nil, fmt.Errorf("leader [%s] overwrites committed entry %d", appendEntriesMsg.LeaderID, index)
+			}
+			r.truncate(index)
+		}
+		r.appendEntry(entry)
+	}
+
+	matchIndex := prevLogIndex + uint64(len(appendEntriesMsg.Entries))
+	if appendEntriesMsg.LeaderCommit > r.commitIndex {
+		commitIndex := appendEntriesMsg.LeaderCommit
+		if commitIndex > matchIndex {
+			commitIndex = matchIndex
+		}
+		if commitIndex > r.commitIndex {
+			r.commitIndex = commitIndex
+			r.notifyCommit()
+		}
+	}
+
+	reply.Success = true
+	reply.MatchIndex = matchIndex
+	return outs, nil
+}
+
+func (r *Raft) handleAppendEntriesReply(msg *multicast.BMsg) ([]*outbound, error) {
+	reply := &AppendEntriesReplyMsg{}
+	err := codec.Unmarshal(msg.Body, reply)
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if reply.Term > r.currentTerm {
+		r.becomeFollower(reply.Term)
+		r.leaderID = ""
+		return nil, nil
+	}
+	if r.state != Leader || reply.Term != r.currentTerm {
+		return nil, nil
+	}
+
+	if reply.Success {
+		if reply.MatchIndex > r.matchIndex[reply.FollowerID] {
+			r.matchIndex[reply.FollowerID] = reply.MatchIndex
+		}
+		if r.nextIndex[reply.FollowerID] < r.matchIndex[reply.FollowerID]+1 {
+			r.nextIndex[reply.FollowerID] = r.matchIndex[reply.FollowerID] + 1
+		}
+		r.advanceCommitIndex()
+		return nil, nil
+	}
+
+	nextIndex := reply.ConflictIndex
+	if nextIndex < r.matchIndex[reply.FollowerID]+1 {
+		nextIndex = r.matchIndex[reply.FollowerID] + 1
+	}
+	r.nextIndex[reply.FollowerID] = nextIndex
+	return []*outbound{r.appendEntriesTo(reply.FollowerID)}, nil
+}
+
+func (r *Raft) handleForward(msg *multicast.BMsg) ([]*outbound, error) {
+	forwardMsg := &ForwardMsg{}
+	err := codec.Unmarshal(msg.Body, forwardMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.submit(forwardMsg), nil
+}
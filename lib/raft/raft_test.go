@@ -0,0 +1,223 @@
+package raft
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bamboovir/cs425/lib/codec"
+	"github.com/bamboovir/cs425/lib/mp1/multicast"
+)
+
+// cluster hands the messages of its nodes to each other synchronously, messages to or from a down node are lost
+type cluster struct {
+	t     *testing.T
+	nodes map[string]*Raft
+	down  map[string]bool
+}
+
+func newCluster(t *testing.T, ids ...string) *cluster {
+	c := &cluster{t: t, nodes: map[string]*Raft{}, down: map[string]bool{}}
+	for _, id := range ids {
+		group := multicast.NewGroupBuilder().WithSelfNodeID(id).Build()
+		r := New(group.B(), DefaultConfig())
+		r.peers = ids
+		c.nodes[id] = r
+	}
+	return c
+}
+
+// deliver hands outs and every message they lead to, until no message is left
+func (c *cluster) deliver(srcID string, outs []*outbound) {
+	type sent struct {
+		srcID string
+		out   *outbound
+	}
+	queue := make([]sent, 0, len(outs))
+	for _, out := range outs {
+		queue = append(queue, sent{srcID: srcID, out: out})
+	}
+	for len(queue) > 0 {
+		head := queue[0]
+		queue = queue[1:]
+		if c.down[head.srcID] || c.down[head.out.dstID] {
+			continue
+		}
+		body, err := codec.Marshal(head.out.msg)
+		if err != nil {
+			c.t.Fatalf("encode %s: %v", head.out.path, err)
+		}
+		msg := &multicast.BMsg{SrcID: head.srcID, Path: head.out.path, Body: body}
+		r := c.nodes[head.out.dstID]
+		var next []*outbound
+		switch head.out.path {
+		case RequestVotePath:
+			next, err = r.handleRequestVote(msg)
+		case RequestVoteReplyPath:
+			next, err = r.handleRequestVoteReply(msg)
+		case AppendEntriesPath:
+			next, err = r.handleAppendEntries(msg)
+		case AppendEntriesReplyPath:
+			next, err = r.handleAppendEntriesReply(msg)
+		case ForwardPath:
+			next, err = r.handleForward(msg)
+		}
+		if err != nil {
+			c.t.Fatalf("node [%s] handle %s: %v", head.out.dstID, head.out.path, err)
+		}
+		for _, out := range next {
+			queue = append(queue, sent{srcID: head.out.dstID, out: out})
+		}
+	}
+}
+
+// do runs f on the node with its lock held and delivers what it sends
+func (c *cluster) do(id string, f func(r *Raft) []*outbound) {
+	r := c.nodes[id]
+	r.lock.Lock()
+	outs := f(r)
+	r.lock.Unlock()
+	c.deliver(id, outs)
+}
+
+func (c *cluster) elect(id string) {
+	c.do(id, (*Raft).becomeCandidate)
+}
+
+func (c *cluster) heartbeat(id string) {
+	c.do(id, (*Raft).broadcastAppendEntries)
+}
+
+func (c *cluster) retry(id string) {
+	c.do(id, (*Raft).retryForwards)
+}
+
+// committed the commands up to the commit index of the node, the no-ops left out
+func (c *cluster) committed(id string) []string {
+	r := c.nodes[id]
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	commands := []string{}
+	for _, entry := range r.log[1 : r.commitIndex+1] {
+		if entry.Command != nil {
+			commands = append(commands, string(entry.Command))
+		}
+	}
+	return commands
+}
+
+func (c *cluster) expectLeader(id string, term uint64) {
+	c.t.Helper()
+	for nodeID, r := range c.nodes {
+		if c.down[nodeID] {
+			continue
+		}
+		state, nodeTerm, leaderID := r.Status()
+		if nodeID == id && state != Leader {
+			c.t.Fatalf("node [%s] is %s, want leader", nodeID, state)
+		}
+		if nodeID != id && state == Leader {
+			c.t.Fatalf("node [%s] is leader too", nodeID)
+		}
+		if nodeTerm != term || leaderID != id {
+			c.t.Fatalf("node [%s] follows [%s] in term %d, want [%s] in term %d", nodeID, leaderID, nodeTerm, id, term)
+		}
+	}
+}
+
+func TestElectionRefusesCandidateWithStaleLog(t *testing.T) {
+	c := newCluster(t, "A", "B", "C")
+	c.elect("A")
+	c.expectLeader("A", 1)
+
+	c.down["C"] = true
+	c.nodes["A"].Submit([]byte("x"))
+	c.heartbeat("A")
+	if got := c.committed("A"); !reflect.DeepEqual(got, []string{"x"}) {
+		t.Fatalf("leader committed %v, want [x] on a quorum without C", got)
+	}
+
+	// C missed x, so A and B refuse to vote for it
+	c.down["A"] = true
+	c.down["C"] = false
+	c.elect("C")
+	if state, _, _ := c.nodes["C"].Status(); state == Leader {
+		t.Fatalf("node [C] without the committed entry was elected")
+	}
+
+	c.elect("B")
+	c.expectLeader("B", 3)
+	c.heartbeat("B")
+	if got := c.committed("C"); !reflect.DeepEqual(got, []string{"x"}) {
+		t.Fatalf("node [C] committed %v after the new leader caught it up, want [x]", got)
+	}
+}
+
+func TestLogReplicationCatchesUpFollower(t *testing.T) {
+	c := newCluster(t, "A", "B", "C")
+	c.elect("A")
+	c.down["C"] = true
+	for _, command := range []string{"1", "2", "3"} {
+		c.nodes["A"].Submit([]byte(command))
+	}
+	// the first heartbeat commits on the leader, the second carries the commit index to the followers
+	c.heartbeat("A")
+	c.heartbeat("A")
+	want := []string{"1", "2", "3"}
+	for _, id := range []string{"A", "B"} {
+		if got := c.committed(id); !reflect.DeepEqual(got, want) {
+			t.Fatalf("node [%s] committed %v, want %v", id, got, want)
+		}
+	}
+	if got := c.committed("C"); len(got) != 0 {
+		t.Fatalf("down node [C] committed %v", got)
+	}
+
+	c.down["C"] = false
+	c.heartbeat("A")
+	c.heartbeat("A")
+	if got := c.committed("C"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("node [C] committed %v after rejoining, want %v", got, want)
+	}
+}
+
+func TestForwardIsRetriedAndAppendedOnce(t *testing.T) {
+	c := newCluster(t, "A", "B", "C")
+	c.elect("A")
+
+	// the cluster has no transport, so the forward of Submit is lost
+	c.nodes["B"].Submit([]byte("x"))
+	if got := c.committed("A"); len(got) != 0 {
+		t.Fatalf("leader committed %v before the forward arrived", got)
+	}
+	c.retry("B")
+	c.retry("B")
+	c.heartbeat("A")
+	if got := c.committed("A"); !reflect.DeepEqual(got, []string{"x"}) {
+		t.Fatalf("leader committed %v after retried forwards, want x once", got)
+	}
+}
+
+func TestForwardHeldByCrashedLeaderIsResubmitted(t *testing.T) {
+	c := newCluster(t, "A", "B", "C")
+	c.elect("A")
+
+	// A appends the forward, then crashes before it replicates it
+	c.nodes["B"].Submit([]byte("x"))
+	c.nodes["A"].lock.Lock()
+	c.nodes["A"].submit(c.nodes["B"].unacked[1])
+	c.nodes["A"].lock.Unlock()
+	c.down["A"] = true
+
+	// the new leader learns x from the retry B sends to it
+	c.elect("C")
+	c.expectLeader("C", 2)
+	c.heartbeat("C")
+	if got := c.committed("C"); !reflect.DeepEqual(got, []string{"x"}) {
+		t.Fatalf("new leader committed %v, want the resubmitted x", got)
+	}
+	c.retry("B")
+	c.heartbeat("C")
+	if got := c.committed("B"); !reflect.DeepEqual(got, []string{"x"}) {
+		t.Fatalf("node [B] committed %v, want x once", got)
+	}
+}
@@ -0,0 +1,122 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/bamboovir/cs425/lib/mp1/metrics"
+	"github.com/bamboovir/cs425/lib/mp1/multicast"
+	"github.com/bamboovir/cs425/lib/mp1/router"
+	"github.com/bamboovir/cs425/lib/mp1/tracing"
+	errors "github.com/pkg/errors"
+)
+
+const (
+	StrategyName = "raft"
+)
+
+// TotalOrder runs the TO interface of a group on raft, so the same handlers run as a replicated state machine,
+// every member delivers the committed TO messages in log order
+type TotalOrder struct {
+	raft       *Raft
+	rmulticast *multicast.RMulticast
+	router     *router.Router
+}
+
+func NewTotalOrder(b *multicast.BMulticast, r *multicast.RMulticast, config *Config) *TotalOrder {
+	return &TotalOrder{
+		raft:       New(b, config),
+		rmulticast: r,
+		router:     multicast.NewProtocolRouter("raft", (*multicast.TOMsg)(nil)),
+	}
+}
+
+// NewTotalOrderFactory builds the total order strategy of a group, see multicast.GroupBuilder.WithTotalOrderFactory
+func NewTotalOrderFactory(config *Config) multicast.TotalOrderFactory {
+	return func(b *multicast.BMulticast, r *multicast.RMulticast) multicast.TotalOrderStrategy {
+		return NewTotalOrder(b, r, config)
+	}
+}
+
+func (t *TotalOrder) Raft() *Raft {
+	return t.raft
+}
+
+func (t *TotalOrder) Start(ctx context.Context) (err error) {
+	t.raft.Bind()
+	err = t.rmulticast.Start(ctx)
+	if err != nil {
+		return err
+	}
+	t.raft.Start(ctx)
+	go t.deliver(ctx)
+	return nil
+}
+
+func (t *TotalOrder) Bind(path string, f func(msg *multicast.TOMsg) error) {
+	t.router.Bind(path, func(v interface{}) error {
+		return f(v.(*multicast.TOMsg))
+	})
+}
+
+func (t *TotalOrder) Multicast(path string, v interface{}) (err error) {
+	return t.MulticastContext(context.Background(), path, v)
+}
+
+// MulticastContext raft has no admission, a submitted command is never waited for, so ctx is only checked once
+func (t *TotalOrder) MulticastContext(ctx context.Context, path string, v interface{}) (err error) {
+	if ctx.Err() != nil {
+		return errors.Wrap(ctx.Err(), "to-multicast failed")
+	}
+	tomsg, err := multicast.NewTOMsg(path, v)
+	if err != nil {
+		return errors.Wrap(err, "to-multicast failed")
+	}
+	span := tracing.Start(t.raft.selfID(), "to.multicast", nil)
+	span.SetAttribute("path", path)
+	tomsg.Trace = span.Context()
+	tomsgBytes, err := tomsg.Encode()
+	if err != nil {
+		return errors.Wrap(err, "to-multicast failed")
+	}
+	// raft ids a message by its log position once it is committed, so the latency is tracked by the digest of the message
+	digest := multicast.SHA1(string(tomsgBytes))
+	metrics.TrackTOMulticast(t.raft.selfID(), digest)
+	tracing.Park(digest, span)
+	t.raft.Submit(tomsgBytes)
+	return nil
+}
+
+func (t *TotalOrder) deliver(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case applyMsg := <-t.raft.Apply():
+			msgID := fmt.Sprintf("raft-%d-%d", applyMsg.Term, applyMsg.Index)
+			logger.Infof("TO deliver [%d:%d][%s]", applyMsg.Index, applyMsg.Term, msgID)
+			metrics.NewDelayLogEntry(t.raft.selfID(), msgID).Log()
+			digest := multicast.SHA1(string(applyMsg.Command))
+			metrics.NewDeliverLogEntry(t.raft.selfID(), msgID, applyMsg.Index, strconv.FormatUint(applyMsg.Term, 10), digest).Log()
+			metrics.ObserveTODelivery(t.raft.selfID(), digest)
+
+			tomsg := &multicast.TOMsg{}
+			_, err := tomsg.Decode(applyMsg.Command)
+			if err != nil {
+				logger.Errorf("decode to msg [%s] failed: %v", msgID, err)
+				continue
+			}
+			span := tracing.Start(t.raft.selfID(), "to.deliver", tomsg.Trace)
+			span.SetAttribute("path", tomsg.Path)
+			span.SetAttribute("seq", strconv.FormatUint(applyMsg.Index, 10))
+			span.SetAttribute("term", strconv.FormatUint(applyMsg.Term, 10))
+			err = t.router.Run(tomsg.Path, tomsg)
+			span.End()
+			tracing.Unpark(digest).End()
+			if err != nil {
+				logger.Errorf("process err %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package retry
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// BackoffInterval returns the wait before the i-th retry, it doubles from base up to max,
+// then a random jitter of up to half the interval is subtracted so peers do not retry in lockstep
+func BackoffInterval(i int, base time.Duration, max time.Duration) time.Duration {
+	interval := base
+	for j := 0; j < i && interval < max; j++ {
+		interval *= 2
+	}
+	if interval > max {
+		interval = max
+	}
+	jitter := time.Duration(rand.Int63n(int64(interval)/2 + 1))
+	return interval - jitter
+}
+
+// RetryWithBackoff call f with exponential backoff and jitter until the maximum number of attempts is reached.
+// If the incoming attempts is 0, retry forever
+func RetryWithBackoff(attempts int, base time.Duration, max time.Duration, f RetryableFunc) (err error) {
+	return RetryWithBackoffContext(context.Background(), attempts, base, max, f)
+}
+
+// RetryWithBackoffContext is RetryWithBackoff that gives up once ctx is done
+func RetryWithBackoffContext(ctx context.Context, attempts int, base time.Duration, max time.Duration, f RetryableFunc) (err error) {
+	for i := 0; ; i++ {
+		err = f()
+
+		if err == nil {
+			return
+		}
+
+		if attempts != 0 && i >= (attempts-1) {
+			break
+		}
+
+		err = sleep(ctx, BackoffInterval(i, base, max))
+		if err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("after %d attempts, last error: %v", attempts, err)
+}
@@ -1,6 +1,7 @@
 package retry
 
 import (
+	"context"
 	"fmt"
 	"time"
 )
@@ -11,6 +12,11 @@ type RetryableFunc func() error
 // Retry call f every interval until the maximum number of attempts is reached.
 // If the incoming attempts is 0, retry forever
 func Retry(attempts int, interval time.Duration, f RetryableFunc) (err error) {
+	return RetryContext(context.Background(), attempts, interval, f)
+}
+
+// RetryContext is Retry that gives up once ctx is done
+func RetryContext(ctx context.Context, attempts int, interval time.Duration, f RetryableFunc) (err error) {
 	for i := 0; ; i++ {
 		err = f()
 
@@ -22,8 +28,23 @@ func Retry(attempts int, interval time.Duration, f RetryableFunc) (err error) {
 			break
 		}
 
-		time.Sleep(interval)
+		err = sleep(ctx, interval)
+		if err != nil {
+			return err
+		}
 	}
 
 	return fmt.Errorf("after %d attempts, last error: %v", attempts, err)
 }
+
+// sleep waits for d, it returns ctx.Err() if ctx is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
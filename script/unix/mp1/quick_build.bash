@@ -18,3 +18,5 @@ fi
 PROJECT_ROOT=$(git rev-parse --show-toplevel)
 go build -race -tags "" -mod=vendor -o "${PROJECT_ROOT}/bin/mp1" "${PROJECT_ROOT}/cli/mp1/node"
 
+
+go build -tags "" -mod=vendor -o "${PROJECT_ROOT}/bin/mp1-gencert" "${PROJECT_ROOT}/cli/mp1/gencert"